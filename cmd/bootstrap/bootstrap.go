@@ -54,8 +54,9 @@ func main() {
 	}
 
 	s := server.NewServer(r, configType)
+	defer s.Close()
 	kc := security.NewKeyCache(s.Config.ExpirationTime, s.Config.CleanTime,
-		s.Pub, s.DB, nil)
+		s.Pub, s.Store, nil)
 
 	// Verify the passed signature
 	signature := security.KeySignature{
@@ -70,24 +71,11 @@ func main() {
 		panic(errors.Wrap(err, "Could not verify signature"))
 	}
 
-	// Transactionally add the signing key, admin, and key signature to the DB
-	tx := s.DB.Begin()
-
 	keyID, err := util.RandString(32)
 	if err != nil {
 		panic(errors.Wrap(err, "Could not generate random ID for key"))
 	}
 
-	if err = tx.Create(&security.SigningKey{
-		ID:        keyID,
-		IV:        req.IV,
-		Salt:      req.Salt,
-		PublicKey: req.PublicKey,
-	}).Error; err != nil {
-		tx.Rollback()
-		panic(errors.Wrap(err, "Could not save signing key to the database"))
-	}
-
 	encodedPermissions, err := json.Marshal(req.Permissions)
 	if err != nil {
 		panic(errors.Wrapf(err, "Could not marshal %s as JSON", req.Permissions))
@@ -95,44 +83,53 @@ func main() {
 
 	log.Printf(string(encodedPermissions))
 
-	if err = tx.Create(&server.Admin{
-		ID:                  req.OwnerID,
-		Status:              "active",
-		Name:                req.Name,
-		Email:               req.Email,
-		Permissions:         string(encodedPermissions),
-		Role:                "superadmin",
-		PrimarySigningKeyID: keyID,
-		AdminFor:            "1",
-	}).Error; err != nil {
-		tx.Rollback()
-		panic(errors.Wrap(err, "Could not save admin to the database"))
-	}
-
-	if err = tx.Create(&signature).Error; err != nil {
-		tx.Rollback()
-		panic(errors.Wrap(err, "Could not save key signature to the database"))
-	}
-
 	ltrID, err := util.RandString(32)
 	if err != nil {
-		tx.Rollback()
 		panic(errors.Wrap(err, "Could not generate long-term request ID"))
 	}
 
 	h := crypto.SHA256.New()
 	io.WriteString(h, ltrID)
-	ltr := server.LongTermRequest{
-		ID:    h.Sum(nil),
-		AppID: "1",
-	}
-	if err = tx.Create(&ltr).Error; err != nil {
-		log.Printf("%x", h.Sum(nil))
-		tx.Rollback()
-		panic(errors.Wrap(err, "Could not save long-term request"))
-	}
 
-	if err = tx.Commit().Error; err != nil {
+	// Transactionally add the signing key, admin, and key signature to the DB
+	err = s.Store.Transaction(func(st server.Store) error {
+		if err := st.CreateSigningKey(security.SigningKey{
+			ID:        keyID,
+			IV:        req.IV,
+			Salt:      req.Salt,
+			PublicKey: req.PublicKey,
+		}); err != nil {
+			return errors.Wrap(err, "Could not save signing key to the database")
+		}
+
+		if err := st.CreateAdmin(server.Admin{
+			ID:                  req.OwnerID,
+			Status:              "active",
+			Name:                req.Name,
+			Email:               req.Email,
+			Permissions:         string(encodedPermissions),
+			Role:                "superadmin",
+			PrimarySigningKeyID: keyID,
+			AdminFor:            "1",
+		}); err != nil {
+			return errors.Wrap(err, "Could not save admin to the database")
+		}
+
+		if err := st.CreateKeySignature(signature); err != nil {
+			return errors.Wrap(err, "Could not save key signature to the database")
+		}
+
+		ltr := server.LongTermRequest{
+			ID:    h.Sum(nil),
+			AppID: "1",
+		}
+		if err := st.CreateLongTermRequest(ltr); err != nil {
+			log.Printf("%x", h.Sum(nil))
+			return errors.Wrap(err, "Could not save long-term request")
+		}
+		return nil
+	})
+	if err != nil {
 		panic(errors.Wrap(err, "Could not commit changes to database"))
 	}
 
@@ -0,0 +1,103 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/tera-insights/2Q2R-enterprise/server"
+
+	"github.com/pkg/errors"
+)
+
+const usage = `Usage: migrate [flags] <command>
+
+Commands:
+  status     list the migrations and whether they have been applied
+  up         apply all migrations
+  down       revert the last migration
+  to <n>     migrate up or down to schema version n
+
+Flags:
+`
+
+func main() {
+	var configPath string
+	var configType string
+
+	flag.StringVar(&configPath, "config-path", "./config.yaml",
+		"Path to server configuration file")
+	flag.StringVar(&configType, "config-type", "yaml",
+		"Filetype of config file. Case insensitive. Must be either JSON, "+
+			"YAML, HCL, or Java")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	r, err := os.Open(configPath)
+	if err != nil {
+		panic(errors.Wrapf(err, "Could not open config file at path %s",
+			configPath))
+	}
+	m, err := server.OpenMigrator(server.LoadConfig(r, configType))
+	if err != nil {
+		panic(err)
+	}
+	defer m.Close()
+
+	switch flag.Arg(0) {
+	case "status":
+		err = printStatus(m)
+	case "up":
+		err = m.Up()
+	case "down":
+		err = m.Down()
+	case "to":
+		var target int
+		target, err = strconv.Atoi(flag.Arg(1))
+		if err != nil {
+			err = errors.Errorf("Invalid schema version %q", flag.Arg(1))
+			break
+		}
+		err = m.To(target)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if flag.Arg(0) != "status" {
+		version, err := m.Version()
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("Database is on schema version %d\n", version)
+	}
+}
+
+func printStatus(m *server.Migrator) error {
+	status, err := m.Status()
+	if err != nil {
+		return err
+	}
+	for _, s := range status {
+		applied := "pending"
+		if s.AppliedAt != nil {
+			applied = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%4d  %-50s  %s\n", s.Version, s.Name, applied)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/tera-insights/2Q2R-enterprise/server"
+
+	"github.com/pkg/errors"
+)
+
+// Encrypts the database with a new data key, wrapped by the configured master
+// key. To rotate the master key, stop the servers, configure the new master
+// key, run this with -old-master-key-file pointing at the old one, and start
+// the servers again.
+func main() {
+	var configPath string
+	var configType string
+	var oldMasterKeyFile string
+
+	flag.StringVar(&configPath, "config-path", "./config.yaml",
+		"Path to server configuration file")
+	flag.StringVar(&configType, "config-type", "yaml",
+		"Filetype of config file. Case insensitive. Must be either JSON, "+
+			"YAML, HCL, or Java")
+	flag.StringVar(&oldMasterKeyFile, "old-master-key-file", "",
+		"File with the master key that currently wraps the data keys, if it "+
+			"is not the configured one")
+	flag.Parse()
+
+	r, err := os.Open(configPath)
+	if err != nil {
+		panic(errors.Wrapf(err, "Could not open config file at path %s",
+			configPath))
+	}
+	c := server.LoadConfig(r, configType)
+
+	var oldMaster []byte
+	if oldMasterKeyFile != "" {
+		oldMaster, err = server.ReadMasterKeyFile(oldMasterKeyFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	count, err := server.Reencrypt(c, oldMaster)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Re-encrypted %d records\n", count)
+}
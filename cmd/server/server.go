@@ -3,11 +3,14 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/tera-insights/2Q2R-enterprise/server"
 
@@ -48,14 +51,32 @@ func main() {
 		panic(errors.Wrap(err, s))
 	}
 	s := server.NewServer(r, configType)
-	http.Handle("/", s.GetHandler())
+
+	// Shut down gracefully on SIGINT and SIGTERM
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+		fmt.Printf("Received %s, shutting down\n", sig)
+
+		ctx, cancel := context.WithTimeout(context.Background(),
+			s.Config.ShutdownTimeout)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			log.Printf("Could not shut down gracefully: %v\n", err)
+		}
+	}()
+
 	if s.Config.HTTPS {
 		fmt.Printf("Listening on HTTPS port %s\n", s.Config.Port)
-		log.Fatal(http.ListenAndServeTLS(s.Config.Port, s.Config.CertFile,
-			s.Config.KeyFile, nil))
 	} else {
 		fmt.Printf("Listening on HTTP port %s\n", s.Config.Port)
-		log.Fatal(http.ListenAndServe(s.Config.Port, nil))
 	}
-
+	if err := s.ListenAndServe(); err != http.ErrServerClosed {
+		s.Close()
+		log.Fatal(err)
+	}
+	<-stopped
 }
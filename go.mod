@@ -10,6 +10,8 @@ replace github.com/tera-insights/2Q2R-enterprise/util => ./util
 
 require (
 	github.com/GeertJohan/go.rice v1.0.2 // indirect
+	github.com/felixge/httpsnoop v1.0.1 // indirect
+	github.com/fxamacker/cbor/v2 v2.3.0 // indirect
 	github.com/gorilla/handlers v1.5.1 // indirect
 	github.com/gorilla/mux v1.8.0 // indirect
 	github.com/gorilla/securecookie v1.1.1 // indirect
@@ -17,7 +19,9 @@ require (
 	github.com/jinzhu/gorm v1.9.16
 	github.com/oschwald/maxminddb-golang v1.8.0 // indirect
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.12.2 // indirect
 	github.com/ryanuber/go-glob v1.0.0 // indirect
+	github.com/sirupsen/logrus v1.8.1 // indirect
 	github.com/spf13/viper v1.9.0 // indirect
 	github.com/tera-insights/2Q2R-enterprise v0.2.0 // indirect
 	github.com/tera-insights/2Q2R-enterprise/security v0.0.0-00010101000000-000000000000
@@ -0,0 +1,267 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package security
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Attestation types, as defined in the WebAuthn spec, section 6.5.3.
+const (
+	AttestationTypeNone  = "none"
+	AttestationTypeSelf  = "self"
+	AttestationTypeBasic = "basic"
+)
+
+// OID of the FIDO extension that carries an authenticator's AAGUID inside its
+// attestation certificate.
+var oidFIDOGenCeAAGUID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 45724, 1, 1, 4}
+
+// AttestationResult describes who vouched for a newly created credential.
+type AttestationResult struct {
+	Type string
+
+	// The attestation certificate followed by any intermediates. Empty for
+	// none and self attestation.
+	Chain []*x509.Certificate
+}
+
+// Certificate returns the attestation certificate, if there is one.
+func (ar AttestationResult) Certificate() *x509.Certificate {
+	if len(ar.Chain) == 0 {
+		return nil
+	}
+	return ar.Chain[0]
+}
+
+// VerifyChain checks that the attestation certificate chains up to one of
+// `roots`.
+func (ar AttestationResult) VerifyChain(roots *x509.CertPool) error {
+	cert := ar.Certificate()
+	if cert == nil {
+		return errors.New("Attestation did not include a certificate")
+	}
+	if roots == nil {
+		return errors.New("No trusted attestation roots are configured")
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range ar.Chain[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return errors.Wrap(err, "Could not verify attestation certificate chain")
+}
+
+// FormatAAGUID formats a 16-byte AAGUID in the canonical UUID form.
+func FormatAAGUID(b []byte) string {
+	if len(b) != 16 {
+		return ""
+	}
+	h := hex.EncodeToString(b)
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// LoadCertPool reads every PEM file in `dir` into a certificate pool.
+func LoadCertPool(dir string) (*x509.CertPool, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not read directory %s", dir)
+	}
+	pool := x509.NewCertPool()
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".pem") {
+			continue
+		}
+		raw, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not read %s", f.Name())
+		}
+		if !pool.AppendCertsFromPEM(raw) {
+			return nil, errors.Errorf("%s did not contain any certificates",
+				f.Name())
+		}
+	}
+	return pool, nil
+}
+
+// VerifyAttestationStatement checks the attestation statement of a new
+// WebAuthn credential. Only the "none", "packed" and "fido-u2f" formats are
+// supported. It does not check the certificate chain; see VerifyChain.
+func VerifyAttestationStatement(ao AttestationObject,
+	clientDataHash []byte) (AttestationResult, error) {
+	signed := append(append([]byte{}, ao.RawAuthData...), clientDataHash...)
+
+	switch ao.Format {
+	case "none":
+		if len(ao.Statement) != 0 {
+			return AttestationResult{}, errors.New("\"none\" attestation had " +
+				"a statement")
+		}
+		return AttestationResult{Type: AttestationTypeNone}, nil
+	case "packed":
+		return verifyPackedAttestation(ao, signed)
+	case "fido-u2f":
+		return verifyU2FAttestation(ao, clientDataHash)
+	}
+	return AttestationResult{}, errors.Errorf("Unsupported attestation "+
+		"format %s", ao.Format)
+}
+
+func verifyPackedAttestation(ao AttestationObject,
+	signed []byte) (AttestationResult, error) {
+	alg, ok := statementInt(ao.Statement, "alg")
+	if !ok {
+		return AttestationResult{}, errors.New("Packed attestation had no " +
+			"algorithm")
+	}
+	sig, ok := ao.Statement["sig"].([]byte)
+	if !ok {
+		return AttestationResult{}, errors.New("Packed attestation had no " +
+			"signature")
+	}
+
+	if _, found := ao.Statement["x5c"]; !found {
+		// Self attestation is signed by the credential key itself
+		_, credAlg, err := ParseCOSEKey(ao.AuthData.CredentialPublicKey)
+		if err != nil {
+			return AttestationResult{}, err
+		}
+		if credAlg != alg {
+			return AttestationResult{}, errors.New("Self attestation used a " +
+				"different algorithm than the credential")
+		}
+		if err := VerifyCOSESignature(ao.AuthData.CredentialPublicKey, signed,
+			sig); err != nil {
+			return AttestationResult{}, err
+		}
+		return AttestationResult{Type: AttestationTypeSelf}, nil
+	}
+
+	chain, err := statementChain(ao.Statement)
+	if err != nil {
+		return AttestationResult{}, err
+	}
+	if err := verifySignature(chain[0].PublicKey, alg, signed, sig); err != nil {
+		return AttestationResult{}, err
+	}
+
+	// If the certificate names an AAGUID, it must match the authenticator's
+	for _, ext := range chain[0].Extensions {
+		if !ext.Id.Equal(oidFIDOGenCeAAGUID) {
+			continue
+		}
+		var aaguid []byte
+		if _, err := asn1.Unmarshal(ext.Value, &aaguid); err != nil {
+			return AttestationResult{}, errors.Wrap(err, "Could not decode "+
+				"AAGUID extension")
+		}
+		if !bytes.Equal(aaguid, ao.AuthData.AAGUID) {
+			return AttestationResult{}, errors.New("Attestation certificate " +
+				"AAGUID does not match the authenticator")
+		}
+	}
+	return AttestationResult{Type: AttestationTypeBasic, Chain: chain}, nil
+}
+
+func verifyU2FAttestation(ao AttestationObject,
+	clientDataHash []byte) (AttestationResult, error) {
+	sig, ok := ao.Statement["sig"].([]byte)
+	if !ok {
+		return AttestationResult{}, errors.New("U2F attestation had no " +
+			"signature")
+	}
+	chain, err := statementChain(ao.Statement)
+	if err != nil {
+		return AttestationResult{}, err
+	}
+	if len(chain) != 1 {
+		return AttestationResult{}, errors.New("U2F attestation must have " +
+			"exactly one certificate")
+	}
+
+	pub, _, err := ParseCOSEKey(ao.AuthData.CredentialPublicKey)
+	if err != nil {
+		return AttestationResult{}, err
+	}
+	credKey, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return AttestationResult{}, errors.New("U2F credential was not a P-256 " +
+			"key")
+	}
+
+	// 0x00 | rpIdHash | clientDataHash | credentialId | publicKeyU2F
+	signed := []byte{0}
+	signed = append(signed, ao.AuthData.RPIDHash...)
+	signed = append(signed, clientDataHash...)
+	signed = append(signed, ao.AuthData.CredentialID...)
+	signed = append(signed, elliptic.Marshal(elliptic.P256(), credKey.X,
+		credKey.Y)...)
+	if err := verifySignature(chain[0].PublicKey, COSEAlgES256, signed,
+		sig); err != nil {
+		return AttestationResult{}, err
+	}
+	return AttestationResult{Type: AttestationTypeBasic, Chain: chain}, nil
+}
+
+func statementInt(stmt map[string]interface{}, k string) (int64, bool) {
+	switch v := stmt[k].(type) {
+	case int64:
+		return v, true
+	case uint64:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+func statementChain(stmt map[string]interface{}) ([]*x509.Certificate, error) {
+	raw, ok := stmt["x5c"].([]interface{})
+	if !ok || len(raw) == 0 {
+		return nil, errors.New("Attestation had no certificates")
+	}
+	chain := make([]*x509.Certificate, 0, len(raw))
+	for _, r := range raw {
+		der, ok := r.([]byte)
+		if !ok {
+			return nil, errors.New("Attestation certificate was not a byte " +
+				"string")
+		}
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not parse attestation "+
+				"certificate")
+		}
+		chain = append(chain, c)
+	}
+	return chain, nil
+}
+
+// AttestationKeyIdentifier returns the hex-encoded SHA-1 of the certificate's
+// public key, which is how the FIDO metadata service identifies U2F
+// authenticators that have no AAGUID.
+func AttestationKeyIdentifier(c *x509.Certificate) string {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(c.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return ""
+	}
+	h := sha1.Sum(spki.PublicKey.Bytes)
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,295 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package security
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCertificate is a certificate along with its private key.
+type testCertificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCertificate creates a CA certificate signed by `parent`, or a
+// self-signed one if `parent` is nil. Unless `aaguid` is nil, the certificate
+// names it in the FIDO AAGUID extension.
+func newTestCertificate(t *testing.T, name string, parent *testCertificate,
+	aaguid []byte) testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	if aaguid != nil {
+		value, err := asn1.Marshal(aaguid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.ExtraExtensions = []pkix.Extension{{
+			Id:    oidFIDOGenCeAAGUID,
+			Value: value,
+		}}
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer,
+		&key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testCertificate{cert, key}
+}
+
+// sign signs `data` with the certificate's key, as ES256.
+func (tc testCertificate) sign(t *testing.T, data []byte) []byte {
+	h := sha256.Sum256(data)
+	sig, err := ecdsa.SignASN1(rand.Reader, tc.key, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func parseTestAttestation(t *testing.T, format string,
+	stmt map[string]interface{}, authData []byte) AttestationObject {
+	ao, err := ParseAttestationObject(mustCBOR(t, map[string]interface{}{
+		"fmt":      format,
+		"attStmt":  stmt,
+		"authData": authData,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ao
+}
+
+func TestVerifyAttestationStatement(t *testing.T) {
+	aaguid := []byte("0123456789abcdef")
+	otherAAGUID := []byte("fedcba9876543210")
+	rpIDHash := sha256.Sum256([]byte("example.com"))
+	clientDataHash := sha256.Sum256([]byte("client data"))
+	cred := newTestCredentials(t)[0]
+	cose := mustCBOR(t, cred.cose)
+	credentialID := []byte("credential")
+
+	authData := authenticatorData(rpIDHash[:],
+		FlagUserPresent|FlagAttestedCredentialData, 0, credentialID, cose, nil)
+	copy(authData[37:], aaguid)
+	signed := append(append([]byte{}, authData...), clientDataHash[:]...)
+
+	root := newTestCertificate(t, "Root", nil, nil)
+	attestation := newTestCertificate(t, "Authenticator", &root, aaguid)
+	mismatched := newTestCertificate(t, "Other model", &root, otherAAGUID)
+	u2fCert := newTestCertificate(t, "U2F", &root, nil)
+
+	// The U2F format signs the credential's raw P-256 key
+	pub, _, err := ParseCOSEKey(cose)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec := pub.(*ecdsa.PublicKey)
+	u2fSigned := append([]byte{0}, rpIDHash[:]...)
+	u2fSigned = append(u2fSigned, clientDataHash[:]...)
+	u2fSigned = append(u2fSigned, credentialID...)
+	u2fSigned = append(u2fSigned, elliptic.Marshal(elliptic.P256(), ec.X,
+		ec.Y)...)
+
+	chain := func(certs ...testCertificate) []interface{} {
+		x5c := []interface{}{}
+		for _, c := range certs {
+			x5c = append(x5c, c.cert.Raw)
+		}
+		return x5c
+	}
+
+	for _, c := range []struct {
+		name     string
+		format   string
+		stmt     map[string]interface{}
+		expected string // attestation type, or empty if rejected
+	}{
+		{"none", "none", map[string]interface{}{}, AttestationTypeNone},
+		{"none with a statement", "none",
+			map[string]interface{}{"sig": []byte("sig")}, ""},
+		{"unknown format", "tpm", map[string]interface{}{}, ""},
+
+		{"packed self", "packed", map[string]interface{}{
+			"alg": COSEAlgES256, "sig": cred.sign(signed),
+		}, AttestationTypeSelf},
+		{"packed self with another algorithm", "packed",
+			map[string]interface{}{
+				"alg": COSEAlgEdDSA, "sig": cred.sign(signed),
+			}, ""},
+		{"packed self over other data", "packed", map[string]interface{}{
+			"alg": COSEAlgES256, "sig": cred.sign(authData),
+		}, ""},
+		{"packed basic", "packed", map[string]interface{}{
+			"alg": COSEAlgES256, "sig": attestation.sign(t, signed),
+			"x5c": chain(attestation, root),
+		}, AttestationTypeBasic},
+		{"packed basic signed by the credential", "packed",
+			map[string]interface{}{
+				"alg": COSEAlgES256, "sig": cred.sign(signed),
+				"x5c": chain(attestation),
+			}, ""},
+		{"packed basic of another model", "packed", map[string]interface{}{
+			"alg": COSEAlgES256, "sig": mismatched.sign(t, signed),
+			"x5c": chain(mismatched),
+		}, ""},
+		{"packed without an algorithm", "packed", map[string]interface{}{
+			"sig": attestation.sign(t, signed), "x5c": chain(attestation),
+		}, ""},
+		{"packed without a signature", "packed", map[string]interface{}{
+			"alg": COSEAlgES256, "x5c": chain(attestation),
+		}, ""},
+		{"packed with an empty chain", "packed", map[string]interface{}{
+			"alg": COSEAlgES256, "sig": attestation.sign(t, signed),
+			"x5c": []interface{}{},
+		}, ""},
+		{"packed with an invalid certificate", "packed",
+			map[string]interface{}{
+				"alg": COSEAlgES256, "sig": attestation.sign(t, signed),
+				"x5c": []interface{}{[]byte("not a certificate")},
+			}, ""},
+
+		{"fido-u2f", "fido-u2f", map[string]interface{}{
+			"sig": u2fCert.sign(t, u2fSigned), "x5c": chain(u2fCert),
+		}, AttestationTypeBasic},
+		{"fido-u2f with a chain", "fido-u2f", map[string]interface{}{
+			"sig": u2fCert.sign(t, u2fSigned), "x5c": chain(u2fCert, root),
+		}, ""},
+		{"fido-u2f over the WebAuthn data", "fido-u2f",
+			map[string]interface{}{
+				"sig": u2fCert.sign(t, signed), "x5c": chain(u2fCert),
+			}, ""},
+		{"fido-u2f without a signature", "fido-u2f", map[string]interface{}{
+			"x5c": chain(u2fCert),
+		}, ""},
+	} {
+		ao := parseTestAttestation(t, c.format, c.stmt, authData)
+		res, err := VerifyAttestationStatement(ao, clientDataHash[:])
+		if c.expected == "" {
+			if err == nil {
+				t.Errorf("%s: verified as %s", c.name, res.Type)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if res.Type != c.expected {
+			t.Errorf("%s: type was %s, expected %s", c.name, res.Type,
+				c.expected)
+		}
+	}
+}
+
+func TestVerifyChain(t *testing.T) {
+	root := newTestCertificate(t, "Root", nil, nil)
+	intermediate := newTestCertificate(t, "Intermediate", &root, nil)
+	leaf := newTestCertificate(t, "Authenticator", &intermediate, nil)
+	untrusted := newTestCertificate(t, "Untrusted", nil, nil)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root.cert)
+
+	for _, c := range []struct {
+		name  string
+		chain []*x509.Certificate
+		roots *x509.CertPool
+		valid bool
+	}{
+		{"signed by a root", []*x509.Certificate{intermediate.cert}, roots,
+			true},
+		{"through an intermediate", []*x509.Certificate{leaf.cert,
+			intermediate.cert}, roots, true},
+		{"without the intermediate", []*x509.Certificate{leaf.cert}, roots,
+			false},
+		{"untrusted", []*x509.Certificate{untrusted.cert}, roots, false},
+		{"without roots", []*x509.Certificate{intermediate.cert}, nil, false},
+		{"without a certificate", nil, roots, false},
+	} {
+		err := AttestationResult{Chain: c.chain}.VerifyChain(c.roots)
+		if (err == nil) != c.valid {
+			t.Errorf("%s: expected valid to be %v. Got %v", c.name, c.valid,
+				err)
+		}
+	}
+}
+
+func TestLoadCertPool(t *testing.T) {
+	root := newTestCertificate(t, "Root", nil, nil)
+	encoded := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
+		Bytes: root.cert.Raw})
+
+	dir := t.TempDir()
+	for name, content := range map[string][]byte{
+		"root.pem":   encoded,
+		"README.txt": []byte("not a certificate"),
+	} {
+		err := ioutil.WriteFile(filepath.Join(dir, name), content, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	pool, err := LoadCertPool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = AttestationResult{Chain: []*x509.Certificate{root.cert}}.VerifyChain(
+		pool)
+	if err != nil {
+		t.Errorf("Loaded root was not trusted: %v", err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "broken.pem"),
+		[]byte("not a certificate"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCertPool(dir); err == nil {
+		t.Error("Loaded a PEM file without certificates")
+	}
+	if _, err := LoadCertPool(filepath.Join(dir, "missing")); err == nil {
+		t.Error("Loaded a missing directory")
+	}
+}
+
+func TestFormatAAGUID(t *testing.T) {
+	for raw, expected := range map[string]string{
+		"0123456789abcdef": "30313233-3435-3637-3839-616263646566",
+		"too short":        "",
+		"":                 "",
+	} {
+		if got := FormatAAGUID([]byte(raw)); got != expected {
+			t.Errorf("Formatted %q as %q, expected %q", raw, got, expected)
+		}
+	}
+}
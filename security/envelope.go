@@ -0,0 +1,220 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package security
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Prefixes of values that Envelope encrypted. Values without one are
+// plaintext that was stored before encryption was enabled. Values with the
+// unbound prefix were encrypted before values were bound to their field.
+const (
+	envelopePrefix = "enc2:"
+	unboundPrefix  = "enc:"
+)
+
+// Envelope encrypts values with data keys, which are themselves stored
+// encrypted (wrapped) by a master key. Rotating the master key only requires
+// wrapping the data keys again.
+//
+// Encrypted values look like "enc2:<data key ID>:<base-64 nonce and
+// ciphertext>", so that they can be stored in string columns and decrypted
+// after the data key has been rotated. A nil *Envelope stores plaintext.
+type Envelope struct {
+	current string
+	keys    map[string]cipher.AEAD
+
+	// Whether plaintext and unbound values are refused
+	strict bool
+}
+
+// Field is where a value is stored. Values are bound to their field as
+// additional authenticated data, so that a value copied to another row or
+// column does not decrypt.
+type Field struct {
+	Table  string
+	Column string
+	Row    string
+}
+
+// additionalData encodes the field with the length of each part, so that
+// parts cannot be shifted into each other.
+func (f Field) additionalData() []byte {
+	var ad []byte
+	for _, part := range []string{f.Table, f.Column, f.Row} {
+		ad = strconv.AppendInt(ad, int64(len(part)), 10)
+		ad = append(ad, ':')
+		ad = append(ad, part...)
+	}
+	return ad
+}
+
+// NewEnvelope creates an envelope without data keys.
+func NewEnvelope() *Envelope {
+	return &Envelope{keys: make(map[string]cipher.AEAD)}
+}
+
+// GenerateDataKey returns a new random AES-256 data key.
+func GenerateDataKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, errors.Wrap(err, "Could not generate data key")
+	}
+	return key, nil
+}
+
+// KeyID identifies a master or data key without revealing it.
+func KeyID(key []byte) string {
+	h := sha256.Sum256(key)
+	return hex.EncodeToString(h[:8])
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func seal(aead cipher.AEAD, plain, additional []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Wrap(err, "Could not generate nonce")
+	}
+	return aead.Seal(nonce, nonce, plain, additional), nil
+}
+
+func open(aead cipher.AEAD, sealed, additional []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("Ciphertext is too short")
+	}
+	n := aead.NonceSize()
+	return aead.Open(nil, sealed[:n], sealed[n:], additional)
+}
+
+// WrapKey encrypts a data key with the master key.
+func WrapKey(master, key []byte) ([]byte, error) {
+	aead, err := newGCM(master)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid master key")
+	}
+	return seal(aead, key, nil)
+}
+
+// UnwrapKey decrypts a data key that WrapKey encrypted with the master key.
+func UnwrapKey(master, wrapped []byte) ([]byte, error) {
+	aead, err := newGCM(master)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid master key")
+	}
+	key, err := open(aead, wrapped, nil)
+	return key, errors.Wrap(err, "Could not unwrap data key")
+}
+
+// AddKey adds a data key with ID KeyID(key). If `current` is set, then new
+// values are encrypted with it.
+func (e *Envelope) AddKey(key []byte, current bool) error {
+	aead, err := newGCM(key)
+	if err != nil {
+		return errors.Wrap(err, "Invalid data key")
+	}
+	id := KeyID(key)
+	e.keys[id] = aead
+	if current {
+		e.current = id
+	}
+	return nil
+}
+
+// RejectUnbound makes Decrypt refuse plaintext, and values that were encrypted
+// before values were bound to their field. Call it once every stored value was
+// encrypted by Encrypt.
+func (e *Envelope) RejectUnbound() {
+	e.strict = true
+}
+
+// IsEncrypted returns whether `stored` was encrypted by an envelope.
+func IsEncrypted(stored []byte) bool {
+	return bytes.HasPrefix(stored, []byte(envelopePrefix)) ||
+		bytes.HasPrefix(stored, []byte(unboundPrefix))
+}
+
+// Encrypt encrypts `plain`, which is stored in field `f`, with the current
+// data key. Empty values are kept empty.
+func (e *Envelope) Encrypt(plain []byte, f Field) ([]byte, error) {
+	if e == nil || len(plain) == 0 {
+		return plain, nil
+	}
+	aead, ok := e.keys[e.current]
+	if !ok {
+		return nil, errors.New("Envelope has no current data key")
+	}
+	sealed, err := seal(aead, plain, f.additionalData())
+	if err != nil {
+		return nil, err
+	}
+	return []byte(envelopePrefix + e.current + ":" +
+		base64.RawStdEncoding.EncodeToString(sealed)), nil
+}
+
+// Decrypt decrypts a value that Encrypt returned for field `f`. Plaintext
+// values are returned as they are, unless the envelope rejects them.
+func (e *Envelope) Decrypt(stored []byte, f Field) ([]byte, error) {
+	if !IsEncrypted(stored) {
+		if e != nil && e.strict && len(stored) > 0 {
+			return nil, errors.New("Value is not encrypted")
+		}
+		return stored, nil
+	}
+	if e == nil {
+		return nil, errors.New("Value is encrypted but no master key is " +
+			"configured")
+	}
+
+	prefix, additional := envelopePrefix, f.additionalData()
+	if !bytes.HasPrefix(stored, []byte(prefix)) {
+		if e.strict {
+			return nil, errors.New("Value is not bound to its field")
+		}
+		prefix, additional = unboundPrefix, nil
+	}
+	parts := strings.SplitN(string(stored[len(prefix):]), ":", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("Encrypted value is malformed")
+	}
+	aead, ok := e.keys[parts[0]]
+	if !ok {
+		return nil, errors.Errorf("Unknown data key %s", parts[0])
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.Wrap(err, "Encrypted value is malformed")
+	}
+	plain, err := open(aead, sealed, additional)
+	return plain, errors.Wrap(err, "Could not decrypt value")
+}
+
+// EncryptString is Encrypt for string columns.
+func (e *Envelope) EncryptString(plain string, f Field) (string, error) {
+	sealed, err := e.Encrypt([]byte(plain), f)
+	return string(sealed), err
+}
+
+// DecryptString is Decrypt for string columns.
+func (e *Envelope) DecryptString(stored string, f Field) (string, error) {
+	plain, err := e.Decrypt([]byte(stored), f)
+	return string(plain), err
+}
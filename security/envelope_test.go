@@ -0,0 +1,161 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package security
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+func testEnvelope(t *testing.T) (*Envelope, []byte) {
+	key, err := GenerateDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewEnvelope()
+	if err := e.AddKey(key, true); err != nil {
+		t.Fatal(err)
+	}
+	return e, key
+}
+
+// field is where the values in the tests are stored.
+var field = Field{Table: "keys", Column: "marshalled_registration", Row: "k1"}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	e, _ := testEnvelope(t)
+	plain := []byte{5, 4, 0, 1, 2}
+	sealed, err := e.Encrypt(plain, field)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(sealed) || bytes.Contains(sealed, plain) {
+		t.Fatalf("Value was not encrypted: %q", sealed)
+	}
+	opened, err := e.Decrypt(sealed, field)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, plain) {
+		t.Errorf("Decrypted %v, expected %v", opened, plain)
+	}
+
+	s, err := e.EncryptString("public key", field)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err = e.DecryptString(s, field); err != nil || s != "public key" {
+		t.Errorf("Decrypted %q (%v)", s, err)
+	}
+}
+
+func TestEnvelopePassesPlaintextThrough(t *testing.T) {
+	e, _ := testEnvelope(t)
+	plain := []byte("stored before encryption")
+	opened, err := e.Decrypt(plain, field)
+	if err != nil || !bytes.Equal(opened, plain) {
+		t.Errorf("Decrypted %q (%v)", opened, err)
+	}
+
+	var none *Envelope
+	if sealed, _ := none.Encrypt(plain, field); !bytes.Equal(sealed, plain) {
+		t.Error("Envelope without keys encrypted a value")
+	}
+	sealed, _ := e.Encrypt(plain, field)
+	if _, err := none.Decrypt(sealed, field); err == nil {
+		t.Error("Envelope without keys decrypted a value")
+	}
+}
+
+func TestEnvelopeKeyRotation(t *testing.T) {
+	e, old := testEnvelope(t)
+	sealed, err := e.Encrypt([]byte("secret"), field)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	master := make([]byte, 32)
+	wrapped, err := WrapKey(master, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UnwrapKey(bytes.Repeat([]byte{1}, 32), wrapped); err == nil {
+		t.Fatal("Unwrapped a data key with the wrong master key")
+	}
+	unwrapped, err := UnwrapKey(master, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Values encrypted with an older data key can still be decrypted
+	rotated, _ := testEnvelope(t)
+	if err := rotated.AddKey(unwrapped, false); err != nil {
+		t.Fatal(err)
+	}
+	opened, err := rotated.Decrypt(sealed, field)
+	if err != nil || string(opened) != "secret" {
+		t.Errorf("Decrypted %q (%v)", opened, err)
+	}
+	resealed, _ := rotated.Encrypt(opened, field)
+	if bytes.HasPrefix(resealed, sealed[:len(envelopePrefix)+16]) {
+		t.Error("Value was encrypted with the old data key")
+	}
+}
+
+func TestEnvelopeBindsValuesToFields(t *testing.T) {
+	e, _ := testEnvelope(t)
+	sealed, err := e.Encrypt([]byte("secret"), field)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range []Field{
+		{Table: "keys", Column: "marshalled_registration", Row: "k2"},
+		{Table: "keys", Column: "credential_public_key", Row: "k1"},
+		{Table: "webhooks", Column: "marshalled_registration", Row: "k1"},
+		// The parts of a field cannot be shifted into each other
+		{Table: "keys", Column: "marshalled_registration\x00k1", Row: ""},
+	} {
+		if _, err := e.Decrypt(sealed, f); err == nil {
+			t.Errorf("Value of %+v decrypted for %+v", field, f)
+		}
+	}
+}
+
+func TestEnvelopeRejectsUnboundValues(t *testing.T) {
+	e, key := testEnvelope(t)
+
+	// As encrypted before values were bound to their field
+	aead, err := newGCM(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := seal(aead, []byte("secret"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unbound := []byte(unboundPrefix + KeyID(key) + ":" +
+		base64.RawStdEncoding.EncodeToString(sealed))
+	if opened, err := e.Decrypt(unbound, field); err != nil ||
+		string(opened) != "secret" {
+		t.Errorf("Decrypted %q (%v)", opened, err)
+	}
+
+	e.RejectUnbound()
+	for _, stored := range [][]byte{unbound, []byte("plaintext")} {
+		if _, err := e.Decrypt(stored, field); err == nil {
+			t.Errorf("Decrypted %q after rejecting unbound values", stored)
+		}
+	}
+
+	// Empty values are stored as they are
+	if opened, err := e.Decrypt(nil, field); err != nil || len(opened) != 0 {
+		t.Errorf("Decrypted %q (%v)", opened, err)
+	}
+	bound, _ := e.Encrypt([]byte("secret"), field)
+	if opened, err := e.Decrypt(bound, field); err != nil ||
+		string(opened) != "secret" {
+		t.Errorf("Decrypted %q (%v)", opened, err)
+	}
+}
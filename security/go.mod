@@ -3,7 +3,7 @@ module github.com/tera-insights/2Q2R-enterprise/security
 go 1.16
 
 require (
-	github.com/jinzhu/gorm v1.9.16
+	github.com/fxamacker/cbor/v2 v2.3.0
 	github.com/patrickmn/go-cache v2.1.0+incompatible
 	github.com/pkg/errors v0.9.1
 	github.com/telehash/gogotelehash v0.0.0-20150403070912-c0ffc74a9407
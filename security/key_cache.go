@@ -10,9 +10,9 @@ import (
 	"encoding/base64"
 	"io"
 	"math/big"
+	"sync/atomic"
 	"time"
 
-	"github.com/jinzhu/gorm"
 	cache "github.com/patrickmn/go-cache"
 	"github.com/pkg/errors"
 	"github.com/telehash/gogotelehash/e3x/cipherset/cs1a/ecdh"
@@ -27,9 +27,65 @@ type Key struct {
 	UserID string `json:"userID"`
 	AppID  string `json:"appID"`
 
-	// unmarshalled by go-u2f
+	// FormatU2F or FormatWebAuthn. Keys registered before WebAuthn support
+	// have an empty format and are treated as U2F keys.
+	Format string `json:"format"`
+
+	// unmarshalled by go-u2f, only set for U2F keys
 	MarshalledRegistration []byte `json:"marshalledRegistration"`
-	Counter                uint32 `json:"counter"`
+
+	// COSE-encoded public key, only set for WebAuthn keys
+	CredentialPublicKey []byte `json:"credentialPublicKey"`
+
+	Counter uint32 `json:"counter"`
+
+	// Subject of the attestation certificate and, for WebAuthn keys, the
+	// authenticator's AAGUID. Empty if the app does not request attestation.
+	AttestationSubject string `json:"attestationSubject"`
+	AAGUID             string `json:"aaguid"`
+
+	// Set when the key reports a signature counter that did not increase,
+	// which means that the authenticator may have been cloned.
+	Suspect   bool       `json:"suspect"`
+	SuspectAt *time.Time `json:"suspectAt"`
+
+	// One of the KeyState constants. Keys registered before key states
+	// existed have an empty state and are treated as active.
+	State string `json:"state"`
+
+	// The key is expired after this time. Nil if the key never expires.
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+// Key states. Only active keys can be used to authenticate.
+const (
+	KeyStateActive    = "active"
+	KeyStateSuspended = "suspended" // temporarily, e.g. for a lost token
+	KeyStateExpired   = "expired"
+	KeyStateRevoked   = "revoked" // permanently
+)
+
+// IsWebAuthn returns whether the key holds a WebAuthn credential rather than a
+// legacy U2F registration.
+func (k Key) IsWebAuthn() bool {
+	return k.Format == FormatWebAuthn
+}
+
+// CurrentState returns the key's state at `now`, taking its expiry into
+// account.
+func (k Key) CurrentState(now time.Time) string {
+	if k.State != "" && k.State != KeyStateActive {
+		return k.State
+	}
+	if k.ExpiresAt != nil && !now.Before(*k.ExpiresAt) {
+		return KeyStateExpired
+	}
+	return KeyStateActive
+}
+
+// IsActive returns whether the key can currently be used to authenticate.
+func (k Key) IsActive() bool {
+	return k.CurrentState(time.Now()) == KeyStateActive
 }
 
 // KeySignature is the Gorm model for signatures of both signing and
@@ -49,6 +105,12 @@ type KeySignature struct {
 
 // KeyCache stores and checks the validity of signing keys.
 type KeyCache struct {
+	// Lookups of second-factor keys and app IDs that were served from the
+	// cache, and that had to go to the store. First, so that they are
+	// aligned for atomic access.
+	hits   uint64
+	misses uint64
+
 	validPublic      *cache.Cache // Stores valid public signing keys
 	secondFactorKeys *cache.Cache // Stores valid second-factor keys
 	userToAppID      *cache.Cache // User ID to app ID
@@ -57,7 +119,22 @@ type KeyCache struct {
 
 	serverPub *rsa.PublicKey
 
-	db *gorm.DB
+	store KeyStore
+
+	// Closed by Close to stop cleaning the caches
+	done chan struct{}
+}
+
+// KeyStore is where a KeyCache loads the keys and signatures that it has not
+// cached.
+type KeyStore interface {
+	GetKey(id string) (Key, error)
+
+	// Any of the user's keys, which all belong to the same app
+	GetUserKey(userID string) (Key, error)
+
+	// The signature of a public key
+	GetKeySignature(signedPublicKey string) (KeySignature, error)
 }
 
 // SigningKey is the Gorm model for keys that the admin uses to sign things.
@@ -68,16 +145,73 @@ type SigningKey struct {
 	PublicKey string `json:"publicKey"` // same encoding
 }
 
-// NewKeyCache uses the config to create a new KeyCache.
-func NewKeyCache(et, ct time.Duration, p *rsa.PublicKey, db *gorm.DB, priv []byte) *KeyCache {
-	return &KeyCache{
-		cache.New(et, ct),
-		cache.New(et, ct),
-		cache.New(et, ct),
-		cache.New(et, ct),
+// NewKeyCache uses the config to create a new KeyCache. Expired entries are
+// removed every `ct` until the cache is closed.
+func NewKeyCache(et, ct time.Duration, p *rsa.PublicKey, store KeyStore,
+	priv []byte) *KeyCache {
+	kc := &KeyCache{
+		0,
+		0,
+		cache.New(et, 0),
+		cache.New(et, 0),
+		cache.New(et, 0),
+		cache.New(et, 0),
 		priv,
 		p,
-		db,
+		store,
+		make(chan struct{}),
+	}
+	go cleanCaches(ct, kc.done, kc.validPublic, kc.secondFactorKeys,
+		kc.userToAppID, kc.shared)
+	return kc
+}
+
+// Close stops removing expired entries from the cache.
+func (kc *KeyCache) Close() {
+	close(kc.done)
+}
+
+// KeyCacheStats counts the lookups of second-factor keys and app IDs.
+type KeyCacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+// Stats returns how many lookups the cache has served since it was created.
+func (kc *KeyCache) Stats() KeyCacheStats {
+	return KeyCacheStats{
+		Hits:   atomic.LoadUint64(&kc.hits),
+		Misses: atomic.LoadUint64(&kc.misses),
+	}
+}
+
+// countLookup records whether a lookup was served from the cache.
+func (kc *KeyCache) countLookup(hit bool) {
+	if hit {
+		atomic.AddUint64(&kc.hits, 1)
+	} else {
+		atomic.AddUint64(&kc.misses, 1)
+	}
+}
+
+// cleanCaches removes expired entries from `caches` every `interval` until
+// `done` is closed. Unlike the janitors of go-cache, it can be stopped.
+func cleanCaches(interval time.Duration, done <-chan struct{},
+	caches ...*cache.Cache) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		for _, c := range caches {
+			c.DeleteExpired()
+		}
 	}
 }
 
@@ -90,14 +224,13 @@ func (kc *KeyCache) Add2FAKey(k Key) {
 // in the cache, then Get2FAKey checks the database. If the key is in the DB,
 // then it is added to the cache.
 func (kc *KeyCache) Get2FAKey(id string) (Key, error) {
-	if val, ok := kc.secondFactorKeys.Get(id); ok {
+	val, ok := kc.secondFactorKeys.Get(id)
+	kc.countLookup(ok)
+	if ok {
 		return val.(Key), nil
 	}
 
-	k := Key{}
-	err := kc.db.First(&k, &Key{
-		ID: id,
-	}).Error
+	k, err := kc.store.GetKey(id)
 	if err == nil {
 		kc.secondFactorKeys.Add(id, k, cache.NoExpiration)
 		kc.userToAppID.Add(k.UserID, k.AppID, cache.NoExpiration)
@@ -109,14 +242,13 @@ func (kc *KeyCache) Get2FAKey(id string) (Key, error) {
 // in the userToAppID cache, then GetAppID checks the database. If the user is
 // in the DB, then it is added to the cache.
 func (kc *KeyCache) GetAppID(userID string) (string, error) {
-	if val, ok := kc.userToAppID.Get(userID); ok {
+	val, ok := kc.userToAppID.Get(userID)
+	kc.countLookup(ok)
+	if ok {
 		return val.(string), nil
 	}
 
-	k := Key{}
-	err := kc.db.First(&k, &Key{
-		UserID: userID,
-	}).Error
+	k, err := kc.store.GetUserKey(userID)
 	if err == nil {
 		kc.userToAppID.Add(k.UserID, k.AppID, cache.NoExpiration)
 	}
@@ -222,16 +354,11 @@ func (kc *KeyCache) VerifySignature(sig KeySignature) error {
 				// We have not yet verified the key used to sign `toVerify`.
 				// So, we need to verify both `toVerify` and the key used to
 				// sign `toVerify`.
-				var fetched KeySignature
-				count := 0
-				err := kc.db.Where(KeySignature{
-					SignedPublicKey: toVerify.SigningPublicKey,
-				}).Count(&count).First(&fetched).Error
+				fetched, err := kc.store.GetKeySignature(
+					toVerify.SigningPublicKey)
 				if err != nil {
-					return err
-				}
-				if count == 0 {
-					return errors.Errorf("Signing key was not in the database")
+					return errors.Wrap(err, "Could not find signature of "+
+						"signing key")
 				}
 				if fetched.Type != "signing" {
 					return errors.Errorf("Signing key had type %s, not "+
@@ -259,6 +386,14 @@ func (kc *KeyCache) GetShared(x, y *big.Int) []byte {
 	return s
 }
 
+// PublicKey returns the P-256 point of the private key that GetShared uses,
+// in uncompressed form. Peers multiply it by their own private key to derive
+// the same shared key.
+func (kc *KeyCache) PublicKey() []byte {
+	x, y := elliptic.P256().ScalarBaseMult(kc.priv)
+	return elliptic.Marshal(elliptic.P256(), x, y)
+}
+
 // PutShared stores `shared` in the cache at the index determined by x, y,
 // and the elliptic curve.
 func (kc *KeyCache) PutShared(x, y *big.Int, shared []byte) {
@@ -269,10 +404,8 @@ func (kc *KeyCache) PutShared(x, y *big.Int, shared []byte) {
 // VerifyEphemeralKey verifies the ephemeral public key proposed by an admin.
 func (kc *KeyCache) VerifyEphemeralKey(ephemeralPublic, sig string, sk SigningKey) ([]byte, error) {
 	// Look up signature of signing key
-	var signatureOfAdminsPublic KeySignature
-	if err := kc.db.First(&signatureOfAdminsPublic, KeySignature{
-		SignedPublicKey: sk.PublicKey,
-	}).Error; err != nil {
+	signatureOfAdminsPublic, err := kc.store.GetKeySignature(sk.PublicKey)
+	if err != nil {
 		return nil, err
 	}
 
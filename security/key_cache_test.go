@@ -0,0 +1,32 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package security
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeyCurrentState(t *testing.T) {
+	now := time.Now()
+	past := now.Add(-time.Minute)
+	future := now.Add(time.Minute)
+
+	for _, c := range []struct {
+		key      Key
+		expected string
+	}{
+		// Keys registered before key states existed are active
+		{Key{}, KeyStateActive},
+		{Key{State: KeyStateActive}, KeyStateActive},
+		{Key{State: KeyStateActive, ExpiresAt: &future}, KeyStateActive},
+		{Key{State: KeyStateActive, ExpiresAt: &past}, KeyStateExpired},
+		{Key{ExpiresAt: &now}, KeyStateExpired},
+		{Key{State: KeyStateSuspended, ExpiresAt: &past}, KeyStateSuspended},
+		{Key{State: KeyStateRevoked}, KeyStateRevoked},
+	} {
+		if state := c.key.CurrentState(now); state != c.expected {
+			t.Errorf("Expected %+v to be %s. Got %s", c.key, c.expected, state)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package security
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Authenticator statuses from the FIDO Metadata Service that mean the
+// authenticator must not be trusted.
+var blockingStatuses = map[string]bool{
+	"REVOKED":                      true,
+	"ATTESTATION_KEY_COMPROMISE":   true,
+	"USER_KEY_REMOTE_COMPROMISE":   true,
+	"USER_KEY_PHYSICAL_COMPROMISE": true,
+}
+
+// Certification statuses, from weakest to strongest.
+var certificationLevels = map[string]int{
+	"NOT_FIDO_CERTIFIED":    0,
+	"FIDO_CERTIFIED":        1,
+	"FIDO_CERTIFIED_L1":     1,
+	"FIDO_CERTIFIED_L1plus": 2,
+	"FIDO_CERTIFIED_L2":     3,
+	"FIDO_CERTIFIED_L2plus": 4,
+	"FIDO_CERTIFIED_L3":     5,
+	"FIDO_CERTIFIED_L3plus": 6,
+}
+
+// CertificationLevel returns the rank of a FIDO certification status, or -1
+// if `status` is not a certification status.
+func CertificationLevel(status string) int {
+	if l, found := certificationLevels[status]; found {
+		return l
+	}
+	return -1
+}
+
+// StatusReport is a single status change of an authenticator.
+type StatusReport struct {
+	Status        string `json:"status"`
+	EffectiveDate string `json:"effectiveDate"` // YYYY-MM-DD
+}
+
+// MetadataStatement holds the parts of an authenticator's metadata statement
+// that we show to admins.
+type MetadataStatement struct {
+	Description          string `json:"description"`
+	AuthenticatorVersion uint32 `json:"authenticatorVersion"`
+	ProtocolFamily       string `json:"protocolFamily"`
+}
+
+// MetadataEntry is an authenticator's entry in a FIDO MDS3 blob.
+type MetadataEntry struct {
+	AAGUID                               string            `json:"aaguid"`
+	AAID                                 string            `json:"aaid"`
+	AttestationCertificateKeyIdentifiers []string          `json:"attestationCertificateKeyIdentifiers"`
+	MetadataStatement                    MetadataStatement `json:"metadataStatement"`
+	StatusReports                        []StatusReport    `json:"statusReports"`
+	TimeOfLastStatusChange               string            `json:"timeOfLastStatusChange"`
+}
+
+// Status returns the authenticator's most recent status.
+func (e *MetadataEntry) Status() string {
+	var latest StatusReport
+	for _, r := range e.StatusReports {
+		if r.EffectiveDate >= latest.EffectiveDate {
+			latest = r
+		}
+	}
+	return latest.Status
+}
+
+// Blocked returns whether the authenticator has been revoked or compromised.
+func (e *MetadataEntry) Blocked() bool {
+	return blockingStatuses[e.Status()]
+}
+
+// CertificationLevel returns the highest certification level that the
+// authenticator has reached, or 0 if it has never been certified.
+func (e *MetadataEntry) CertificationLevel() int {
+	level := 0
+	for _, r := range e.StatusReports {
+		if l := CertificationLevel(r.Status); l > level {
+			level = l
+		}
+	}
+	return level
+}
+
+// Metadata is an index of a verified FIDO MDS3 blob.
+type Metadata struct {
+	Number     int    `json:"no"`
+	NextUpdate string `json:"nextUpdate"`
+
+	entries  []MetadataEntry
+	byAAGUID map[string]*MetadataEntry
+	byKeyID  map[string]*MetadataEntry
+}
+
+type metadataPayload struct {
+	Number     int             `json:"no"`
+	NextUpdate string          `json:"nextUpdate"`
+	Entries    []MetadataEntry `json:"entries"`
+}
+
+type jwsHeader struct {
+	Algorithm string   `json:"alg"`
+	X5C       []string `json:"x5c"` // standard base-64, with padding
+}
+
+// LoadMetadata verifies the signature of an MDS3 blob against `roots` and
+// indexes its entries by AAGUID and attestation key identifier.
+func LoadMetadata(blob []byte, roots *x509.CertPool) (*Metadata, error) {
+	parts := strings.Split(strings.TrimSpace(string(blob)), ".")
+	if len(parts) != 3 {
+		return nil, errors.Errorf("Metadata blob had %d parts, expected 3",
+			len(parts))
+	}
+
+	rawHeader, err := decodeBase64(parts[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not decode metadata header")
+	}
+	var header jwsHeader
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return nil, errors.Wrap(err, "Could not decode metadata header")
+	}
+	if len(header.X5C) == 0 {
+		return nil, errors.New("Metadata blob had no signing certificates")
+	}
+
+	chain := make([]*x509.Certificate, 0, len(header.X5C))
+	for _, encoded := range header.X5C {
+		der, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not decode signing certificate")
+		}
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not parse signing certificate")
+		}
+		chain = append(chain, c)
+	}
+	if err := (AttestationResult{Chain: chain}).VerifyChain(roots); err != nil {
+		return nil, errors.Wrap(err, "Metadata blob was not signed by a "+
+			"trusted root")
+	}
+
+	sig, err := decodeBase64(parts[2])
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not decode metadata signature")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	switch header.Algorithm {
+	case "RS256":
+		err = verifySignature(chain[0].PublicKey, COSEAlgRS256, signed, sig)
+	case "ES256":
+		err = verifyJWSES256(chain[0].PublicKey, signed, sig)
+	default:
+		err = errors.Errorf("Unsupported algorithm %s", header.Algorithm)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not verify metadata signature")
+	}
+
+	rawPayload, err := decodeBase64(parts[1])
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not decode metadata payload")
+	}
+	var payload metadataPayload
+	if err := json.Unmarshal(rawPayload, &payload); err != nil {
+		return nil, errors.Wrap(err, "Could not decode metadata payload")
+	}
+
+	m := &Metadata{
+		Number:     payload.Number,
+		NextUpdate: payload.NextUpdate,
+		entries:    payload.Entries,
+		byAAGUID:   make(map[string]*MetadataEntry),
+		byKeyID:    make(map[string]*MetadataEntry),
+	}
+	for i := range m.entries {
+		e := &m.entries[i]
+		if e.AAGUID != "" {
+			m.byAAGUID[strings.ToLower(e.AAGUID)] = e
+		}
+		for _, id := range e.AttestationCertificateKeyIdentifiers {
+			m.byKeyID[strings.ToLower(id)] = e
+		}
+	}
+	return m, nil
+}
+
+// Lookup finds the entry for an authenticator identified by its AAGUID or
+// attestation key identifier.
+func (m *Metadata) Lookup(ids ...string) (*MetadataEntry, bool) {
+	for _, id := range ids {
+		id = strings.ToLower(id)
+		if e, found := m.byAAGUID[id]; found {
+			return e, true
+		}
+		if e, found := m.byKeyID[id]; found {
+			return e, true
+		}
+	}
+	return nil, false
+}
+
+// Len returns the number of authenticators in the blob.
+func (m *Metadata) Len() int {
+	return len(m.entries)
+}
+
+// JWS encodes ES256 signatures as r | s rather than ASN.1.
+func verifyJWSES256(pub interface{}, signed, sig []byte) error {
+	p, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return errors.New("ES256 signature made with a non-ECDSA key")
+	}
+	if len(sig) != 64 {
+		return errors.New("ES256 signature had the wrong length")
+	}
+	h := sha256.Sum256(signed)
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(p, h[:], r, s) {
+		return errors.New("Invalid ES256 signature")
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package security
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// testBlob returns an MDS3 blob with `payload`, signed as ES256 by `signer`
+// whatever `alg` its header names, along with `chain`.
+func testBlob(t *testing.T, alg string, signer testCertificate,
+	chain []testCertificate, payload interface{}) []byte {
+	x5c := []string{}
+	for _, c := range chain {
+		x5c = append(x5c, base64.StdEncoding.EncodeToString(c.cert.Raw))
+	}
+	encode := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := encode(jwsHeader{Algorithm: alg, X5C: x5c}) + "." +
+		encode(payload)
+
+	h := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, signer.key, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return []byte(signed + "." + base64.RawURLEncoding.EncodeToString(sig))
+}
+
+func TestLoadMetadata(t *testing.T) {
+	root := newTestCertificate(t, "Root", nil, nil)
+	intermediate := newTestCertificate(t, "Intermediate", &root, nil)
+	signer := newTestCertificate(t, "Metadata signer", &intermediate, nil)
+	untrusted := newTestCertificate(t, "Untrusted", nil, nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(root.cert)
+
+	payload := metadataPayload{
+		Number:     7,
+		NextUpdate: "2030-01-01",
+		Entries: []MetadataEntry{{
+			AAGUID: "30313233-3435-3637-3839-616263646566",
+			StatusReports: []StatusReport{
+				{Status: "FIDO_CERTIFIED_L2", EffectiveDate: "2020-01-01"},
+			},
+		}, {
+			AttestationCertificateKeyIdentifiers: []string{"ABCDEF"},
+			StatusReports: []StatusReport{
+				{Status: "FIDO_CERTIFIED_L1", EffectiveDate: "2019-01-01"},
+				{Status: "REVOKED", EffectiveDate: "2021-01-01"},
+			},
+		}},
+	}
+	trusted := []testCertificate{signer, intermediate}
+	blob := testBlob(t, "ES256", signer, trusted, payload)
+
+	md, err := LoadMetadata(blob, roots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.Number != 7 || md.NextUpdate != "2030-01-01" || md.Len() != 2 {
+		t.Errorf("Loaded %d entries of blob %d, next update %s", md.Len(),
+			md.Number, md.NextUpdate)
+	}
+	e, found := md.Lookup("unknown", "30313233-3435-3637-3839-616263646566")
+	if !found || e.Blocked() || e.CertificationLevel() != 3 {
+		t.Errorf("Entry by AAGUID was %+v (found: %v)", e, found)
+	}
+	e, found = md.Lookup("abcdef")
+	if !found || !e.Blocked() || e.Status() != "REVOKED" ||
+		e.CertificationLevel() != 1 {
+		t.Errorf("Entry by key identifier was %+v (found: %v)", e, found)
+	}
+	if _, found := md.Lookup("", "unknown"); found {
+		t.Error("Found an unknown authenticator")
+	}
+
+	parts := strings.Split(string(blob), ".")
+	otherPayload := strings.Split(string(testBlob(t, "ES256", signer,
+		trusted, metadataPayload{Number: 8})), ".")[1]
+
+	for name, b := range map[string][]byte{
+		"untrusted chain": testBlob(t, "ES256", untrusted,
+			[]testCertificate{untrusted}, payload),
+		"missing intermediate": testBlob(t, "ES256", signer,
+			[]testCertificate{signer}, payload),
+		"signed by another key": testBlob(t, "ES256", intermediate, trusted,
+			payload),
+		"unsupported algorithm": testBlob(t, "none", signer, trusted,
+			payload),
+		"no certificates": testBlob(t, "ES256", signer, nil, payload),
+		"swapped payload": []byte(parts[0] + "." + otherPayload + "." +
+			parts[2]),
+		"truncated signature": []byte(parts[0] + "." + parts[1] + "." +
+			parts[2][:20]),
+		"two parts":  []byte(parts[0] + "." + parts[1]),
+		"not base64": []byte(parts[0] + ".!!!." + parts[2]),
+	} {
+		if _, err := LoadMetadata(b, roots); err == nil {
+			t.Errorf("Loaded a blob with %s", name)
+		}
+	}
+	if _, err := LoadMetadata(blob, nil); err == nil {
+		t.Error("Loaded a blob without roots")
+	}
+}
+
+func TestCertificationLevel(t *testing.T) {
+	for status, expected := range map[string]int{
+		"NOT_FIDO_CERTIFIED":    0,
+		"FIDO_CERTIFIED":        1,
+		"FIDO_CERTIFIED_L2plus": 4,
+		"REVOKED":               -1,
+		"":                      -1,
+	} {
+		if l := CertificationLevel(status); l != expected {
+			t.Errorf("Level of %q was %d, expected %d", status, l, expected)
+		}
+	}
+
+	// An authenticator keeps its certification after being revoked
+	e := MetadataEntry{StatusReports: []StatusReport{
+		{Status: "ATTESTATION_KEY_COMPROMISE", EffectiveDate: "2022-05-01"},
+		{Status: "FIDO_CERTIFIED_L3", EffectiveDate: "2020-02-01"},
+	}}
+	if e.Status() != "ATTESTATION_KEY_COMPROMISE" || !e.Blocked() ||
+		e.CertificationLevel() != 5 {
+		t.Errorf("Entry had status %s, level %d", e.Status(),
+			e.CertificationLevel())
+	}
+	if (&MetadataEntry{}).Blocked() {
+		t.Error("Entry without reports was blocked")
+	}
+}
@@ -3,46 +3,92 @@
 package security
 
 import (
-	"math/rand"
+	"crypto/rand"
+	"encoding/base64"
+	"sync"
 	"time"
 
 	"github.com/patrickmn/go-cache"
 	"github.com/pkg/errors"
 )
 
+// Number of random bytes in a nonce
+const nonceLength = 32
+
 // NonceGen holds information about the nonces used to secure the admin frontend.
+// Nonces are kept in memory, so a nonce can only be used on the instance that
+// issued it.
 type NonceGen struct {
 	valid  time.Duration
-	nonces *cache.Cache
+	nonces *cache.Cache // nonce to nonceBinding
+
+	// Held while using a nonce so that it can only be used once
+	lock sync.Mutex
+
+	// Closed by Close to stop cleaning the cache
+	done chan struct{}
 }
 
-// NewNonceGen creates a new KeyGen that automatically regenerates its private
-// key.
+// nonceBinding is what a nonce may be used for.
+type nonceBinding struct {
+	adminID string
+	method  string
+	path    string
+}
+
+// NewNonceGen creates a new NonceGen whose nonces are valid for `d`.
 func NewNonceGen(d time.Duration) *NonceGen {
-	return &NonceGen{
-		d,
-		cache.New(d, d),
+	ng := &NonceGen{
+		valid:  d,
+		nonces: cache.New(d, 0),
+		done:   make(chan struct{}),
 	}
+	go cleanCaches(d, ng.done, ng.nonces)
+	return ng
+}
+
+// Close stops removing expired nonces.
+func (ng *NonceGen) Close() {
+	close(ng.done)
 }
 
-// GenerateNonce generates a nonce for an admin. If the admin already has a nonce,
-// returns an error.
-func (ng *NonceGen) GenerateNonce(adminID string) (string, time.Duration, error) {
-	if _, found := ng.nonces.Get(adminID); found {
-		return "", 0, errors.Errorf("Admin with id %s already has a nonce",
-			adminID)
+// GenerateNonce generates a nonce that an admin can use once, within the
+// returned duration, for a request to `method` and `path`. Admins can have
+// several outstanding nonces.
+func (ng *NonceGen) GenerateNonce(adminID, method,
+	path string) (string, time.Duration, error) {
+	b := make([]byte, nonceLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", 0, errors.Wrap(err, "Could not generate nonce")
+	}
+	n := base64.RawURLEncoding.EncodeToString(b)
+
+	err := ng.nonces.Add(n, nonceBinding{adminID, method, path}, ng.valid)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "Could not store nonce")
 	}
-	n := string(rand.Int())
-	ng.nonces.Add(adminID, n, 30*time.Second)
-	return n, 30 * time.Second, nil
+	return n, ng.valid, nil
 }
 
-// GetNonce returns the nonce for a particular admin. If the admin does not
-// have one, returns an error.
-func (ng *NonceGen) GetNonce(adminID string) (string, error) {
-	if val, ok := ng.nonces.Get(adminID); ok {
-		ng.nonces.Delete(adminID)
-		return val.(string), nil
+// UseNonce checks that `nonce` was generated for the admin and the request,
+// and has not expired. A nonce is used up by the first call to UseNonce,
+// even if that call returns an error.
+func (ng *NonceGen) UseNonce(nonce, adminID, method, path string) error {
+	ng.lock.Lock()
+	val, found := ng.nonces.Get(nonce)
+	ng.nonces.Delete(nonce)
+	ng.lock.Unlock()
+
+	if !found {
+		return errors.New("Nonce is unknown, expired or already used")
+	}
+	b := val.(nonceBinding)
+	if b.adminID != adminID {
+		return errors.Errorf("Nonce was not generated for admin %s", adminID)
+	}
+	if b.method != method || b.path != path {
+		return errors.Errorf("Nonce was generated for %s %s, not %s %s",
+			b.method, b.path, method, path)
 	}
-	return "", errors.Errorf("No nonce for id %s", adminID)
+	return nil
 }
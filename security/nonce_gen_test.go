@@ -0,0 +1,86 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package security
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNonceIsSingleUse(t *testing.T) {
+	ng := NewNonceGen(time.Minute)
+	n, _, err := ng.GenerateNonce("admin", "POST", "/admin/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ng.UseNonce(n, "admin", "POST", "/admin/app"); err != nil {
+		t.Fatalf("First use failed: %v", err)
+	}
+	if err := ng.UseNonce(n, "admin", "POST", "/admin/app"); err == nil {
+		t.Fatal("Nonce was accepted twice")
+	}
+}
+
+func TestNonceExpires(t *testing.T) {
+	ng := NewNonceGen(50 * time.Millisecond)
+	n, valid, err := ng.GenerateNonce("admin", "POST", "/admin/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid != 50*time.Millisecond {
+		t.Errorf("Nonce was valid for %v, expected the configured 50ms", valid)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := ng.UseNonce(n, "admin", "POST", "/admin/app"); err == nil {
+		t.Fatal("Expired nonce was accepted")
+	}
+}
+
+func TestNonceIsBoundToRequest(t *testing.T) {
+	ng := NewNonceGen(time.Minute)
+	tests := []struct {
+		adminID, method, path string
+	}{
+		{"other", "POST", "/admin/app"},
+		{"admin", "DELETE", "/admin/app"},
+		{"admin", "POST", "/admin/server"},
+	}
+	for _, test := range tests {
+		n, _, err := ng.GenerateNonce("admin", "POST", "/admin/app")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ng.UseNonce(n, test.adminID, test.method,
+			test.path); err == nil {
+			t.Errorf("Nonce was accepted for %s %s by %s", test.method,
+				test.path, test.adminID)
+		}
+		// A failed attempt still uses up the nonce
+		if err := ng.UseNonce(n, "admin", "POST", "/admin/app"); err == nil {
+			t.Error("Nonce was accepted after a failed use")
+		}
+	}
+}
+
+func TestMultipleNoncesPerAdmin(t *testing.T) {
+	ng := NewNonceGen(time.Minute)
+	first, _, err := ng.GenerateNonce("admin", "POST", "/admin/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := ng.GenerateNonce("admin", "POST", "/admin/app")
+	if err != nil {
+		t.Fatalf("Could not generate a second nonce: %v", err)
+	}
+	if first == second {
+		t.Fatal("Generated the same nonce twice")
+	}
+	if len(first) != 43 {
+		t.Errorf("Nonce had length %d, expected 43", len(first))
+	}
+	for _, n := range []string{second, first} {
+		if err := ng.UseNonce(n, "admin", "POST", "/admin/app"); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package security
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/pkg/errors"
+)
+
+// Key formats stored in Key.Format.
+const (
+	FormatU2F      = "u2f"
+	FormatWebAuthn = "webauthn"
+)
+
+// Authenticator data flags, as defined in the WebAuthn spec, section 6.1.
+const (
+	FlagUserPresent            byte = 0x01
+	FlagUserVerified           byte = 0x04
+	FlagAttestedCredentialData byte = 0x40
+	FlagExtensionData          byte = 0x80
+)
+
+// COSE algorithm identifiers that we accept for WebAuthn credentials.
+const (
+	COSEAlgES256 int64 = -7
+	COSEAlgEdDSA int64 = -8
+	COSEAlgRS256 int64 = -257
+)
+
+// COSE key types and curves, from RFC 8152.
+const (
+	coseKeyTypeOKP int64 = 1
+	coseKeyTypeEC2 int64 = 2
+	coseKeyTypeRSA int64 = 3
+
+	coseCurveP256    int64 = 1
+	coseCurveEd25519 int64 = 6
+)
+
+// CollectedClientData is the JSON structure that the browser signs over in
+// both WebAuthn ceremonies.
+type CollectedClientData struct {
+	Type        string `json:"type"`      // webauthn.create or webauthn.get
+	Challenge   string `json:"challenge"` // base-64 web encoded, no padding
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+// AuthenticatorData is the parsed form of the authenticator data returned by
+// both navigator.credentials.create() and navigator.credentials.get().
+type AuthenticatorData struct {
+	RPIDHash []byte
+	Flags    byte
+	Counter  uint32
+
+	// Only set when FlagAttestedCredentialData is set
+	AAGUID              []byte
+	CredentialID        []byte
+	CredentialPublicKey []byte // COSE-encoded
+}
+
+// AttestationObject is the CBOR structure returned from
+// navigator.credentials.create().
+type AttestationObject struct {
+	Format      string                 `cbor:"fmt"`
+	Statement   map[string]interface{} `cbor:"attStmt"`
+	RawAuthData []byte                 `cbor:"authData"`
+	AuthData    AuthenticatorData      `cbor:"-"`
+}
+
+// The meaning of the negative COSE labels depends on the key type, so the
+// header is decoded first and then the type-specific parameters.
+type coseKeyHeader struct {
+	KeyType   int64 `cbor:"1,keyasint"`
+	Algorithm int64 `cbor:"3,keyasint"`
+}
+
+type coseCurveKey struct {
+	Curve int64  `cbor:"-1,keyasint"`
+	X     []byte `cbor:"-2,keyasint"`
+	Y     []byte `cbor:"-3,keyasint,omitempty"` // not present for OKP
+}
+
+type coseRSAKey struct {
+	N []byte `cbor:"-1,keyasint"`
+	E []byte `cbor:"-2,keyasint"`
+}
+
+// ParseClientData decodes the raw clientDataJSON and checks that it was
+// produced for the expected ceremony type.
+func ParseClientData(raw []byte, ceremony string) (CollectedClientData, error) {
+	var cd CollectedClientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return cd, errors.Wrap(err, "Could not decode client data")
+	}
+	if cd.Type != ceremony {
+		return cd, errors.Errorf("Client data had type %s, not %s", cd.Type,
+			ceremony)
+	}
+	return cd, nil
+}
+
+// ParseAuthenticatorData parses the binary authenticator data.
+func ParseAuthenticatorData(b []byte) (AuthenticatorData, error) {
+	ad := AuthenticatorData{}
+	if len(b) < 37 {
+		return ad, errors.Errorf("Authenticator data was %d bytes, expected "+
+			"at least 37", len(b))
+	}
+	ad.RPIDHash = b[:32]
+	ad.Flags = b[32]
+	ad.Counter = binary.BigEndian.Uint32(b[33:37])
+	rest := b[37:]
+
+	if ad.Flags&FlagAttestedCredentialData != 0 {
+		if len(rest) < 18 {
+			return ad, errors.New("Attested credential data was truncated")
+		}
+		ad.AAGUID = rest[:16]
+		n := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < n {
+			return ad, errors.New("Credential ID was truncated")
+		}
+		ad.CredentialID = rest[:n]
+		rest = rest[n:]
+
+		// The COSE key has no length prefix, so we let the CBOR decoder tell
+		// us where it ends.
+		var raw cbor.RawMessage
+		if err := cbor.NewDecoder(bytes.NewReader(rest)).Decode(&raw); err != nil {
+			return ad, errors.Wrap(err, "Could not decode credential public key")
+		}
+		ad.CredentialPublicKey = []byte(raw)
+		rest = rest[len(raw):]
+	}
+
+	if ad.Flags&FlagExtensionData != 0 {
+		var ext cbor.RawMessage
+		if err := cbor.Unmarshal(rest, &ext); err != nil {
+			return ad, errors.Wrap(err, "Could not decode extensions")
+		}
+		rest = rest[len(ext):]
+	}
+
+	if len(rest) != 0 {
+		return ad, errors.Errorf("Authenticator data had %d trailing bytes",
+			len(rest))
+	}
+	return ad, nil
+}
+
+// ParseAttestationObject decodes a CBOR attestation object along with the
+// authenticator data inside of it.
+func ParseAttestationObject(b []byte) (AttestationObject, error) {
+	ao := AttestationObject{}
+	if err := cbor.Unmarshal(b, &ao); err != nil {
+		return ao, errors.Wrap(err, "Could not decode attestation object")
+	}
+	ad, err := ParseAuthenticatorData(ao.RawAuthData)
+	if err != nil {
+		return ao, err
+	}
+	if ad.Flags&FlagAttestedCredentialData == 0 {
+		return ao, errors.New("Attestation object had no credential data")
+	}
+	ao.AuthData = ad
+	return ao, nil
+}
+
+// ParseCOSEKey converts a COSE-encoded public key to its Go equivalent. It
+// returns the key along with its COSE algorithm identifier.
+func ParseCOSEKey(b []byte) (crypto.PublicKey, int64, error) {
+	var h coseKeyHeader
+	if err := cbor.Unmarshal(b, &h); err != nil {
+		return nil, 0, errors.Wrap(err, "Could not decode COSE key")
+	}
+
+	switch h.KeyType {
+	case coseKeyTypeEC2, coseKeyTypeOKP:
+		var k coseCurveKey
+		if err := cbor.Unmarshal(b, &k); err != nil {
+			return nil, 0, errors.Wrap(err, "Could not decode COSE key")
+		}
+		if h.KeyType == coseKeyTypeOKP {
+			if h.Algorithm != COSEAlgEdDSA || k.Curve != coseCurveEd25519 {
+				return nil, 0, errors.Errorf("Unsupported OKP algorithm %d "+
+					"on curve %d", h.Algorithm, k.Curve)
+			}
+			if len(k.X) != ed25519.PublicKeySize {
+				return nil, 0, errors.New("Ed25519 public key had the wrong " +
+					"size")
+			}
+			return ed25519.PublicKey(k.X), h.Algorithm, nil
+		}
+		if h.Algorithm != COSEAlgES256 || k.Curve != coseCurveP256 {
+			return nil, 0, errors.Errorf("Unsupported EC2 algorithm %d on "+
+				"curve %d", h.Algorithm, k.Curve)
+		}
+		x := new(big.Int).SetBytes(k.X)
+		y := new(big.Int).SetBytes(k.Y)
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, 0, errors.New("Public key was not on the elliptic curve")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y},
+			h.Algorithm, nil
+	case coseKeyTypeRSA:
+		var k coseRSAKey
+		if err := cbor.Unmarshal(b, &k); err != nil {
+			return nil, 0, errors.Wrap(err, "Could not decode COSE RSA key")
+		}
+		if h.Algorithm != COSEAlgRS256 {
+			return nil, 0, errors.Errorf("Unsupported RSA algorithm %d",
+				h.Algorithm)
+		}
+		e := new(big.Int).SetBytes(k.E)
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, 0, errors.New("RSA exponent was too large")
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(k.N),
+			E: int(e.Int64()),
+		}, h.Algorithm, nil
+	}
+	return nil, 0, errors.Errorf("Unsupported COSE key type %d", h.KeyType)
+}
+
+// VerifyCOSESignature checks `sig` over `data` using a COSE-encoded key.
+func VerifyCOSESignature(key, data, sig []byte) error {
+	pub, alg, err := ParseCOSEKey(key)
+	if err != nil {
+		return err
+	}
+	return verifySignature(pub, alg, data, sig)
+}
+
+func verifySignature(pub crypto.PublicKey, alg int64, data, sig []byte) error {
+	switch alg {
+	case COSEAlgES256:
+		p, ok := pub.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("ES256 signature made with a non-ECDSA key")
+		}
+		h := sha256.Sum256(data)
+		if !ecdsa.VerifyASN1(p, h[:], sig) {
+			return errors.New("Invalid ES256 signature")
+		}
+	case COSEAlgRS256:
+		p, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("RS256 signature made with a non-RSA key")
+		}
+		h := sha256.Sum256(data)
+		if err := rsa.VerifyPKCS1v15(p, crypto.SHA256, h[:], sig); err != nil {
+			return errors.Wrap(err, "Invalid RS256 signature")
+		}
+	case COSEAlgEdDSA:
+		p, ok := pub.(ed25519.PublicKey)
+		if !ok {
+			return errors.New("EdDSA signature made with a non-Ed25519 key")
+		}
+		if !ed25519.Verify(p, data, sig) {
+			return errors.New("Invalid EdDSA signature")
+		}
+	default:
+		return errors.Errorf("Unsupported COSE algorithm %d", alg)
+	}
+	return nil
+}
+
+// VerifyAssertion verifies a WebAuthn assertion made by the credential with
+// the COSE-encoded public key `key`. It returns the parsed authenticator data
+// so that the caller can check the signature counter.
+func VerifyAssertion(key, rpIDHash, rawAuthData, clientDataJSON,
+	sig []byte) (AuthenticatorData, error) {
+	ad, err := ParseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return ad, err
+	}
+	if !bytes.Equal(ad.RPIDHash, rpIDHash) {
+		return ad, errors.New("Assertion was made for a different relying party")
+	}
+	if ad.Flags&FlagUserPresent == 0 {
+		return ad, errors.New("User was not present")
+	}
+
+	h := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, rawAuthData...), h[:]...)
+	if err := VerifyCOSESignature(key, signed, sig); err != nil {
+		return ad, err
+	}
+	return ad, nil
+}
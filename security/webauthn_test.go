@@ -0,0 +1,358 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package security
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/big"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+func mustCBOR(t *testing.T, v interface{}) []byte {
+	b, err := cbor.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// testCredential is a credential of one of the COSE algorithms that we
+// accept, with its COSE key and a function to sign with it.
+type testCredential struct {
+	alg  string
+	cose map[int64]interface{}
+	sign func(data []byte) []byte
+}
+
+func newTestCredentials(t *testing.T) []testCredential {
+	ec, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return []testCredential{{
+		"ES256",
+		map[int64]interface{}{1: coseKeyTypeEC2, 3: COSEAlgES256,
+			-1: coseCurveP256, -2: ec.X.FillBytes(make([]byte, 32)),
+			-3: ec.Y.FillBytes(make([]byte, 32))},
+		func(data []byte) []byte {
+			h := sha256.Sum256(data)
+			sig, err := ecdsa.SignASN1(rand.Reader, ec, h[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			return sig
+		},
+	}, {
+		"EdDSA",
+		map[int64]interface{}{1: coseKeyTypeOKP, 3: COSEAlgEdDSA,
+			-1: coseCurveEd25519, -2: []byte(edPub)},
+		func(data []byte) []byte {
+			return ed25519.Sign(edPriv, data)
+		},
+	}, {
+		"RS256",
+		map[int64]interface{}{1: coseKeyTypeRSA, 3: COSEAlgRS256,
+			-1: rs.N.Bytes(), -2: big.NewInt(int64(rs.E)).Bytes()},
+		func(data []byte) []byte {
+			h := sha256.Sum256(data)
+			sig, err := rsa.SignPKCS1v15(rand.Reader, rs, crypto.SHA256, h[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			return sig
+		},
+	}}
+}
+
+// withLabels returns a copy of the COSE key `key` with `labels` changed, or
+// removed where they are nil.
+func withLabels(key map[int64]interface{},
+	labels map[int64]interface{}) map[int64]interface{} {
+	changed := map[int64]interface{}{}
+	for label, value := range key {
+		changed[label] = value
+	}
+	for label, value := range labels {
+		if value == nil {
+			delete(changed, label)
+		} else {
+			changed[label] = value
+		}
+	}
+	return changed
+}
+
+func TestParseCOSEKey(t *testing.T) {
+	creds := newTestCredentials(t)
+	es256, eddsa, rs256 := creds[0].cose, creds[1].cose, creds[2].cose
+
+	for _, c := range []struct {
+		name  string
+		key   interface{}
+		valid bool
+	}{
+		{"ES256", es256, true},
+		{"EdDSA", eddsa, true},
+		{"RS256", rs256, true},
+		{"not CBOR", "not a map", false},
+		{"unknown key type", withLabels(es256, map[int64]interface{}{1: 4}),
+			false},
+		{"EC2 with EdDSA", withLabels(es256,
+			map[int64]interface{}{3: COSEAlgEdDSA}), false},
+		{"EC2 on another curve", withLabels(es256,
+			map[int64]interface{}{-1: 2}), false},
+		{"EC2 off the curve", withLabels(es256,
+			map[int64]interface{}{-3: make([]byte, 32)}), false},
+		{"OKP with ES256", withLabels(eddsa,
+			map[int64]interface{}{3: COSEAlgES256}), false},
+		{"OKP on another curve", withLabels(eddsa,
+			map[int64]interface{}{-1: 4}), false},
+		{"short Ed25519 key", withLabels(eddsa,
+			map[int64]interface{}{-2: make([]byte, 31)}), false},
+		{"RSA with PS256", withLabels(rs256,
+			map[int64]interface{}{3: -37}), false},
+		{"huge RSA exponent", withLabels(rs256,
+			map[int64]interface{}{-2: bytes.Repeat([]byte{0xff}, 9)}), false},
+		{"RSA key in EC2 labels", withLabels(rs256,
+			map[int64]interface{}{-1: "modulus"}), false},
+	} {
+		_, _, err := ParseCOSEKey(mustCBOR(t, c.key))
+		if (err == nil) != c.valid {
+			t.Errorf("%s: expected valid to be %v. Got %v", c.name, c.valid,
+				err)
+		}
+	}
+}
+
+func TestVerifyCOSESignature(t *testing.T) {
+	creds := newTestCredentials(t)
+	data := []byte("signed data")
+	for i, cred := range creds {
+		key := mustCBOR(t, cred.cose)
+		sig := cred.sign(data)
+		other := mustCBOR(t, creds[(i+1)%len(creds)].cose)
+		relabeled := mustCBOR(t, withLabels(cred.cose,
+			map[int64]interface{}{3: creds[(i+1)%len(creds)].cose[3]}))
+
+		for _, c := range []struct {
+			name  string
+			key   []byte
+			data  []byte
+			sig   []byte
+			valid bool
+		}{
+			{"valid", key, data, sig, true},
+			{"other data", key, []byte("other data"), sig, false},
+			{"truncated signature", key, data, sig[:len(sig)-1], false},
+			{"no signature", key, data, nil, false},
+			{"another key", other, data, sig, false},
+			{"another algorithm", relabeled, data, sig, false},
+		} {
+			err := VerifyCOSESignature(c.key, c.data, c.sig)
+			if (err == nil) != c.valid {
+				t.Errorf("%s, %s: expected valid to be %v. Got %v", cred.alg,
+					c.name, c.valid, err)
+			}
+		}
+	}
+}
+
+// authenticatorData builds authenticator data, with attested credential data
+// if `cose` is set and with extension data if `extensions` is set.
+func authenticatorData(rpIDHash []byte, flags byte, counter uint32,
+	credentialID, cose, extensions []byte) []byte {
+	b := append([]byte{}, rpIDHash...)
+	b = append(b, flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[len(b)-4:], counter)
+	if cose != nil {
+		b = append(b, make([]byte, 16+2)...) // AAGUID and ID length
+		binary.BigEndian.PutUint16(b[len(b)-2:], uint16(len(credentialID)))
+		b = append(b, credentialID...)
+		b = append(b, cose...)
+	}
+	return append(b, extensions...)
+}
+
+func TestParseAuthenticatorData(t *testing.T) {
+	rpIDHash := sha256.Sum256([]byte("example.com"))
+	cose := mustCBOR(t, newTestCredentials(t)[1].cose)
+	extensions := mustCBOR(t, map[string]interface{}{"credProtect": 2})
+	attested := FlagUserPresent | FlagAttestedCredentialData
+	full := authenticatorData(rpIDHash[:], attested|FlagExtensionData, 7,
+		[]byte("credential"), cose, extensions)
+
+	for _, c := range []struct {
+		name  string
+		data  []byte
+		valid bool
+	}{
+		{"assertion", authenticatorData(rpIDHash[:], FlagUserPresent, 7, nil,
+			nil, nil), true},
+		{"attested credential and extensions", full, true},
+		{"empty", nil, false},
+		{"truncated header", rpIDHash[:], false},
+		{"truncated AAGUID", authenticatorData(rpIDHash[:], attested, 7,
+			nil, nil, make([]byte, 10)), false},
+		{"truncated credential ID", full[:37+18+5], false},
+		{"truncated COSE key", full[:len(full)-len(extensions)-1], false},
+		{"extensions without their flag", authenticatorData(rpIDHash[:],
+			attested, 7, []byte("credential"), cose, extensions), false},
+		{"flagged extensions that are missing", authenticatorData(
+			rpIDHash[:], attested|FlagExtensionData, 7, []byte("credential"),
+			cose, nil), false},
+		{"trailing bytes", append(append([]byte{}, full...), 0), false},
+	} {
+		ad, err := ParseAuthenticatorData(c.data)
+		if (err == nil) != c.valid {
+			t.Errorf("%s: expected valid to be %v. Got %v", c.name, c.valid,
+				err)
+			continue
+		}
+		if c.valid && ad.Counter != 7 {
+			t.Errorf("%s: counter was %d, expected 7", c.name, ad.Counter)
+		}
+	}
+
+	ad, err := ParseAuthenticatorData(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ad.CredentialID) != "credential" ||
+		string(ad.CredentialPublicKey) != string(cose) {
+		t.Errorf("Parsed credential %q with key %x", ad.CredentialID,
+			ad.CredentialPublicKey)
+	}
+}
+
+func TestParseAttestationObject(t *testing.T) {
+	rpIDHash := sha256.Sum256([]byte("example.com"))
+	cose := mustCBOR(t, newTestCredentials(t)[0].cose)
+	attested := authenticatorData(rpIDHash[:],
+		FlagUserPresent|FlagAttestedCredentialData, 0, []byte("credential"),
+		cose, nil)
+	object := func(authData []byte) []byte {
+		return mustCBOR(t, map[string]interface{}{
+			"fmt":      "none",
+			"attStmt":  map[string]interface{}{},
+			"authData": authData,
+		})
+	}
+
+	for _, c := range []struct {
+		name   string
+		object []byte
+		valid  bool
+	}{
+		{"valid", object(attested), true},
+		{"not CBOR", []byte("not CBOR"), false},
+		{"without a credential", object(authenticatorData(rpIDHash[:],
+			FlagUserPresent, 0, nil, nil, nil)), false},
+		{"with invalid authenticator data", object(rpIDHash[:]), false},
+	} {
+		ao, err := ParseAttestationObject(c.object)
+		if (err == nil) != c.valid {
+			t.Errorf("%s: expected valid to be %v. Got %v", c.name, c.valid,
+				err)
+			continue
+		}
+		if c.valid && (ao.Format != "none" ||
+			string(ao.AuthData.CredentialID) != "credential") {
+			t.Errorf("%s: parsed %+v", c.name, ao)
+		}
+	}
+}
+
+func TestParseClientData(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		raw   string
+		valid bool
+	}{
+		{"valid", `{"type":"webauthn.get","challenge":"abc",` +
+			`"origin":"https://example.com"}`, true},
+		{"other ceremony", `{"type":"webauthn.create","challenge":"abc"}`,
+			false},
+		{"no type", `{"challenge":"abc"}`, false},
+		{"not JSON", `webauthn.get`, false},
+	} {
+		_, err := ParseClientData([]byte(c.raw), "webauthn.get")
+		if (err == nil) != c.valid {
+			t.Errorf("%s: expected valid to be %v. Got %v", c.name, c.valid,
+				err)
+		}
+	}
+}
+
+func TestVerifyAssertion(t *testing.T) {
+	cred := newTestCredentials(t)[0]
+	key := mustCBOR(t, cred.cose)
+	rpIDHash := sha256.Sum256([]byte("example.com"))
+	otherRP := sha256.Sum256([]byte("evil.example"))
+	clientData := []byte(`{"type":"webauthn.get","challenge":"abc"}`)
+
+	// sign returns authenticator data and a signature over it and
+	// `signedClientData`.
+	sign := func(rp []byte, flags byte, signedClientData []byte) ([]byte,
+		[]byte) {
+		authData := authenticatorData(rp, flags, 3, nil, nil, nil)
+		h := sha256.Sum256(signedClientData)
+		return authData, cred.sign(append(append([]byte{}, authData...),
+			h[:]...))
+	}
+
+	for _, c := range []struct {
+		name       string
+		rp         []byte
+		flags      byte
+		signedData []byte
+		valid      bool
+	}{
+		{"valid", rpIDHash[:], FlagUserPresent, clientData, true},
+		{"user verified", rpIDHash[:], FlagUserPresent | FlagUserVerified,
+			clientData, true},
+		{"other relying party", otherRP[:], FlagUserPresent, clientData,
+			false},
+		{"user not present", rpIDHash[:], FlagUserVerified, clientData, false},
+		{"other client data", rpIDHash[:], FlagUserPresent,
+			[]byte(`{"type":"webauthn.get","challenge":"xyz"}`), false},
+	} {
+		authData, sig := sign(c.rp, c.flags, c.signedData)
+		ad, err := VerifyAssertion(key, rpIDHash[:], authData, clientData,
+			sig)
+		if (err == nil) != c.valid {
+			t.Errorf("%s: expected valid to be %v. Got %v", c.name, c.valid,
+				err)
+			continue
+		}
+		if c.valid && ad.Counter != 3 {
+			t.Errorf("%s: counter was %d, expected 3", c.name, ad.Counter)
+		}
+	}
+
+	// The authenticator data is covered by the signature
+	authData, sig := sign(rpIDHash[:], FlagUserPresent, clientData)
+	authData[32] |= FlagUserVerified
+	if _, err := VerifyAssertion(key, rpIDHash[:], authData, clientData,
+		sig); err == nil {
+		t.Error("Verified an assertion whose flags were changed")
+	}
+}
@@ -4,9 +4,13 @@ package server
 
 import (
 	"crypto"
+	"crypto/elliptic"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/tera-insights/2Q2R-enterprise/security"
@@ -16,13 +20,23 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
-	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
 )
 
 type adminHandler struct {
 	s *Server
 }
 
+// Page sizes of GET /admin/events
+const (
+	defaultEventsLimit = 100
+	maxEventsLimit     = 1000
+)
+
+// How often GET /admin/stats/stream writes to an idle stream, so that proxies
+// keep it open
+const sseKeepAlive = 15 * time.Second
+
 // NewAdmin challenges the incoming admin, replying with a request ID that must
 // be used in order to add a second-factor authentication mechanism. If the
 // challenge signature is valid, then we store the admin.
@@ -31,6 +45,7 @@ func (ah *adminHandler) NewAdmin(w http.ResponseWriter, r *http.Request) {
 	req := NewAdminRequest{}
 	err := json.NewDecoder(r.Body).Decode(&req)
 	util.OptionalBadRequestPanic(err, "Could not decode request body")
+	adminFor(r).requireApp(req.AdminFor)
 
 	encodedPermissions, err := json.Marshal(req.Permissions)
 	util.OptionalInternalPanic(err, "Could not encode permissions for storage")
@@ -51,47 +66,85 @@ func (ah *adminHandler) NewAdmin(w http.ResponseWriter, r *http.Request) {
 	util.OptionalPanic(err, http.StatusForbidden,
 		"Could not verify public key signature")
 
-	err = ah.s.DB.Create(&Admin{
-		ID:          adminID,
-		Name:        req.Name,
-		Email:       req.Email,
-		Role:        "admin",
-		Status:      "active",
-		Permissions: string(encodedPermissions),
-		AdminFor:    req.AdminFor,
-	}).Error
-	util.OptionalInternalPanic(err, "Could not save admin")
-
-	err = ah.s.DB.Create(&security.SigningKey{
-		ID:        keyID,
-		IV:        req.IV,
-		Salt:      req.Salt,
-		PublicKey: req.PublicKey,
-	}).Error
-	util.OptionalInternalPanic(err, "Could not save signing key")
-
 	requestID, err := util.RandString(32)
 	util.OptionalInternalPanic(err, "Could not generate request ID")
 
 	h := crypto.SHA256.New()
 	io.WriteString(h, requestID)
-	query := ah.s.DB.Create(&LongTermRequest{
-		AppID: "1",
-		ID:    h.Sum(nil),
+
+	err = ah.s.Store.Transaction(func(st Store) error {
+		err := st.CreateAdmin(Admin{
+			ID:          adminID,
+			Name:        req.Name,
+			Email:       req.Email,
+			Role:        roleAdmin,
+			Status:      adminActive,
+			Permissions: string(encodedPermissions),
+			AdminFor:    req.AdminFor,
+		})
+		if err != nil {
+			return errors.Wrap(err, "Could not save admin")
+		}
+
+		err = st.CreateSigningKey(security.SigningKey{
+			ID:        keyID,
+			IV:        req.IV,
+			Salt:      req.Salt,
+			PublicKey: req.PublicKey,
+		})
+		if err != nil {
+			return errors.Wrap(err, "Could not save signing key")
+		}
+
+		err = st.CreateLongTermRequest(LongTermRequest{
+			AppID: "1",
+			ID:    h.Sum(nil),
+		})
+		return errors.Wrap(err, "Could not save long-term request")
 	})
-	util.OptionalInternalPanic(query.Error, "Could not save long-term request "+
-		"to the database")
+	util.OptionalInternalPanic(err, "Could not save admin to the database")
 
 	writeJSON(w, http.StatusOK, newAdminReply{
 		RequestID: requestID,
 	})
 }
 
-// GetAdmins lists all the admins.
+// Logout ends the current admin session.
+// POST /admin/logout
+func (ah *adminHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	err := ah.s.sessions.Delete(adminFor(r).SessionID)
+	util.OptionalInternalPanic(err, "Could not end session")
+
+	ah.s.clearSessionCookie(w)
+	writeJSON(w, http.StatusOK, "Logged out")
+}
+
+// GetSessions lists an admin's active sessions.
+// GET /admin/session/{adminID}
+func (ah *adminHandler) GetSessions(w http.ResponseWriter, r *http.Request) {
+	found, err := ah.s.sessions.ListForAdmin(mux.Vars(r)["adminID"])
+	util.OptionalInternalPanic(err, "Could not read sessions")
+
+	writeJSON(w, http.StatusOK, found)
+}
+
+// RevokeSessions logs an admin out everywhere.
+// DELETE /admin/session/{adminID}
+func (ah *adminHandler) RevokeSessions(w http.ResponseWriter,
+	r *http.Request) {
+	n, err := ah.s.sessions.DeleteForAdmin(mux.Vars(r)["adminID"])
+	util.OptionalInternalPanic(err, "Could not revoke sessions")
+
+	writeJSON(w, http.StatusOK, modificationReply{
+		NumAffected: n,
+	})
+}
+
+// GetAdmins lists all the admins, or only those of their own app for app-scoped
+// admins.
 // GET /admin/admin
 func (ah *adminHandler) GetAdmins(w http.ResponseWriter, r *http.Request) {
-	var result []Admin
-	err := ah.s.DB.Model(&Admin{}).Find(&result).Error
+	result, err := ah.s.Store.GetAdmins(adminFor(r).scope())
 	util.OptionalBadRequestPanic(err, "Failed to read admins")
 
 	writeJSON(w, http.StatusOK, result)
@@ -108,21 +161,33 @@ func (ah *adminHandler) UpdateAdmin(w http.ResponseWriter, r *http.Request) {
 	err = util.CheckBase64(adminID)
 	util.OptionalBadRequestPanic(err, "Admin ID was not base-64 encoded")
 
-	err = ah.s.DB.Where(&Admin{
-		ID: adminID,
-	}).Updates(Admin{
-		Name:                req.Name,
-		Email:               req.Email,
-		PrimarySigningKeyID: req.PrimarySigningKeyID,
-		AdminFor:            req.AdminFor,
-	}).Error
-	util.OptionalInternalPanic(err, "Failed to update admin")
+	as := adminFor(r)
+	updated, err := ah.s.Store.GetAdmin(adminID)
+	util.OptionalBadRequestPanic(err, "Could not find admin")
+	as.requireApp(updated.AdminFor)
+	util.PanicIfFalse(updated.Role != roleSuperAdmin || as.isSuper(),
+		http.StatusForbidden, "Only superadmins can update superadmins")
+
+	// Empty fields are left as they are
+	if req.Name != "" {
+		updated.Name = req.Name
+	}
+	if req.Email != "" {
+		updated.Email = req.Email
+	}
+	if req.PrimarySigningKeyID != "" {
+		// The signing key is what vouches for the admin's requests
+		util.PanicIfFalse(as.isSuper(), http.StatusForbidden,
+			"Only superadmins can change signing keys")
+		updated.PrimarySigningKeyID = req.PrimarySigningKeyID
+	}
+	if req.AdminFor != "" {
+		as.requireApp(req.AdminFor)
+		updated.AdminFor = req.AdminFor
+	}
 
-	var updated Admin
-	err = ah.s.DB.First(&updated, &Admin{
-		ID: adminID,
-	}).Error
-	util.OptionalInternalPanic(err, "Failed to read updated admin")
+	err = ah.s.Store.UpdateAdmin(updated)
+	util.OptionalInternalPanic(err, "Failed to update admin")
 
 	writeJSON(w, http.StatusOK, updated)
 }
@@ -134,13 +199,14 @@ func (ah *adminHandler) DeleteAdmin(w http.ResponseWriter, r *http.Request) {
 	err := util.CheckBase64(adminID)
 	util.OptionalBadRequestPanic(err, "Admin ID was not base-64 encoded")
 
-	query := ah.s.DB.Delete(Admin{}, &Admin{
-		ID: adminID,
-	})
-	util.OptionalInternalPanic(query.Error, "Failed to delete admins")
+	n, err := ah.s.Store.DeleteAdmin(adminID)
+	util.OptionalInternalPanic(err, "Failed to delete admins")
+
+	_, err = ah.s.sessions.DeleteForAdmin(adminID)
+	util.OptionalInternalPanic(err, "Failed to revoke admin's sessions")
 
 	writeJSON(w, http.StatusOK, modificationReply{
-		NumAffected: query.RowsAffected,
+		NumAffected: n,
 	})
 }
 
@@ -151,30 +217,50 @@ func (ah *adminHandler) ChangeAdminRoles(w http.ResponseWriter, r *http.Request)
 	err := json.NewDecoder(r.Body).Decode(&req)
 	util.OptionalBadRequestPanic(err, "Could not decode request body")
 
-	err = ah.s.DB.Model(&Admin{}).Where(&Admin{
-		ID: req.AdminID,
-	}).Updates(Admin{
-		Role:        req.Role,
-		Status:      req.Status,
-		Permissions: req.Permissions,
-		AdminFor:    req.AdminFor,
-	}).Error
+	updated, err := ah.s.Store.GetAdmin(req.AdminID)
+	if err == ErrNotFound {
+		panic(util.BubbledError{
+			StatusCode: http.StatusNotFound,
+			Message:    "Admin not found",
+		})
+	}
+	util.OptionalInternalPanic(err, "Could not read admin")
+
+	// Empty fields are left as they are
+	if req.Role != "" {
+		util.PanicIfFalse(req.Role == roleSuperAdmin || req.Role == roleAdmin,
+			http.StatusBadRequest, "Unknown role")
+		updated.Role = req.Role
+	}
+	if req.Status != "" {
+		util.PanicIfFalse(req.Status == adminActive ||
+			req.Status == adminInactive, http.StatusBadRequest,
+			"Unknown status")
+		updated.Status = req.Status
+	}
+	if req.Permissions != "" {
+		updated.Permissions = req.Permissions
+	}
+	if req.AdminFor != "" {
+		updated.AdminFor = req.AdminFor
+	}
+
+	err = ah.s.Store.UpdateAdmin(updated)
 	util.OptionalInternalPanic(err, "Failed to change admin roles")
 
-	var updated Admin
-	err = ah.s.DB.First(&updated, &Admin{
-		ID: req.AdminID,
-	}).Error
-	util.OptionalInternalPanic(err, "Could not read updated admin")
+	// Deactivated admins are logged out everywhere
+	if req.Status != "" && req.Status != adminActive {
+		_, err = ah.s.sessions.DeleteForAdmin(req.AdminID)
+		util.OptionalInternalPanic(err, "Failed to revoke admin's sessions")
+	}
 
 	writeJSON(w, http.StatusOK, updated)
 }
 
-// GetApps gets all AppInfos.
+// GetApps gets all AppInfos, or only their own app for app-scoped admins.
 // GET /admin/app
 func (ah *adminHandler) GetApps(w http.ResponseWriter, r *http.Request) {
-	var found []AppInfo
-	err := ah.s.DB.Model(&AppInfo{}).Find(&found).Error
+	found, err := ah.s.Store.GetApps(adminFor(r).scope())
 	util.OptionalInternalPanic(err, "Could not read app infos")
 
 	writeJSON(w, http.StatusOK, found)
@@ -188,21 +274,40 @@ func (ah *adminHandler) NewApp(w http.ResponseWriter, r *http.Request) {
 	err := decoder.Decode(&req)
 	util.OptionalBadRequestPanic(err, "Could not decode request body")
 
+	if req.AttestationPolicy == "" {
+		req.AttestationPolicy = attestationNone
+	}
+	util.PanicIfFalse(validAttestationPolicy(req.AttestationPolicy),
+		http.StatusBadRequest, "Invalid attestation policy")
+
+	checkRiskThresholds(req.AnomalyThreshold, req.MaxTravelSpeed)
+
+	allowed, err := json.Marshal(req.AllowedAuthenticators)
+	util.OptionalInternalPanic(err, "Could not encode allowed authenticators")
+
 	appID, err := util.RandString(32)
 	util.OptionalInternalPanic(err, "Could not generate app ID")
 
 	info := AppInfo{
-		ID:      appID,
-		AppName: req.AppName,
+		ID:                    appID,
+		AppName:               req.AppName,
+		AttestationPolicy:     req.AttestationPolicy,
+		AllowedAuthenticators: string(allowed),
+		MinCertificationLevel: normalizeCertificationLevel(
+			req.MinCertificationLevel),
+		SuspendClonedKeys: req.SuspendClonedKeys,
+		AnomalyThreshold:  req.AnomalyThreshold,
+		MaxTravelSpeed:    req.MaxTravelSpeed,
 	}
-	err = ah.s.DB.Create(&info).Error
+	checkCertificationPolicy(info)
+	err = ah.s.Store.CreateApp(info)
 	util.OptionalInternalPanic(err, "Could not create app info")
 
 	writeJSON(w, http.StatusOK, info)
 }
 
 // UpdateApp updates an app with a particular app ID.
-// PUT /admin/app/{appID}
+// POST /admin/app/{appID}
 func (ah *adminHandler) UpdateApp(w http.ResponseWriter, r *http.Request) {
 	req := appUpdateRequest{}
 	err := json.NewDecoder(r.Body).Decode(&req)
@@ -211,23 +316,51 @@ func (ah *adminHandler) UpdateApp(w http.ResponseWriter, r *http.Request) {
 	appID := mux.Vars(r)["appID"]
 	err = util.CheckBase64(appID)
 	util.OptionalBadRequestPanic(err, "App ID was not base-64 encoded")
+	adminFor(r).requireApp(appID)
 
 	// So that we don't overwrite the app name if there is no app name passed
 	util.PanicIfFalse(req.AppName != "", http.StatusBadRequest,
 		"Cannot have an empty app name")
 
-	err = ah.s.DB.Model(&AppInfo{}).Where(&AppInfo{
-		ID: appID,
-	}).Update(map[string]interface{}{
-		gorm.ToDBName("AppName"): req.AppName,
-	}).Error
-	util.OptionalInternalPanic(err, "Could not update app")
+	updated, err := ah.s.Store.GetApp(appID)
+	if err == ErrNotFound {
+		panic(util.BubbledError{
+			StatusCode: http.StatusNotFound,
+			Message:    "App not found",
+		})
+	}
+	util.OptionalInternalPanic(err, "Could not read app")
+
+	updated.AppName = req.AppName
+	if req.AttestationPolicy != "" {
+		util.PanicIfFalse(validAttestationPolicy(req.AttestationPolicy),
+			http.StatusBadRequest, "Invalid attestation policy")
+		updated.AttestationPolicy = req.AttestationPolicy
+	}
+	if req.AllowedAuthenticators != nil {
+		allowed, err := json.Marshal(req.AllowedAuthenticators)
+		util.OptionalInternalPanic(err, "Could not encode allowed "+
+			"authenticators")
+		updated.AllowedAuthenticators = string(allowed)
+	}
+	if req.MinCertificationLevel != "" {
+		updated.MinCertificationLevel = normalizeCertificationLevel(
+			req.MinCertificationLevel)
+	}
+	checkCertificationPolicy(updated)
+	if req.SuspendClonedKeys != nil {
+		updated.SuspendClonedKeys = *req.SuspendClonedKeys
+	}
+	if req.AnomalyThreshold != nil {
+		updated.AnomalyThreshold = *req.AnomalyThreshold
+	}
+	if req.MaxTravelSpeed != nil {
+		updated.MaxTravelSpeed = *req.MaxTravelSpeed
+	}
+	checkRiskThresholds(updated.AnomalyThreshold, updated.MaxTravelSpeed)
 
-	var updated AppInfo
-	err = ah.s.DB.Where(&updated, &AppInfo{
-		ID: appID,
-	}).Error
-	util.OptionalInternalPanic(err, "Could not read updated app")
+	err = ah.s.Store.UpdateApp(updated)
+	util.OptionalInternalPanic(err, "Could not update app")
 
 	writeJSON(w, http.StatusOK, updated)
 }
@@ -239,13 +372,11 @@ func (ah *adminHandler) DeleteApp(w http.ResponseWriter, r *http.Request) {
 	err := util.CheckBase64(appID)
 	util.OptionalBadRequestPanic(err, "App ID was not base-64 encoded")
 
-	query := ah.s.DB.Delete(AppInfo{}, &AppInfo{
-		ID: appID,
-	})
-	util.OptionalInternalPanic(query.Error, "Could not delete app")
+	n, err := ah.s.Store.DeleteApp(appID)
+	util.OptionalInternalPanic(err, "Could not delete app")
 
 	writeJSON(w, http.StatusOK, modificationReply{
-		NumAffected: query.RowsAffected,
+		NumAffected: n,
 	})
 }
 
@@ -256,34 +387,52 @@ func (ah *adminHandler) NewServer(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	err := decoder.Decode(&req)
 	util.OptionalBadRequestPanic(err, "Could not decode request body")
+	adminFor(r).requireApp(req.AppID)
 
 	serverID, err := util.RandString(32)
 	util.OptionalBadRequestPanic(err, "Could not generate server ID")
 
+	pub := decodeServerPublicKey(req.PublicKey)
+
 	info := AppServerInfo{
 		ID:          serverID,
 		BaseURL:     req.BaseURL,
 		AppID:       req.AppID,
 		KeyType:     req.KeyType,
-		PublicKey:   []byte(req.PublicKey),
+		PublicKey:   pub,
 		Permissions: req.Permissions,
 	}
-	err = ah.s.DB.Create(&info).Error
+	err = ah.s.Store.CreateServer(info)
 	util.OptionalInternalPanic(err, "Could not create app server")
 
 	writeJSON(w, http.StatusOK, info)
 }
 
+// decodeServerPublicKey decodes the base-64 encoded public key of an app
+// server, which must be a point on P-256.
+func decodeServerPublicKey(encoded string) []byte {
+	pub, err := util.DecodeBase64(encoded)
+	util.OptionalBadRequestPanic(err, "Public key was not properly encoded")
+	util.PanicIfFalse(isCurvePoint(pub), http.StatusBadRequest,
+		"Public key was not a point on P-256")
+	return pub
+}
+
+// isCurvePoint returns whether `pub` is a marshalled point on P-256.
+func isCurvePoint(pub []byte) bool {
+	x, _ := elliptic.Unmarshal(elliptic.P256(), pub)
+	return x != nil
+}
+
 // DeleteServer deletes a server on behalf of a valid admin.
 // DELETE /admin/server/{serverID}
 func (ah *adminHandler) DeleteServer(w http.ResponseWriter, r *http.Request) {
 	serverID := mux.Vars(r)["serverID"]
 	err := util.CheckBase64(serverID)
 	util.OptionalBadRequestPanic(err, "Server ID was not base-64 encoded")
+	adminFor(r).requireApp(ah.serverAppID(serverID))
 
-	err = ah.s.DB.Where(AppServerInfo{
-		ID: serverID,
-	}).Delete(AppServerInfo{}).Error
+	_, err = ah.s.Store.DeleteServer(serverID)
 	util.OptionalInternalPanic(err, "Could not delete app server")
 
 	writeJSON(w, http.StatusOK, "Server deleted")
@@ -292,8 +441,7 @@ func (ah *adminHandler) DeleteServer(w http.ResponseWriter, r *http.Request) {
 // GetServers gets information about app servers.
 // GET /admin/server
 func (ah *adminHandler) GetServers(w http.ResponseWriter, r *http.Request) {
-	var info []AppServerInfo
-	err := ah.s.DB.Model(&AppServerInfo{}).Find(&info).Error
+	info, err := ah.s.Store.GetServers(adminFor(r).scope())
 	util.OptionalBadRequestPanic(err, "Failed to find servers")
 
 	writeJSON(w, http.StatusOK, info)
@@ -309,25 +457,31 @@ func (ah *adminHandler) UpdateServer(w http.ResponseWriter, r *http.Request) {
 	serverID := mux.Vars(r)["serverID"]
 	err = util.CheckBase64(serverID)
 	util.OptionalBadRequestPanic(err, "Server ID was not base-64 encoded")
+	updated, err := ah.s.Store.GetServer(serverID)
+	util.OptionalBadRequestPanic(err, "Could not find app server")
+	adminFor(r).requireApp(updated.AppID)
 
-	pub, err := util.DecodeBase64(req.PublicKey)
-	util.OptionalBadRequestPanic(err, "Public key was not properly encoded")
+	var pub []byte
+	if req.PublicKey != "" {
+		pub = decodeServerPublicKey(req.PublicKey)
+	}
 
-	err = ah.s.DB.Where(&AppServerInfo{
-		ID: serverID,
-	}).Updates(AppServerInfo{
-		BaseURL:     req.BaseURL,
-		KeyType:     req.KeyType,
-		PublicKey:   pub,
-		Permissions: req.Permissions,
-	}).Error
-	util.OptionalInternalPanic(err, "Failed to update app server info")
+	// Empty fields are left as they are
+	if req.BaseURL != "" {
+		updated.BaseURL = req.BaseURL
+	}
+	if req.KeyType != "" {
+		updated.KeyType = req.KeyType
+	}
+	if len(pub) > 0 {
+		updated.PublicKey = pub
+	}
+	if req.Permissions != "" {
+		updated.Permissions = req.Permissions
+	}
 
-	var updated AppServerInfo
-	err = ah.s.DB.First(&updated, &AppServerInfo{
-		ID: serverID,
-	}).Error
-	util.OptionalInternalPanic(err, "Failed to read updated app server info")
+	err = ah.s.Store.UpdateServer(updated)
+	util.OptionalInternalPanic(err, "Failed to update app server info")
 
 	writeJSON(w, http.StatusOK, updated)
 }
@@ -338,6 +492,7 @@ func (ah *adminHandler) NewLongTerm(w http.ResponseWriter, r *http.Request) {
 	req := newLTRRequest{}
 	err := json.NewDecoder(r.Body).Decode(&req)
 	util.OptionalBadRequestPanic(err, "Could not decode request body as JSON")
+	adminFor(r).requireApp(req.AppID)
 
 	id, err := util.RandString(32)
 	util.OptionalInternalPanic(err, "Could not generate request ID")
@@ -345,11 +500,11 @@ func (ah *adminHandler) NewLongTerm(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(h, id)
 	hashedID := h.Sum(nil)
 
-	query := ah.s.DB.Create(&LongTermRequest{
+	err = ah.s.Store.CreateLongTermRequest(LongTermRequest{
 		AppID: req.AppID,
 		ID:    hashedID,
 	})
-	util.OptionalInternalPanic(query.Error,
+	util.OptionalInternalPanic(err,
 		"Could not save long-term request to the database")
 
 	writeJSON(w, http.StatusOK, requestIDWrapper{
@@ -363,33 +518,31 @@ func (ah *adminHandler) DeleteLongTerm(w http.ResponseWriter, r *http.Request) {
 	req := deleteLTRRequest{}
 	err := json.NewDecoder(r.Body).Decode(&req)
 	util.OptionalBadRequestPanic(err, "Could not decode request body as JSON")
+	adminFor(r).requireApp(req.AppID)
 
-	query := ah.s.DB.Delete(LongTermRequest{}, &LongTermRequest{
-		AppID: req.AppID,
-		ID:    []byte(req.HashedRequestID),
-	})
-	util.OptionalInternalPanic(query.Error, "Could not delete long-term request")
+	n, err := ah.s.Store.DeleteLongTermRequest(req.AppID,
+		[]byte(req.HashedRequestID))
+	util.OptionalInternalPanic(err, "Could not delete long-term request")
 
 	writeJSON(w, http.StatusOK, modificationReply{
-		NumAffected: query.RowsAffected,
+		NumAffected: n,
 	})
 }
 
 // GetSigningKeys returns all signing keys in the database.
 // GET /admin/signing-key
 func (ah *adminHandler) GetSigningKeys(w http.ResponseWriter, r *http.Request) {
-	var result []security.SigningKey
-	err := ah.s.DB.Model(&security.SigningKey{}).Find(&result).Error
+	result, err := ah.s.Store.GetSigningKeys()
 	util.OptionalInternalPanic(err, "Could not read signing keys")
 
 	writeJSON(w, http.StatusOK, result)
 }
 
-// GetPermissions returns all permission in the DB.
+// GetPermissions returns all permission in the DB, or only those for their own
+// app for app-scoped admins.
 // GET /admin/permission
 func (ah *adminHandler) GetPermissions(w http.ResponseWriter, r *http.Request) {
-	var result []Permission
-	err := ah.s.DB.Model(&Permission{}).Find(&result).Error
+	result, err := ah.s.Store.GetPermissions(adminFor(r).scope())
 	util.OptionalInternalPanic(err, "Could not read permissions")
 
 	writeJSON(w, http.StatusOK, result)
@@ -403,17 +556,13 @@ func (ah *adminHandler) NewPermissions(w http.ResponseWriter,
 	err := json.NewDecoder(r.Body).Decode(&req)
 	util.OptionalBadRequestPanic(err, "Could not decode request body")
 
-	tx := ah.s.DB.Begin()
+	as := adminFor(r)
 	for _, p := range req.Permissions {
-		err = ah.s.DB.Create(&p).Error
-		if err != nil {
-			tx.Rollback()
-			util.OptionalInternalPanic(err, "Could not save permission")
-		}
+		as.requireGrantable(p)
 	}
 
-	err = tx.Commit().Error
-	util.OptionalInternalPanic(err, "Could not commit transaction to database")
+	err = ah.s.Store.CreatePermissions(req.Permissions)
+	util.OptionalInternalPanic(err, "Could not save permissions")
 
 	writeJSON(w, http.StatusOK, modificationReply{
 		NumAffected: int64(len(req.Permissions)),
@@ -436,43 +585,164 @@ func (ah *adminHandler) DeletePermission(w http.ResponseWriter,
 
 	err = util.CheckBase64(permission)
 	util.OptionalBadRequestPanic(err, "Permission was not base-64 encoded")
+	adminFor(r).requireApp(appID)
 
-	query := ah.s.DB.Delete(Permission{}, &Permission{
+	n, err := ah.s.Store.DeletePermission(Permission{
 		AppID:      appID,
 		AdminID:    adminID,
 		Permission: permission,
 	})
-	util.OptionalInternalPanic(query.Error, "Could not delete permission")
+	util.OptionalInternalPanic(err, "Could not delete permission")
 
 	writeJSON(w, http.StatusOK, modificationReply{
-		NumAffected: query.RowsAffected,
+		NumAffected: n,
 	})
 }
 
-// RegisterListener creates a new websocket-based stats listener from the
-// request.
-// GET /admin/stats/listen
-func (ah *adminHandler) RegisterListener(w http.ResponseWriter,
+// GetAuthenticator returns the FIDO metadata for an authenticator, identified
+// by either its AAGUID or its attestation key identifier.
+// GET /admin/metadata/{id}
+func (ah *adminHandler) GetAuthenticator(w http.ResponseWriter,
+	r *http.Request) {
+	entry, found := ah.s.metadata.lookup(mux.Vars(r)["id"])
+	util.PanicIfFalse(found, http.StatusNotFound, "Authenticator not found")
+
+	writeJSON(w, http.StatusOK, authenticatorReply{
+		Entry:              entry,
+		Status:             entry.Status(),
+		CertificationLevel: entry.CertificationLevel(),
+	})
+}
+
+// ReloadMetadata re-reads the metadata blob from disk, e.g. after a cron job
+// downloads a new one.
+// POST /admin/metadata/reload
+func (ah *adminHandler) ReloadMetadata(w http.ResponseWriter,
+	r *http.Request) {
+	err := ah.s.metadata.reload()
+	util.OptionalInternalPanic(err, "Could not reload metadata blob")
+
+	md := ah.s.metadata.get()
+	writeJSON(w, http.StatusOK, metadataReply{
+		Number:     md.Number,
+		NextUpdate: md.NextUpdate,
+		NumEntries: md.Len(),
+	})
+}
+
+// GetSuspectKeys lists the keys that may belong to cloned authenticators. The
+// optional appID query parameter limits the list to one app.
+// GET /admin/key/suspect
+func (ah *adminHandler) GetSuspectKeys(w http.ResponseWriter,
+	r *http.Request) {
+	appID := r.URL.Query().Get("appID")
+	if as := adminFor(r); !as.isSuper() {
+		appID = as.Admin.AdminFor
+	}
+
+	found, err := ah.s.Store.GetSuspectKeys(appID)
+	util.OptionalInternalPanic(err, "Could not read suspect keys")
+
+	writeJSON(w, http.StatusOK, found)
+}
+
+// ClearSuspectKey clears a key's suspect flag once an admin has investigated
+// it. If the key was suspended, it is reinstated.
+// POST /admin/key/{keyID}/clear
+func (ah *adminHandler) ClearSuspectKey(w http.ResponseWriter,
 	r *http.Request) {
-	cookie, err := r.Cookie("admin-session")
-	util.OptionalPanic(err, http.StatusUnauthorized, "No session cookie")
+	keyID := mux.Vars(r)["keyID"]
+	err := util.CheckBase64(keyID)
+	util.OptionalBadRequestPanic(err, "Key ID was not base-64 encoded")
+	adminFor(r).requireApp(ah.keyAppID(keyID))
+
+	n, err := ah.s.Store.ClearKeySuspect(keyID)
+	util.OptionalInternalPanic(err, "Could not clear key")
+	ah.s.kc.Remove2FAKey(keyID)
 
-	var m map[string]interface{}
-	err = ah.s.sc.Decode("admin-session", cookie.Value, &m)
-	util.OptionalPanic(err, http.StatusUnauthorized, "Invalid session "+
-		"cookie")
+	writeJSON(w, http.StatusOK, modificationReply{
+		NumAffected: n,
+	})
+}
+
+// UpdateKey changes the state or expiry of a key, e.g. to suspend a lost token
+// and reactivate it once it is found. Revoked keys cannot be changed.
+// PUT /admin/key/{keyID}
+func (ah *adminHandler) UpdateKey(w http.ResponseWriter, r *http.Request) {
+	req := keyUpdateRequest{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	util.OptionalBadRequestPanic(err, "Could not decode request body")
+
+	keyID := mux.Vars(r)["keyID"]
+	err = util.CheckBase64(keyID)
+	util.OptionalBadRequestPanic(err, "Key ID was not base-64 encoded")
+
+	k, err := ah.s.Store.GetKey(keyID)
+	if err == ErrNotFound {
+		panic(util.BubbledError{
+			StatusCode: http.StatusNotFound,
+			Message:    "Key not found",
+		})
+	}
+	util.OptionalInternalPanic(err, "Could not read key")
+	adminFor(r).requireApp(ah.s.keyAppID(k.AppID, k.UserID))
+	util.PanicIfFalse(k.State != security.KeyStateRevoked,
+		http.StatusConflict, "Key has been revoked")
+
+	util.PanicIfFalse(req.State != "" || req.NeverExpires ||
+		req.ExpiresAt != nil, http.StatusBadRequest, "Nothing to update")
+	if req.State != "" {
+		util.PanicIfFalse(req.State == security.KeyStateActive ||
+			req.State == security.KeyStateSuspended ||
+			req.State == security.KeyStateRevoked, http.StatusBadRequest,
+			"Invalid key state")
+	}
 
-	val, found := m["app"]
-	util.PanicIfFalse(found, http.StatusUnauthorized, "Missing app ID in cookie")
+	err = ah.s.Store.Transaction(func(st Store) error {
+		if req.State != "" {
+			if err := st.UpdateKeyState(keyID, req.State); err != nil {
+				return err
+			}
+		}
+		if req.NeverExpires {
+			return st.UpdateKeyExpiry(keyID, nil)
+		} else if req.ExpiresAt != nil {
+			return st.UpdateKeyExpiry(keyID, req.ExpiresAt)
+		}
+		return nil
+	})
+	util.OptionalInternalPanic(err, "Could not update key")
+	ah.s.kc.Remove2FAKey(keyID)
 
-	appID, ok := val.(string)
-	util.PanicIfFalse(ok, http.StatusUnauthorized, "Invalid app ID in cookie")
+	updated, err := ah.s.Store.GetKey(keyID)
+	util.OptionalInternalPanic(err, "Could not read updated key")
 
-	val, found = m["admin"]
-	util.PanicIfFalse(found, http.StatusUnauthorized, "Missing admin ID in cookie")
+	now := time.Now()
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	ah.s.disperser.addEvent(keyStateChange, now,
+		ah.s.keyAppID(updated.AppID, updated.UserID),
+		updated.CurrentState(now), updated.UserID, host, host)
 
-	adminID, ok := val.(string)
-	util.PanicIfFalse(ok, http.StatusUnauthorized, "Invalid admin ID in cookie")
+	writeJSON(w, http.StatusOK, updated)
+}
+
+// RegisterListener creates a new websocket-based stats listener from the
+// request. It is sent each event once, as it happens. A client that
+// reconnects passes the ID of the last event it received as the after query
+// parameter to first get the events that it missed.
+// GET /admin/stats/listen
+func (ah *adminHandler) RegisterListener(w http.ResponseWriter,
+	r *http.Request) {
+	as := adminFor(r)
+	appID := as.Admin.AdminFor
+	adminID := as.Admin.ID
+
+	var after uint64
+	if param := r.URL.Query().Get("after"); param != "" {
+		var err error
+		after, err = strconv.ParseUint(param, 10, 64)
+		util.OptionalBadRequestPanic(err, "Invalid event ID")
+	}
 
 	upgrader := websocket.Upgrader{
 		ReadBufferSize:  1024,
@@ -482,13 +752,186 @@ func (ah *adminHandler) RegisterListener(w http.ResponseWriter,
 	util.OptionalBadRequestPanic(err, "Could not upgrade request to a websocket")
 
 	host, _, _ := net.SplitHostPort(r.RemoteAddr)
-	ah.s.disperser.addListener(listener{conn, appID})
-	ah.s.disperser.addEvent(listenerRegistered, time.Now(), appID, adminID,
-		"success", host, host)
-	writeJSON(w, http.StatusOK, "Socket created")
+	ah.s.disperser.addListener(conn, appID, after)
+	ah.s.disperser.addEvent(listenerRegistered, time.Now(), appID, "success",
+		adminID, host, host)
+}
+
+// StreamEvents sends new events as Server-Sent Events, for clients that
+// cannot use the websocket of RegisterListener. Each event is a message whose
+// ID is the event's ID and whose type is the event's name. The query
+// parameters appID, userID, type and status filter the events, as for
+// GetEvents. A client that reconnects with a Last-Event-ID header is first
+// sent the events that it missed, at most the latest 1000. Clients that fall
+// behind are disconnected and should reconnect.
+// GET /admin/stats/stream
+func (ah *adminHandler) StreamEvents(w http.ResponseWriter, r *http.Request) {
+	q := eventFilter(adminFor(r), r.URL.Query())
+	var after uint64
+	if lastID := r.Header.Get("Last-Event-ID"); lastID != "" {
+		var err error
+		after, err = strconv.ParseUint(lastID, 10, 64)
+		util.OptionalBadRequestPanic(err, "Invalid Last-Event-ID")
+	}
+	flusher, ok := w.(http.Flusher)
+	util.PanicIfFalse(ok, http.StatusInternalServerError,
+		"Response cannot be streamed")
+
+	ah.s.panicIfStopping(w)
+	l := ah.s.disperser.subscribe(q)
+	util.PanicIfFalse(l != nil, http.StatusServiceUnavailable,
+		"Server is shutting down")
+	defer ah.s.disperser.unsubscribe(l)
+	ctx, cancel := ah.s.waitContext(r)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // for nginx
+	w.WriteHeader(http.StatusOK)
+
+	// Events that are both missed and queued are only sent once
+	lastID := after
+	send := func(e event) error {
+		if e.ID != 0 && e.ID <= lastID {
+			return nil
+		}
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if e.ID != 0 {
+			lastID = e.ID
+			fmt.Fprintf(w, "id: %d\n", e.ID)
+		}
+		_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Name, data)
+		return err
+	}
+	if after > 0 {
+		missed, err := ah.s.disperser.missed(l, after)
+		if err != nil {
+			logFor(r).WithError(err).Error("Could not read missed events")
+		}
+		for _, e := range missed {
+			if send(e) != nil {
+				return
+			}
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			return
+		case <-l.gone:
+			return
+		case <-keepAlive.C:
+			_, err = io.WriteString(w, ": keep-alive\n\n")
+		case e := <-l.queue:
+			err = send(e)
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
 }
 
+// GetMostRecent returns the most recent events, limited to their own app for
+// app-scoped admins.
+// GET /admin/stats/recent
 func (ah *adminHandler) GetMostRecent(w http.ResponseWriter,
 	r *http.Request) {
-	writeJSON(w, http.StatusOK, ah.s.disperser.getRecent())
+	as := adminFor(r)
+	recent := []event{}
+	for _, e := range ah.s.disperser.getRecent() {
+		if as.canActFor(e.AppID) {
+			recent = append(recent, e)
+		}
+	}
+	writeJSON(w, http.StatusOK, recent)
+}
+
+// eventFilter reads the query parameters appID, userID, type and status,
+// which select events. App-scoped admins only get their own app's events.
+func eventFilter(as adminSession, params url.Values) eventQuery {
+	q := eventQuery{
+		AppID:  params.Get("appID"),
+		UserID: params.Get("userID"),
+		Name:   params.Get("type"),
+		Status: params.Get("status"),
+	}
+	if q.AppID == "" {
+		q.AppID = as.scope()
+	} else {
+		as.requireApp(q.AppID)
+	}
+	if q.Name != "" {
+		found := false
+		for _, name := range events {
+			found = found || name == q.Name
+		}
+		util.PanicIfFalse(found, http.StatusBadRequest, "Unknown event type")
+	}
+	return q
+}
+
+// GetEvents returns the persisted events, newest first, limited to their own
+// app for app-scoped admins. The query parameters appID, userID, type and
+// status filter the events; from and to (RFC 3339) limit them to a time range;
+// limit sets the page size and cursor, the nextCursor of the previous page,
+// returns the next page.
+// GET /admin/events
+func (ah *adminHandler) GetEvents(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	q := eventFilter(adminFor(r), params)
+	q.Limit = defaultEventsLimit
+
+	var err error
+	if from := params.Get("from"); from != "" {
+		q.From, err = time.Parse(time.RFC3339, from)
+		util.OptionalBadRequestPanic(err, "Invalid from time")
+	}
+	if to := params.Get("to"); to != "" {
+		q.To, err = time.Parse(time.RFC3339, to)
+		util.OptionalBadRequestPanic(err, "Invalid to time")
+	}
+	if cursor := params.Get("cursor"); cursor != "" {
+		q.Before, err = strconv.ParseUint(cursor, 10, 64)
+		util.OptionalBadRequestPanic(err, "Invalid cursor")
+	}
+	if limit := params.Get("limit"); limit != "" {
+		q.Limit, err = strconv.Atoi(limit)
+		util.OptionalBadRequestPanic(err, "Invalid limit")
+		util.PanicIfFalse(0 < q.Limit && q.Limit <= maxEventsLimit,
+			http.StatusBadRequest, "Limit must be between 1 and "+
+				strconv.Itoa(maxEventsLimit))
+	}
+
+	found, err := ah.s.events.Query(q)
+	util.OptionalInternalPanic(err, "Could not read events")
+
+	reply := eventsReply{Events: found}
+	if len(found) == q.Limit {
+		reply.NextCursor = strconv.FormatUint(found[len(found)-1].ID, 10)
+	}
+	writeJSON(w, http.StatusOK, reply)
+}
+
+// serverAppID returns the app that an app server belongs to.
+func (ah *adminHandler) serverAppID(serverID string) string {
+	info, err := ah.s.Store.GetServer(serverID)
+	util.OptionalBadRequestPanic(err, "Could not find app server")
+	return info.AppID
+}
+
+// keyAppID returns the app that a key belongs to.
+func (ah *adminHandler) keyAppID(keyID string) string {
+	k, err := ah.s.Store.GetKey(keyID)
+	util.OptionalBadRequestPanic(err, "Could not find key")
+	return ah.s.keyAppID(k.AppID, k.UserID)
 }
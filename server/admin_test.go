@@ -2,10 +2,230 @@
 
 package server
 
-import "testing"
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
 
-// Create app and app server
+	"github.com/tera-insights/2Q2R-enterprise/security"
+	"github.com/tera-insights/2Q2R-enterprise/util"
+
+	"github.com/stretchr/testify/require"
+)
 
 func TestAddUserToSystem(t *testing.T) {
+	s, ts := newTestServer(t)
+	cookie := loginSuperAdmin(t, s)
+
+	// Create app and app server
+	r := newTestRequest(t, ts, "POST", "/admin/app", newAppRequest{
+		AppName: "foo",
+	})
+	r.AddCookie(cookie)
+	app := AppInfo{}
+	require.Equal(t, http.StatusOK, do(t, r, &app))
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	r = newTestRequest(t, ts, "POST", "/admin/server", newServerRequest{
+		AppID:   app.ID,
+		BaseURL: "https://app.example.com",
+		KeyType: "P256",
+		PublicKey: util.EncodeBase64(elliptic.Marshal(elliptic.P256(),
+			key.X, key.Y)),
+		Permissions: `["Register"]`,
+	})
+	r.AddCookie(cookie)
+	asi := testAppServer{key: key}
+	require.Equal(t, http.StatusOK, do(t, r, &asi.AppServerInfo))
+
+	// Users are added by registering their first key
+	r = newTestRequest(t, ts, "GET", "/v1/users/bar", nil)
+	signRequest(t, s, r, asi)
+	exists := userExistsReply{}
+	require.Equal(t, http.StatusOK, do(t, r, &exists))
+	require.False(t, exists.Exists)
+
+	rr := setUpRegistration(t, s, ts, asi, "bar")
+	r = newTestRequest(t, ts, "POST", "/v1/register", newU2FToken(t).register(
+		t, util.EncodeBase64(rr.Challenge.Challenge),
+		s.Config.getBaseURLWithProtocol()))
+	require.Equal(t, http.StatusOK, do(t, r, nil))
+
+	keys, err := s.Store.GetKeys(app.ID, "bar")
+	require.Nil(t, err)
+	require.Len(t, keys, 1)
+}
+
+func TestUpdateKey(t *testing.T) {
+	s, ts := newTestServer(t)
+	cookie := loginSuperAdmin(t, s)
+	app := newTestApp(t, s, "foo")
+	asi := newTestAppServer(t, s, app.ID, permissionRegister,
+		permissionLogin)
+	tok := registerToken(t, s, ts, asi, "bar")
+
+	update := func(req keyUpdateRequest) (int, security.Key) {
+		r := newTestRequest(t, ts, "PUT", "/admin/key/"+tok.id(), req)
+		r.AddCookie(cookie)
+		updated := security.Key{}
+		return do(t, r, &updated), updated
+	}
+	// pick returns whether the user can pick the key to authenticate with.
+	pick := func() int {
+		nonce, err := util.RandString(16)
+		require.Nil(t, err)
+		r := newTestRequest(t, ts, "GET", "/v1/auth/request/bar/"+nonce, nil)
+		signRequest(t, s, r, asi)
+		setupInfo := authenticationSetupReply{}
+		require.Equal(t, http.StatusOK, do(t, r, &setupInfo))
+		r = newTestRequest(t, ts, "POST", "/v1/auth/challenge",
+			setKeyRequest{tok.id(), setupInfo.RequestID})
+		return do(t, r, nil)
+	}
+	require.Equal(t, http.StatusOK, pick())
+
+	// A lost token is suspended until it is found
+	code, k := update(keyUpdateRequest{State: security.KeyStateSuspended})
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, security.KeyStateSuspended, k.State)
+	require.Equal(t, http.StatusForbidden, pick())
+	code, _ = update(keyUpdateRequest{State: security.KeyStateActive})
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, http.StatusOK, pick())
+
+	// Expired keys are inactive without changing their state
+	past := time.Now().Add(-time.Minute)
+	code, k = update(keyUpdateRequest{ExpiresAt: &past})
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, security.KeyStateExpired, k.CurrentState(time.Now()))
+	require.Equal(t, http.StatusForbidden, pick())
+	code, k = update(keyUpdateRequest{NeverExpires: true})
+	require.Equal(t, http.StatusOK, code)
+	require.Nil(t, k.ExpiresAt)
+	require.Equal(t, http.StatusOK, pick())
+
+	code, _ = update(keyUpdateRequest{State: security.KeyStateExpired})
+	require.Equal(t, http.StatusBadRequest, code)
+	code, _ = update(keyUpdateRequest{})
+	require.Equal(t, http.StatusBadRequest, code)
+
+	// Revocation is permanent
+	code, _ = update(keyUpdateRequest{State: security.KeyStateRevoked})
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, http.StatusForbidden, pick())
+	code, _ = update(keyUpdateRequest{State: security.KeyStateActive})
+	require.Equal(t, http.StatusConflict, code)
+
+	r := newTestRequest(t, ts, "PUT", "/admin/key/unknown",
+		keyUpdateRequest{State: security.KeyStateActive})
+	r.AddCookie(cookie)
+	require.Equal(t, http.StatusNotFound, do(t, r, nil))
+}
+
+func TestServerPublicKeysMustBeOnTheCurve(t *testing.T) {
+	s, ts := newTestServer(t)
+	cookie := loginSuperAdmin(t, s)
+	app := newTestApp(t, s, "foo")
+	asi := newTestAppServer(t, s, app.ID)
+
+	invalid := map[string]string{
+		"missing":     "",
+		"not base-64": "not base-64!",
+		"not a point": util.EncodeBase64([]byte("not a point")),
+		"off the curve": util.EncodeBase64(append([]byte{4},
+			make([]byte, 64)...)),
+	}
+	for name, key := range invalid {
+		r := newTestRequest(t, ts, "POST", "/admin/server", newServerRequest{
+			AppID:     app.ID,
+			KeyType:   "P256",
+			PublicKey: key,
+		})
+		r.AddCookie(cookie)
+		if code := do(t, r, nil); code != http.StatusBadRequest {
+			t.Errorf("Expected 400 creating a server with a %s key. Got %d",
+				name, code)
+		}
+		if key == "" {
+			continue
+		}
+
+		r = newTestRequest(t, ts, "PUT", "/admin/server/"+asi.ID,
+			serverUpdateRequest{PublicKey: key})
+		r.AddCookie(cookie)
+		if code := do(t, r, nil); code != http.StatusBadRequest {
+			t.Errorf("Expected 400 updating a server with a %s key. Got %d",
+				name, code)
+		}
+	}
+
+	// Updates without a public key keep the old one
+	r := newTestRequest(t, ts, "PUT", "/admin/server/"+asi.ID,
+		serverUpdateRequest{BaseURL: "https://app.example.com"})
+	r.AddCookie(cookie)
+	updated := AppServerInfo{}
+	require.Equal(t, http.StatusOK, do(t, r, &updated))
+	require.Equal(t, asi.PublicKey, updated.PublicKey)
+}
+
+// getNonce gets a nonce for admin `adminID` to make one request with.
+func getNonce(t *testing.T, ts *httptest.Server, cookie *http.Cookie,
+	adminID, method, path string) string {
+	r := newTestRequest(t, ts, "GET", "/admin/nonce/"+adminID+"?method="+
+		url.QueryEscape(method)+"&path="+url.QueryEscape(path), nil)
+	r.AddCookie(cookie)
+	reply := map[string]interface{}{}
+	require.Equal(t, http.StatusOK, do(t, r, &reply))
+	return reply["nonce"].(string)
+}
+
+func TestSensitiveAdminRoutesNeedNonces(t *testing.T) {
+	s, ts := newTestServer(t)
+	cookie := loginSuperAdmin(t, s)
+	app := newTestApp(t, s, "foo")
+	path := "/admin/app/" + app.ID
+
+	for _, c := range []struct {
+		name  string
+		nonce string
+	}{
+		{"no", ""},
+		{"an unknown", "unknown"},
+		{"another route's", getNonce(t, ts, cookie, "super", "DELETE",
+			"/admin/app/other")},
+		{"another method's", getNonce(t, ts, cookie, "super", "GET", path)},
+	} {
+		r := newTestRequest(t, ts, "DELETE", path, nil)
+		r.AddCookie(cookie)
+		r.Header.Set(nonceHeader, c.nonce)
+		if code := do(t, r, nil); code != http.StatusForbidden {
+			t.Errorf("Expected 403 with %s nonce. Got %d", c.name, code)
+		}
+	}
+	_, err := s.Store.GetApp(app.ID)
+	require.Nil(t, err)
+
+	// Nonces are bound to their admin
+	other := loginAdmin(t, s, Admin{ID: "other", Role: roleSuperAdmin,
+		AdminFor: "1"})
+	r := newTestRequest(t, ts, "DELETE", path, nil)
+	r.AddCookie(other)
+	r.Header.Set(nonceHeader, getNonce(t, ts, cookie, "super", "DELETE", path))
+	require.Equal(t, http.StatusForbidden, do(t, r, nil))
 
+	nonce := getNonce(t, ts, cookie, "super", "DELETE", path)
+	for _, expected := range []int{http.StatusOK, http.StatusForbidden} {
+		r := newTestRequest(t, ts, "DELETE", path, nil)
+		r.AddCookie(cookie)
+		r.Header.Set(nonceHeader, nonce)
+		require.Equal(t, expected, do(t, r, nil))
+	}
+	_, err = s.Store.GetApp(app.ID)
+	require.Equal(t, ErrNotFound, err)
 }
@@ -0,0 +1,87 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/tera-insights/2Q2R-enterprise/util"
+
+	glob "github.com/ryanuber/go-glob"
+)
+
+// Permissions that can be granted in AppServerInfo.Permissions.
+const (
+	permissionRegister = "Register"
+	permissionDelete   = "Delete"
+	permissionLogin    = "Login"
+)
+
+// serverRoute is a route that app servers call.
+type serverRoute struct {
+	pattern    string
+	method     string // empty for every method
+	permission string // empty if any authenticated app server may call it
+}
+
+// serverRoutes lists the routes that app servers call. The first match wins.
+var serverRoutes = []serverRoute{
+	{"/v1/register/request/*", "", permissionRegister},
+	{"/v1/auth/request/*", "", permissionLogin},
+	{"/v1/users/*", "DELETE", permissionDelete},
+	{"/v1/users/*", "", ""},
+	{"/v1/keys/*", "DELETE", permissionDelete},
+	{"/v1/keys/*", "", ""},
+}
+
+// serverRouteFor returns the app server route that `r` is for, if any.
+func serverRouteFor(r *http.Request) (serverRoute, bool) {
+	for _, route := range serverRoutes {
+		if glob.Glob(route.pattern, r.URL.Path) &&
+			(route.method == "" || route.method == r.Method) {
+			return route, true
+		}
+	}
+	return serverRoute{}, false
+}
+
+// hasPermission returns whether the app server was granted `p`.
+func (asi AppServerInfo) hasPermission(p string) bool {
+	var granted []string
+	if err := json.Unmarshal([]byte(asi.Permissions), &granted); err != nil {
+		return false
+	}
+	for _, g := range granted {
+		if g == p {
+			return true
+		}
+	}
+	return false
+}
+
+type appServerKey struct{}
+
+// authenticateAppServer authenticates a request to an app server route and
+// checks that the server has the route's permission. It returns the request
+// with the server attached, for handlers to read with appServerFor.
+func (s *Server) authenticateAppServer(r *http.Request,
+	route serverRoute) *http.Request {
+	asi := s.headerAuthentication(r)
+	if route.permission != "" {
+		util.PanicIfFalse(asi.hasPermission(route.permission),
+			http.StatusForbidden, "App server does not have the "+
+				route.permission+" permission")
+	}
+	return r.WithContext(context.WithValue(r.Context(), appServerKey{}, asi))
+}
+
+// appServerFor returns the app server that made an authenticated request.
+// Handlers must scope their queries to its AppID.
+func appServerFor(r *http.Request) AppServerInfo {
+	asi, ok := r.Context().Value(appServerKey{}).(AppServerInfo)
+	util.PanicIfFalse(ok, http.StatusUnauthorized, "Request was not made by "+
+		"an app server")
+	return asi
+}
@@ -0,0 +1,153 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/tera-insights/2Q2R-enterprise/security"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppServerAuthentication(t *testing.T) {
+	s, ts := newTestServer(t)
+	app := newTestApp(t, s, "foo")
+	asi := newTestAppServer(t, s, app.ID)
+	other := newTestAppServer(t, s, app.ID)
+	path := "/v1/users/bar"
+	body := []byte("body")
+
+	// request sends `body` with the given headers
+	request := func(method, authentication, timestamp string) int {
+		r, err := http.NewRequest(method, ts.URL+path, bytes.NewReader(body))
+		require.Nil(t, err)
+		if authentication != "" {
+			r.Header.Set("X-Authentication", authentication)
+		}
+		if timestamp != "" {
+			r.Header.Set("X-Timestamp", timestamp)
+		}
+		return do(t, r, nil)
+	}
+	at := func(d time.Duration) string {
+		return strconv.FormatInt(time.Now().Add(d).Unix(), 10)
+	}
+	now := at(0)
+	mac := serverMAC(t, s, asi, "GET", path, now, body)
+
+	for _, c := range []struct {
+		name           string
+		authentication string
+		timestamp      string
+	}{
+		{"no headers", "", ""},
+		{"no timestamp", asi.ID + ":" + mac, ""},
+		{"no server ID", mac, now},
+		{"a MAC that is not base-64", asi.ID + ":!!!", now},
+		{"an unknown server", "unknown:" + mac, now},
+		{"another server's MAC", other.ID + ":" + mac, now},
+		{"another timestamp", asi.ID + ":" + mac, at(time.Second)},
+		{"another path", asi.ID + ":" + serverMAC(t, s, asi, "GET",
+			"/v1/users/baz", now, body), now},
+		{"another method", asi.ID + ":" + serverMAC(t, s, asi, "DELETE",
+			path, now, body), now},
+		{"another body", asi.ID + ":" + serverMAC(t, s, asi, "GET", path,
+			now, []byte("other")), now},
+		{"an old timestamp", asi.ID + ":" + serverMAC(t, s, asi, "GET",
+			path, at(-2*s.Config.ServerAuthSkew), body),
+			at(-2 * s.Config.ServerAuthSkew)},
+		{"a future timestamp", asi.ID + ":" + serverMAC(t, s, asi, "GET",
+			path, at(2*s.Config.ServerAuthSkew), body),
+			at(2 * s.Config.ServerAuthSkew)},
+	} {
+		require.Equal(t, http.StatusUnauthorized, request("GET",
+			c.authentication, c.timestamp), c.name)
+	}
+
+	require.Equal(t, http.StatusOK, request("GET", asi.ID+":"+mac, now))
+	// Each MAC is only accepted once
+	require.Equal(t, http.StatusUnauthorized, request("GET", asi.ID+":"+mac,
+		now))
+	// Even with padding added to its encoding
+	require.Equal(t, http.StatusUnauthorized, request("GET",
+		asi.ID+":"+mac+"=", now))
+
+	// Routes that need a permission refuse servers without it
+	mac = serverMAC(t, s, asi, "DELETE", path, now, body)
+	require.Equal(t, http.StatusForbidden, request("DELETE", asi.ID+":"+mac,
+		now))
+	deleter := newTestAppServer(t, s, app.ID, permissionDelete)
+	mac = serverMAC(t, s, deleter, "DELETE", path, now, body)
+	require.Equal(t, http.StatusOK, request("DELETE", deleter.ID+":"+mac,
+		now))
+
+	// Bodies are only read up to a limit
+	body = bytes.Repeat([]byte("a"), maxServerRequestSize+1)
+	mac = serverMAC(t, s, asi, "GET", path, now, body)
+	require.Equal(t, http.StatusRequestEntityTooLarge, request("GET",
+		asi.ID+":"+mac, now))
+}
+
+func TestAppServerPermissions(t *testing.T) {
+	for permissions, expected := range map[string]bool{
+		`["Register", "Delete"]`: true,
+		`["Register"]`:           false,
+		`["delete"]`:             false,
+		"[]":                     false,
+		"":                       false,
+	} {
+		asi := AppServerInfo{Permissions: permissions}
+		require.Equal(t, expected, asi.hasPermission(permissionDelete),
+			"Permissions %q", permissions)
+	}
+}
+
+func TestAppServersOnlySeeTheirApp(t *testing.T) {
+	s, ts := newTestServer(t)
+	app := newTestApp(t, s, "foo")
+	other := newTestApp(t, s, "bar")
+	asi := newTestAppServer(t, s, app.ID, permissionLogin, permissionDelete)
+
+	// Both apps have a key for "bar" and the other app also has one for "baz"
+	for _, k := range []security.Key{
+		{ID: "mine", AppID: app.ID, UserID: "bar"},
+		{ID: "theirs", AppID: other.ID, UserID: "bar"},
+		{ID: "baz", AppID: other.ID, UserID: "baz"},
+	} {
+		k.Type = "u2f"
+		k.Format = security.FormatU2F
+		k.State = security.KeyStateActive
+		require.Nil(t, s.Store.CreateKey(k))
+	}
+
+	send := func(method, path string, reply interface{}) int {
+		r := newTestRequest(t, ts, method, path, nil)
+		signRequest(t, s, r, asi)
+		return do(t, r, reply)
+	}
+
+	var keys []security.Key
+	require.Equal(t, http.StatusOK, send("GET", "/v1/keys/get", &keys))
+	require.Len(t, keys, 1)
+	require.Equal(t, "mine", keys[0].ID)
+
+	exists := userExistsReply{}
+	require.Equal(t, http.StatusOK, send("GET", "/v1/users/baz", &exists))
+	require.False(t, exists.Exists)
+	require.Equal(t, http.StatusNotFound, send("GET",
+		"/v1/auth/request/baz/nonce", nil))
+	require.Equal(t, http.StatusNotFound, send("DELETE",
+		"/v1/keys/bar/theirs", nil))
+
+	deleted := modificationReply{}
+	require.Equal(t, http.StatusOK, send("DELETE", "/v1/users/bar", &deleted))
+	require.Equal(t, int64(1), deleted.NumAffected)
+	keys, err := s.Store.GetKeys(other.ID, "")
+	require.Nil(t, err)
+	require.Len(t, keys, 2)
+}
@@ -123,6 +123,38 @@ addState("u2f-login", "u2fAuth",
     }
 );
 
+addState("webauthn-login", "u2fAuth",
+    function () {
+        return {
+            key: data.keys[keyIndex],
+            windowUrl: window.location
+        }
+    }, function (sel) {
+        $.postJSON(data.webAuthnOptionsUrl, { requestID: data.id }, function (options) {
+            options.challenge = decodeBase64(options.challenge);
+            options.allowCredentials.forEach(function (cred) {
+                cred.id = decodeBase64(cred.id);
+            });
+            navigator.credentials.get({ publicKey: options }).then(function (cred) {
+                $.postJSON(data.webAuthnUrl, {
+                    id: cred.id,
+                    clientDataJSON: encodeBase64(cred.response.clientDataJSON),
+                    authenticatorData: encodeBase64(cred.response.authenticatorData),
+                    signature: encodeBase64(cred.response.signature),
+                    userHandle: cred.response.userHandle ?
+                        encodeBase64(cred.response.userHandle) : ""
+                }, function (res) {
+                    console.log("Succesful: ", res);
+                }).fail(function (jqXHR, textStatus) {
+                    console.log("Error: ", jqXHR.status);
+                });
+            }).catch(function (err) {
+                alert("Login failed: " + err);
+            });
+        });
+    }
+);
+
 $(document).ready(function () {
     init({
         title: 'Authentication'
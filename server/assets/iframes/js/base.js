@@ -16,6 +16,11 @@ function makeKeyInfo(type) {
                 value: "u2f", name: "FIDO U2F Device", icon: "img/u2f.png"
             };
 
+        case "webauthn":
+            return {
+                value: "webauthn", name: "Security Key or Passkey", icon: "img/u2f.png"
+            };
+
         case "software":
             return {
                 value: "software", name: "Software Key"
@@ -106,6 +111,32 @@ function selectState(state) {
         stateSel.html("<h1>State " + state + " not implemented </h1>");
 }
 
+/**
+ * Auxiliary functions to convert between base-64 web encoded strings (no
+ * padding) and the ArrayBuffers used by the WebAuthn API
+ */
+function decodeBase64(s) {
+    s = s.replace(/-/g, "+").replace(/_/g, "/");
+    while (s.length % 4) {
+        s += "=";
+    }
+    var raw = atob(s);
+    var out = new Uint8Array(raw.length);
+    for (var i = 0; i < raw.length; i++) {
+        out[i] = raw.charCodeAt(i);
+    }
+    return out.buffer;
+}
+
+function encodeBase64(buf) {
+    var bytes = new Uint8Array(buf);
+    var raw = "";
+    for (var i = 0; i < bytes.length; i++) {
+        raw += String.fromCharCode(bytes[i]);
+    }
+    return btoa(raw).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+}
+
 /**
  * Auxiliary function to extract big and small displayable text out of challenges
  * 
@@ -112,6 +112,43 @@ addState('u2f-generate', 'u2fRegister',
     }
 );
 
+addState('webauthn-generate', 'u2fRegister',
+    function () {
+        return {
+            windowUrl: window.location + "?k=webauthn",
+            ext: !!window.PublicKeyCredential
+        }
+    }, function (sel) {
+        $.postJSON(data.webAuthnOptionsUrl, { requestID: data.id }, function (options) {
+            options.challenge = decodeBase64(options.challenge);
+            options.user.id = decodeBase64(options.user.id);
+            options.excludeCredentials.forEach(function (cred) {
+                cred.id = decodeBase64(cred.id);
+            });
+            navigator.credentials.create({ publicKey: options }).then(function (cred) {
+                $.postJSON(data.webAuthnUrl, {
+                    id: cred.id,
+                    clientDataJSON: encodeBase64(cred.response.clientDataJSON),
+                    attestationObject: encodeBase64(cred.response.attestationObject),
+                    deviceName: "Security Key",
+                    type: "webauthn"
+                }, function (res) {
+                    if (res.successful)
+                        console.log("Succesful: ", res);
+                    else
+                        console.log("Error: ", res);
+                }).fail(function (jqXHR, textStatus) {
+                    console.log("Error: ", jqXHR.status);
+                });
+            }).catch(function (err) {
+                console.log("WebAuthn registration failed: ", err);
+                $("#u2f-window", sel).show();
+                $("#u2f-msg").hide();
+            });
+        });
+    }
+);
+
 $(document).ready(function () {
     init({
         title: 'Device Registration'
@@ -122,6 +159,10 @@ $(document).ready(function () {
         selectState("u2f-generate");
         $('html').addClass("window");
     }
+    else if (query === "k=webauthn") {
+        selectState("webauthn-generate");
+        $('html').addClass("window");
+    }
     else {
         // start with key type selection
         selectState("keytype");
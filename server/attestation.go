@@ -0,0 +1,151 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/tera-insights/2Q2R-enterprise/security"
+	"github.com/tera-insights/2Q2R-enterprise/util"
+
+	"github.com/tstranex/u2f"
+)
+
+// Attestation policies for AppInfo.AttestationPolicy. They double as the
+// WebAuthn attestation conveyance preference sent to the browser.
+const (
+	// Accept any authenticator without checking its attestation
+	attestationNone = "none"
+
+	// Check attestation when the authenticator provides it, but allow
+	// anonymized and self attestation
+	attestationIndirect = "indirect"
+
+	// Require an attestation certificate that chains to a trusted root
+	attestationDirect = "direct"
+)
+
+func validAttestationPolicy(p string) bool {
+	return p == attestationNone || p == attestationIndirect ||
+		p == attestationDirect
+}
+
+// getAttestationPolicy returns the app's policy, defaulting to none for apps
+// created before policies existed.
+func (app AppInfo) getAttestationPolicy() string {
+	if app.AttestationPolicy == "" {
+		return attestationNone
+	}
+	return app.AttestationPolicy
+}
+
+// allowsAuthenticator returns whether an authenticator identified by either
+// its AAGUID or its attestation key identifier is on the app's allow list. An
+// empty allow list allows every authenticator, including unidentified ones.
+func (app AppInfo) allowsAuthenticator(ids ...string) bool {
+	if app.AllowedAuthenticators == "" {
+		return true
+	}
+	var allowed []string
+	if err := json.Unmarshal([]byte(app.AllowedAuthenticators),
+		&allowed); err != nil {
+		return false
+	}
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, a := range allowed {
+		for _, id := range ids {
+			if id != "" && strings.EqualFold(a, id) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// appForRequest loads the app that a registration request is for. Admins
+// register under app ID "1", which has no AppInfo, so a missing app yields the
+// default settings.
+func (s *Server) appForRequest(appID string) AppInfo {
+	app, err := s.Store.GetApp(appID)
+	if err == ErrNotFound {
+		return AppInfo{ID: appID}
+	}
+	util.OptionalInternalPanic(err, "Failed to find app information")
+	return app
+}
+
+// u2fConfig returns the go-u2f configuration that enforces the app's
+// attestation policy. U2F devices always send an attestation certificate, so
+// indirect and direct are treated the same.
+func (s *Server) u2fConfig(app AppInfo) *u2f.Config {
+	if app.getAttestationPolicy() == attestationNone {
+		return &u2f.Config{SkipAttestationVerify: true}
+	}
+	util.PanicIfFalse(s.attestationRoots != nil, http.StatusInternalServerError,
+		"No trusted attestation roots are configured")
+	return &u2f.Config{RootAttestationCertPool: s.attestationRoots}
+}
+
+// checkU2FAttestation applies the app's allow list to a verified U2F
+// registration and returns the attestation certificate's subject.
+func (s *Server) checkU2FAttestation(app AppInfo, reg *u2f.Registration) string {
+	if app.getAttestationPolicy() == attestationNone ||
+		reg.AttestationCert == nil {
+		return ""
+	}
+	keyID := security.AttestationKeyIdentifier(reg.AttestationCert)
+	util.PanicIfFalse(app.allowsAuthenticator(keyID), http.StatusForbidden,
+		"Authenticator is not allowed for this app")
+	s.checkMetadata(app, keyID)
+	return reg.AttestationCert.Subject.String()
+}
+
+// checkWebAuthnAttestation enforces the app's attestation policy on a new
+// WebAuthn credential.
+func (s *Server) checkWebAuthnAttestation(app AppInfo,
+	ao security.AttestationObject,
+	clientDataHash []byte) security.AttestationResult {
+	policy := app.getAttestationPolicy()
+	if policy == attestationNone {
+		return security.AttestationResult{Type: security.AttestationTypeNone}
+	}
+
+	res, err := security.VerifyAttestationStatement(ao, clientDataHash)
+	util.OptionalPanic(err, http.StatusForbidden, "Could not verify "+
+		"attestation")
+
+	// The authenticator is only identified by a trusted chain. Without one,
+	// its AAGUID is unattested, so it matches no allow list and no metadata.
+	var ids []string
+	if cert := res.Certificate(); cert != nil {
+		util.PanicIfFalse(s.attestationRoots != nil,
+			http.StatusInternalServerError, "No trusted attestation roots "+
+				"are configured")
+		err = res.VerifyChain(s.attestationRoots)
+		util.OptionalPanic(err, http.StatusForbidden, "Authenticator is not "+
+			"trusted")
+		ids = []string{security.FormatAAGUID(ao.AuthData.AAGUID),
+			security.AttestationKeyIdentifier(cert)}
+	} else {
+		util.PanicIfFalse(policy != attestationDirect, http.StatusForbidden,
+			"App requires attestation from a trusted authenticator")
+	}
+
+	util.PanicIfFalse(app.allowsAuthenticator(ids...),
+		http.StatusForbidden, "Authenticator is not allowed for this app")
+	s.checkMetadata(app, ids...)
+	return res
+}
+
+// loadAttestationRoots loads the trust store, if one is configured.
+func loadAttestationRoots(dir string) (*x509.CertPool, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	return security.LoadCertPool(dir)
+}
@@ -0,0 +1,192 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"net/http"
+	"testing"
+
+	"github.com/tera-insights/2Q2R-enterprise/security"
+	"github.com/tera-insights/2Q2R-enterprise/util"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tstranex/u2f"
+)
+
+// panicStatus runs `f` and returns the status code of the error it panics
+// with, or 0 if it returns normally.
+func panicStatus(f func()) (code int) {
+	defer func() {
+		if e := recover(); e != nil {
+			code = e.(util.BubbledError).StatusCode
+		}
+	}()
+	f()
+	return 0
+}
+
+func TestAllowsAuthenticator(t *testing.T) {
+	for allowed, expected := range map[string]bool{
+		"":                 true,
+		"[]":               true,
+		`["ABC", "def"]`:   true,
+		`["def"]`:          false,
+		`[""]`:             false,
+		"not a JSON array": false,
+	} {
+		app := AppInfo{AllowedAuthenticators: allowed}
+		require.Equal(t, expected, app.allowsAuthenticator("", "abc"),
+			"Allow list %q", allowed)
+	}
+}
+
+func TestU2FAttestationPolicy(t *testing.T) {
+	s, _ := newTestServer(t)
+	tok := newU2FToken(t)
+	cert, err := x509.ParseCertificate(tok.attestationCert)
+	require.Nil(t, err)
+	keyID := security.AttestationKeyIdentifier(cert)
+	reg := &u2f.Registration{AttestationCert: cert}
+
+	none := AppInfo{AttestationPolicy: attestationNone,
+		AllowedAuthenticators: `["other"]`}
+	require.True(t, s.u2fConfig(none).SkipAttestationVerify)
+	require.Equal(t, "", s.checkU2FAttestation(none, reg))
+
+	// U2F devices always have a certificate, so indirect needs roots too
+	direct := AppInfo{AttestationPolicy: attestationDirect}
+	indirect := AppInfo{AttestationPolicy: attestationIndirect}
+	s.attestationRoots = nil
+	require.Equal(t, http.StatusInternalServerError, panicStatus(func() {
+		s.u2fConfig(direct)
+	}))
+	require.Equal(t, http.StatusInternalServerError, panicStatus(func() {
+		s.u2fConfig(indirect)
+	}))
+
+	s.attestationRoots = x509.NewCertPool()
+	s.attestationRoots.AddCert(cert)
+	config := s.u2fConfig(direct)
+	require.False(t, config.SkipAttestationVerify)
+	require.Equal(t, s.attestationRoots, config.RootAttestationCertPool)
+	require.Equal(t, cert.Subject.String(), s.checkU2FAttestation(direct,
+		reg))
+
+	direct.AllowedAuthenticators = `["other"]`
+	require.Equal(t, http.StatusForbidden, panicStatus(func() {
+		s.checkU2FAttestation(direct, reg)
+	}))
+	direct.AllowedAuthenticators = `["` + keyID + `"]`
+	s.checkU2FAttestation(direct, reg)
+}
+
+func TestWebAuthnAttestationPolicy(t *testing.T) {
+	s, _ := newTestServer(t)
+	trusted := newU2FToken(t)
+	untrusted := newU2FToken(t)
+	cert, err := x509.ParseCertificate(trusted.attestationCert)
+	require.Nil(t, err)
+	keyID := security.AttestationKeyIdentifier(cert)
+
+	aaguid := []byte("0123456789abcdef")
+	rawAuthData := []byte("authenticator data")
+	clientDataHash := sha256.Sum256([]byte("client data"))
+	signed := append(append([]byte{}, rawAuthData...), clientDataHash[:]...)
+
+	// packed returns a basic attestation signed by the token's attestation
+	// certificate.
+	packed := func(tok *u2fToken) security.AttestationObject {
+		h := sha256.Sum256(signed)
+		sig, err := ecdsa.SignASN1(rand.Reader, tok.attestationKey, h[:])
+		require.Nil(t, err)
+		return security.AttestationObject{
+			Format: "packed",
+			Statement: map[string]interface{}{
+				"alg": security.COSEAlgES256,
+				"sig": sig,
+				"x5c": []interface{}{tok.attestationCert},
+			},
+			RawAuthData: rawAuthData,
+			AuthData:    security.AuthenticatorData{AAGUID: aaguid},
+		}
+	}
+	none := security.AttestationObject{
+		Format:      "none",
+		Statement:   map[string]interface{}{},
+		RawAuthData: rawAuthData,
+		AuthData:    security.AuthenticatorData{AAGUID: aaguid},
+	}
+	forged := packed(trusted)
+	forged.Statement["sig"] = []byte("not a signature")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	formatted := security.FormatAAGUID(aaguid)
+
+	for _, c := range []struct {
+		name    string
+		policy  string
+		allowed string
+		roots   *x509.CertPool
+		ao      security.AttestationObject
+		code    int
+	}{
+		{"none accepts anything", attestationNone, `["other"]`, nil, forged,
+			0},
+		{"indirect accepts no attestation", attestationIndirect, "", nil,
+			none, 0},
+		{"indirect checks the signature", attestationIndirect, "", roots,
+			forged, http.StatusForbidden},
+		{"indirect checks the chain", attestationIndirect, "", roots,
+			packed(untrusted), http.StatusForbidden},
+		{"indirect with a trusted chain", attestationIndirect, "", roots,
+			packed(trusted), 0},
+		{"direct requires a certificate", attestationDirect, "", roots, none,
+			http.StatusForbidden},
+		{"direct with a trusted chain", attestationDirect, "", roots,
+			packed(trusted), 0},
+		{"direct with an untrusted chain", attestationDirect, "", roots,
+			packed(untrusted), http.StatusForbidden},
+		{"direct without roots", attestationDirect, "", nil, packed(trusted),
+			http.StatusInternalServerError},
+		{"allowed by AAGUID", attestationDirect, `["` + formatted + `"]`,
+			roots, packed(trusted), 0},
+		{"allowed by key identifier", attestationDirect, `["` + keyID + `"]`,
+			roots, packed(trusted), 0},
+		{"not allowed", attestationDirect, `["other"]`, roots,
+			packed(trusted), http.StatusForbidden},
+		// Unattested AAGUIDs can be anything the client likes
+		{"allowed by AAGUID without attestation", attestationIndirect,
+			`["` + formatted + `"]`, roots, none, http.StatusForbidden},
+		{"an empty allow list without attestation", attestationIndirect,
+			"[]", roots, none, 0},
+		{"not allowed and anonymous", attestationIndirect, `["other"]`,
+			roots, none, http.StatusForbidden},
+	} {
+		s.attestationRoots = c.roots
+		app := AppInfo{AttestationPolicy: c.policy,
+			AllowedAuthenticators: c.allowed}
+		require.Equal(t, c.code, panicStatus(func() {
+			s.checkWebAuthnAttestation(app, c.ao, clientDataHash[:])
+		}), c.name)
+	}
+
+	// Nor do unattested AAGUIDs match metadata
+	s.attestationRoots = roots
+	s.metadata, _ = newTestMetadataStore(t, security.MetadataEntry{
+		AAGUID:        formatted,
+		StatusReports: []security.StatusReport{certified("FIDO_CERTIFIED")},
+	})
+	app := AppInfo{AttestationPolicy: attestationIndirect,
+		MinCertificationLevel: "FIDO_CERTIFIED"}
+	require.Equal(t, http.StatusForbidden, panicStatus(func() {
+		s.checkWebAuthnAttestation(app, none, clientDataHash[:])
+	}))
+	require.Equal(t, 0, panicStatus(func() {
+		s.checkWebAuthnAttestation(app, packed(trusted), clientDataHash[:])
+	}))
+}
@@ -4,12 +4,11 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"html/template"
 	"net"
 	"net/http"
-	"sync"
-	"sync/atomic"
 
 	"github.com/tera-insights/2Q2R-enterprise/security"
 	"github.com/tera-insights/2Q2R-enterprise/util"
@@ -18,7 +17,6 @@ import (
 
 	rice "github.com/GeertJohan/go.rice"
 	"github.com/gorilla/mux"
-	cache "github.com/patrickmn/go-cache"
 	"github.com/pkg/errors"
 	"github.com/tstranex/u2f"
 )
@@ -32,17 +30,10 @@ type authenticationData struct {
 type authHandler struct {
 	s *Server
 
-	requests             *cache.Cache // Request ID to *authReq
-	challengeToRequestID *cache.Cache
-	expiration           time.Duration
-
-	// Migrated from queue
+	requests   requestStore
+	expiration time.Duration
 	rcTimeout  time.Duration
-	rcInterval time.Duration
 	lTimeout   time.Duration
-	lInterval  time.Duration
-
-	stateLock *sync.RWMutex
 }
 
 type keyDataToEmbed struct {
@@ -52,100 +43,77 @@ type keyDataToEmbed struct {
 }
 
 type authenticateData struct {
-	RequestID    string           `json:"id"`
-	Counter      int              `json:"counter"`
-	Keys         []keyDataToEmbed `json:"keys"`
-	Challenge    string           `json:"challenge"` // base-64 URL-encoded
-	UserID       string           `json:"userID"`
-	AppID        string           `json:"appId"`
-	BaseURL      string           `json:"baseUrl"`
-	AuthURL      string           `json:"authUrl"`
-	InfoURL      string           `json:"infoUrl"`
-	WaitURL      string           `json:"waitUrl"`
-	ChallengeURL string           `json:"challengeUrl"`
-	AppURL       string           `json:"appUrl"`
+	RequestID          string           `json:"id"`
+	Counter            int              `json:"counter"`
+	Keys               []keyDataToEmbed `json:"keys"`
+	Challenge          string           `json:"challenge"` // base-64 URL-encoded
+	UserID             string           `json:"userID"`
+	AppID              string           `json:"appId"`
+	BaseURL            string           `json:"baseUrl"`
+	AuthURL            string           `json:"authUrl"`
+	InfoURL            string           `json:"infoUrl"`
+	WaitURL            string           `json:"waitUrl"`
+	ChallengeURL       string           `json:"challengeUrl"`
+	AppURL             string           `json:"appUrl"`
+	WebAuthnOptionsURL string           `json:"webAuthnOptionsUrl"`
+	WebAuthnURL        string           `json:"webAuthnUrl"`
 }
 
 func newAuthHandler(s *Server) *authHandler {
-	rcet := s.Config.RecentlyCompletedExpirationTime
-	ct := s.Config.CleanTime
-
 	return &authHandler{
 		s,
-		cache.New(rcet, ct),
-		cache.New(rcet, ct),
+		s.authentications,
 		s.Config.ExpirationTime,
-		rcet,
-		ct,
+		s.Config.RecentlyCompletedExpirationTime,
 		s.Config.ListenerExpirationTime,
-		ct,
-		&sync.RWMutex{},
 	}
 }
 
-type authReq struct {
-	RequestID     string
-	Challenge     *u2f.Challenge
-	KeyHandle     string
-	AppID         string
-	UserID        string
-	OriginalIP    string
-	Nonce         string
-	Closed        chan struct{}
-	Status        int
-	NumListeners  int32 // Used atomically
-	SettingResult int32 // Used atomically
-}
-
 // GetRequest returns the request for a particular request ID.
-func (ah *authHandler) GetRequest(id string) (*authReq, error) {
-	if val, found := ah.requests.Get(id); found {
-		ptr := val.(*authReq)
-		return ptr, nil
+func (ah *authHandler) GetRequest(id string) (*pendingRequest, error) {
+	ar, err := ah.requests.Get(id)
+	if err == errRequestNotFound {
+		return nil, errors.Errorf("Could not find auth request with id %s", id)
+	} else if err != nil {
+		return nil, err
 	}
-	return nil, errors.Errorf("Could not find auth request with id %s", id)
+	return &ar, nil
 }
 
-// Listen returns a chan that emits an HTTP status code corresponding to the
-// authentication request. It also returns a pointer to the request so that, if
-// appropriate, handlers can attach cookies.
-func (ah *authHandler) Listen(id string) (chan int, *authReq, error) {
+// Listen blocks until the authentication request completes, on whichever
+// server instance, or times out. It returns the HTTP status code of the result
+// and the request so that, if appropriate, handlers can attach cookies.
+func (ah *authHandler) Listen(ctx context.Context, id string) (int,
+	*pendingRequest, error) {
 	ar, err := ah.GetRequest(id)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "Could not listen to unknown request")
+		return 0, nil, errors.Wrap(err, "Could not listen to unknown request")
 	}
 
-	if atomic.AddInt32(&ar.NumListeners, 1) != 1 {
-		return nil, nil, errors.New("Someone is already listening")
+	status, timedOut, err := awaitResult(ctx, ah.requests, id, ah.lTimeout,
+		ah.rcTimeout)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "Could not wait for request")
 	}
-
-	c := make(chan int)
-	go func() {
-		<-ar.Closed
-		c <- ar.Status
-	}()
-
-	go func() {
-		time.Sleep(ah.lTimeout)
-		// If no one set result
-		if atomic.CompareAndSwapInt32(&ar.SettingResult, 0, 1) {
-			ar.Status = http.StatusRequestTimeout
-			ah.requests.Set(id, ar, ah.rcTimeout)
-			ah.s.disperser.addEvent(authentication, time.Now(),
-				ar.AppID, "timeout", ar.UserID, ar.OriginalIP, "")
-			close(ar.Closed)
-		}
-	}()
-
-	return c, ar, nil
+	if timedOut {
+		ah.s.metrics.countResult(authenticationRequests, ar.AppID,
+			resultTimeout)
+		ah.s.disperser.addEvent(authentication, time.Now(),
+			ar.AppID, "timeout", ar.UserID, ar.OriginalIP, "")
+	}
+	return status, ar, nil
 }
 
 // AuthRequestSetupHandler sets up a two-factor authentication request.
 // GET /v1/auth/request/{userID}/{nonce}
 func (ah *authHandler) Setup(w http.ResponseWriter, r *http.Request) {
+	appID := appServerFor(r).AppID
 	userID := mux.Vars(r)["userID"]
-	appID, err := ah.s.kc.GetAppID(userID)
-	util.OptionalInternalPanic(err, "Failed to load key")
+
+	keys, err := ah.s.Store.GetKeys(appID, userID)
+	util.OptionalInternalPanic(err, "Failed to load keys")
+	util.PanicIfFalse(len(keys) > 0, http.StatusNotFound, "User has no keys for "+
+		"this app")
 
 	challenge, err := u2f.NewChallenge(ah.s.Config.getBaseURLWithProtocol(),
 		[]string{ah.s.Config.getBaseURLWithProtocol()})
@@ -155,18 +123,16 @@ func (ah *authHandler) Setup(w http.ResponseWriter, r *http.Request) {
 	util.OptionalInternalPanic(err, "Failed to generate request ID")
 
 	host, _, _ := net.SplitHostPort(r.RemoteAddr)
-	ar := authReq{
+	err = ah.requests.Put(pendingRequest{
 		RequestID:  requestID,
 		Challenge:  challenge,
 		AppID:      appID,
 		UserID:     userID,
 		OriginalIP: host,
 		Nonce:      mux.Vars(r)["nonce"],
-		Closed:     make(chan struct{}),
-	}
-	ah.requests.Set(requestID, &ar, ah.expiration)
-	s := util.EncodeBase64(ar.Challenge.Challenge)
-	ah.challengeToRequestID.Set(s, requestID, ah.expiration)
+	}, ah.expiration)
+	util.OptionalInternalPanic(err, "Failed to save request")
+	ah.s.metrics.countSetup(authenticationRequests, appID)
 
 	writeJSON(w, http.StatusOK, authenticationSetupReply{
 		requestID,
@@ -185,7 +151,7 @@ func (ah *authHandler) IFrame(w http.ResponseWriter, r *http.Request) {
 	templateBox, err := rice.FindBox("assets")
 	util.OptionalInternalPanic(err, "Failed to load assets")
 
-	templateString, err := templateBox.String("all.html")
+	templateString, err := templateBox.String("iframes/all.html")
 	util.OptionalInternalPanic(err, "Failed to load template")
 
 	t, err := template.New("auth").Parse(templateString)
@@ -194,41 +160,37 @@ func (ah *authHandler) IFrame(w http.ResponseWriter, r *http.Request) {
 	cached, err := ah.GetRequest(req.RequestID)
 	util.OptionalPanic(err, http.StatusBadRequest, "Failed to load cached request")
 
-	query := security.Key{AppID: cached.AppID, UserID: cached.UserID}
-	rows, err := ah.s.DB.Model(&security.Key{}).Where(query).Select([]string{
-		"key_id", "type", "name",
-	}).Rows()
+	stored, err := ah.s.Store.GetKeys(cached.AppID, cached.UserID)
 	util.OptionalInternalPanic(err, "Could not load keys")
 
-	defer rows.Close()
-
+	// Suspended, expired and revoked keys are not offered to the user
 	var keys []keyDataToEmbed
-	for rows.Next() {
-		var keyID string
-		var keyType string
-		var name string
-		err := rows.Scan(&keyID, &keyType, &name)
-		util.OptionalInternalPanic(err, "Internal server error")
+	for _, k := range stored {
+		if !k.IsActive() {
+			continue
+		}
 		keys = append(keys, keyDataToEmbed{
-			KeyID: keyID,
-			Type:  keyType,
-			Name:  name,
+			KeyID: k.ID,
+			Type:  k.Type,
+			Name:  k.Name,
 		})
 	}
 	base := ah.s.Config.getBaseURLWithProtocol()
 	data, err := json.Marshal(authenticateData{
-		RequestID:    req.RequestID,
-		Counter:      1,
-		Keys:         keys,
-		Challenge:    util.EncodeBase64(cached.Challenge.Challenge),
-		UserID:       cached.UserID,
-		AppID:        cached.AppID,
-		BaseURL:      base,
-		AppURL:       base,
-		AuthURL:      base + "/v1/auth/",
-		InfoURL:      base + "/v1/info/" + cached.AppID,
-		WaitURL:      base + "/v1/auth/wait",
-		ChallengeURL: base + "/v1/auth/challenge",
+		RequestID:          req.RequestID,
+		Counter:            1,
+		Keys:               keys,
+		Challenge:          util.EncodeBase64(cached.Challenge.Challenge),
+		UserID:             cached.UserID,
+		AppID:              cached.AppID,
+		BaseURL:            base,
+		AppURL:             base,
+		AuthURL:            base + "/v1/auth/",
+		InfoURL:            base + "/v1/info/" + cached.AppID,
+		WaitURL:            base + "/v1/auth/wait",
+		ChallengeURL:       base + "/v1/auth/challenge",
+		WebAuthnOptionsURL: base + "/v1/auth/webauthn/options",
+		WebAuthnURL:        base + "/v1/auth/webauthn",
 	})
 	util.OptionalInternalPanic(err, "Failed to render template")
 
@@ -276,20 +238,21 @@ func (ah *authHandler) Authenticate(w http.ResponseWriter, r *http.Request) {
 	err = decoder.Decode(&clientData)
 	util.OptionalBadRequestPanic(err, "Could not decode client data")
 
-	requestID, found := ah.challengeToRequestID.Get(clientData.Challenge)
-	if !found {
-		panic(util.BubbledError{
-			StatusCode: http.StatusForbidden,
-			Message:    "Challenge does not exist",
-		})
-	}
-
 	// Get authentication request
-	ar, err := ah.GetRequest(requestID.(string))
-	util.OptionalInternalPanic(err, "Failed to look up data for valid challenge")
+	ar := ah.requestForChallenge(clientData.Challenge)
+	defer ah.reportFailure(r, ar)
+	util.PanicIfFalse(ar.KeyHandle != "", http.StatusBadRequest,
+		"No key was chosen for this request")
 
 	storedKey, err := ah.s.kc.Get2FAKey(ar.KeyHandle)
 	util.OptionalInternalPanic(err, "Failed to look up stored key")
+	util.PanicIfFalse(storedKey.UserID == ar.UserID &&
+		storedKey.AppID == ar.AppID, http.StatusForbidden,
+		"Key does not belong to this user")
+	util.PanicIfFalse(!storedKey.IsWebAuthn(), http.StatusBadRequest,
+		"Key is a WebAuthn credential")
+	util.PanicIfFalse(storedKey.IsActive(), http.StatusForbidden,
+		"Key is not active")
 
 	var reg u2f.Registration
 	err = reg.UnmarshalBinary(storedKey.MarshalledRegistration)
@@ -300,60 +263,210 @@ func (ah *authHandler) Authenticate(w http.ResponseWriter, r *http.Request) {
 		SignatureData: successData.SignatureData,
 		ClientData:    successData.ClientData,
 	}
-	newCounter, err := reg.Authenticate(resp, *ar.Challenge, storedKey.Counter)
+	// The library compares counters before it checks the signature, so the
+	// counter is only compared once the response is known to be genuine
+	newCounter, err := reg.Authenticate(resp, *ar.Challenge, 0)
 	util.OptionalPanic(err, http.StatusBadRequest, "Authentication failed")
+	if counterRegressed(newCounter, storedKey.Counter) {
+		ah.reportClone(r, ar, storedKey)
+	}
 
-	tx := ah.s.DB.Begin()
+	ah.complete(w, r, ar, newCounter)
+}
 
-	// Store updated counter in the database.
-	err = tx.Model(&security.Key{}).Where(&security.Key{
-		UserID: ar.UserID,
-		ID:     ar.KeyHandle,
-	}).Update("counter", newCounter).Error
-	if err != nil {
-		tx.Rollback()
-		util.OptionalInternalPanic(err, "Failed to update counter")
-	}
+// WebAuthnOptions returns the options that the iFrame passes to
+// navigator.credentials.get() for a pending authentication request.
+// POST /v1/auth/webauthn/options
+func (ah *authHandler) WebAuthnOptions(w http.ResponseWriter,
+	r *http.Request) {
+	var req requestIDWrapper
+	err := json.NewDecoder(r.Body).Decode(&req)
+	util.OptionalBadRequestPanic(err, "Could not decode request body")
+
+	ar, err := ah.GetRequest(req.RequestID)
+	util.OptionalBadRequestPanic(err, "Could not find auth request with id "+
+		req.RequestID)
+
+	keys, err := ah.s.Store.GetKeys(ar.AppID, ar.UserID)
+	util.OptionalInternalPanic(err, "Could not load keys")
 
-	// Notify request listeners
-	defer func() {
-		if r := recover(); r != nil {
-			tx.Rollback()
-			ah.requests.Delete(requestID.(string))
+	allow := []webAuthnCredentialDescriptor{}
+	for _, k := range keys {
+		if !k.IsWebAuthn() || !k.IsActive() {
+			continue
 		}
-	}()
+		allow = append(allow, webAuthnCredentialDescriptor{
+			Type: "public-key",
+			ID:   k.ID,
+		})
+	}
+	util.PanicIfFalse(len(allow) > 0, http.StatusNotFound, "User has no "+
+		"active WebAuthn keys")
+
+	writeJSON(w, http.StatusOK, webAuthnRequestOptions{
+		Challenge:        util.EncodeBase64(ar.Challenge.Challenge),
+		RPID:             ah.s.Config.getRelyingPartyID(),
+		Timeout:          int64(ah.expiration / time.Millisecond),
+		AllowCredentials: allow,
+		UserVerification: "discouraged",
+	})
+}
 
-	util.PanicIfFalse(atomic.CompareAndSwapInt32(&ar.SettingResult, 0, 1),
-		http.StatusConflict, "Request already timed out")
+// AuthenticateWebAuthn performs authentication for a WebAuthn credential.
+// POST /v1/auth/webauthn
+func (ah *authHandler) AuthenticateWebAuthn(w http.ResponseWriter,
+	r *http.Request) {
+	req := webAuthnAuthenticateRequest{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	util.OptionalBadRequestPanic(err, "Could not decode JSON body")
 
-	ar.Status = http.StatusOK
-	ah.requests.Set(requestID.(string), ar, ah.rcTimeout)
-	close(ar.Closed)
+	clientDataJSON, err := util.DecodeBase64(req.ClientDataJSON)
+	util.OptionalBadRequestPanic(err, "Could not decode client data")
 
-	err = tx.Commit().Error
-	util.OptionalInternalPanic(err, "Could not commit transaction to database")
+	clientData, err := security.ParseClientData(clientDataJSON, "webauthn.get")
+	util.OptionalBadRequestPanic(err, "Invalid client data")
+	util.PanicIfFalse(clientData.Origin == ah.s.Config.getBaseURLWithProtocol(),
+		http.StatusForbidden, "Client data has the wrong origin")
+
+	ar := ah.requestForChallenge(clientData.Challenge)
+	defer ah.reportFailure(r, ar)
+
+	storedKey, err := ah.s.kc.Get2FAKey(req.ID)
+	util.OptionalBadRequestPanic(err, "Unknown credential")
+	util.PanicIfFalse(storedKey.IsWebAuthn() && storedKey.UserID == ar.UserID &&
+		storedKey.AppID == ar.AppID, http.StatusForbidden,
+		"Credential does not belong to this user")
+	util.PanicIfFalse(storedKey.IsActive(), http.StatusForbidden,
+		"Key is not active")
+
+	authData, err := util.DecodeBase64(req.AuthenticatorData)
+	util.OptionalBadRequestPanic(err, "Could not decode authenticator data")
+
+	sig, err := util.DecodeBase64(req.Signature)
+	util.OptionalBadRequestPanic(err, "Could not decode signature")
 
-	// If the authentication was for an admin, then look up the admin's app ID
-	// and log the event under that key
-	var appID string
-	if ar.AppID == "1" {
-		var a Admin
-		err = ah.s.DB.First(&a, Admin{
-			ID: ar.UserID,
-		}).Error
-		util.OptionalBadRequestPanic(err, "Could not find admin")
-
-		appID = a.AdminFor
-	} else {
-		appID = ar.AppID
+	ad, err := security.VerifyAssertion(storedKey.CredentialPublicKey,
+		ah.s.Config.getRelyingPartyIDHash(), authData, clientDataJSON, sig)
+	util.OptionalPanic(err, http.StatusBadRequest, "Authentication failed")
+
+	if counterRegressed(ad.Counter, storedKey.Counter) {
+		ah.reportClone(r, ar, storedKey)
 	}
 
+	ar.KeyHandle = storedKey.ID
+	ah.complete(w, r, ar, ad.Counter)
+}
+
+// requestForChallenge returns the pending authentication request that issued
+// `challenge`.
+func (ah *authHandler) requestForChallenge(
+	challenge string) *pendingRequest {
+	ar, err := ah.requests.GetByChallenge(challenge)
+	util.PanicIfFalse(err != errRequestNotFound, http.StatusForbidden,
+		"Challenge does not exist")
+	util.OptionalInternalPanic(err, "Failed to look up data for valid "+
+		"challenge")
+	return &ar
+}
+
+// complete stores the key's new counter and marks the authentication request
+// as successful, which wakes up its listener.
+func (ah *authHandler) complete(w http.ResponseWriter, r *http.Request,
+	ar *pendingRequest, newCounter uint32) {
+	timedOut := false
+	err := ah.s.Store.Transaction(func(st Store) error {
+		// Store updated counter in the database.
+		err := st.UpdateKeyCounter(ar.KeyHandle, ar.UserID, newCounter)
+		if err != nil {
+			return errors.Wrap(err, "Failed to update counter")
+		}
+
+		// Notify request listeners
+		set, err := ah.requests.Within(st).SetResult(ar.RequestID,
+			http.StatusOK, ah.rcTimeout)
+		if err != nil {
+			return err
+		} else if !set {
+			timedOut = true
+			return errors.New("Request already timed out")
+		}
+		return nil
+	})
+	if timedOut {
+		panic(util.BubbledError{
+			StatusCode: http.StatusConflict,
+			Message:    "Request already timed out",
+		})
+	}
+	util.OptionalInternalPanic(err, "Could not commit transaction to database")
+
+	// The cached copy of the key still has the old counter
+	ah.s.kc.Remove2FAKey(ar.KeyHandle)
+	ah.s.metrics.countResult(authenticationRequests, ar.AppID, resultSuccess)
+
 	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	appID := ah.s.keyAppID(ar.AppID, ar.UserID)
 	ah.s.disperser.addEvent(authentication, time.Now(), appID, "success",
 		ar.UserID, ar.OriginalIP, host)
 	writeJSON(w, http.StatusOK, "Authentication successful")
 }
 
+// reportFailure counts a failed authentication and emits an event for it if
+// the handler is panicking, then keeps panicking. It must be deferred.
+func (ah *authHandler) reportFailure(r *http.Request, ar *pendingRequest) {
+	if err := recover(); err != nil {
+		ah.s.metrics.countResult(authenticationRequests, ar.AppID,
+			resultFailure)
+
+		// Like keyAppID, but without panicking again
+		appID := ar.AppID
+		if appID == "1" {
+			if a, getErr := ah.s.Store.GetAdmin(ar.UserID); getErr == nil {
+				appID = a.AdminFor
+			}
+		}
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		ah.s.disperser.addEvent(authentication, time.Now(), appID, "failure",
+			ar.UserID, ar.OriginalIP, host)
+		panic(err)
+	}
+}
+
+// counterRegressed returns whether a verified signature counter failed to
+// increase past the stored one. Authenticators without a signature counter
+// always report zero.
+func counterRegressed(received, stored uint32) bool {
+	return received <= stored && !(received == 0 && stored == 0)
+}
+
+// reportClone handles a key whose signature counter did not increase. Since
+// that means that two authenticators may share the same private key, the key
+// is marked as suspect and, if the app asks for it, suspended. The
+// authentication fails either way.
+func (ah *authHandler) reportClone(r *http.Request, ar *pendingRequest,
+	k security.Key) {
+	app := ah.s.appForRequest(k.AppID)
+
+	now := time.Now()
+	status := "suspect"
+	if app.SuspendClonedKeys {
+		status = security.KeyStateSuspended
+	}
+	err := ah.s.Store.MarkKeySuspect(k.ID, now, app.SuspendClonedKeys)
+	util.OptionalInternalPanic(err, "Failed to mark key as suspect")
+	ah.s.kc.Remove2FAKey(k.ID)
+
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	appID := ah.s.keyAppID(ar.AppID, ar.UserID)
+	ah.s.disperser.addEvent(cloneDetected, now, appID, status, ar.UserID,
+		ar.OriginalIP, host)
+
+	panic(util.BubbledError{
+		StatusCode: http.StatusForbidden,
+		Message:    "Authentication failed: key may have been cloned",
+	})
+}
+
 // Wait allows the requester to check the result of the authentication. It
 // blocks until the authentication is complete.
 // POST /v1/auth/wait
@@ -363,30 +476,21 @@ func (ah *authHandler) Wait(w http.ResponseWriter, r *http.Request) {
 	err := decoder.Decode(&req)
 	util.OptionalBadRequestPanic(err, "Could not decode request body")
 
-	c, ar, err := ah.Listen(req.RequestID)
+	ctx, cancel := ah.s.waitContext(r)
+	defer cancel()
+	start := time.Now()
+	status, ar, err := ah.Listen(ctx, req.RequestID)
+	ah.s.panicIfStopping(w)
 	util.OptionalBadRequestPanic(err, "Could not listen for unknown request")
-
-	status := <-c
+	ah.s.metrics.observeWait(authenticationRequests, start, status,
+		status == http.StatusRequestTimeout)
 	if status == http.StatusOK && ar.AppID == "1" {
-		var a Admin
-		err = ah.s.DB.First(&a, Admin{
-			ID: ar.UserID,
-		}).Error
+		a, err := ah.s.Store.GetAdmin(ar.UserID)
 		util.OptionalBadRequestPanic(err, "Could not find admin with id "+ar.UserID)
 
-		encoded, err := ah.s.sc.Encode("admin-session", map[string]interface{}{
-			"set":   time.Now(),
-			"app":   a.AdminFor,
-			"admin": a.ID,
-		})
-
-		util.OptionalInternalPanic(err, "Could not set session cookie")
-
-		http.SetCookie(w, &http.Cookie{
-			Name:  "admin-session",
-			Value: encoded,
-			Path:  "/",
-		})
+		util.PanicIfFalse(a.Status == adminActive, http.StatusForbidden,
+			"Admin is not active")
+		ah.s.startSession(w, r, a)
 	}
 	writeJSON(w, status, ar.Nonce)
 }
@@ -398,16 +502,23 @@ func (ah *authHandler) SetKey(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	err := decoder.Decode(&req)
 	util.OptionalPanic(err, http.StatusBadRequest, "Could not decode request body")
+	util.PanicIfFalse(req.KeyHandle != "", http.StatusBadRequest,
+		"Key handle cannot be \"\"")
 
 	ar, err := ah.GetRequest(req.RequestID)
 	util.OptionalBadRequestPanic(err, "Could not find auth "+
 		"request with id "+req.RequestID)
 
-	ar.KeyHandle = req.KeyHandle
-	ah.requests.Set(req.RequestID, ar, ah.expiration)
-
 	stored, err := ah.s.kc.Get2FAKey(req.KeyHandle)
 	util.OptionalBadRequestPanic(err, "Failed to get stored key")
+	util.PanicIfFalse(stored.UserID == ar.UserID && stored.AppID == ar.AppID,
+		http.StatusForbidden, "Key does not belong to this user")
+	util.PanicIfFalse(stored.IsActive(), http.StatusForbidden,
+		"Key is not active")
+
+	ar.KeyHandle = req.KeyHandle
+	err = ah.requests.Put(*ar, ah.expiration)
+	util.OptionalInternalPanic(err, "Failed to save request")
 
 	writeJSON(w, http.StatusOK, setKeyReply{
 		KeyHandle: req.KeyHandle,
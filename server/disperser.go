@@ -6,9 +6,9 @@ import (
 	"time"
 
 	"sync"
+	"sync/atomic"
 
 	"github.com/gorilla/websocket"
-	maxminddb "github.com/oschwald/maxminddb-golang"
 	"github.com/pkg/errors"
 )
 
@@ -21,18 +21,77 @@ import (
 
 type disperser struct {
 	listenersLock sync.RWMutex
-	listeners     map[string]listener
+	listeners     map[*listener]struct{}
+
+	// Events waiting to be sent out by getMessages
+	incoming chan event
 
-	events     map[string][]event // keys are app IDs
 	recent     *ring.Ring
 	eventsLock sync.RWMutex
 
-	mmdb *maxminddb.Reader
+	geo GeoResolver
+
+	// Where every event is persisted
+	log eventLog
+
+	// Queues events for the webhooks of their apps; may be nil
+	webhooks *webhookDispatcher
+
+	// Assesses successful authentications for anomalies; may be nil
+	risk *riskEngine
+
+	// done is closed to stop getMessages, which closes stopped when it
+	// returns
+	done    chan struct{}
+	stopped chan struct{}
+
+	// When getMessages last woke up, in Unix nanoseconds. Used atomically.
+	lastTick int64
+
+	// Counts the goroutines that write to listeners
+	writers sync.WaitGroup
 }
 
+// Bounds of the disperser's queues
+const (
+	// Events that wait for getMessages. Events beyond it are persisted but
+	// not sent to listeners.
+	incomingQueueSize = 4096
+
+	// Events that wait to be written to a listener. A listener whose queue
+	// fills up is too slow and is disconnected.
+	listenerQueueSize = 256
+
+	// Events in one message to a listener
+	maxEventsPerMessage = 100
+
+	// Events that a resuming listener is sent from the event log
+	maxReplayedEvents = 1000
+
+	// Events returned by GET /admin/stats/recent
+	recentEvents = 10000
+)
+
+// How long a write to a listener may take before it is disconnected
+const listenerWriteWait = 10 * time.Second
+
+// listener receives events through a websocket or, if conn is nil, a
+// Server-Sent Events stream. Only its serve goroutine writes messages to
+// conn.
 type listener struct {
-	conn  *websocket.Conn
-	appID string // if 1, receives all events
+	conn *websocket.Conn
+
+	// Selects the events to send; its limit and bounds are ignored
+	filter eventQuery
+
+	// Events to send, oldest first
+	queue chan event
+
+	// Closed by disconnect; the close frame to send, if any, is set first
+	gone      chan struct{}
+	goneOnce  sync.Once
+	closeCode int
+	closeText string
 }
 
 type eventName int
@@ -42,6 +101,9 @@ const (
 	authentication
 	registration
 	keyDeletion
+	cloneDetected
+	keyStateChange
+	anomaly
 )
 
 var events = map[eventName]string{
@@ -49,66 +111,249 @@ var events = map[eventName]string{
 	authentication:     "authentication",
 	registration:       "registration",
 	keyDeletion:        "keyDeletion",
+	cloneDetected:      "cloneDetected",
+	keyStateChange:     "keyStateChange",
+	anomaly:            "anomaly",
 }
 
+// event is a security event. It is also the Gorm model of the event log.
 type event struct {
-	Name          string    `json:"name"`
+	ID            uint64    `json:"id" gorm:"primary_key"` // set by the eventLog
+	Name          string    `json:"name" gorm:"index"`
 	OriginalIP    string    `json:"originalIP"`
 	OriginalLat   float64   `json:"originalLat"`
 	OriginalLong  float64   `json:"originalLong"`
 	ResolvingIP   string    `json:"resolvingIP"`
 	ResolvingLat  float64   `json:"resolvingLat"`
 	ResolvingLong float64   `json:"resolvingLong"`
-	AppID         string    `json:"appID"`
-	Timestamp     time.Time `json:"when"`
-	Status        string    `json:"status"` // success, failure, or timeout
-	UserID        string    `json:"userID"`
+	AppID         string    `json:"appID" gorm:"index"`
+	Timestamp     time.Time `json:"when" gorm:"column:occurred_at;index"`
+	Status        string    `json:"status" gorm:"index"` // success, failure, timeout, suspect, or a key state
+	UserID        string    `json:"userID" gorm:"index"`
+
+	// Where the IP addresses are, if the GeoResolver knows
+	OriginalCountry  string `json:"originalCountry,omitempty"`
+	OriginalCity     string `json:"originalCity,omitempty"`
+	OriginalASN      uint   `json:"originalASN,omitempty"`
+	ResolvingCountry string `json:"resolvingCountry,omitempty"`
+	ResolvingCity    string `json:"resolvingCity,omitempty"`
+	ResolvingASN     uint   `json:"resolvingASN,omitempty"`
+
+	// For anomalies, the risk score out of 100, the comma-separated reasons
+	// for it, and the ID of the authentication that was assessed
+	RiskScore   int    `json:"riskScore,omitempty"`
+	RiskReasons string `json:"riskReasons,omitempty"`
+	CauseID     uint64 `json:"causeID,omitempty"`
 }
 
-type eventsMap map[string][]event
+func (event) TableName() string { return "events" }
 
-// Lists the events that happened over the previous 100 ms
+// A message with events, oldest first. Clients that reconnect pass the ID of
+// the last event they received, so that they are sent the events they missed.
 type eventsList struct {
 	Type   string  `json:"__type__"` // type of message
 	Events []event `json:"events"`
 }
 
-func newDisperser(f string) (*disperser, error) {
-	mmdb, err := maxminddb.Open(f)
-	if err != nil {
-		return nil, errors.Wrap(err, "Could not open maxmind DB")
-	}
-
+// startDisperser returns a running disperser that locates IP addresses with
+// `geo` and, unless `risk` is nil, looks for anomalies with it.
+func startDisperser(geo GeoResolver, log eventLog,
+	webhooks *webhookDispatcher, risk *riskEngine) *disperser {
 	d := &disperser{
 		sync.RWMutex{},
-		make(map[string]listener),
-		make(eventsMap),
-		ring.New(10000),
+		make(map[*listener]struct{}),
+		make(chan event, incomingQueueSize),
+		ring.New(recentEvents),
 		sync.RWMutex{},
-		mmdb,
+		geo,
+		log,
+		webhooks,
+		risk,
+		make(chan struct{}),
+		make(chan struct{}),
+		time.Now().UnixNano(),
+		sync.WaitGroup{},
 	}
 
 	go d.getMessages()
 
-	return d, nil
+	return d
+}
+
+// addListener starts sending the events of app `appID`, or every event if
+// it is 1, to `conn`. If `after` is not 0, the listener is first sent the
+// events after it from the event log, at most the latest maxReplayedEvents.
+func (d *disperser) addListener(conn *websocket.Conn, appID string,
+	after uint64) {
+	filter := eventQuery{AppID: appID}
+	if appID == "1" {
+		filter.AppID = ""
+	}
+	l := d.subscribe(filter)
+	if l == nil {
+		conn.Close()
+		return
+	}
+	l.conn = conn
+
+	go l.readUntilClosed()
+	go d.serve(l, after)
+}
+
+// subscribe returns a new listener that is queued the events that match
+// `filter`, or nil if the disperser was stopped. The listener must be
+// unsubscribed once it is disconnected.
+func (d *disperser) subscribe(filter eventQuery) *listener {
+	l := &listener{
+		filter: filter,
+		queue:  make(chan event, listenerQueueSize),
+		gone:   make(chan struct{}),
+	}
+
+	d.listenersLock.Lock()
+	defer d.listenersLock.Unlock()
+	select {
+	case <-d.done:
+		return nil
+	default:
+	}
+	d.listeners[l] = struct{}{}
+	d.writers.Add(1)
+	return l
 }
 
-func (d *disperser) addListener(l listener) {
+func (d *disperser) unsubscribe(l *listener) {
 	d.listenersLock.Lock()
+	delete(d.listeners, l)
+	d.listenersLock.Unlock()
+	d.writers.Done()
+}
+
+// missed returns the events after `after` that the listener receives, oldest
+// first, at most the latest maxReplayedEvents. A listener that is subscribed
+// before it reads them misses no event, but may be queued some of them too.
+func (d *disperser) missed(l *listener, after uint64) ([]event, error) {
+	q := l.filter
+	q.After = after
+	q.Limit = maxReplayedEvents
+	found, err := d.log.Query(q)
+	for i, j := 0, len(found)-1; i < j; i, j = i+1, j-1 {
+		found[i], found[j] = found[j], found[i]
+	}
+	return found, err
+}
+
+// disconnect makes serve send a close frame with `code` and `text`, unless
+// code is 0, and close the connection. It does not block.
+func (l *listener) disconnect(code int, text string) {
+	l.goneOnce.Do(func() {
+		l.closeCode = code
+		l.closeText = text
+		close(l.gone)
+	})
+}
+
+// readUntilClosed reads from the websocket, which handles control frames,
+// until the client goes away.
+func (l *listener) readUntilClosed() {
+	for {
+		if _, _, err := l.conn.NextReader(); err != nil {
+			l.disconnect(0, "")
+			return
+		}
+	}
+}
+
+func (l *listener) write(v interface{}) error {
+	l.conn.SetWriteDeadline(time.Now().Add(listenerWriteWait))
+	return l.conn.WriteJSON(v)
+}
+
+// serve writes the listener's events to it until it is disconnected, or a
+// write fails or takes longer than listenerWriteWait.
+func (d *disperser) serve(l *listener, after uint64) {
+	defer d.unsubscribe(l)
+
+	// Closing the connection also ends a write that is blocked on a slow
+	// client
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		<-l.gone
+		if l.closeCode != 0 {
+			l.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(l.closeCode, l.closeText),
+				time.Now().Add(time.Second))
+		}
+		l.conn.Close()
+	}()
+	defer func() {
+		l.disconnect(0, "")
+		<-closed
+	}()
 
 	toSend := map[string]eventName{}
 	for short, long := range events {
 		toSend[long] = short
 	}
-	l.conn.WriteJSON(toSend)
-	d.listeners[l.conn.LocalAddr().String()] = l
-	origHandler := l.conn.CloseHandler()
-	l.conn.SetCloseHandler(func(code int, text string) error {
-		delete(d.listeners, l.conn.LocalAddr().String())
-		return origHandler(code, text)
-	})
+	if err := l.write(toSend); err != nil {
+		return
+	}
 
-	d.listenersLock.Unlock()
+	// Events that are both missed and queued are only sent once
+	lastID := after
+	if after > 0 {
+		missed, err := d.missed(l, after)
+		if err != nil {
+			logger.WithError(err).Error("Could not read missed events")
+		}
+		for len(missed) > 0 {
+			n := len(missed)
+			if n > maxEventsPerMessage {
+				n = maxEventsPerMessage
+			}
+			if err = l.write(eventsList{"List", missed[:n]}); err != nil {
+				return
+			}
+			lastID = missed[n-1].ID
+			missed = missed[n:]
+		}
+	}
+
+	for {
+		var e event
+		select {
+		case <-l.gone:
+			return
+		case e = <-l.queue:
+		}
+
+		// Send what is queued in one message
+		batch := make([]event, 0, 1)
+	drain:
+		for {
+			if e.ID == 0 || e.ID > lastID {
+				batch = append(batch, e)
+				if e.ID > lastID {
+					lastID = e.ID
+				}
+			}
+			if len(batch) == maxEventsPerMessage {
+				break
+			}
+			select {
+			case e = <-l.queue:
+			default:
+				break drain
+			}
+		}
+		if len(batch) == 0 {
+			continue
+		}
+		if err := l.write(eventsList{"List", batch}); err != nil {
+			return
+		}
+	}
 }
 
 func (d *disperser) addEvent(n eventName, t time.Time, aID, s, uID,
@@ -125,103 +370,156 @@ func (d *disperser) addEvent(n eventName, t time.Time, aID, s, uID,
 		UserID:    uID,
 	}
 
-	if net.ParseIP(oIP) != nil {
-		var oRec struct {
-			Location struct {
-				AccuracyRadius uint16  `maxminddb:"accuracy_radius"`
-				Latitude       float64 `maxminddb:"latitude"`
-				Longitude      float64 `maxminddb:"longitude"`
-				MetroCode      uint    `maxminddb:"metro_code"`
-				TimeZone       string  `maxminddb:"time_zone"`
-			} `maxminddb:"location"`
-		}
-		err := d.mmdb.Lookup(net.ParseIP(oIP), &oRec)
-		if err != nil {
-			return err
-		}
-
+	if ip := net.ParseIP(oIP); ip != nil {
 		e.OriginalIP = oIP
-		e.OriginalLat = oRec.Location.Latitude
-		e.OriginalLong = oRec.Location.Longitude
-	}
-
-	if net.ParseIP(rIP) != nil {
-		var rRec struct {
-			Location struct {
-				AccuracyRadius uint16  `maxminddb:"accuracy_radius"`
-				Latitude       float64 `maxminddb:"latitude"`
-				Longitude      float64 `maxminddb:"longitude"`
-				MetroCode      uint    `maxminddb:"metro_code"`
-				TimeZone       string  `maxminddb:"time_zone"`
-			} `maxminddb:"location"`
-		}
-		err := d.mmdb.Lookup(net.ParseIP(rIP), &rRec)
-		if err != nil {
-			return err
-		}
+		loc := d.locate(ip)
+		e.OriginalLat, e.OriginalLong = loc.Lat, loc.Long
+		e.OriginalCountry, e.OriginalCity = loc.Country, loc.City
+		e.OriginalASN = loc.ASN
+	}
 
+	if ip := net.ParseIP(rIP); ip != nil {
 		e.ResolvingIP = rIP
-		e.ResolvingLat = rRec.Location.Latitude
-		e.ResolvingLong = rRec.Location.Longitude
+		loc := d.locate(ip)
+		e.ResolvingLat, e.ResolvingLong = loc.Lat, loc.Long
+		e.ResolvingCountry, e.ResolvingCity = loc.Country, loc.City
+		e.ResolvingASN = loc.ASN
 	}
 
-	go func() {
-		d.eventsLock.Lock()
-		d.events[e.AppID] = append(d.events[e.AppID], e)
+	d.record(e)
+	return nil
+}
 
-		// Add event to the global events list if it not done above
-		if e.AppID != "1" {
-			d.events["1"] = append(d.events[e.AppID], e)
+// record persists `e`, queues it for webhooks and listeners and, if it is a
+// successful authentication that looks risky, records an anomaly after it.
+func (d *disperser) record(e event) {
+	if err := d.log.Append(&e); err != nil {
+		logger.WithError(err).WithField("event", e.Name).Error(
+			"Could not persist event")
+	}
+	if d.webhooks != nil {
+		if err := d.webhooks.enqueue(e); err != nil {
+			logger.WithError(err).WithField("event", e.Name).Error(
+				"Could not queue event for webhooks")
 		}
+	}
 
-		// If the recent list is full, overwrite the oldest event
-		d.recent.Value = e
-		d.recent = d.recent.Next()
-		d.eventsLock.Unlock()
-	}()
+	select {
+	case d.incoming <- e:
+	default:
+		logger.WithField("event", e.Name).Warn(
+			"Disperser is behind; event is not sent to listeners")
+	}
 
-	return nil
+	if d.risk == nil {
+		return
+	}
+	a, err := d.risk.assess(e)
+	if err != nil {
+		logger.WithError(err).WithField("event", e.ID).Error(
+			"Could not assess the risk of event")
+	} else if a != nil {
+		d.record(*a)
+	}
 }
 
-// Every second, aggregates all the events for the last second. Sends the
-// results out to the clients.
-func (d *disperser) getMessages() {
-	defer func() {
-		err := d.mmdb.Close()
-		if err != nil {
-			panic(errors.Wrap(err, "Could not close MaxMind DB"))
-		}
-	}()
-
-	for true {
-		time.Sleep(100 * time.Millisecond)
+// locate returns what the GeoResolver knows about `ip`. Events are recorded
+// without a location if it fails.
+func (d *disperser) locate(ip net.IP) GeoLocation {
+	loc, _, err := d.geo.Lookup(ip)
+	if err != nil {
+		logger.WithError(err).WithField("ip", ip.String()).Warn(
+			"Could not locate address")
+	}
+	return loc
+}
 
-		// Copy current events
-		eventsCopy := make(map[string][]event)
-		d.eventsLock.RLock()
-		for k, v := range d.events {
-			eventsCopy[k] = v
+// getMessages sends new events to the listeners that receive them. Listeners
+// whose queue is full are disconnected, so that they cannot hold up the
+// others or make the disperser buffer without bounds. Returns once the
+// disperser is closed.
+func (d *disperser) getMessages() {
+	defer close(d.stopped)
+
+	// Wakes up even without events, for checkRunning
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		atomic.StoreInt64(&d.lastTick, time.Now().UnixNano())
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+		case e := <-d.incoming:
+			d.dispatch(e)
 		}
-		d.eventsLock.RUnlock()
+	}
+}
 
-		// Copy current listeners
-		listenersCopy := make(map[string]listener)
-		d.listenersLock.RLock()
-		for k, v := range d.listeners {
-			listenersCopy[k] = v
+func (d *disperser) dispatch(e event) {
+	// If the recent list is full, overwrite the oldest event
+	d.eventsLock.Lock()
+	d.recent.Value = e
+	d.recent = d.recent.Next()
+	d.eventsLock.Unlock()
+
+	d.listenersLock.RLock()
+	defer d.listenersLock.RUnlock()
+	for l := range d.listeners {
+		if !l.filter.matches(e) {
+			continue
 		}
-		d.listenersLock.RUnlock()
-
-		// Send events to listeners
-		for _, l := range listenersCopy {
-			l.conn.WriteJSON(eventsList{
-				Type:   "List",
-				Events: eventsCopy[l.appID],
-			})
+		select {
+		case l.queue <- e:
+		default:
+			l.disconnect(websocket.CloseTryAgainLater,
+				"Listener is too slow")
 		}
 	}
 }
 
+// close stops the disperser and closes its GeoResolver.
+func (d *disperser) close() error {
+	d.stop()
+	return d.geo.Close()
+}
+
+// stop stops sending events, tells the listeners that the server is going
+// away and closes their websockets.
+func (d *disperser) stop() {
+	close(d.done)
+	<-d.stopped
+
+	d.listenersLock.RLock()
+	for l := range d.listeners {
+		l.disconnect(websocket.CloseGoingAway, "Server is shutting down")
+	}
+	d.listenersLock.RUnlock()
+	d.writers.Wait()
+}
+
+// checkRunning returns an error unless getMessages is running and has woken
+// up within the last `stall`.
+func (d *disperser) checkRunning(stall time.Duration) error {
+	select {
+	case <-d.stopped:
+		return errors.New("Disperser was stopped")
+	default:
+	}
+	last := time.Unix(0, atomic.LoadInt64(&d.lastTick))
+	if since := time.Since(last); since > stall {
+		return errors.Errorf("Disperser has not run for %s", since)
+	}
+	return nil
+}
+
+// listenerCount returns the number of connected websocket listeners.
+func (d *disperser) listenerCount() int {
+	d.listenersLock.RLock()
+	defer d.listenersLock.RUnlock()
+	return len(d.listeners)
+}
+
 func (d *disperser) getRecent() []event {
 	var out []event
 	d.eventsLock.RLock()
@@ -0,0 +1,270 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"bufio"
+	"container/ring"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+// testDisperser returns a disperser that does not locate addresses, and the
+// URL of a websocket server that adds its clients as listeners. The query
+// parameters appID and after are passed to addListener.
+func testDisperser(t testing.TB) (*disperser, string) {
+	d := startDisperser(noopResolver{}, &memoryEventLog{}, nil, nil)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		after, _ := strconv.ParseUint(r.URL.Query().Get("after"), 10, 64)
+		d.addListener(conn, r.URL.Query().Get("appID"), after)
+	}))
+	t.Cleanup(func() {
+		d.stop()
+		srv.Close()
+	})
+	return d, "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// dialListener connects a listener and reads the map of event names.
+func dialListener(t testing.TB, url string) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	var names map[string]eventName
+	if err = conn.ReadJSON(&names); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// readEvents reads messages until it has read `n` events.
+func readEvents(t *testing.T, conn *websocket.Conn, n int) []event {
+	var read []event
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(read) < n {
+		var msg eventsList
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("Read %d events: %v", len(read), err)
+		}
+		read = append(read, msg.Events...)
+	}
+	return read
+}
+
+// waitForListeners waits until `d` has `n` listeners.
+func waitForListeners(t testing.TB, d *disperser, n int) {
+	for start := time.Now(); d.listenerCount() != n; {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("Disperser has %d listeners, expected %d",
+				d.listenerCount(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDisperserSendsOnlyNewEvents(t *testing.T) {
+	d, url := testDisperser(t)
+	conn := dialListener(t, url+"?appID=a")
+	waitForListeners(t, d, 1)
+
+	for _, appID := range []string{"a", "b", "a"} {
+		d.addEvent(registration, time.Now(), appID, "success", "u", "", "")
+	}
+	first := readEvents(t, conn, 2)
+	if len(first) != 2 || first[0].AppID != "a" || first[1].AppID != "a" ||
+		first[0].ID >= first[1].ID {
+		t.Fatalf("Listener received %+v", first)
+	}
+
+	d.addEvent(keyDeletion, time.Now(), "a", "success", "u", "", "")
+	next := readEvents(t, conn, 1)
+	if len(next) != 1 || next[0].Name != "keyDeletion" {
+		t.Errorf("Listener received %+v after a new event", next)
+	}
+
+	// A listener that reconnects gets the events that it missed, then new
+	// ones
+	resumed := dialListener(t, url+"?appID=a&after="+
+		strconv.FormatUint(first[0].ID, 10))
+	waitForListeners(t, d, 2)
+	d.addEvent(keyStateChange, time.Now(), "a", "suspended", "u", "", "")
+	got := eventIDs(readEvents(t, resumed, 3))
+	expected := []uint64{first[1].ID, next[0].ID, next[0].ID + 1}
+	if !equalIDs(got, expected) {
+		t.Errorf("Resumed listener received %v, expected %v", got, expected)
+	}
+}
+
+func TestDisperserDisconnectsSlowListeners(t *testing.T) {
+	d := &disperser{listeners: make(map[*listener]struct{}),
+		recent: ring.New(recentEvents)}
+	slow := &listener{queue: make(chan event, 2), gone: make(chan struct{})}
+	other := &listener{filter: eventQuery{AppID: "b"},
+		queue: make(chan event, 2), gone: make(chan struct{})}
+	d.listeners[slow] = struct{}{}
+	d.listeners[other] = struct{}{}
+
+	for i := 0; i < 3; i++ {
+		d.dispatch(event{ID: uint64(i + 1), AppID: "a"})
+	}
+	select {
+	case <-slow.gone:
+		if slow.closeCode != websocket.CloseTryAgainLater {
+			t.Errorf("Slow listener was closed with %d", slow.closeCode)
+		}
+	default:
+		t.Error("Slow listener was not disconnected")
+	}
+	select {
+	case <-other.gone:
+		t.Error("Listener of another app was disconnected")
+	default:
+	}
+	if len(d.getRecent()) != 3 {
+		t.Errorf("Recent events were %v", d.getRecent())
+	}
+}
+
+// waitForQueues waits until the disperser has caught up with its events, and
+// the listeners that are still connected with theirs.
+func waitForQueues(d *disperser) {
+	for {
+		behind := len(d.incoming) > 0
+		d.listenersLock.RLock()
+		for l := range d.listeners {
+			select {
+			case <-l.gone:
+			default:
+				behind = behind || len(l.queue) > listenerQueueSize/2
+			}
+		}
+		d.listenersLock.RUnlock()
+		if !behind {
+			return
+		}
+		time.Sleep(10 * time.Microsecond)
+	}
+}
+
+// BenchmarkDisperserFanOut sends b.N events, as fast as the listeners read
+// them, to fast listeners while a listener that never reads is connected.
+// The slow listener is disconnected, and the heap after the benchmark stays
+// the same however large b.N is, e.g. with -benchtime 100000x and 1000000x.
+func BenchmarkDisperserFanOut(b *testing.B) {
+	captureLog(b, logrus.ErrorLevel)
+	d, url := testDisperser(b)
+
+	const fast = 8
+	done := make(chan struct{})
+	for i := 0; i < fast; i++ {
+		conn := dialListener(b, url+"?appID=1")
+		go func() {
+			for {
+				if _, _, err := conn.NextReader(); err != nil {
+					return
+				}
+				select {
+				case <-done:
+					return
+				default:
+				}
+			}
+		}()
+	}
+	dialListener(b, url+"?appID=1")
+	waitForListeners(b, d, fast+1)
+
+	runtime.GC()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d.addEvent(authentication, time.Now(), "a", "success", "u", "", "")
+		if i%(listenerQueueSize/4) == 0 {
+			waitForQueues(d)
+		}
+	}
+	waitForQueues(d)
+	b.StopTimer()
+	close(done)
+
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	b.ReportMetric(float64(stats.HeapInuse), "heap-bytes")
+	b.ReportMetric(float64(d.listenerCount()), "listeners")
+}
+
+func TestEventStreamResumesAndFilters(t *testing.T) {
+	d, _ := testDisperser(t)
+	s := &Server{disperser: d, lc: newLifecycle(&Config{})}
+	ah := adminHandler{s}
+	srv := httptest.NewServer(s.recoverWrap(http.HandlerFunc(func(
+		w http.ResponseWriter, r *http.Request) {
+		as := adminSession{Admin: Admin{Role: roleAdmin, AdminFor: "a"}}
+		ah.StreamEvents(w, r.WithContext(context.WithValue(r.Context(),
+			adminSessionKey{}, as)))
+	})))
+	defer srv.Close()
+	defer s.stop()
+
+	resp, err := http.Get(srv.URL + "?appID=b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Streaming another app's events answered %d",
+			resp.StatusCode)
+	}
+
+	d.addEvent(registration, time.Now(), "a", "success", "u", "", "")
+	d.addEvent(authentication, time.Now(), "a", "success", "u", "", "")
+	d.addEvent(authentication, time.Now(), "b", "success", "u", "", "")
+
+	req, _ := http.NewRequest("GET", srv.URL+"?type=authentication", nil)
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Stream had content type %s", ct)
+	}
+	waitForListeners(t, d, 1)
+	d.addEvent(registration, time.Now(), "a", "success", "u", "", "")
+	d.addEvent(authentication, time.Now(), "a", "failure", "u", "", "")
+
+	// Reads the IDs and types of the first two messages
+	var got []string
+	lines := bufio.NewScanner(resp.Body)
+	for len(got) < 4 && lines.Scan() {
+		line := lines.Text()
+		if strings.HasPrefix(line, "id: ") ||
+			strings.HasPrefix(line, "event: ") {
+			got = append(got, line)
+		}
+	}
+	expected := []string{"id: 2", "event: authentication", "id: 5",
+		"event: authentication"}
+	if strings.Join(got, ",") != strings.Join(expected, ",") {
+		t.Errorf("Stream sent %v, expected %v", got, expected)
+	}
+}
@@ -0,0 +1,329 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tera-insights/2Q2R-enterprise/security"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// dataKey is the Gorm model for a data key that encrypts sensitive columns.
+// It is stored wrapped by the master key with ID MasterKeyID. SealsAll is set
+// once every sensitive value is encrypted and bound to its field, after which
+// plaintext and unbound values are rejected.
+type dataKey struct {
+	ID          string
+	WrappedKey  []byte
+	MasterKeyID string
+	SealsAll    bool
+	CreatedAt   time.Time
+}
+
+// The fields of the encrypted columns, which encrypted values are bound to
+// so that they cannot be moved to other rows or columns.
+func keyField(column, id string) security.Field {
+	return security.Field{Table: "keys", Column: column, Row: id}
+}
+
+func serverField(column, id string) security.Field {
+	return security.Field{Table: "app_server_infos", Column: column, Row: id}
+}
+
+func signingKeyField(column, id string) security.Field {
+	return security.Field{Table: "signing_keys", Column: column, Row: id}
+}
+
+func webhookField(column, id string) security.Field {
+	return security.Field{Table: "webhooks", Column: column, Row: id}
+}
+
+// hasSensitiveValues returns whether the database has any rows with columns
+// that are encrypted.
+func hasSensitiveValues(db *gorm.DB) (bool, error) {
+	for _, model := range []interface{}{&security.Key{}, &AppServerInfo{},
+		&security.SigningKey{}, &Webhook{}} {
+		var count int
+		if err := db.Model(model).Count(&count).Error; err != nil {
+			return false, errors.Wrap(err, "Could not count sensitive rows")
+		}
+		if count > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// parseMasterKey decodes a standard base-64 encoded 32-byte master key.
+func parseMasterKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, errors.Wrap(err, "Master key is not standard base-64")
+	}
+	if len(key) != 32 {
+		return nil, errors.Errorf("Master key has %d bytes, expected 32",
+			len(key))
+	}
+	return key, nil
+}
+
+// ReadMasterKeyFile reads a master key from a file.
+func ReadMasterKeyFile(path string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not read master key file %s",
+			path)
+	}
+	return parseMasterKey(string(contents))
+}
+
+// loadMasterKey reads the master key from Config.MasterKeyFile or, if that is
+// not set, from the environment variable named by Config.MasterKeyEnv. It
+// returns nil if there is no master key.
+func loadMasterKey(c *Config) ([]byte, error) {
+	if c.MasterKeyFile != "" {
+		return ReadMasterKeyFile(c.MasterKeyFile)
+	}
+	if c.MasterKeyEnv == "" {
+		return nil, nil
+	}
+	if encoded := os.Getenv(c.MasterKeyEnv); encoded != "" {
+		key, err := parseMasterKey(encoded)
+		return key, errors.Wrapf(err, "Invalid master key in $%s",
+			c.MasterKeyEnv)
+	}
+	return nil, nil
+}
+
+// newDataKey generates a data key and wraps it with `master`.
+func newDataKey(master []byte) (dataKey, []byte, error) {
+	key, err := security.GenerateDataKey()
+	if err != nil {
+		return dataKey{}, nil, err
+	}
+	wrapped, err := security.WrapKey(master, key)
+	if err != nil {
+		return dataKey{}, nil, err
+	}
+	return dataKey{
+		ID:          security.KeyID(key),
+		WrappedKey:  wrapped,
+		MasterKeyID: security.KeyID(master),
+	}, key, nil
+}
+
+// unwrapDataKeys adds the data keys in the database to `env`, unwrapping each
+// with whichever of `masters` wrapped it.
+func unwrapDataKeys(db *gorm.DB, env *security.Envelope,
+	masters ...[]byte) error {
+	var keys []dataKey
+	if err := db.Order("created_at").Find(&keys).Error; err != nil {
+		return errors.Wrap(err, "Could not load data keys")
+	}
+
+	for i, dk := range keys {
+		var master []byte
+		for _, m := range masters {
+			if m != nil && security.KeyID(m) == dk.MasterKeyID {
+				master = m
+			}
+		}
+		if master == nil {
+			return errors.Errorf("Data key %s is wrapped by master key %s, "+
+				"which is not configured. Use cmd/reencrypt to rotate the "+
+				"master key", dk.ID, dk.MasterKeyID)
+		}
+		key, err := security.UnwrapKey(master, dk.WrappedKey)
+		if err != nil {
+			return errors.Wrapf(err, "Could not unwrap data key %s", dk.ID)
+		}
+		if err = env.AddKey(key, i == len(keys)-1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadEnvelope unwraps the data keys in the database with the master key,
+// creating the first data key if there is none. Without a master key, it
+// returns a nil envelope, which stores plaintext. A database that is
+// encrypted from the start rejects plaintext values right away; otherwise,
+// that only starts after Reencrypt has sealed the existing values.
+func loadEnvelope(db *gorm.DB, master []byte) (*security.Envelope, error) {
+	var count int
+	if err := db.Model(&dataKey{}).Count(&count).Error; err != nil {
+		return nil, errors.Wrap(err, "Could not count data keys")
+	}
+	if master == nil {
+		if count > 0 {
+			return nil, errors.New("The database is encrypted, but no " +
+				"master key is configured")
+		}
+		logger.Warn("No master key is configured! Key registrations and " +
+			"signing keys are stored in plaintext")
+		return nil, nil
+	}
+
+	if count == 0 {
+		dk, _, err := newDataKey(master)
+		if err != nil {
+			return nil, err
+		}
+		sensitive, err := hasSensitiveValues(db)
+		if err != nil {
+			return nil, err
+		}
+		dk.SealsAll = !sensitive
+		if err = db.Create(&dk).Error; err != nil {
+			return nil, errors.Wrap(err, "Could not save data key")
+		}
+	}
+	env := security.NewEnvelope()
+	if err := unwrapDataKeys(db, env, master); err != nil {
+		return nil, err
+	}
+	err := db.Model(&dataKey{}).Where("seals_all = ?", true).Count(&count).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not count data keys")
+	}
+	if count > 0 {
+		env.RejectUnbound()
+	}
+	return env, nil
+}
+
+// Reencrypt encrypts every sensitive column with a new data key, wrapped by
+// the configured master key, and deletes the old data keys. Values that were
+// stored in plaintext, or before values were bound to their field, are
+// encrypted as well, after which the server rejects such values. To rotate the master key,
+// configure the new one and pass the old one as `oldMaster`, which is only
+// needed while data keys are wrapped by it. No server should be running on
+// the database, as servers load the data keys when they start. Reencrypt
+// returns the number of records that it re-encrypted.
+func Reencrypt(c *Config, oldMaster []byte) (int, error) {
+	master, err := loadMasterKey(c)
+	if err != nil {
+		return 0, err
+	}
+	if master == nil {
+		return 0, errors.New("No master key is configured")
+	}
+
+	db, err := gorm.Open(c.DatabaseType, c.DatabaseName)
+	if err != nil {
+		return 0, errors.Wrap(err, "Could not open database")
+	}
+	defer db.Close()
+	if err = checkSchemaVersion(db); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	err = db.Transaction(func(tx *gorm.DB) error {
+		old := security.NewEnvelope()
+		if err := unwrapDataKeys(tx, old, master, oldMaster); err != nil {
+			return err
+		}
+		dk, key, err := newDataKey(master)
+		if err != nil {
+			return err
+		}
+		dk.SealsAll = true
+		fresh := security.NewEnvelope()
+		if err = fresh.AddKey(key, true); err != nil {
+			return err
+		}
+
+		reader := &gormStore{tx, old}
+		writer := &gormStore{tx, fresh}
+		keys, err := reader.GetKeys("", "")
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err = writer.sealKey(&k); err != nil {
+				return err
+			}
+			err = writer.updateKey(k.ID, map[string]interface{}{
+				gorm.ToDBName("MarshalledRegistration"): k.MarshalledRegistration,
+				gorm.ToDBName("CredentialPublicKey"):    k.CredentialPublicKey,
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+		count += len(keys)
+
+		servers, err := reader.GetServers("")
+		if err != nil {
+			return err
+		}
+		for _, info := range servers {
+			if err = writer.sealServer(&info); err != nil {
+				return err
+			}
+			err = tx.Model(&AppServerInfo{}).Where(&AppServerInfo{
+				ID: info.ID,
+			}).Update(gorm.ToDBName("PublicKey"), info.PublicKey).Error
+			if err != nil {
+				return err
+			}
+		}
+		count += len(servers)
+
+		signingKeys, err := reader.GetSigningKeys()
+		if err != nil {
+			return err
+		}
+		for _, sk := range signingKeys {
+			if err = writer.sealSigningKey(&sk); err != nil {
+				return err
+			}
+			err = tx.Model(&security.SigningKey{}).Where(&security.SigningKey{
+				ID: sk.ID,
+			}).Updates(map[string]interface{}{
+				gorm.ToDBName("IV"):        sk.IV,
+				gorm.ToDBName("Salt"):      sk.Salt,
+				gorm.ToDBName("PublicKey"): sk.PublicKey,
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+		count += len(signingKeys)
+
+		webhooks, err := (&dbWebhookStore{tx, old}).allWebhooks()
+		if err != nil {
+			return err
+		}
+		for _, h := range webhooks {
+			secret, err := fresh.EncryptString(h.Secret,
+				webhookField("secret", h.ID))
+			if err != nil {
+				return err
+			}
+			err = tx.Model(&Webhook{}).Where("id = ?", h.ID).Update(
+				gorm.ToDBName("Secret"), secret).Error
+			if err != nil {
+				return err
+			}
+		}
+		count += len(webhooks)
+
+		if err = tx.Delete(dataKey{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&dk).Error
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "Could not re-encrypt database")
+	}
+	return count, nil
+}
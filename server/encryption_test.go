@@ -0,0 +1,230 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/tera-insights/2Q2R-enterprise/security"
+)
+
+func writeMasterKey(t *testing.T, fill byte) (string, []byte) {
+	key := bytes.Repeat([]byte{fill}, 32)
+	path := filepath.Join(t.TempDir(), "master.key")
+	err := ioutil.WriteFile(path,
+		[]byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, key
+}
+
+func TestStoreEncryptsAtRest(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.db")
+	conn := openTestDatabase(t, "sqlite3", name)
+	if err := NewMigrator(conn).Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stored before a master key was configured
+	registration := []byte{5, 4, 1, 2, 3}
+	plain := &gormStore{conn, nil}
+	if err := plain.CreateKey(security.Key{
+		ID:                     "old",
+		MarshalledRegistration: registration,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	oldPath, oldMaster := writeMasterKey(t, 1)
+	st, err := openGormStore("sqlite3", name, 1, oldMaster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.db.Close()
+	if err = st.CreateKey(security.Key{
+		ID:                     "new",
+		MarshalledRegistration: registration,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err = st.CreateSigningKey(security.SigningKey{
+		ID:        "signing",
+		IV:        "iv",
+		Salt:      "salt",
+		PublicKey: "public",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err = newWebhookStore(st).CreateWebhook(Webhook{
+		ID:     "hook",
+		AppID:  "app",
+		URL:    "https://hooks.example.com",
+		Secret: "webhook secret",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var raw security.Key
+	if err = conn.First(&raw, &security.Key{ID: "new"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !security.IsEncrypted(raw.MarshalledRegistration) {
+		t.Error("Key registration was stored in plaintext")
+	}
+	kc := security.NewKeyCache(0, 0, nil, st, nil)
+	for _, id := range []string{"old", "new"} {
+		k, err := kc.Get2FAKey(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(k.MarshalledRegistration, registration) {
+			t.Errorf("Key %s had registration %v", id, k.MarshalledRegistration)
+		}
+	}
+
+	if _, err := openGormStore("sqlite3", name, 1, nil); err == nil {
+		t.Error("Opened an encrypted database without a master key")
+	}
+	newPath, newMaster := writeMasterKey(t, 2)
+	if _, err := openGormStore("sqlite3", name, 1, newMaster); err == nil {
+		t.Error("Opened a database with the wrong master key")
+	}
+
+	// Rotate the master key
+	c := &Config{DatabaseType: "sqlite3", DatabaseName: name,
+		MasterKeyFile: newPath}
+	if _, err := Reencrypt(c, nil); err == nil {
+		t.Error("Re-encrypted without the old master key")
+	}
+	count, err := Reencrypt(c, oldMaster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Errorf("Re-encrypted %d records, expected 4", count)
+	}
+	if _, err := openGormStore("sqlite3", name, 1, oldMaster); err == nil {
+		t.Error("Opened a database with the old master key")
+	}
+	c.MasterKeyFile = oldPath
+	if _, err := Reencrypt(c, nil); err == nil {
+		t.Error("Re-encrypted with the old master key")
+	}
+
+	rotated, err := openGormStore("sqlite3", name, 1, newMaster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rotated.db.Close()
+	var rawOld security.Key
+	if err = conn.First(&rawOld, &security.Key{ID: "old"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !security.IsEncrypted(rawOld.MarshalledRegistration) {
+		t.Error("Plaintext key registration was not encrypted")
+	}
+	k, err := rotated.GetKey("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(k.MarshalledRegistration, registration) {
+		t.Errorf("Key had registration %v", k.MarshalledRegistration)
+	}
+	sks, err := rotated.GetSigningKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sks) != 1 || sks[0].IV != "iv" || sks[0].PublicKey != "public" {
+		t.Errorf("Signing keys were %+v", sks)
+	}
+	h, err := newWebhookStore(rotated).GetWebhook("hook")
+	if err != nil || h.Secret != "webhook secret" {
+		t.Errorf("Webhook was %+v: %v", h, err)
+	}
+
+	// Every value is now sealed, so plaintext is no longer accepted
+	err = conn.Model(&security.Key{}).Where("id = ?", "old").Update(
+		"marshalled_registration", registration).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rotated.GetKey("old"); err == nil {
+		t.Error("Read a plaintext registration after re-encrypting")
+	}
+}
+
+func TestEncryptedValuesAreBoundToTheirField(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.db")
+	conn := openTestDatabase(t, "sqlite3", name)
+	if err := NewMigrator(conn).Up(); err != nil {
+		t.Fatal(err)
+	}
+	_, master := writeMasterKey(t, 1)
+	st, err := openGormStore("sqlite3", name, 1, master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.db.Close()
+
+	for _, id := range []string{"alice", "mallory"} {
+		if err = st.CreateKey(security.Key{
+			ID:                     id,
+			MarshalledRegistration: []byte("registration of " + id),
+			CredentialPublicKey:    []byte("credential of " + id),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	raw := map[string]security.Key{}
+	for _, id := range []string{"alice", "mallory"} {
+		var k security.Key
+		if err = conn.First(&k, "id = ?", id).Error; err != nil {
+			t.Fatal(err)
+		}
+		raw[id] = k
+	}
+	for _, c := range []struct {
+		name    string
+		column  string
+		moved   []byte
+		correct []byte
+	}{
+		{"another row", "marshalled_registration",
+			raw["mallory"].MarshalledRegistration,
+			raw["alice"].MarshalledRegistration},
+		{"another column", "credential_public_key",
+			raw["alice"].MarshalledRegistration,
+			raw["alice"].CredentialPublicKey},
+	} {
+		update := func(value []byte) {
+			err := conn.Model(&security.Key{}).Where("id = ?", "alice").Update(
+				c.column, value).Error
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		update(c.moved)
+		if _, err := st.GetKey("alice"); err == nil {
+			t.Errorf("Read a value moved from %s into %s", c.name, c.column)
+		}
+		update(c.correct)
+	}
+	if _, err := st.GetKey("alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The database was encrypted from the start, so plaintext is rejected
+	if err = conn.Model(&security.Key{}).Where("id = ?", "mallory").Update(
+		"credential_public_key", []byte("plaintext")).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.GetKey("mallory"); err == nil {
+		t.Error("Read a plaintext value from a database that is encrypted")
+	}
+}
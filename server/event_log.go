@@ -0,0 +1,174 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// How many events a memoryEventLog keeps
+const maxMemoryEvents = 10000
+
+// eventQuery selects events from an eventLog. Empty fields match everything.
+type eventQuery struct {
+	AppID  string
+	UserID string
+	Name   string
+	Status string
+
+	// Events at or after From and before To
+	From time.Time
+	To   time.Time
+
+	// Only events with lower IDs, for paging; 0 for the newest events
+	Before uint64
+
+	// Only events with higher IDs, for catching up; 0 for all events
+	After uint64
+
+	Limit int
+}
+
+// eventLog persists security events, so that their history survives
+// restarts. Events get increasing IDs.
+type eventLog interface {
+	// Saves the event, setting its ID
+	Append(e *event) error
+
+	// The events that match `q`, newest first
+	Query(q eventQuery) ([]event, error)
+
+	// Removes events that happened before `t`
+	DeleteBefore(t time.Time) (int64, error)
+}
+
+// newEventLog keeps events in the database if `store` is backed by one, and
+// in memory otherwise.
+func newEventLog(store Store) eventLog {
+	if gs, ok := store.(*gormStore); ok {
+		return &dbEventLog{gs.db}
+	}
+	return &memoryEventLog{}
+}
+
+// dbEventLog keeps events in the events table.
+type dbEventLog struct {
+	db *gorm.DB
+}
+
+func (el *dbEventLog) Append(e *event) error {
+	return el.db.Create(e).Error
+}
+
+func (el *dbEventLog) Query(q eventQuery) ([]event, error) {
+	query := el.db.Where(&event{
+		AppID:  q.AppID,
+		UserID: q.UserID,
+		Name:   q.Name,
+		Status: q.Status,
+	})
+	if !q.From.IsZero() {
+		query = query.Where("occurred_at >= ?", q.From)
+	}
+	if !q.To.IsZero() {
+		query = query.Where("occurred_at < ?", q.To)
+	}
+	if q.Before > 0 {
+		query = query.Where("id < ?", q.Before)
+	}
+	if q.After > 0 {
+		query = query.Where("id > ?", q.After)
+	}
+	if q.Limit > 0 {
+		query = query.Limit(q.Limit)
+	}
+
+	found := []event{}
+	err := query.Order("id desc").Find(&found).Error
+	return found, err
+}
+
+func (el *dbEventLog) DeleteBefore(t time.Time) (int64, error) {
+	query := el.db.Where("occurred_at < ?", t).Delete(event{})
+	return query.RowsAffected, query.Error
+}
+
+// memoryEventLog keeps the latest maxMemoryEvents events in memory. It is
+// meant for tests and the memory store.
+type memoryEventLog struct {
+	lock   sync.RWMutex
+	events []event // oldest first
+	lastID uint64
+}
+
+func (el *memoryEventLog) Append(e *event) error {
+	el.lock.Lock()
+	defer el.lock.Unlock()
+	el.lastID++
+	e.ID = el.lastID
+	el.events = append(el.events, *e)
+
+	// Trimming only once the log has twice the events that it keeps makes
+	// appends take constant time on average
+	if len(el.events) > 2*maxMemoryEvents {
+		el.events = append([]event(nil), el.kept()...)
+	}
+	return nil
+}
+
+// kept returns the latest maxMemoryEvents events.
+func (el *memoryEventLog) kept() []event {
+	if len(el.events) > maxMemoryEvents {
+		return el.events[len(el.events)-maxMemoryEvents:]
+	}
+	return el.events
+}
+
+// matches returns whether `e` is selected by `q`, ignoring its limit.
+func (q eventQuery) matches(e event) bool {
+	return (q.AppID == "" || e.AppID == q.AppID) &&
+		(q.UserID == "" || e.UserID == q.UserID) &&
+		(q.Name == "" || e.Name == q.Name) &&
+		(q.Status == "" || e.Status == q.Status) &&
+		(q.From.IsZero() || !e.Timestamp.Before(q.From)) &&
+		(q.To.IsZero() || e.Timestamp.Before(q.To)) &&
+		(q.Before == 0 || e.ID < q.Before) &&
+		(q.After == 0 || e.ID > q.After)
+}
+
+func (el *memoryEventLog) Query(q eventQuery) ([]event, error) {
+	el.lock.RLock()
+	defer el.lock.RUnlock()
+	kept := el.kept()
+	found := []event{}
+	for i := len(kept) - 1; i >= 0; i-- {
+		if q.Limit > 0 && len(found) == q.Limit {
+			break
+		}
+		if q.matches(kept[i]) {
+			found = append(found, kept[i])
+		}
+	}
+	return found, nil
+}
+
+func (el *memoryEventLog) DeleteBefore(t time.Time) (int64, error) {
+	el.lock.Lock()
+	defer el.lock.Unlock()
+
+	// Events are appended in about the order in which they happened, but
+	// not exactly, so every event is checked
+	old := el.kept()
+	kept := make([]event, 0, len(old))
+	for _, e := range old {
+		if !e.Timestamp.Before(t) {
+			kept = append(kept, e)
+		}
+	}
+	removed := int64(len(old) - len(kept))
+	el.events = kept
+	return removed, nil
+}
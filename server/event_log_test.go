@@ -0,0 +1,114 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testEventLogs(t *testing.T) map[string]eventLog {
+	conn := openTestDatabase(t, "sqlite3",
+		filepath.Join(t.TempDir(), "test.db"))
+	if err := NewMigrator(conn).Up(); err != nil {
+		t.Fatal(err)
+	}
+	return map[string]eventLog{
+		"memory":   &memoryEventLog{},
+		"database": newEventLog(&gormStore{conn, nil}),
+	}
+}
+
+func eventIDs(found []event) []uint64 {
+	ids := []uint64{}
+	for _, e := range found {
+		ids = append(ids, e.ID)
+	}
+	return ids
+}
+
+func TestEventLogQueries(t *testing.T) {
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	for kind, el := range testEventLogs(t) {
+		t.Run(kind, func(t *testing.T) {
+			for i, e := range []event{
+				{Name: "registration", AppID: "a", UserID: "u", Status: "success"},
+				{Name: "authentication", AppID: "a", UserID: "u", Status: "failure"},
+				{Name: "authentication", AppID: "b", UserID: "v", Status: "success"},
+				{Name: "authentication", AppID: "a", UserID: "u", Status: "success"},
+				{Name: "keyDeletion", AppID: "a", UserID: "v", Status: "success"},
+			} {
+				e.Timestamp = start.Add(time.Duration(i) * time.Hour)
+				if err := el.Append(&e); err != nil {
+					t.Fatal(err)
+				}
+				if e.ID == 0 {
+					t.Fatal("Event did not get an ID")
+				}
+			}
+
+			all, err := el.Query(eventQuery{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(all) != 5 || all[0].ID <= all[4].ID {
+				t.Fatalf("Events were not newest first: %v", eventIDs(all))
+			}
+			id := func(i int) uint64 { return all[4-i].ID }
+
+			for name, c := range map[string]struct {
+				q        eventQuery
+				expected []uint64
+			}{
+				"app": {eventQuery{AppID: "a"},
+					[]uint64{id(4), id(3), id(1), id(0)}},
+				"type and status": {eventQuery{Name: "authentication",
+					Status: "success"}, []uint64{id(3), id(2)}},
+				"user": {eventQuery{AppID: "a", UserID: "v"}, []uint64{id(4)}},
+				"time range": {eventQuery{From: start.Add(time.Hour),
+					To: start.Add(3 * time.Hour)}, []uint64{id(2), id(1)}},
+				"first page": {eventQuery{AppID: "a", Limit: 2},
+					[]uint64{id(4), id(3)}},
+				"next page": {eventQuery{AppID: "a", Limit: 2, Before: id(3)},
+					[]uint64{id(1), id(0)}},
+			} {
+				found, err := el.Query(c.q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := eventIDs(found); !equalIDs(got, c.expected) {
+					t.Errorf("%s: found %v, expected %v", name, got, c.expected)
+				}
+			}
+
+			n, err := el.DeleteBefore(start.Add(2 * time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 2 {
+				t.Errorf("Deleted %d events, expected 2", n)
+			}
+			left, err := el.Query(eventQuery{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := eventIDs(left); !equalIDs(got,
+				[]uint64{id(4), id(3), id(2)}) {
+				t.Errorf("Kept %v", got)
+			}
+		})
+	}
+}
+
+func equalIDs(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,356 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	maxminddb "github.com/oschwald/maxminddb-golang"
+	"github.com/pkg/errors"
+)
+
+// Kinds of GeoResolver, for Config.GeoResolver
+const (
+	geoMaxMind = "maxmind"
+	geoCIDR    = "cidr"
+	geoNone    = "none"
+)
+
+// GeoLocation is what is known about where an IP address is. Fields that are
+// unknown are empty.
+type GeoLocation struct {
+	Lat     float64
+	Long    float64
+	Country string // ISO 3166-1 code
+	City    string
+	ASN     uint
+}
+
+// GeoResolver locates IP addresses for security events. Events are recorded
+// whether or not their addresses can be located.
+type GeoResolver interface {
+	// Lookup returns the location of `ip`, and false if it is unknown.
+	Lookup(ip net.IP) (GeoLocation, bool, error)
+
+	// Ping returns why addresses cannot be located, e.g. because a DB could
+	// not be opened, or nil.
+	Ping() error
+
+	Close() error
+}
+
+// newGeoResolver returns the GeoResolver that Config.GeoResolver names.
+func newGeoResolver(c *Config) (GeoResolver, error) {
+	switch c.GeoResolver {
+	case geoMaxMind:
+		return newMaxMindResolver(c.MaxMindPath, c.MaxMindASNPath,
+			c.GeoReloadInterval), nil
+	case geoCIDR:
+		return newCIDRResolver(c.GeoCIDRPath)
+	case geoNone:
+		return noopResolver{}, nil
+	}
+	return nil, errors.Errorf("Unknown geo resolver %s", c.GeoResolver)
+}
+
+// noopResolver locates nothing.
+type noopResolver struct{}
+
+func (noopResolver) Lookup(ip net.IP) (GeoLocation, bool, error) {
+	return GeoLocation{}, false, nil
+}
+
+func (noopResolver) Ping() error {
+	return nil
+}
+
+func (noopResolver) Close() error {
+	return nil
+}
+
+// mmdbFile is a MaxMind DB that is reopened when the file changes, so that
+// it can be updated, e.g. by geoipupdate, without restarting the server.
+type mmdbFile struct {
+	path string
+
+	lock    sync.RWMutex
+	reader  *maxminddb.Reader // nil until the file could be opened
+	modTime time.Time
+}
+
+// reload opens the file if it changed since it was last opened. On error,
+// the previous version is kept.
+func (f *mmdbFile) reload() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return errors.Wrapf(err, "Could not read MaxMind DB %s", f.path)
+	}
+	f.lock.RLock()
+	unchanged := f.reader != nil && info.ModTime().Equal(f.modTime)
+	f.lock.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	reader, err := maxminddb.Open(f.path)
+	if err != nil {
+		return errors.Wrapf(err, "Could not open MaxMind DB %s", f.path)
+	}
+	f.lock.Lock()
+	old := f.reader
+	f.reader, f.modTime = reader, info.ModTime()
+	f.lock.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// lookup decodes the record of `ip` into `record`, and returns false if the
+// file is not open or has no record.
+func (f *mmdbFile) lookup(ip net.IP, record interface{}) (bool, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	if f.reader == nil {
+		return false, nil
+	}
+	_, found, err := f.reader.LookupNetwork(ip, record)
+	return found, err
+}
+
+func (f *mmdbFile) ping() error {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	if f.reader == nil {
+		return errors.Errorf("MaxMind DB %s is not open", f.path)
+	}
+	return nil
+}
+
+func (f *mmdbFile) close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.reader == nil {
+		return nil
+	}
+	err := f.reader.Close()
+	f.reader = nil
+	return err
+}
+
+// maxMindResolver locates addresses with a MaxMind City DB and, optionally, a
+// MaxMind ASN DB. Both are checked for changes every reload interval. Until a
+// DB can be opened, the fields that it would provide are unknown.
+type maxMindResolver struct {
+	city *mmdbFile
+	asn  *mmdbFile // nil without an ASN DB
+
+	done chan struct{}
+}
+
+func newMaxMindResolver(cityPath, asnPath string,
+	reloadInterval time.Duration) *maxMindResolver {
+	mr := &maxMindResolver{&mmdbFile{path: cityPath}, nil,
+		make(chan struct{})}
+	if asnPath != "" {
+		mr.asn = &mmdbFile{path: asnPath}
+	}
+	mr.reload()
+	if reloadInterval > 0 {
+		go mr.watch(reloadInterval)
+	}
+	return mr
+}
+
+func (mr *maxMindResolver) files() []*mmdbFile {
+	if mr.asn == nil {
+		return []*mmdbFile{mr.city}
+	}
+	return []*mmdbFile{mr.city, mr.asn}
+}
+
+func (mr *maxMindResolver) reload() {
+	for _, f := range mr.files() {
+		if err := f.reload(); err != nil {
+			logger.WithError(err).Warn("Geolocation is unavailable")
+		}
+	}
+}
+
+// watch reloads the DBs every `interval` until the resolver is closed.
+func (mr *maxMindResolver) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-mr.done:
+			return
+		case <-ticker.C:
+			mr.reload()
+		}
+	}
+}
+
+func (mr *maxMindResolver) Lookup(ip net.IP) (GeoLocation, bool, error) {
+	var loc GeoLocation
+	var city struct {
+		City struct {
+			Names map[string]string `maxminddb:"names"`
+		} `maxminddb:"city"`
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+		Location struct {
+			Latitude  float64 `maxminddb:"latitude"`
+			Longitude float64 `maxminddb:"longitude"`
+		} `maxminddb:"location"`
+		ASN uint `maxminddb:"autonomous_system_number"`
+	}
+	found, err := mr.city.lookup(ip, &city)
+	if err != nil {
+		return loc, false, errors.Wrap(err, "Could not look up address")
+	}
+	loc.Lat = city.Location.Latitude
+	loc.Long = city.Location.Longitude
+	loc.Country = city.Country.ISOCode
+	loc.City = city.City.Names["en"]
+	loc.ASN = city.ASN // set in ISP and Enterprise DBs
+
+	if mr.asn != nil {
+		var asn struct {
+			ASN uint `maxminddb:"autonomous_system_number"`
+		}
+		foundASN, err := mr.asn.lookup(ip, &asn)
+		if err != nil {
+			return loc, found, errors.Wrap(err, "Could not look up ASN")
+		}
+		if foundASN {
+			loc.ASN = asn.ASN
+		}
+		found = found || foundASN
+	}
+	return loc, found, nil
+}
+
+func (mr *maxMindResolver) Ping() error {
+	for _, f := range mr.files() {
+		if err := f.ping(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mr *maxMindResolver) Close() error {
+	close(mr.done)
+	var err error
+	for _, f := range mr.files() {
+		if closeErr := f.close(); err == nil {
+			err = closeErr
+		}
+	}
+	return errors.Wrap(err, "Could not close MaxMind DB")
+}
+
+// cidrResolver locates addresses with a static list of networks, for
+// deployments without MaxMind DBs, e.g. to name the offices of an intranet.
+// Its file has one network per line:
+//
+//	<CIDR>,<country>,<city>,<latitude>,<longitude>,<ASN>
+//
+// Trailing fields may be left out, and lines starting with # are ignored. The
+// most specific network that contains an address locates it.
+type cidrResolver struct {
+	networks []cidrNetwork
+}
+
+type cidrNetwork struct {
+	network  *net.IPNet
+	location GeoLocation
+}
+
+func newCIDRResolver(path string) (*cidrResolver, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not open CIDR file")
+	}
+	defer f.Close()
+
+	cr := &cidrResolver{}
+	lines := bufio.NewScanner(f)
+	for n := 1; lines.Scan(); n++ {
+		line := strings.TrimSpace(lines.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		network, err := parseCIDRLine(line)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Line %d of %s", n, path)
+		}
+		cr.networks = append(cr.networks, network)
+	}
+	return cr, errors.Wrap(lines.Err(), "Could not read CIDR file")
+}
+
+func parseCIDRLine(line string) (cidrNetwork, error) {
+	fields := strings.Split(line, ",")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	for len(fields) < 6 {
+		fields = append(fields, "")
+	}
+
+	var cn cidrNetwork
+	var err error
+	if _, cn.network, err = net.ParseCIDR(fields[0]); err != nil {
+		return cn, err
+	}
+	cn.location.Country = fields[1]
+	cn.location.City = fields[2]
+	if fields[3] != "" || fields[4] != "" {
+		if cn.location.Lat, err = strconv.ParseFloat(fields[3], 64); err != nil {
+			return cn, errors.Wrap(err, "Invalid latitude")
+		}
+		if cn.location.Long, err = strconv.ParseFloat(fields[4], 64); err != nil {
+			return cn, errors.Wrap(err, "Invalid longitude")
+		}
+	}
+	if fields[5] != "" {
+		asn, err := strconv.ParseUint(strings.TrimPrefix(fields[5], "AS"), 10,
+			32)
+		if err != nil {
+			return cn, errors.Wrap(err, "Invalid ASN")
+		}
+		cn.location.ASN = uint(asn)
+	}
+	return cn, nil
+}
+
+func (cr *cidrResolver) Lookup(ip net.IP) (GeoLocation, bool, error) {
+	best, bestBits := -1, -1
+	for i, cn := range cr.networks {
+		if bits, _ := cn.network.Mask.Size(); cn.network.Contains(ip) &&
+			bits > bestBits {
+			best, bestBits = i, bits
+		}
+	}
+	if best < 0 {
+		return GeoLocation{}, false, nil
+	}
+	return cr.networks[best].location, true, nil
+}
+
+func (cr *cidrResolver) Ping() error {
+	return nil
+}
+
+func (cr *cidrResolver) Close() error {
+	return nil
+}
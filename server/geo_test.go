@@ -0,0 +1,129 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func writeTempFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCIDRResolverPicksMostSpecificNetwork(t *testing.T) {
+	cr, err := newCIDRResolver(writeTempFile(t, "networks.csv", `
+# Offices
+10.0.0.0/8, US, , 38.9, -77.0, AS64500
+10.1.2.0/24, US, Gainesville, 29.65, -82.32
+2001:db8::/32, DE, Berlin
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for ip, expected := range map[string]GeoLocation{
+		"10.9.9.9":    {Lat: 38.9, Long: -77.0, Country: "US", ASN: 64500},
+		"10.1.2.3":    {Lat: 29.65, Long: -82.32, Country: "US", City: "Gainesville"},
+		"2001:db8::1": {Country: "DE", City: "Berlin"},
+	} {
+		loc, found, err := cr.Lookup(net.ParseIP(ip))
+		if err != nil || !found || loc != expected {
+			t.Errorf("%s was located at %+v, %v, %v", ip, loc, found, err)
+		}
+	}
+	if _, found, _ := cr.Lookup(net.ParseIP("192.0.2.1")); found {
+		t.Error("Located an address outside of every network")
+	}
+
+	_, err = newCIDRResolver(writeTempFile(t, "bad.csv", "10.0.0.0/8,US,,north"))
+	if err == nil {
+		t.Error("Loaded a file with an invalid latitude")
+	}
+}
+
+func TestMaxMindResolverWaitsForDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "city.mmdb")
+	mr := newMaxMindResolver(path, "", 0)
+	defer mr.Close()
+
+	_, found, err := mr.Lookup(net.ParseIP("192.0.2.1"))
+	if found || err != nil {
+		t.Errorf("Lookup without a DB returned %v, %v", found, err)
+	}
+
+	// A DB that cannot be opened is not used
+	if err = ioutil.WriteFile(path, []byte("not a DB"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = mr.city.reload(); err == nil {
+		t.Error("Reloaded an invalid DB")
+	}
+	if _, found, err = mr.Lookup(net.ParseIP("192.0.2.1")); found || err != nil {
+		t.Errorf("Lookup after a failed reload returned %v, %v", found, err)
+	}
+	if err = mr.Ping(); err == nil {
+		t.Error("Resolver without a DB was healthy")
+	}
+}
+
+func TestReadinessReportsGeolocation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "city.mmdb")
+	_, ts := newTestServerWithConfig(t, strings.Replace(testConfig,
+		"GeoResolver: none", "GeoResolver: maxmind\nMaxMindPath: "+path, 1))
+
+	r := newTestRequest(t, ts, "GET", "/readyz", nil)
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	reply := readinessReply{}
+	if err = json.NewDecoder(res.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+
+	// A missing DB is reported, but the server can still serve requests
+	if res.StatusCode != http.StatusOK || !reply.Ready {
+		t.Errorf("Server was not ready: %d %+v", res.StatusCode, reply)
+	}
+	if !strings.Contains(reply.Checks["geo"], path) {
+		t.Errorf("Geolocation check was %q", reply.Checks["geo"])
+	}
+}
+
+// failingResolver cannot locate anything.
+type failingResolver struct{ noopResolver }
+
+func (failingResolver) Lookup(ip net.IP) (GeoLocation, bool, error) {
+	return GeoLocation{}, false, errors.New("DB is corrupt")
+}
+
+func TestEventsAreRecordedWithoutGeolocation(t *testing.T) {
+	log := &memoryEventLog{}
+	d := startDisperser(failingResolver{}, log, nil, nil)
+	defer d.stop()
+
+	err := d.addEvent(authentication, time.Now(), "a", "success", "u",
+		"192.0.2.1", "198.51.100.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, _ := log.Query(eventQuery{})
+	if len(found) != 1 || found[0].OriginalIP != "192.0.2.1" ||
+		found[0].ResolvingIP != "198.51.100.1" {
+		t.Errorf("Recorded %+v", found)
+	}
+}
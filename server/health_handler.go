@@ -0,0 +1,112 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Build information, set at build time with
+// -ldflags "-X github.com/tera-insights/2Q2R-enterprise/server.Version=..."
+var (
+	Version   = "dev"
+	Commit    = ""
+	BuildTime = ""
+)
+
+// How long the disperser may go without sending events before the server is
+// no longer ready
+const disperserStall = 5 * time.Second
+
+// healthHandler answers the orchestrator's probes. Its routes need neither an
+// admin session nor app server authentication.
+type healthHandler struct {
+	s *Server
+}
+
+type readinessReply struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"` // "ok" or why the check failed
+}
+
+type versionReply struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildTime string `json:"buildTime,omitempty"`
+	GoVersion string `json:"goVersion"`
+
+	// The schema version that the server runs on and, for SQL stores, the
+	// version that the database is on
+	SchemaVersion         int  `json:"schemaVersion"`
+	DatabaseSchemaVersion *int `json:"databaseSchemaVersion,omitempty"`
+}
+
+// Healthz reports that the process is alive.
+// GET /healthz
+func (hh *healthHandler) Healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Readyz reports whether the server can serve requests: it is not shutting
+// down, the database answers, the private key is loaded, and the disperser is
+// running. It answers 503 if any check fails. Whether addresses can be
+// located is reported as well, but does not make the server unready, as
+// events are recorded without their location.
+// GET /readyz
+func (hh *healthHandler) Readyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]error{
+		"database":  hh.s.Store.Ping(),
+		"disperser": hh.s.disperser.checkRunning(disperserStall),
+	}
+	if hh.s.stopping() {
+		checks["shutdown"] = errors.New("Server is shutting down")
+	} else {
+		checks["shutdown"] = nil
+	}
+	if hh.s.priv == nil {
+		checks["privateKey"] = errors.New("Private key is not loaded")
+	} else {
+		checks["privateKey"] = nil
+	}
+
+	reply := readinessReply{true, make(map[string]string)}
+	for name, err := range checks {
+		if err != nil {
+			reply.Ready = false
+			reply.Checks[name] = err.Error()
+		} else {
+			reply.Checks[name] = "ok"
+		}
+	}
+	reply.Checks["geo"] = "ok"
+	if err := hh.s.disperser.geo.Ping(); err != nil {
+		reply.Checks["geo"] = err.Error()
+	}
+	status := http.StatusOK
+	if !reply.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, reply)
+}
+
+// GetVersion returns the build information and schema version.
+// GET /version
+func (hh *healthHandler) GetVersion(w http.ResponseWriter, r *http.Request) {
+	reply := versionReply{
+		Version:       Version,
+		Commit:        Commit,
+		BuildTime:     BuildTime,
+		GoVersion:     runtime.Version(),
+		SchemaVersion: LatestSchemaVersion(),
+	}
+	if gs, ok := hh.s.Store.(*gormStore); ok {
+		if v, err := NewMigrator(gs.db).Version(); err == nil {
+			reply.DatabaseSchemaVersion = &v
+		}
+	}
+	writeJSON(w, http.StatusOK, reply)
+}
@@ -0,0 +1,42 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbes(t *testing.T) {
+	s, ts := newTestServer(t)
+
+	r := newTestRequest(t, ts, "GET", "/healthz", nil)
+	require.Equal(t, http.StatusOK, do(t, r, nil))
+
+	ready := readinessReply{}
+	r = newTestRequest(t, ts, "GET", "/readyz", nil)
+	require.Equal(t, http.StatusOK, do(t, r, &ready))
+	require.True(t, ready.Ready)
+	for _, check := range []string{"database", "disperser", "shutdown",
+		"privateKey"} {
+		require.Equal(t, "ok", ready.Checks[check], check)
+	}
+
+	version := versionReply{}
+	r = newTestRequest(t, ts, "GET", "/version", nil)
+	require.Equal(t, http.StatusOK, do(t, r, &version))
+	require.Equal(t, Version, version.Version)
+	require.Equal(t, LatestSchemaVersion(), version.SchemaVersion)
+	// The memory store has no schema
+	require.Nil(t, version.DatabaseSchemaVersion)
+
+	// Load balancers stop sending requests once shutdown starts, while the
+	// process is still alive
+	s.stop()
+	r = newTestRequest(t, ts, "GET", "/readyz", nil)
+	require.Equal(t, http.StatusServiceUnavailable, do(t, r, nil))
+	r = newTestRequest(t, ts, "GET", "/healthz", nil)
+	require.Equal(t, http.StatusOK, do(t, r, nil))
+}
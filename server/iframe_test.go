@@ -6,52 +6,67 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"strings"
 	"testing"
-	"time"
 
+	"github.com/tera-insights/2Q2R-enterprise/security"
 	"github.com/tera-insights/2Q2R-enterprise/util"
 
 	"github.com/stretchr/testify/require"
 )
 
-func extractEmbeddedData(route string, o interface{}) {
-	res, _ := http.Get(ts.URL + route)
-	bytes, _ := ioutil.ReadAll(res.Body)
+// extractEmbeddedData posts `requestID` to the iFrame at `route` and decodes
+// the data embedded in it into `o`.
+func extractEmbeddedData(t *testing.T, ts *httptest.Server, route,
+	requestID string, o interface{}) {
+	r := newTestRequest(t, ts, "POST", route, requestIDWrapper{requestID})
+	res, err := http.DefaultClient.Do(r)
+	require.Nil(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	bytes, err := ioutil.ReadAll(res.Body)
+	require.Nil(t, err)
 	iFrameBody := string(bytes)
 
 	// require that data embedded in the iFrame is what we expect
-	startIndex := strings.Index(iFrameBody, "{")
-	endIndex := strings.Index(iFrameBody, ";")
-	embedded := iFrameBody[startIndex:endIndex]
-	json.NewDecoder(strings.NewReader(embedded)).Decode(o)
+	startIndex := strings.Index(iFrameBody, "var data = ")
+	require.NotEqual(t, -1, startIndex)
+	embedded := iFrameBody[startIndex+len("var data = "):]
+	endIndex := strings.Index(embedded, ";")
+	require.NotEqual(t, -1, endIndex)
+	err = json.Unmarshal([]byte(embedded[:endIndex]), o)
+	require.Nil(t, err)
 }
 
 func TestRegisterIFrameGeneration(t *testing.T) {
-	res, err := http.Get("/v1/register/request/bar")
-	require.Nil(t, err)
-	setupInfo := new(RegistrationSetupReply)
-	unmarshalJSONBody(res, setupInfo)
+	s, ts := newTestServer(t)
+	app := newTestApp(t, s, "foo")
+	asi := newTestAppServer(t, s, app.ID, permissionRegister)
 
-	// Get registration iFrame
-	gleanedData := new(registerData)
-	extractEmbeddedData("/register/"+setupInfo.RequestID, gleanedData)
+	r := newTestRequest(t, ts, "GET", "/v1/register/request/bar", nil)
+	signRequest(t, s, r, asi)
+	setupInfo := registrationSetupReply{}
+	require.Equal(t, http.StatusOK, do(t, r, &setupInfo))
 
-	// Get app info
-	res, _ = http.Get(ts.URL + "/v1/info/" + goodAppID)
-	appInfo := new(AppIDInfoReply)
-	unmarshalJSONBody(res, appInfo)
+	// Get registration iFrame
+	gleanedData := registerData{}
+	extractEmbeddedData(t, ts, "/v1/register/iframe", setupInfo.RequestID,
+		&gleanedData)
 
-	cachedRequest, _ := s.Cache.GetRegistrationRequest(setupInfo.RequestID)
+	cachedRequest, err := s.registrations.Get(setupInfo.RequestID)
+	require.Nil(t, err)
+	base := s.Config.getBaseURLWithProtocol()
 	correctData := registerData{
 		RequestID: setupInfo.RequestID,
-		KeyTypes:  []string{"2q2r", "u2f"},
+		KeyTypes:  []string{"2q2r", "u2f", "webauthn"},
 		Challenge: util.EncodeBase64(cachedRequest.Challenge.Challenge),
 		UserID:    "bar",
-		AppID:     goodAppID,
-		InfoURL:   appInfo.BaseURL + "/v1/info/" + goodAppID,
-		WaitURL:   appInfo.BaseURL + "/v1/register/" + setupInfo.RequestID + "/wait",
+		AppID:     app.ID,
+		InfoURL:   base + "/v1/info/" + app.ID,
+		WaitURL:   base + "/v1/register/wait",
 	}
 	if gleanedData.RequestID != correctData.RequestID {
 		t.Errorf("RequestID was not properly templated")
@@ -77,66 +92,47 @@ func TestRegisterIFrameGeneration(t *testing.T) {
 }
 
 func TestAuthenticateIFrameGeneration(t *testing.T) {
-	// Set up registration request
-	asr := AuthenticationSetupRequest{
-		AppID:     goodAppID,
-		Timestamp: time.Now(),
-		UserID:    "bar",
-		KeyID:     "baz",
-	}
-	res, _ := postJSON("/v1/auth/request", asr)
-	setupInfo := new(AuthenticationSetupReply)
-	unmarshalJSONBody(res, setupInfo)
+	s, ts := newTestServer(t)
+	app := newTestApp(t, s, "foo")
+	asi := newTestAppServer(t, s, app.ID, permissionLogin)
+
+	// Suspended keys are not offered to the user
+	for _, k := range []security.Key{
+		{ID: "baz", Type: "2q2r", Name: "Phone", State: security.KeyStateActive},
+		{ID: "qux", Type: "u2f", Name: "Old", State: security.KeyStateSuspended},
+	} {
+		k.UserID = "bar"
+		k.AppID = app.ID
+		k.Format = security.FormatU2F
+		require.Nil(t, s.Store.CreateKey(k))
+	}
+
+	// Set up authentication request
+	r := newTestRequest(t, ts, "GET", "/v1/auth/request/bar/nonce", nil)
+	signRequest(t, s, r, asi)
+	setupInfo := authenticationSetupReply{}
+	require.Equal(t, http.StatusOK, do(t, r, &setupInfo))
 
 	// Get authentication iFrame
-	res, _ = http.Get(ts.URL + "/v1/auth/" + setupInfo.RequestID)
-	bytes, _ := ioutil.ReadAll(res.Body)
-	iFrameBody := string(bytes)
-
-	startIndex := strings.Index(iFrameBody, "{")
-	endIndex := strings.Index(iFrameBody, ";")
-	require.NotEqual(t, startIndex, -1)
-	require.NotEqual(t, endIndex, -1)
-
-	embedded := iFrameBody[startIndex:endIndex]
-	gleanedData := new(authenticateData)
-	json.NewDecoder(strings.NewReader(embedded)).Decode(gleanedData)
-
-	// Get app info
-	res, _ = http.Get(ts.URL + "/v1/info/" + asr.AppID)
-	appInfo := new(AppIDInfoReply)
-	unmarshalJSONBody(res, appInfo)
+	gleanedData := authenticateData{}
+	extractEmbeddedData(t, ts, "/v1/auth/iframe", setupInfo.RequestID,
+		&gleanedData)
 
-	authenticationRequest, _ := s.Cache.GetAuthenticationRequest(setupInfo.RequestID)
-
-	query := Key{AppID: asr.AppID, UserID: asr.UserID}
-	rows, err := s.DB.Model(&Key{}).Where(query).Select([]string{"key_id", "type", "name"}).Rows()
+	authenticationRequest, err := s.authentications.Get(setupInfo.RequestID)
 	require.Nil(t, err)
-	defer rows.Close()
-	var keys []keyDataToEmbed
-	for rows.Next() {
-		var keyID string
-		var keyType string
-		var name string
-		err := rows.Scan(&keyID, &keyType, &name)
-		require.Nil(t, err)
-		keys = append(keys, keyDataToEmbed{
-			KeyID: keyID,
-			Type:  keyType,
-			Name:  name,
-		})
-	}
-
+	base := s.Config.getBaseURLWithProtocol()
 	correctData := authenticateData{
-		RequestID:    setupInfo.RequestID,
-		Counter:      1,
-		Keys:         keys,
+		RequestID: setupInfo.RequestID,
+		Counter:   1,
+		Keys: []keyDataToEmbed{
+			{KeyID: "baz", Type: "2q2r", Name: "Phone"},
+		},
 		Challenge:    util.EncodeBase64(authenticationRequest.Challenge.Challenge),
-		UserID:       asr.UserID,
-		AppID:        asr.AppID,
-		InfoURL:      appInfo.BaseURL + "/v1/info/" + asr.AppID,
-		WaitURL:      appInfo.BaseURL + "/v1/auth/" + setupInfo.RequestID + "/wait",
-		ChallengeURL: appInfo.BaseURL + "/v1/auth/" + setupInfo.RequestID + "/challenge",
+		UserID:       "bar",
+		AppID:        app.ID,
+		InfoURL:      base + "/v1/info/" + app.ID,
+		WaitURL:      base + "/v1/auth/wait",
+		ChallengeURL: base + "/v1/auth/challenge",
 	}
 	if gleanedData.RequestID != correctData.RequestID {
 		t.Errorf("RequestID was not properly templated")
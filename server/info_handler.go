@@ -21,20 +21,15 @@ func (ih *infoHandler) AppinfoHandler(w http.ResponseWriter, r *http.Request) {
 	err := util.CheckBase64(appID)
 	util.OptionalBadRequestPanic(err, "App ID was not a valid base-64 string")
 
-	query := AppInfo{ID: appID}
-	count := 0
-	err = ih.s.DB.Model(&AppInfo{}).Where(&query).Count(&count).Error
-	util.OptionalInternalPanic(err, "Failed to count apps inside database")
-
-	if count > 0 {
-		var info AppInfo
-		err = ih.s.DB.Model(&AppInfo{}).Where(&query).First(&info).Error
+	info, err := ih.s.Store.GetApp(appID)
+	if err != ErrNotFound {
+		util.OptionalInternalPanic(err, "Failed to find app inside database")
 		reply := appIDInfoReply{
 			AppName:   info.AppName,
 			BaseURL:   ih.s.Config.getBaseURLWithProtocol(),
 			AppURL:    ih.s.Config.getBaseURLWithProtocol(),
 			AppID:     info.ID,
-			PublicKey: ih.s.Config.Base64EncodedPublicKey,
+			PublicKey: util.EncodeBase64(ih.s.kc.PublicKey()),
 			KeyType:   ih.s.Config.KeyType,
 		}
 		writeJSON(w, http.StatusOK, reply)
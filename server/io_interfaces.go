@@ -5,6 +5,8 @@ package server
 import (
 	"math/big"
 	"time"
+
+	"github.com/tera-insights/2Q2R-enterprise/security"
 )
 
 // NewAdminRequest the request to add a new admin. It is used both in HTTP
@@ -47,12 +49,41 @@ type adminRoleChangeRequest struct {
 
 // newAppRequest is the request to POST /admin/app
 type newAppRequest struct {
-	AppName string `json:"appName"`
+	AppName               string   `json:"appName"`
+	AttestationPolicy     string   `json:"attestationPolicy"`
+	AllowedAuthenticators []string `json:"allowedAuthenticators"`
+	MinCertificationLevel string   `json:"minCertificationLevel"`
+	SuspendClonedKeys     bool     `json:"suspendClonedKeys"`
+	AnomalyThreshold      int      `json:"anomalyThreshold"`
+	MaxTravelSpeed        float64  `json:"maxTravelSpeed"`
 }
 
-// Request to PUT /admin/app/{appID}
+// Request to POST /admin/app/{appID}
 type appUpdateRequest struct {
 	AppName string `json:"appName"`
+
+	// Left unchanged when empty or nil
+	AttestationPolicy     string   `json:"attestationPolicy"`
+	AllowedAuthenticators []string `json:"allowedAuthenticators"`
+
+	// "NOT_FIDO_CERTIFIED" removes the minimum
+	MinCertificationLevel string `json:"minCertificationLevel"`
+
+	SuspendClonedKeys *bool `json:"suspendClonedKeys"`
+
+	// 0 restores the default
+	AnomalyThreshold *int     `json:"anomalyThreshold"`
+	MaxTravelSpeed   *float64 `json:"maxTravelSpeed"`
+}
+
+// Request to PUT /admin/key/{keyID}
+type keyUpdateRequest struct {
+	// Left unchanged when empty
+	State string `json:"state"`
+
+	// Left unchanged when nil, unless NeverExpires is set
+	ExpiresAt    *time.Time `json:"expiresAt"`
+	NeverExpires bool       `json:"neverExpires"`
 }
 
 type modificationReply struct {
@@ -71,7 +102,8 @@ type appIDInfoReply struct {
 
 	AppID string `json:"appID"`
 
-	// base 64 encoded public key of the 2Q2R server
+	// base 64 encoded, uncompressed P-256 point of the 2Q2R server, from
+	// which app servers derive the key that MACs their requests
 	PublicKey string `json:"serverPubKey"`
 
 	// Only P256 supported for now
@@ -210,3 +242,124 @@ type deleteLTRRequest struct {
 type newPermissionsRequest struct {
 	Permissions []Permission `json:"permissions"`
 }
+
+// Request to POST /v1/register/webauthn. Binary fields are base-64 web
+// encoded with no padding.
+type webAuthnRegisterRequest struct {
+	ID                string `json:"id"`
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AttestationObject string `json:"attestationObject"`
+	DeviceName        string `json:"deviceName"`
+	Type              string `json:"type"`
+}
+
+// Request to POST /v1/auth/webauthn. Binary fields are base-64 web encoded
+// with no padding.
+type webAuthnAuthenticateRequest struct {
+	ID                string `json:"id"`
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AuthenticatorData string `json:"authenticatorData"`
+	Signature         string `json:"signature"`
+	UserHandle        string `json:"userHandle"`
+}
+
+type webAuthnRelyingParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type webAuthnUser struct {
+	ID          string `json:"id"` // base-64 web encoded user handle
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type webAuthnCredentialParam struct {
+	Type      string `json:"type"`
+	Algorithm int64  `json:"alg"`
+}
+
+type webAuthnCredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"` // base-64 web encoded credential ID
+}
+
+// Reply to POST /v1/register/webauthn/options. Passed by the iFrame to
+// navigator.credentials.create().
+type webAuthnCreationOptions struct {
+	Challenge          string                         `json:"challenge"`
+	RP                 webAuthnRelyingParty           `json:"rp"`
+	User               webAuthnUser                   `json:"user"`
+	PubKeyCredParams   []webAuthnCredentialParam      `json:"pubKeyCredParams"`
+	Timeout            int64                          `json:"timeout"` // ms
+	ExcludeCredentials []webAuthnCredentialDescriptor `json:"excludeCredentials"`
+	Attestation        string                         `json:"attestation"`
+}
+
+// Reply to POST /v1/auth/webauthn/options. Passed by the iFrame to
+// navigator.credentials.get().
+type webAuthnRequestOptions struct {
+	Challenge        string                         `json:"challenge"`
+	RPID             string                         `json:"rpId"`
+	Timeout          int64                          `json:"timeout"` // ms
+	AllowCredentials []webAuthnCredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                         `json:"userVerification"`
+}
+
+// Reply to GET /admin/metadata/{id}
+type authenticatorReply struct {
+	Entry              *security.MetadataEntry `json:"entry"`
+	Status             string                  `json:"status"`
+	CertificationLevel int                     `json:"certificationLevel"`
+}
+
+// Reply to POST /admin/metadata/reload
+type metadataReply struct {
+	Number     int    `json:"no"`
+	NextUpdate string `json:"nextUpdate"`
+	NumEntries int    `json:"numEntries"`
+}
+
+// Reply to GET /admin/events
+type eventsReply struct {
+	Events []event `json:"events"`
+
+	// Pass as `cursor` to get the next, older page. Empty on the last page.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// Request to POST /admin/app/{appID}/webhooks
+type newWebhookRequest struct {
+	URL string `json:"url"`
+
+	// Names of the events to send; every event when empty
+	EventTypes []string `json:"eventTypes"`
+
+	// Key of the HMAC that signs payloads; generated when empty
+	Secret string `json:"secret"`
+}
+
+// Request to PUT /admin/app/{appID}/webhooks/{webhookID}
+type webhookUpdateRequest struct {
+	// Left unchanged when empty or nil. An empty list of event types selects
+	// every event.
+	URL        string   `json:"url"`
+	EventTypes []string `json:"eventTypes"`
+	Active     *bool    `json:"active"`
+}
+
+// A webhook in replies to /admin/app/{appID}/webhooks
+type webhookReply struct {
+	Webhook
+	EventTypes []string `json:"eventTypes"`
+
+	// Only returned when the webhook is created
+	Secret string `json:"secret,omitempty"`
+}
+
+// Reply to POST /admin/app/{appID}/webhooks/{webhookID}/test
+type webhookTestReply struct {
+	Delivered bool   `json:"delivered"`
+	Status    int    `json:"status"` // 0 if the webhook did not answer
+	Error     string `json:"error,omitempty"`
+}
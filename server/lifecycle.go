@@ -0,0 +1,193 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tera-insights/2Q2R-enterprise/util"
+)
+
+// lifecycle tracks whether the server is running. It is shared by copies of
+// the Server.
+type lifecycle struct {
+	http *http.Server
+
+	// Closed when the server starts shutting down
+	done     chan struct{}
+	stopOnce sync.Once
+
+	// Background jobs, which must finish before the store is closed
+	jobs sync.WaitGroup
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func newLifecycle(c *Config) *lifecycle {
+	return &lifecycle{
+		http: &http.Server{Addr: c.Port},
+		done: make(chan struct{}),
+	}
+}
+
+// ListenAndServe serves the server on Config.Port, over HTTPS if Config.HTTPS
+// is set. After Shutdown or Close, it returns http.ErrServerClosed.
+func (s *Server) ListenAndServe() error {
+	s.lc.http.Handler = s.GetHandler()
+	if s.Config.HTTPS {
+		return s.lc.http.ListenAndServeTLS(s.Config.CertFile, s.Config.KeyFile)
+	}
+	return s.lc.http.ListenAndServe()
+}
+
+// Shutdown stops the server gracefully. /readyz starts failing and pending
+// waits for registration and authentication results are answered with 503 and
+// a Retry-After header, so that clients retry them. After
+// Config.ShutdownDelay, which gives load balancers time to notice, the server
+// stops accepting connections and drains in-flight requests until `ctx` is
+// done. Then everything is released as by Close.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.stop()
+	if s.Config.ShutdownDelay > 0 {
+		select {
+		case <-time.After(s.Config.ShutdownDelay):
+		case <-ctx.Done():
+		}
+	}
+	err := s.lc.http.Shutdown(ctx)
+	if err != nil {
+		s.lc.http.Close()
+	}
+	if closeErr := s.release(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Close stops the server immediately, closing its connections, and releases
+// everything that it holds: websocket listeners, cache janitors, the
+// GeoResolver and the store. Webhook deliveries that are being sent are
+// finished first.
+func (s *Server) Close() error {
+	s.stop()
+	err := s.lc.http.Close()
+	if closeErr := s.release(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// stop tells long-running handlers and background jobs that the server is
+// shutting down.
+func (s *Server) stop() {
+	s.lc.stopOnce.Do(func() {
+		close(s.lc.done)
+	})
+}
+
+// stopping returns whether the server is shutting down.
+func (s *Server) stopping() bool {
+	select {
+	case <-s.lc.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// background runs `job`, which must return once the server starts shutting
+// down. release waits for it.
+func (s *Server) background(job func()) {
+	s.lc.jobs.Add(1)
+	go func() {
+		defer s.lc.jobs.Done()
+		job()
+	}()
+}
+
+// release waits for background jobs and then closes everything that the
+// server holds, once.
+func (s *Server) release() error {
+	s.lc.closeOnce.Do(func() {
+		s.lc.jobs.Wait()
+		s.kc.Close()
+		s.ng.Close()
+		err := s.disperser.close()
+		if storeErr := s.Store.Close(); err == nil {
+			err = storeErr
+		}
+		s.lc.closeErr = err
+	})
+	return s.lc.closeErr
+}
+
+// clean removes expired sessions, requests and app server MACs, and events
+// and finished webhook deliveries older than Config.EventRetention, every
+// Config.CleanTime until the server shuts down.
+func (s *Server) clean() {
+	ticker := time.NewTicker(s.Config.CleanTime)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.lc.done:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		err := s.sessions.DeleteExpired(now.Add(-s.Config.AdminSessionLength),
+			now.Add(-s.Config.AdminSessionMaxLength))
+		if err != nil {
+			logger.WithError(err).Error("Could not delete expired sessions")
+		}
+		for _, rs := range []requestStore{s.registrations, s.authentications} {
+			if err := rs.DeleteExpired(); err != nil {
+				logger.WithError(err).Error("Could not delete expired requests")
+			}
+		}
+		s.serverMACs.DeleteExpired()
+		if s.Config.EventRetention > 0 {
+			_, err := s.events.DeleteBefore(now.Add(-s.Config.EventRetention))
+			if err != nil {
+				logger.WithError(err).Error("Could not delete old events")
+			}
+			_, err = s.webhooks.store.DeleteDeliveriesBefore(
+				now.Add(-s.Config.EventRetention).UTC())
+			if err != nil {
+				logger.WithError(err).Error(
+					"Could not delete old webhook deliveries")
+			}
+		}
+	}
+}
+
+// waitContext returns the context for a long poll, which is canceled when the
+// client goes away or the server starts shutting down.
+func (s *Server) waitContext(r *http.Request) (context.Context,
+	context.CancelFunc) {
+	ctx, cancel := context.WithCancel(r.Context())
+	go func() {
+		select {
+		case <-s.lc.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// panicIfStopping answers with 503 if the server is shutting down, so that
+// the client retries the request, e.g. against another instance.
+func (s *Server) panicIfStopping(w http.ResponseWriter) {
+	if s.stopping() {
+		w.Header().Set("Retry-After", "1")
+		panic(util.BubbledError{
+			StatusCode: http.StatusServiceUnavailable,
+			Message:    "Server is shutting down",
+		})
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+
+	"github.com/felixge/httpsnoop"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/tera-insights/2Q2R-enterprise/util"
+)
+
+// logger is the server's structured logger. LoadConfig sets its level and
+// format from Config.LogLevel and Config.LogFormat.
+var logger = logrus.New()
+
+// The header that carries a request's ID, in requests and replies
+const requestIDHeader = "X-Request-ID"
+
+// IDs that clients and proxies may choose for their requests
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type requestIDKey struct{}
+
+// configureLogging sets the level and format of the logger.
+func configureLogging(c *Config) error {
+	level, err := logrus.ParseLevel(c.LogLevel)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid log level %q", c.LogLevel)
+	}
+	switch c.LogFormat {
+	case "json":
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	case "logfmt":
+		logger.SetFormatter(&logrus.TextFormatter{
+			DisableColors: true,
+			FullTimestamp: true,
+		})
+	default:
+		return errors.Errorf("Unknown log format %q", c.LogFormat)
+	}
+	logger.SetLevel(level)
+	return nil
+}
+
+// requestIDFor returns the ID that trace gave the request.
+func requestIDFor(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// logFor returns a log entry for messages about the request.
+func logFor(r *http.Request) *logrus.Entry {
+	return logger.WithField("request_id", requestIDFor(r))
+}
+
+// trace gives each request an ID, which is echoed in the X-Request-ID header
+// and added to the request's log messages. A valid ID that the client or a
+// proxy sent is kept, so that requests can be followed across services. If
+// Config.LogRequests is set, every request is logged when it has been served.
+func (s *Server) trace(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			var err error
+			id, err = util.RandString(12)
+			if err != nil {
+				logger.WithError(err).Error("Could not generate request ID")
+			}
+		}
+		w.Header().Set(requestIDHeader, id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+
+		if !s.Config.LogRequests {
+			h.ServeHTTP(w, r)
+			return
+		}
+		m := httpsnoop.CaptureMetrics(h, w, r)
+		logFor(r).WithFields(logrus.Fields{
+			"method":   r.Method,
+			"path":     r.URL.Path,
+			"remote":   r.RemoteAddr,
+			"status":   m.Code,
+			"bytes":    m.Written,
+			"duration": m.Duration.Seconds(),
+		}).Info("Served request")
+	})
+}
@@ -0,0 +1,102 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/tera-insights/2Q2R-enterprise/util"
+)
+
+// captureLog sends the log, as JSON, to the returned buffer until the test
+// ends.
+func captureLog(t testing.TB, level logrus.Level) *bytes.Buffer {
+	var buf bytes.Buffer
+	out, formatter, oldLevel := logger.Out, logger.Formatter, logger.Level
+	logger.SetOutput(&buf)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.SetLevel(level)
+	t.Cleanup(func() {
+		logger.SetOutput(out)
+		logger.SetFormatter(formatter)
+		logger.SetLevel(oldLevel)
+	})
+	return &buf
+}
+
+func TestRequestIDIsEchoed(t *testing.T) {
+	s := &Server{Config: &Config{}}
+	var seen string
+	h := s.trace(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		seen = requestIDFor(r)
+	}))
+
+	for sent, kept := range map[string]bool{
+		"":                   false,
+		"from-the-proxy.1":   true,
+		"spaces are invalid": false,
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(requestIDHeader, sent)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		echoed := w.Header().Get(requestIDHeader)
+		if echoed == "" || echoed != seen {
+			t.Errorf("Echoed %q, handler saw %q", echoed, seen)
+		}
+		if (echoed == sent) != kept {
+			t.Errorf("Request ID %q was replaced by %q", sent, echoed)
+		}
+	}
+}
+
+func TestInternalErrorsAreLogged(t *testing.T) {
+	buf := captureLog(t, logrus.InfoLevel)
+	s := &Server{Config: &Config{}}
+	h := s.trace(s.recoverWrap(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		switch r.URL.Path {
+		case "/internal":
+			util.OptionalInternalPanic(errors.New("disk is full"),
+				"Could not save key")
+		case "/bad":
+			util.OptionalBadRequestPanic(errors.New("EOF"),
+				"Could not decode request body")
+		}
+	})))
+
+	r := httptest.NewRequest("GET", "/bad", nil)
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if buf.Len() != 0 {
+		t.Errorf("Logged a client error at level info: %s", buf.String())
+	}
+
+	r = httptest.NewRequest("GET", "/internal", nil)
+	r.Header.Set(requestIDHeader, "request")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	var response errorResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.RequestID != "request" {
+		t.Errorf("Reply had request ID %q", response.RequestID)
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["level"] != "error" || entry["request_id"] != "request" ||
+		entry["error"] != "disk is full" || entry["stack"] == nil {
+		t.Errorf("Logged %v", entry)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/tera-insights/2Q2R-enterprise/security"
+	"github.com/tera-insights/2Q2R-enterprise/util"
+
+	"github.com/pkg/errors"
+)
+
+// metadataStore holds the most recently loaded FIDO MDS3 blob. The blob is
+// downloaded out of band; admins can reload it without restarting.
+type metadataStore struct {
+	blobPath  string
+	rootsPath string
+
+	lock sync.RWMutex
+	md   *security.Metadata // nil if no blob is configured
+}
+
+func newMetadataStore(blobPath, rootsPath string) (*metadataStore, error) {
+	ms := &metadataStore{
+		blobPath:  blobPath,
+		rootsPath: rootsPath,
+	}
+	if blobPath == "" {
+		return ms, nil
+	}
+	return ms, ms.reload()
+}
+
+// reload reads and verifies the blob from disk. The previous blob is kept if
+// the new one is invalid.
+func (ms *metadataStore) reload() error {
+	if ms.blobPath == "" {
+		return errors.New("No metadata blob is configured")
+	}
+	roots, err := security.LoadCertPool(ms.rootsPath)
+	if err != nil {
+		return errors.Wrap(err, "Could not load metadata roots")
+	}
+	blob, err := ioutil.ReadFile(ms.blobPath)
+	if err != nil {
+		return errors.Wrapf(err, "Could not read metadata blob at path %s",
+			ms.blobPath)
+	}
+	md, err := security.LoadMetadata(blob, roots)
+	if err != nil {
+		return err
+	}
+
+	ms.lock.Lock()
+	ms.md = md
+	ms.lock.Unlock()
+	return nil
+}
+
+func (ms *metadataStore) get() *security.Metadata {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	return ms.md
+}
+
+// lookup finds an authenticator by AAGUID or attestation key identifier.
+func (ms *metadataStore) lookup(ids ...string) (*security.MetadataEntry, bool) {
+	md := ms.get()
+	if md == nil {
+		return nil, false
+	}
+	return md.Lookup(ids...)
+}
+
+// validCertificationLevel returns whether `l` may be used as an app's minimum
+// certification level. The empty string means no minimum.
+func validCertificationLevel(l string) bool {
+	return l == "" || security.CertificationLevel(l) >= 0
+}
+
+// normalizeCertificationLevel validates an app's minimum certification level
+// and returns it as it is stored. NOT_FIDO_CERTIFIED is met by every
+// authenticator, so it is stored as no minimum.
+func normalizeCertificationLevel(l string) string {
+	util.PanicIfFalse(validCertificationLevel(l), http.StatusBadRequest,
+		"Invalid certification level")
+	if l == "NOT_FIDO_CERTIFIED" {
+		return ""
+	}
+	return l
+}
+
+// checkCertificationPolicy refuses apps that set a minimum certification level
+// without checking attestation, since their authenticators are never looked up
+// in the metadata.
+func checkCertificationPolicy(app AppInfo) {
+	util.PanicIfFalse(app.MinCertificationLevel == "" ||
+		app.getAttestationPolicy() != attestationNone, http.StatusBadRequest,
+		"A minimum certification level needs an attestation policy")
+}
+
+// checkMetadata refuses authenticators that the metadata service lists as
+// revoked or compromised, as well as authenticators below the app's minimum
+// certification level.
+func (s *Server) checkMetadata(app AppInfo, ids ...string) {
+	entry, found := s.metadata.lookup(ids...)
+	if found {
+		util.PanicIfFalse(!entry.Blocked(), http.StatusForbidden,
+			"Authenticator has status "+entry.Status())
+	}
+
+	if app.MinCertificationLevel == "" {
+		return
+	}
+	util.PanicIfFalse(found, http.StatusForbidden, "Authenticator is not in "+
+		"the FIDO metadata service")
+	util.PanicIfFalse(entry.CertificationLevel() >=
+		security.CertificationLevel(app.MinCertificationLevel),
+		http.StatusForbidden, "Authenticator is not certified to "+
+			app.MinCertificationLevel)
+}
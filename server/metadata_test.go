@@ -0,0 +1,180 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/tera-insights/2Q2R-enterprise/security"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeMetadata writes an MDS3 blob listing `entries`, signed by the
+// attestation certificate of `tok`, to `path`.
+func writeMetadata(t *testing.T, path string, tok *u2fToken,
+	entries ...security.MetadataEntry) {
+	encode := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		require.Nil(t, err)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := encode(map[string]interface{}{
+		"alg": "ES256",
+		"x5c": []string{base64.StdEncoding.EncodeToString(
+			tok.attestationCert)},
+	}) + "." + encode(map[string]interface{}{
+		"no":      1,
+		"entries": entries,
+	})
+
+	h := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, tok.attestationKey, h[:])
+	require.Nil(t, err)
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	blob := signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+	require.Nil(t, ioutil.WriteFile(path, []byte(blob), 0600))
+}
+
+// newTestMetadataStore loads a blob listing `entries` that is signed by a
+// trusted root.
+func newTestMetadataStore(t *testing.T,
+	entries ...security.MetadataEntry) (*metadataStore, string) {
+	tok := newU2FToken(t)
+	roots := t.TempDir()
+	require.Nil(t, ioutil.WriteFile(filepath.Join(roots, "root.pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
+			Bytes: tok.attestationCert}), 0600))
+
+	blob := filepath.Join(t.TempDir(), "blob.jwt")
+	writeMetadata(t, blob, tok, entries...)
+	ms, err := newMetadataStore(blob, roots)
+	require.Nil(t, err)
+	return ms, blob
+}
+
+func certified(level string) security.StatusReport {
+	return security.StatusReport{Status: level, EffectiveDate: "2020-01-01"}
+}
+
+func TestMetadataStore(t *testing.T) {
+	ms, err := newMetadataStore("", "")
+	require.Nil(t, err)
+	require.Nil(t, ms.get())
+	_, found := ms.lookup("abc")
+	require.False(t, found)
+	require.NotNil(t, ms.reload())
+
+	ms, blob := newTestMetadataStore(t, security.MetadataEntry{
+		AAGUID:        "ABC",
+		StatusReports: []security.StatusReport{certified("FIDO_CERTIFIED")},
+	})
+	e, found := ms.lookup("unknown", "abc")
+	require.True(t, found)
+	require.Equal(t, "FIDO_CERTIFIED", e.Status())
+
+	// A blob that is not signed by a trusted root does not replace the
+	// previous one
+	writeMetadata(t, blob, newU2FToken(t))
+	require.NotNil(t, ms.reload())
+	_, found = ms.lookup("abc")
+	require.True(t, found)
+
+	require.Nil(t, ioutil.WriteFile(blob, []byte("not a blob"), 0600))
+	require.NotNil(t, ms.reload())
+	require.Equal(t, 1, ms.get().Len())
+
+	// Nor is a server started with an invalid blob
+	_, err = newMetadataStore(blob, ms.rootsPath)
+	require.NotNil(t, err)
+}
+
+func TestCheckMetadata(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.metadata, _ = newTestMetadataStore(t, security.MetadataEntry{
+		AAGUID: "l1",
+		StatusReports: []security.StatusReport{
+			certified("FIDO_CERTIFIED_L1"),
+		},
+	}, security.MetadataEntry{
+		AttestationCertificateKeyIdentifiers: []string{"l2"},
+		StatusReports: []security.StatusReport{
+			certified("FIDO_CERTIFIED_L2"),
+		},
+	}, security.MetadataEntry{
+		AAGUID: "revoked",
+		StatusReports: []security.StatusReport{
+			certified("FIDO_CERTIFIED_L3"),
+			{Status: "REVOKED", EffectiveDate: "2021-01-01"},
+		},
+	})
+
+	for _, c := range []struct {
+		minimum string
+		id      string
+		code    int
+	}{
+		{"", "unknown", 0},
+		{"", "l1", 0},
+		{"", "revoked", http.StatusForbidden},
+		{"FIDO_CERTIFIED_L1", "unknown", http.StatusForbidden},
+		{"FIDO_CERTIFIED_L1", "l1", 0},
+		{"FIDO_CERTIFIED_L1", "l2", 0},
+		{"FIDO_CERTIFIED_L2", "l1", http.StatusForbidden},
+		{"FIDO_CERTIFIED_L2", "revoked", http.StatusForbidden},
+	} {
+		app := AppInfo{MinCertificationLevel: c.minimum}
+		require.Equal(t, c.code, panicStatus(func() {
+			s.checkMetadata(app, "", c.id)
+		}), "%s at minimum %q", c.id, c.minimum)
+	}
+}
+
+func TestAppCertificationPolicy(t *testing.T) {
+	s, ts := newTestServer(t)
+	cookie := loginSuperAdmin(t, s)
+	request := func(path string, body interface{}, reply *AppInfo) int {
+		r := newTestRequest(t, ts, "POST", path, body)
+		r.AddCookie(cookie)
+		return do(t, r, reply)
+	}
+	// Apps that do not check attestation cannot require a level
+	app := AppInfo{}
+	require.Equal(t, http.StatusBadRequest, request("/admin/app",
+		newAppRequest{AppName: "foo",
+			MinCertificationLevel: "FIDO_CERTIFIED"}, nil))
+	require.Equal(t, http.StatusBadRequest, request("/admin/app",
+		newAppRequest{AppName: "foo", AttestationPolicy: attestationDirect,
+			MinCertificationLevel: "FIDO_CERTIFIED_L9"}, nil))
+	// Every authenticator is at least NOT_FIDO_CERTIFIED
+	require.Equal(t, http.StatusOK, request("/admin/app",
+		newAppRequest{AppName: "foo",
+			MinCertificationLevel: "NOT_FIDO_CERTIFIED"}, &app))
+	require.Equal(t, "", app.MinCertificationLevel)
+
+	require.Equal(t, http.StatusBadRequest, request("/admin/app/"+app.ID,
+		appUpdateRequest{AppName: "foo",
+			MinCertificationLevel: "FIDO_CERTIFIED"}, nil))
+	require.Equal(t, http.StatusOK, request("/admin/app/"+app.ID,
+		appUpdateRequest{AppName: "foo", AttestationPolicy: attestationDirect,
+			MinCertificationLevel: "FIDO_CERTIFIED"}, &app))
+	require.Equal(t, "FIDO_CERTIFIED", app.MinCertificationLevel)
+	require.Equal(t, http.StatusBadRequest, request("/admin/app/"+app.ID,
+		appUpdateRequest{AppName: "foo", AttestationPolicy: attestationNone},
+		nil))
+	require.Equal(t, http.StatusOK, request("/admin/app/"+app.ID,
+		appUpdateRequest{AppName: "foo",
+			MinCertificationLevel: "NOT_FIDO_CERTIFIED"}, &app))
+	require.Equal(t, "", app.MinCertificationLevel)
+}
@@ -0,0 +1,171 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/felixge/httpsnoop"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/tera-insights/2Q2R-enterprise/security"
+)
+
+// Prefix of the names of the server's metrics
+const metricsNamespace = "twoq2r"
+
+// Results of registration and authentication requests
+const (
+	resultSuccess = "success"
+	resultFailure = "failure"
+	resultTimeout = "timeout"
+)
+
+// metrics holds the Prometheus collectors of a server. Each server has its own
+// registry, so that several servers can run in one process.
+type metrics struct {
+	registry *prometheus.Registry
+
+	setups   *prometheus.CounterVec // by kind and app ID
+	results  *prometheus.CounterVec // by kind, app ID and result
+	latency  *prometheus.HistogramVec
+	waitTime *prometheus.HistogramVec
+}
+
+// newMetrics creates the collectors. The gauges read the pending requests,
+// websocket listeners and key cache statistics when they are scraped.
+func newMetrics(registrations, authentications requestStore, d *disperser,
+	kc *security.KeyCache) *metrics {
+	m := &metrics{
+		prometheus.NewRegistry(),
+		prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "setups_total",
+			Help:      "Registration and authentication requests set up.",
+		}, []string{"kind", "app_id"}),
+		prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "results_total",
+			Help: "Registration and authentication requests that " +
+				"succeeded, failed or timed out.",
+		}, []string{"kind", "app_id", "result"}),
+		prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Latency of HTTP requests by route.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method", "code"}),
+		prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "wait_duration_seconds",
+			Help: "Time that /wait blocked until the request completed or " +
+				"timed out.",
+			Buckets: []float64{.1, .5, 1, 2.5, 5, 10, 20, 30, 60, 120, 180},
+		}, []string{"kind", "result"}),
+	}
+
+	m.registry.MustRegister(m.setups, m.results, m.latency, m.waitTime,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	for kind, rs := range map[string]requestStore{
+		registrationRequests:   registrations,
+		authenticationRequests: authentications,
+	} {
+		rs := rs
+		m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "pending_requests",
+			Help:        "Requests that are waiting for a result.",
+			ConstLabels: prometheus.Labels{"kind": kind},
+		}, func() float64 {
+			pending, err := rs.Pending()
+			if err != nil {
+				return math.NaN()
+			}
+			return float64(pending)
+		}))
+	}
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "websocket_listeners",
+		Help:      "Connected listeners of /admin/stats/listen.",
+	}, func() float64 {
+		return float64(d.listenerCount())
+	}))
+	for result, count := range map[string]func(security.KeyCacheStats) uint64{
+		"hit":  func(st security.KeyCacheStats) uint64 { return st.Hits },
+		"miss": func(st security.KeyCacheStats) uint64 { return st.Misses },
+	} {
+		count := count
+		m.registry.MustRegister(prometheus.NewCounterFunc(
+			prometheus.CounterOpts{
+				Namespace:   metricsNamespace,
+				Name:        "key_cache_lookups_total",
+				Help:        "Key and app ID lookups by whether they hit the cache.",
+				ConstLabels: prometheus.Labels{"result": result},
+			}, func() float64 {
+				return float64(count(kc.Stats()))
+			}))
+	}
+	return m
+}
+
+// handler serves the metrics in the Prometheus text format.
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// countSetup counts a request that was set up for `appID`.
+func (m *metrics) countSetup(kind, appID string) {
+	m.setups.WithLabelValues(kind, appID).Inc()
+}
+
+// countResult counts a request that completed with `result`.
+func (m *metrics) countResult(kind, appID, result string) {
+	m.results.WithLabelValues(kind, appID, result).Inc()
+}
+
+// countFailure counts a failed request if the handler is panicking, then
+// keeps panicking. It must be deferred.
+func (m *metrics) countFailure(kind, appID string) {
+	if err := recover(); err != nil {
+		m.countResult(kind, appID, resultFailure)
+		panic(err)
+	}
+}
+
+// observeWait records how long a wait for a request's result took.
+func (m *metrics) observeWait(kind string, start time.Time, status int,
+	timedOut bool) {
+	result := resultSuccess
+	if timedOut {
+		result = resultTimeout
+	} else if status != http.StatusOK {
+		result = resultFailure
+	}
+	m.waitTime.WithLabelValues(kind, result).Observe(
+		time.Since(start).Seconds())
+}
+
+// instrument records the latency of the requests that `h` serves, by the
+// template of the route in `router` that they match, so that paths with IDs do
+// not each get their own series. It wraps the middleware, so that the status
+// of requests that fail authentication is recorded too.
+func (m *metrics) instrument(router *mux.Router, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unmatched"
+		var match mux.RouteMatch
+		if router.Match(r, &match) && match.Route != nil {
+			if tmpl, err := match.Route.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+		snoop := httpsnoop.CaptureMetrics(h, w, r)
+		m.latency.WithLabelValues(route, r.Method,
+			strconv.Itoa(snoop.Code)).Observe(snoop.Duration.Seconds())
+	})
+}
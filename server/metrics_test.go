@@ -0,0 +1,110 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/tera-insights/2Q2R-enterprise/security"
+)
+
+func TestMetricsCountRequests(t *testing.T) {
+	conn := openTestDatabase(t, "sqlite3",
+		filepath.Join(t.TempDir(), "test.db"))
+	if err := NewMigrator(conn).Up(); err != nil {
+		t.Fatal(err)
+	}
+	st := &gormStore{conn, nil}
+	if err := st.CreateKey(security.Key{ID: "key", UserID: "user",
+		AppID: "app"}); err != nil {
+		t.Fatal(err)
+	}
+	kc := security.NewKeyCache(time.Minute, 0, nil, st, nil)
+	registrations := newMemoryRequestStore()
+	authentications := newMemoryRequestStore()
+	d := &disperser{listeners: make(map[*listener]struct{})}
+	m := newMetrics(registrations, authentications, d, kc)
+
+	for _, id := range []string{"a", "b"} {
+		err := registrations.Put(pendingRequest{RequestID: id}, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.countSetup(registrationRequests, "app")
+	}
+	registrations.SetResult("a", http.StatusOK, time.Minute)
+	m.countResult(registrationRequests, "app", resultSuccess)
+	func() {
+		defer func() { recover() }()
+		defer m.countFailure(registrationRequests, "app")
+		panic("Verification failed")
+	}()
+
+	for i := 0; i < 3; i++ {
+		if _, err := kc.Get2FAKey("key"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := `
+# HELP twoq2r_key_cache_lookups_total Key and app ID lookups by whether they hit the cache.
+# TYPE twoq2r_key_cache_lookups_total counter
+twoq2r_key_cache_lookups_total{result="hit"} 2
+twoq2r_key_cache_lookups_total{result="miss"} 1
+# HELP twoq2r_pending_requests Requests that are waiting for a result.
+# TYPE twoq2r_pending_requests gauge
+twoq2r_pending_requests{kind="authentication"} 0
+twoq2r_pending_requests{kind="registration"} 1
+# HELP twoq2r_results_total Registration and authentication requests that succeeded, failed or timed out.
+# TYPE twoq2r_results_total counter
+twoq2r_results_total{app_id="app",kind="registration",result="failure"} 1
+twoq2r_results_total{app_id="app",kind="registration",result="success"} 1
+# HELP twoq2r_setups_total Registration and authentication requests set up.
+# TYPE twoq2r_setups_total counter
+twoq2r_setups_total{app_id="app",kind="registration"} 2
+# HELP twoq2r_websocket_listeners Connected listeners of /admin/stats/listen.
+# TYPE twoq2r_websocket_listeners gauge
+twoq2r_websocket_listeners 0
+`
+	err := testutil.GatherAndCompare(m.registry, strings.NewReader(expected),
+		"twoq2r_key_cache_lookups_total", "twoq2r_pending_requests",
+		"twoq2r_results_total", "twoq2r_setups_total",
+		"twoq2r_websocket_listeners")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMetricsLabelLatencyByRoute(t *testing.T) {
+	m := newMetrics(newMemoryRequestStore(), newMemoryRequestStore(),
+		&disperser{listeners: make(map[*listener]struct{})},
+		security.NewKeyCache(time.Minute, 0, nil, nil, nil))
+	router := mux.NewRouter()
+	forMethod(router, "/v1/users/{userID}", func(w http.ResponseWriter,
+		r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}, "GET")
+	h := m.instrument(router, router)
+
+	for _, path := range []string{"/v1/users/a", "/v1/users/b", "/nowhere"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path,
+			nil))
+	}
+	if n := testutil.CollectAndCount(m.latency); n != 2 {
+		t.Errorf("Latency had %d series, expected 2", n)
+	}
+	// Looking up a series that was not recorded would add it
+	for _, route := range []string{"/v1/users/{userID}", "unmatched"} {
+		m.latency.WithLabelValues(route, "GET", "404")
+	}
+	if n := testutil.CollectAndCount(m.latency); n != 2 {
+		t.Errorf("Latency was not recorded by route template")
+	}
+}
@@ -0,0 +1,719 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"github.com/tera-insights/2Q2R-enterprise/util"
+)
+
+// migration moves the schema from version `version - 1` to `version` and,
+// with down, back. Migrations use their own copies of the models, as they were
+// at that version, so that changing a model does not change old migrations.
+type migration struct {
+	version int
+	name    string
+	up      func(tx *gorm.DB) error
+	down    func(tx *gorm.DB) error
+}
+
+// schemaMigration is the Gorm model for an applied migration. The schema is on
+// the highest applied version.
+type schemaMigration struct {
+	Version   int `gorm:"primary_key;auto_increment:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+func (schemaMigration) TableName() string { return "schema_migrations" }
+
+// Models as they were before versioned migrations. Migration 1 uses
+// AutoMigrate, so databases that were created by AutoMigrate are adopted.
+type appInfoV1 struct {
+	ID      string
+	AppName string
+}
+
+func (appInfoV1) TableName() string { return "app_infos" }
+
+type appServerInfoV1 struct {
+	ID          string
+	BaseURL     string
+	AppID       string
+	KeyType     string
+	PublicKey   []byte
+	Permissions string
+}
+
+func (appServerInfoV1) TableName() string { return "app_server_infos" }
+
+type keyV1 struct {
+	ID                     string
+	Type                   string
+	Name                   string
+	UserID                 string
+	AppID                  string
+	MarshalledRegistration []byte
+	Counter                uint32
+}
+
+func (keyV1) TableName() string { return "keys" }
+
+type adminV1 struct {
+	ID                  string
+	Status              string
+	Name                string
+	Email               string
+	Permissions         string
+	Role                string
+	PrimarySigningKeyID string
+	AdminFor            string
+}
+
+func (adminV1) TableName() string { return "admins" }
+
+type keySignatureV1 struct {
+	SigningPublicKey string `gorm:"primary_key"`
+	SignedPublicKey  string `gorm:"primary_key"`
+	Type             string
+	OwnerID          string
+	Signature        string
+}
+
+func (keySignatureV1) TableName() string { return "key_signatures" }
+
+type signingKeyV1 struct {
+	ID        string
+	IV        string
+	Salt      string
+	PublicKey string
+}
+
+func (signingKeyV1) TableName() string { return "signing_keys" }
+
+type permissionV1 struct {
+	AdminID    string `gorm:"primary_key"`
+	AppID      string `gorm:"primary_key"`
+	Permission string `gorm:"primary_key"`
+}
+
+func (permissionV1) TableName() string { return "permissions" }
+
+type longTermRequestV1 struct {
+	ID    []byte
+	AppID string
+}
+
+func (longTermRequestV1) TableName() string { return "long_term_requests" }
+
+// Version 2: WebAuthn credentials and attestation
+type keyV2 struct {
+	ID                     string
+	Type                   string
+	Name                   string
+	UserID                 string
+	AppID                  string
+	Format                 string
+	MarshalledRegistration []byte
+	CredentialPublicKey    []byte
+	Counter                uint32
+	AttestationSubject     string
+	AAGUID                 string
+}
+
+func (keyV2) TableName() string { return "keys" }
+
+// Version 3: per-app attestation policy
+type appInfoV3 struct {
+	ID                    string
+	AppName               string
+	AttestationPolicy     string
+	AllowedAuthenticators string
+	MinCertificationLevel string
+}
+
+func (appInfoV3) TableName() string { return "app_infos" }
+
+// Version 4: clone detection
+type keyV4 struct {
+	ID                     string
+	Type                   string
+	Name                   string
+	UserID                 string
+	AppID                  string
+	Format                 string
+	MarshalledRegistration []byte
+	CredentialPublicKey    []byte
+	Counter                uint32
+	AttestationSubject     string
+	AAGUID                 string
+	Suspect                bool
+	SuspectAt              *time.Time
+}
+
+func (keyV4) TableName() string { return "keys" }
+
+type appInfoV4 struct {
+	ID                    string
+	AppName               string
+	AttestationPolicy     string
+	AllowedAuthenticators string
+	MinCertificationLevel string
+	SuspendClonedKeys     bool
+}
+
+func (appInfoV4) TableName() string { return "app_infos" }
+
+// Version 5: key states
+type keyV5 struct {
+	ID                     string
+	Type                   string
+	Name                   string
+	UserID                 string
+	AppID                  string
+	Format                 string
+	MarshalledRegistration []byte
+	CredentialPublicKey    []byte
+	Counter                uint32
+	AttestationSubject     string
+	AAGUID                 string
+	Suspect                bool
+	SuspectAt              *time.Time
+	State                  string
+	ExpiresAt              *time.Time
+}
+
+func (keyV5) TableName() string { return "keys" }
+
+// Version 6: server-side admin sessions
+type adminSessionV6 struct {
+	ID        string
+	AdminID   string
+	IP        string
+	UserAgent string
+	CreatedAt time.Time
+	LastSeen  time.Time
+}
+
+func (adminSessionV6) TableName() string { return "admin_sessions" }
+
+type dataKeyV8 struct {
+	ID          string
+	WrappedKey  []byte
+	MasterKeyID string
+	SealsAll    bool
+	CreatedAt   time.Time
+}
+
+func (dataKeyV8) TableName() string { return "data_keys" }
+
+type requestStateV9 struct {
+	Kind      string `gorm:"primary_key"`
+	ID        string `gorm:"primary_key"`
+	Challenge string `gorm:"index"`
+	Request   []byte
+	Status    int
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+func (requestStateV9) TableName() string { return "request_states" }
+
+type eventV10 struct {
+	ID            uint64 `gorm:"primary_key"`
+	Name          string `gorm:"index"`
+	OriginalIP    string
+	OriginalLat   float64
+	OriginalLong  float64
+	ResolvingIP   string
+	ResolvingLat  float64
+	ResolvingLong float64
+	AppID         string    `gorm:"index"`
+	Timestamp     time.Time `gorm:"column:occurred_at;index"`
+	Status        string    `gorm:"index"`
+	UserID        string    `gorm:"index"`
+}
+
+func (eventV10) TableName() string { return "events" }
+
+type webhookV11 struct {
+	ID         string
+	AppID      string `gorm:"index"`
+	URL        string
+	Secret     string
+	EventTypes string
+	Active     bool
+	CreatedAt  time.Time
+}
+
+func (webhookV11) TableName() string { return "webhooks" }
+
+type webhookDeliveryV11 struct {
+	ID          uint64 `gorm:"primary_key"`
+	WebhookID   string `gorm:"index"`
+	AppID       string `gorm:"index"`
+	EventID     uint64
+	EventType   string
+	Payload     []byte
+	State       string `gorm:"index"`
+	Attempts    int
+	NextAttempt time.Time `gorm:"index"`
+	LastStatus  int
+	LastError   string
+	CreatedAt   time.Time
+}
+
+func (webhookDeliveryV11) TableName() string { return "webhook_deliveries" }
+
+type eventV12 struct {
+	eventV10
+	OriginalCountry  string
+	OriginalCity     string
+	OriginalASN      uint
+	ResolvingCountry string
+	ResolvingCity    string
+	ResolvingASN     uint
+}
+
+func (eventV12) TableName() string { return "events" }
+
+type appInfoV13 struct {
+	ID                    string
+	AppName               string
+	AttestationPolicy     string
+	AllowedAuthenticators string
+	MinCertificationLevel string
+	SuspendClonedKeys     bool
+	AnomalyThreshold      int
+	MaxTravelSpeed        float64
+}
+
+func (appInfoV13) TableName() string { return "app_infos" }
+
+type eventV13 struct {
+	eventV12
+	RiskScore   int
+	RiskReasons string
+	CauseID     uint64
+}
+
+func (eventV13) TableName() string { return "events" }
+
+// migrations are all the migrations, in order. Only ever append to them.
+var migrations = []migration{{
+	version: 1,
+	name:    "Initial schema",
+	up: func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&appInfoV1{}, &appServerInfoV1{}, &keyV1{},
+			&adminV1{}, &keySignatureV1{}, &signingKeyV1{}, &permissionV1{},
+			&longTermRequestV1{}).Error
+	},
+	down: func(tx *gorm.DB) error {
+		return tx.DropTableIfExists(&appInfoV1{}, &appServerInfoV1{},
+			&keyV1{}, &adminV1{}, &keySignatureV1{}, &signingKeyV1{},
+			&permissionV1{}, &longTermRequestV1{}).Error
+	},
+}, {
+	version: 2,
+	name:    "Add WebAuthn credentials and attestation to keys",
+	up: func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&keyV2{}).Error
+	},
+	down: func(tx *gorm.DB) error {
+		return dropColumns(tx, &keyV1{}, "Format", "CredentialPublicKey",
+			"AttestationSubject", "AAGUID")
+	},
+}, {
+	version: 3,
+	name:    "Add attestation policy to apps",
+	up: func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&appInfoV3{}).Error
+	},
+	down: func(tx *gorm.DB) error {
+		return dropColumns(tx, &appInfoV1{}, "AttestationPolicy",
+			"AllowedAuthenticators", "MinCertificationLevel")
+	},
+}, {
+	version: 4,
+	name:    "Add clone detection",
+	up: func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&keyV4{}, &appInfoV4{}).Error
+	},
+	down: func(tx *gorm.DB) error {
+		err := dropColumns(tx, &keyV2{}, "Suspect", "SuspectAt")
+		if err != nil {
+			return err
+		}
+		return dropColumns(tx, &appInfoV3{}, "SuspendClonedKeys")
+	},
+}, {
+	version: 5,
+	name:    "Add key states",
+	up: func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&keyV5{}).Error
+	},
+	down: func(tx *gorm.DB) error {
+		return dropColumns(tx, &keyV4{}, "State", "ExpiresAt")
+	},
+}, {
+	version: 6,
+	name:    "Add admin sessions",
+	up: func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&adminSessionV6{}).Error
+	},
+	down: func(tx *gorm.DB) error {
+		return tx.DropTableIfExists(&adminSessionV6{}).Error
+	},
+}, {
+	version: 7,
+	name:    "Decode the public keys of app servers",
+	up: func(tx *gorm.DB) error {
+		return recodeServerPublicKeys(tx, func(pub []byte) []byte {
+			if isCurvePoint(pub) {
+				return nil
+			}
+			decoded, err := util.DecodeBase64(string(pub))
+			if err != nil || !isCurvePoint(decoded) {
+				return nil
+			}
+			return decoded
+		})
+	},
+	down: func(tx *gorm.DB) error {
+		return recodeServerPublicKeys(tx, func(pub []byte) []byte {
+			if !isCurvePoint(pub) {
+				return nil
+			}
+			return []byte(util.EncodeBase64(pub))
+		})
+	},
+}, {
+	version: 8,
+	name:    "Add data keys for encryption at rest",
+	up: func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&dataKeyV8{}).Error
+	},
+	down: func(tx *gorm.DB) error {
+		return tx.DropTableIfExists(&dataKeyV8{}).Error
+	},
+}, {
+	version: 9,
+	name:    "Add shared state of in-flight requests",
+	up: func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&requestStateV9{}).Error
+	},
+	down: func(tx *gorm.DB) error {
+		return tx.DropTableIfExists(&requestStateV9{}).Error
+	},
+}, {
+	version: 10,
+	name:    "Add the security event log",
+	up: func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&eventV10{}).Error
+	},
+	down: func(tx *gorm.DB) error {
+		return tx.DropTableIfExists(&eventV10{}).Error
+	},
+}, {
+	version: 11,
+	name:    "Add webhooks and their delivery queue",
+	up: func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&webhookV11{}, &webhookDeliveryV11{}).Error
+	},
+	down: func(tx *gorm.DB) error {
+		return tx.DropTableIfExists(&webhookDeliveryV11{}, &webhookV11{}).Error
+	},
+}, {
+	version: 12,
+	name:    "Add countries, cities and ASNs to events",
+	up: func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&eventV12{}).Error
+	},
+	down: func(tx *gorm.DB) error {
+		return dropColumns(tx, &eventV10{}, "OriginalCountry", "OriginalCity",
+			"OriginalASN", "ResolvingCountry", "ResolvingCity", "ResolvingASN")
+	},
+}, {
+	version: 13,
+	name:    "Add anomaly detection",
+	up: func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&appInfoV13{}, &eventV13{}).Error
+	},
+	down: func(tx *gorm.DB) error {
+		err := dropColumns(tx, &eventV12{}, "RiskScore", "RiskReasons",
+			"CauseID")
+		if err != nil {
+			return err
+		}
+		return dropColumns(tx, &appInfoV4{}, "AnomalyThreshold",
+			"MaxTravelSpeed")
+	},
+}}
+
+// LatestSchemaVersion returns the schema version that this server runs on.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// dropColumns drops the columns of `fields` from the table of `model`, which
+// must be the model as it was without them. SQLite cannot drop columns, so
+// there the table is rebuilt from `model`.
+func dropColumns(tx *gorm.DB, model interface{}, fields ...string) error {
+	if tx.Dialect().GetName() != "sqlite3" {
+		for _, f := range fields {
+			err := tx.Model(model).DropColumn(gorm.ToDBName(f)).Error
+			if err != nil {
+				return errors.Wrapf(err, "Could not drop column for %s", f)
+			}
+		}
+		return nil
+	}
+
+	scope := tx.NewScope(model)
+	table := scope.TableName()
+	old := table + "_old"
+	var columns []string
+	for _, f := range scope.Fields() {
+		if f.IsNormal {
+			columns = append(columns, scope.Quote(f.DBName))
+		}
+	}
+	list := strings.Join(columns, ", ")
+
+	err := tx.Exec("ALTER TABLE " + scope.Quote(table) + " RENAME TO " +
+		scope.Quote(old)).Error
+	if err != nil {
+		return errors.Wrapf(err, "Could not rename %s", table)
+	}
+
+	// The indexes moved with the old table, but the new one needs their names
+	var indexes []string
+	err = tx.Raw("SELECT name FROM sqlite_master WHERE type = 'index' AND "+
+		"tbl_name = ? AND sql IS NOT NULL", old).Pluck("name", &indexes).Error
+	if err != nil {
+		return errors.Wrapf(err, "Could not list indexes of %s", table)
+	}
+	for _, index := range indexes {
+		if err = tx.Exec("DROP INDEX " + scope.Quote(index)).Error; err != nil {
+			return errors.Wrapf(err, "Could not drop index %s", index)
+		}
+	}
+	if err = tx.CreateTable(model).Error; err != nil {
+		return errors.Wrapf(err, "Could not recreate %s", table)
+	}
+	err = tx.Exec("INSERT INTO " + scope.Quote(table) + " (" + list + ") " +
+		"SELECT " + list + " FROM " + scope.Quote(old)).Error
+	if err != nil {
+		return errors.Wrapf(err, "Could not copy %s", table)
+	}
+	return tx.DropTable(old).Error
+}
+
+// MigrationStatus describes a migration and whether it has been applied.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time // nil if the migration has not been applied
+}
+
+// Migrator moves a database between schema versions.
+type Migrator struct {
+	db *gorm.DB
+}
+
+// NewMigrator returns a Migrator for `db`.
+func NewMigrator(db *gorm.DB) *Migrator {
+	return &Migrator{db}
+}
+
+// OpenMigrator opens the database of `c`.
+func OpenMigrator(c *Config) (*Migrator, error) {
+	db, err := gorm.Open(c.DatabaseType, c.DatabaseName)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not open database")
+	}
+	return NewMigrator(db), nil
+}
+
+// Close closes the database.
+func (m *Migrator) Close() error {
+	return m.db.Close()
+}
+
+// applied returns the applied migrations.
+func (m *Migrator) applied() ([]schemaMigration, error) {
+	var found []schemaMigration
+	if !m.db.HasTable(&schemaMigration{}) {
+		return found, nil
+	}
+	err := m.db.Order("version").Find(&found).Error
+	return found, err
+}
+
+// Version returns the database's schema version. A database without any
+// applied migrations is on version 0.
+func (m *Migrator) Version() (int, error) {
+	found, err := m.applied()
+	if err != nil {
+		return 0, errors.Wrap(err, "Could not read schema version")
+	}
+	if len(found) == 0 {
+		return 0, nil
+	}
+	return found[len(found)-1].Version, nil
+}
+
+// Status lists every migration that this server knows about, followed by any
+// applied migrations that it does not know about.
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	found, err := m.applied()
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not read applied migrations")
+	}
+	appliedAt := make(map[int]time.Time)
+	for _, sm := range found {
+		appliedAt[sm.Version] = sm.AppliedAt
+	}
+
+	var status []MigrationStatus
+	for _, mig := range migrations {
+		ms := MigrationStatus{Version: mig.version, Name: mig.name}
+		if t, ok := appliedAt[mig.version]; ok {
+			ms.AppliedAt = &t
+		}
+		status = append(status, ms)
+	}
+	for _, sm := range found {
+		if sm.Version > LatestSchemaVersion() {
+			t := sm.AppliedAt
+			status = append(status, MigrationStatus{sm.Version, sm.Name, &t})
+		}
+	}
+	return status, nil
+}
+
+// Up migrates the database to LatestSchemaVersion.
+func (m *Migrator) Up() error {
+	return m.To(LatestSchemaVersion())
+}
+
+// Down reverts the database's last migration.
+func (m *Migrator) Down() error {
+	version, err := m.Version()
+	if err != nil {
+		return err
+	}
+	if version == 0 {
+		return errors.New("No migrations to revert")
+	}
+	return m.To(version - 1)
+}
+
+// To migrates the database up or down to `target`, one migration per
+// transaction.
+func (m *Migrator) To(target int) error {
+	if target < 0 || target > LatestSchemaVersion() {
+		return errors.Errorf("Unknown schema version %d; the latest is %d",
+			target, LatestSchemaVersion())
+	}
+	version, err := m.Version()
+	if err != nil {
+		return err
+	}
+	if version > LatestSchemaVersion() {
+		return errors.Errorf("Database is on schema version %d, which is "+
+			"newer than this server's %d", version, LatestSchemaVersion())
+	}
+
+	if err = m.db.AutoMigrate(&schemaMigration{}).Error; err != nil {
+		return errors.Wrap(err, "Could not create schema version table")
+	}
+	for ; version < target; version++ {
+		mig := migrations[version]
+		err = m.apply(mig.up, func(tx *gorm.DB) error {
+			return tx.Create(&schemaMigration{
+				Version:   mig.version,
+				Name:      mig.name,
+				AppliedAt: time.Now(),
+			}).Error
+		})
+		if err != nil {
+			return errors.Wrapf(err, "Could not apply migration %d",
+				mig.version)
+		}
+	}
+	for ; version > target; version-- {
+		mig := migrations[version-1]
+		err = m.apply(mig.down, func(tx *gorm.DB) error {
+			return tx.Delete(schemaMigration{}, &schemaMigration{
+				Version: mig.version,
+			}).Error
+		})
+		if err != nil {
+			return errors.Wrapf(err, "Could not revert migration %d",
+				mig.version)
+		}
+	}
+	return nil
+}
+
+// apply runs `change` and then `record` in a transaction.
+func (m *Migrator) apply(change, record func(tx *gorm.DB) error) error {
+	tx := m.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if err := change(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := record(tx); err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "Could not record schema version")
+	}
+	return tx.Commit().Error
+}
+
+// checkSchemaVersion returns an error unless the database is on
+// LatestSchemaVersion.
+func checkSchemaVersion(db *gorm.DB) error {
+	version, err := NewMigrator(db).Version()
+	if err != nil {
+		return err
+	}
+	if version < LatestSchemaVersion() {
+		return errors.Errorf("Database is on schema version %d but this "+
+			"server needs %d. Run cmd/migrate up", version,
+			LatestSchemaVersion())
+	}
+	if version > LatestSchemaVersion() {
+		return errors.Errorf("Database is on schema version %d, which is "+
+			"newer than this server's %d", version, LatestSchemaVersion())
+	}
+	return nil
+}
+
+// recodeServerPublicKeys replaces the public key of each app server with what
+// `recode` returns for it, unless that is nil.
+func recodeServerPublicKeys(tx *gorm.DB, recode func([]byte) []byte) error {
+	var servers []appServerInfoV1
+	if err := tx.Find(&servers).Error; err != nil {
+		return errors.Wrap(err, "Could not load app servers")
+	}
+	for _, info := range servers {
+		pub := recode(info.PublicKey)
+		if pub == nil {
+			continue
+		}
+		err := tx.Model(&appServerInfoV1{}).Where("id = ?", info.ID).Update(
+			"public_key", pub).Error
+		if err != nil {
+			return errors.Wrapf(err, "Could not update app server %s",
+				info.ID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tera-insights/2Q2R-enterprise/security"
+	"github.com/tera-insights/2Q2R-enterprise/util"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Models that the latest migration must have created tables for
+var migratedModels = []interface{}{
+	&AppInfo{},
+	&AppServerInfo{},
+	&security.Key{},
+	&Admin{},
+	&security.KeySignature{},
+	&security.SigningKey{},
+	&Permission{},
+	&LongTermRequest{},
+	&AdminSession{},
+	&dataKey{},
+	&requestState{},
+	&event{},
+	&Webhook{},
+	&webhookDelivery{},
+}
+
+// testDatabases returns the databases to run migrations against: a new
+// SQLite file and, if TEST_POSTGRES_DSN is set, that PostgreSQL database,
+// which should be empty.
+func testDatabases(t *testing.T) map[string][2]string {
+	dbs := map[string][2]string{
+		"sqlite": {"sqlite3", filepath.Join(t.TempDir(), "test.db")},
+	}
+	if dsn := os.Getenv("TEST_POSTGRES_DSN"); dsn != "" {
+		dbs["postgres"] = [2]string{"postgres", dsn}
+	} else {
+		t.Log("TEST_POSTGRES_DSN is not set; skipping PostgreSQL")
+	}
+	return dbs
+}
+
+func openTestDatabase(t *testing.T, dialect, name string) *gorm.DB {
+	db, err := gorm.Open(dialect, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func checkVersion(t *testing.T, m *Migrator, expected int) {
+	version, err := m.Version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != expected {
+		t.Fatalf("Database was on version %d, expected %d", version, expected)
+	}
+}
+
+func TestMigrateUpAndDown(t *testing.T) {
+	for kind, db := range testDatabases(t) {
+		t.Run(kind, func(t *testing.T) {
+			conn := openTestDatabase(t, db[0], db[1])
+			m := NewMigrator(conn)
+			checkVersion(t, m, 0)
+
+			if err := m.Up(); err != nil {
+				t.Fatal(err)
+			}
+			checkVersion(t, m, LatestSchemaVersion())
+
+			// The migrations must create every column of the models
+			for _, model := range migratedModels {
+				scope := conn.NewScope(model)
+				for _, f := range scope.Fields() {
+					if f.IsNormal && !conn.Dialect().HasColumn(
+						scope.TableName(), f.DBName) {
+						t.Errorf("Table %s is missing column %s",
+							scope.TableName(), f.DBName)
+					}
+				}
+			}
+
+			now := time.Now()
+			err := conn.Create(&security.Key{
+				ID:        "key",
+				UserID:    "user",
+				AppID:     "app",
+				Counter:   7,
+				State:     security.KeyStateActive,
+				ExpiresAt: &now,
+			}).Error
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Step down to the initial schema; rows must survive
+			for v := LatestSchemaVersion() - 1; v >= 1; v-- {
+				if err := m.Down(); err != nil {
+					t.Fatal(err)
+				}
+				checkVersion(t, m, v)
+			}
+			var k keyV1
+			if err := conn.First(&k, &keyV1{ID: "key"}).Error; err != nil {
+				t.Fatal(err)
+			}
+			if k.Counter != 7 || k.UserID != "user" {
+				t.Errorf("Key was not kept: %+v", k)
+			}
+			if conn.Dialect().HasColumn("keys", "state") {
+				t.Error("Column state was not dropped")
+			}
+
+			if err := m.To(0); err != nil {
+				t.Fatal(err)
+			}
+			checkVersion(t, m, 0)
+			if conn.HasTable("keys") {
+				t.Error("Table keys was not dropped")
+			}
+			if err := m.Down(); err == nil {
+				t.Error("Reverted a migration on an empty database")
+			}
+
+			// And back up again
+			if err := m.Up(); err != nil {
+				t.Fatal(err)
+			}
+			checkVersion(t, m, LatestSchemaVersion())
+			if err := m.To(0); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestMigrateAdoptsAutoMigratedDatabase(t *testing.T) {
+	for kind, db := range testDatabases(t) {
+		t.Run(kind, func(t *testing.T) {
+			conn := openTestDatabase(t, db[0], db[1])
+			if err := conn.AutoMigrate(migratedModels...).Error; err != nil {
+				t.Fatal(err)
+			}
+			err := conn.Create(&AppInfo{ID: "app", AppName: "Kept"}).Error
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m := NewMigrator(conn)
+			if err := m.Up(); err != nil {
+				t.Fatal(err)
+			}
+			checkVersion(t, m, LatestSchemaVersion())
+
+			var app AppInfo
+			if err := conn.First(&app, &AppInfo{ID: "app"}).Error; err != nil {
+				t.Fatal(err)
+			}
+			if app.AppName != "Kept" {
+				t.Errorf("App was not kept: %+v", app)
+			}
+			if err := m.To(0); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestStoreRefusesWrongSchemaVersion(t *testing.T) {
+	for kind, db := range testDatabases(t) {
+		t.Run(kind, func(t *testing.T) {
+			conn := openTestDatabase(t, db[0], db[1])
+			m := NewMigrator(conn)
+
+			if _, err := openGormStore(db[0], db[1], 1, nil); err == nil {
+				t.Error("Opened an unmigrated database")
+			}
+
+			if err := m.To(LatestSchemaVersion() - 1); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := openGormStore(db[0], db[1], 1, nil); err == nil {
+				t.Error("Opened a database that is behind")
+			}
+
+			if err := m.Up(); err != nil {
+				t.Fatal(err)
+			}
+			st, err := openGormStore(db[0], db[1], 1, nil)
+			if err != nil {
+				t.Fatalf("Could not open a migrated database: %v", err)
+			}
+			st.db.Close()
+
+			// A newer server migrated the database further
+			err = conn.Create(&schemaMigration{
+				Version: LatestSchemaVersion() + 1,
+				Name:    "From the future",
+			}).Error
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := openGormStore(db[0], db[1], 1, nil); err == nil {
+				t.Error("Opened a database that is ahead")
+			}
+			if err := m.To(0); err == nil {
+				t.Error("Migrated down from an unknown version")
+			}
+
+			err = conn.Delete(schemaMigration{}, &schemaMigration{
+				Version: LatestSchemaVersion() + 1,
+			}).Error
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := m.To(0); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestMigrateDecodesServerPublicKeys(t *testing.T) {
+	for kind, db := range testDatabases(t) {
+		t.Run(kind, func(t *testing.T) {
+			conn := openTestDatabase(t, db[0], db[1])
+			m := NewMigrator(conn)
+			if err := m.To(6); err != nil {
+				t.Fatal(err)
+			}
+
+			pub := newPublicKey(t)
+			encoded := []byte(util.EncodeBase64(pub))
+			stored := map[string][]byte{
+				"encoded": encoded,
+				"decoded": pub,
+				"invalid": []byte("not a key"),
+			}
+			for id, key := range stored {
+				err := conn.Create(&appServerInfoV1{ID: id,
+					PublicKey: key}).Error
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			check := func(expected map[string][]byte) {
+				for id, key := range expected {
+					var info appServerInfoV1
+					if err := conn.First(&info, "id = ?", id).Error; err != nil {
+						t.Fatal(err)
+					}
+					if !bytes.Equal(info.PublicKey, key) {
+						t.Errorf("Server %s had public key %q, expected %q", id,
+							info.PublicKey, key)
+					}
+				}
+			}
+
+			if err := m.Up(); err != nil {
+				t.Fatal(err)
+			}
+			check(map[string][]byte{"encoded": pub, "decoded": pub,
+				"invalid": stored["invalid"]})
+
+			if err := m.To(6); err != nil {
+				t.Fatal(err)
+			}
+			check(map[string][]byte{"encoded": encoded, "decoded": encoded,
+				"invalid": stored["invalid"]})
+			if err := m.To(0); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
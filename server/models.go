@@ -2,10 +2,36 @@
 
 package server
 
+import "time"
+
 // AppInfo is the Gorm model that holds information about an app.
 type AppInfo struct {
 	ID      string `json:"appID"`
 	AppName string `json:"appName"`
+
+	// Either "none" (the default), "indirect" or "direct"
+	AttestationPolicy string `json:"attestationPolicy"`
+
+	// JSON array of AAGUIDs and attestation key identifiers that may
+	// register. Empty to allow any trusted authenticator.
+	AllowedAuthenticators string `json:"allowedAuthenticators"`
+
+	// Lowest FIDO certification status, e.g. "FIDO_CERTIFIED_L1", that new
+	// authenticators must have. Empty to allow uncertified authenticators.
+	MinCertificationLevel string `json:"minCertificationLevel"`
+
+	// Whether keys that look cloned are suspended until an admin clears them,
+	// rather than only being flagged as suspect
+	SuspendClonedKeys bool `json:"suspendClonedKeys"`
+
+	// Lowest risk score, out of 100, of a successful authentication that
+	// emits an anomaly event. 0 for the default, defaultAnomalyThreshold;
+	// above 100 to turn anomaly detection off.
+	AnomalyThreshold int `json:"anomalyThreshold"`
+
+	// Fastest that users can travel between authentications, in km/h. 0 for
+	// the default, defaultMaxTravelSpeed.
+	MaxTravelSpeed float64 `json:"maxTravelSpeed"`
 }
 
 // AppServerInfo is the Gorm model that holds information about an app server.
@@ -21,7 +47,7 @@ type AppServerInfo struct {
 	// P256, etc.
 	KeyType string `json:"keyType"`
 
-	// JSON
+	// Marshalled P-256 point
 	PublicKey []byte `json:"publicKey"`
 
 	// JSON array containing a subset of ["Register", "Delete", "Login"]
@@ -63,3 +89,14 @@ type Permission struct {
 	// Must be inside the valid list of permissions
 	Permission string `gorm:"primary_key" json:"permission"`
 }
+
+// AdminSession is the Gorm model for an admin's login session. The
+// admin-session cookie holds its ID.
+type AdminSession struct {
+	ID        string    `json:"sessionID"`
+	AdminID   string    `json:"adminID"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent"`
+	CreatedAt time.Time `json:"createdAt"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
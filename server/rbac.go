@@ -0,0 +1,189 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/tera-insights/2Q2R-enterprise/util"
+
+	glob "github.com/ryanuber/go-glob"
+)
+
+// Admin roles and statuses.
+const (
+	roleSuperAdmin = "superadmin"
+	roleAdmin      = "admin"
+
+	adminActive   = "active"
+	adminInactive = "inactive"
+)
+
+// Permissions that can be granted to admins through Permission rows.
+// Superadmins have every permission.
+const (
+	permissionAdmins      = "Admins"
+	permissionApps        = "Apps"
+	permissionServers     = "Servers"
+	permissionLongTerm    = "LongTermRequests"
+	permissionPermissions = "Permissions"
+	permissionKeys        = "Keys"
+	permissionAnalytics   = "Analytics"
+)
+
+// adminRoute declares who may call an admin route.
+type adminRoute struct {
+	pattern    string
+	method     string // empty for every method
+	permission string // empty if every active admin may call it
+	superOnly  bool
+
+	// Whether requests need a nonce from GET /admin/nonce/{adminID} in the
+	// X-Nonce header. Nonces only need the session, so they stop replayed and
+	// cross-site requests, not someone holding a stolen session.
+	nonce bool
+}
+
+// Header that admin requests carry their nonce in
+const nonceHeader = "X-Nonce"
+
+// adminRoutes lists the admin routes. The first match wins. Routes that are not
+// listed are only open to superadmins. Handlers must additionally check that
+// app-scoped admins only touch their own app; see adminSession.requireApp.
+var adminRoutes = []adminRoute{
+	{"/admin/new", "POST", permissionAdmins, false, false},
+	{"/admin/logout", "POST", "", false, false},
+	{"/admin/session/*", "", "", true, false},
+	{"/admin/admin/roles", "POST", "", true, true},
+	{"/admin/admin/*", "DELETE", "", true, true},
+	{"/admin/admin*", "", permissionAdmins, false, false},
+
+	{"/admin/app/*/webhooks*", "", permissionApps, false, false},
+	{"/admin/app", "GET", "", false, false},
+	{"/admin/app", "POST", "", true, false},
+	{"/admin/app/*", "DELETE", "", true, true},
+	{"/admin/app/*", "POST", permissionApps, false, false},
+
+	{"/admin/server*", "", permissionServers, false, false},
+	{"/admin/signing-key*", "", "", true, false},
+	{"/admin/ltr*", "", permissionLongTerm, false, false},
+	{"/admin/permission*", "GET", permissionPermissions, false, false},
+	{"/admin/permission*", "", permissionPermissions, false, true},
+	{"/admin/key/*", "", permissionKeys, false, false},
+
+	{"/admin/metadata/reload", "", "", true, false},
+	{"/admin/metadata/*", "GET", "", false, false},
+
+	{"/admin/stats/*", "GET", permissionAnalytics, false, false},
+	{"/admin/events", "GET", permissionAnalytics, false, false},
+	{"/admin/nonce/*", "GET", "", false, false},
+}
+
+func adminRouteFor(r *http.Request) adminRoute {
+	for _, route := range adminRoutes {
+		if glob.Glob(route.pattern, r.URL.Path) &&
+			(route.method == "" || route.method == r.Method) {
+			return route
+		}
+	}
+	return adminRoute{superOnly: true}
+}
+
+// adminSession is the admin behind an authenticated admin request.
+type adminSession struct {
+	Admin     Admin
+	SessionID string
+
+	// Permissions granted either for the admin's app or globally
+	permissions map[string]bool
+}
+
+func (as adminSession) isSuper() bool {
+	return as.Admin.Role == roleSuperAdmin
+}
+
+func (as adminSession) hasPermission(p string) bool {
+	return as.isSuper() || as.permissions[p]
+}
+
+// canActFor returns whether the admin may touch resources of app `appID`.
+func (as adminSession) canActFor(appID string) bool {
+	return as.isSuper() || appID == as.Admin.AdminFor
+}
+
+// requireApp panics unless the admin may touch resources of app `appID`.
+func (as adminSession) requireApp(appID string) {
+	util.PanicIfFalse(as.canActFor(appID), http.StatusForbidden,
+		"Admin cannot act for app "+appID)
+}
+
+// requireGrantable panics unless the admin may grant `p`. Only superadmins
+// may grant permissions to themselves or grant the Permissions permission, so
+// that admins cannot raise their own privileges, directly or through another
+// admin.
+func (as adminSession) requireGrantable(p Permission) {
+	as.requireApp(p.AppID)
+	if as.isSuper() {
+		return
+	}
+	util.PanicIfFalse(p.AdminID != as.Admin.ID, http.StatusForbidden,
+		"Admins cannot grant permissions to themselves")
+	util.PanicIfFalse(p.Permission != permissionPermissions,
+		http.StatusForbidden, "Only superadmins can grant the "+
+			permissionPermissions+" permission")
+}
+
+// scope returns the app ID to filter listings by: the admin's app, or empty
+// for superadmins, who see everything.
+func (as adminSession) scope() string {
+	if as.isSuper() {
+		return ""
+	}
+	return as.Admin.AdminFor
+}
+
+type adminSessionKey struct{}
+
+// authorizeAdmin loads the admin of session `sess`, checks that they may call
+// the route of `r` and returns the request with the admin attached, for
+// handlers to read with adminFor.
+func (s *Server) authorizeAdmin(r *http.Request,
+	sess AdminSession) *http.Request {
+	a, err := s.Store.GetAdmin(sess.AdminID)
+	util.OptionalPanic(err, http.StatusUnauthorized, "Could not find admin")
+	util.PanicIfFalse(a.Status == adminActive, http.StatusForbidden,
+		"Admin is not active")
+
+	granted, err := s.Store.GetAdminPermissions(a.ID, a.AdminFor, "1")
+	util.OptionalInternalPanic(err, "Could not load admin permissions")
+
+	as := adminSession{a, sess.ID, make(map[string]bool)}
+	for _, p := range granted {
+		as.permissions[p.Permission] = true
+	}
+
+	route := adminRouteFor(r)
+	util.PanicIfFalse(!route.superOnly || as.isSuper(), http.StatusForbidden,
+		"Only superadmins can do this")
+	if route.permission != "" {
+		util.PanicIfFalse(as.hasPermission(route.permission),
+			http.StatusForbidden, "Admin does not have the "+
+				route.permission+" permission")
+	}
+	if route.nonce {
+		err := s.ng.UseNonce(r.Header.Get(nonceHeader), a.ID, r.Method,
+			r.URL.Path)
+		util.OptionalPanic(err, http.StatusForbidden, "Request needs a valid "+
+			"nonce for "+r.Method+" "+r.URL.Path)
+	}
+	return r.WithContext(context.WithValue(r.Context(), adminSessionKey{}, as))
+}
+
+// adminFor returns the admin that made an authorized admin request.
+func adminFor(r *http.Request) adminSession {
+	as, ok := r.Context().Value(adminSessionKey{}).(adminSession)
+	util.PanicIfFalse(ok, http.StatusUnauthorized, "Request was not made by "+
+		"an admin")
+	return as
+}
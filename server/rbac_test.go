@@ -0,0 +1,254 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminRouteFor(t *testing.T) {
+	for _, c := range []struct {
+		method, path string
+		expected     adminRoute
+	}{
+		{"GET", "/admin/admin", adminRoute{"/admin/admin*", "",
+			permissionAdmins, false, false}},
+		{"POST", "/admin/admin/roles", adminRoute{"/admin/admin/roles",
+			"POST", "", true, true}},
+		{"DELETE", "/admin/admin/foo", adminRoute{"/admin/admin/*", "DELETE",
+			"", true, true}},
+		// Webhook routes are matched before the app routes that share their
+		// prefix
+		{"DELETE", "/admin/app/foo/webhooks/bar", adminRoute{
+			"/admin/app/*/webhooks*", "", permissionApps, false, false}},
+		{"DELETE", "/admin/app/foo", adminRoute{"/admin/app/*", "DELETE", "",
+			true, true}},
+		{"POST", "/admin/app/foo", adminRoute{"/admin/app/*", "POST",
+			permissionApps, false, false}},
+		{"GET", "/admin/permission", adminRoute{"/admin/permission*", "GET",
+			permissionPermissions, false, false}},
+		{"POST", "/admin/permission", adminRoute{"/admin/permission*", "",
+			permissionPermissions, false, true}},
+		{"POST", "/admin/metadata/reload", adminRoute{
+			"/admin/metadata/reload", "", "", true, false}},
+		{"GET", "/admin/events", adminRoute{"/admin/events", "GET",
+			permissionAnalytics, false, false}},
+
+		// Routes and methods that are not listed are only for superadmins
+		{"GET", "/admin/unknown", adminRoute{superOnly: true}},
+		{"PUT", "/admin/app", adminRoute{superOnly: true}},
+		{"POST", "/admin/stats/recent", adminRoute{superOnly: true}},
+	} {
+		r := httptest.NewRequest(c.method, c.path, nil)
+		require.Equal(t, c.expected, adminRouteFor(r), "%s %s", c.method,
+			c.path)
+	}
+}
+
+func TestAppAdminsAreScopedToTheirApp(t *testing.T) {
+	s, ts := newTestServer(t)
+	app := newTestApp(t, s, "foo")
+	other := newTestApp(t, s, "bar")
+	mine := newTestAppServer(t, s, app.ID)
+	newTestAppServer(t, s, other.ID)
+
+	cookie := loginAdmin(t, s, Admin{ID: "admin", Role: roleAdmin,
+		AdminFor: app.ID})
+	// Permissions granted for another app do not count
+	require.Nil(t, s.Store.CreatePermissions([]Permission{
+		{"admin", app.ID, permissionApps},
+		{"admin", other.ID, permissionServers},
+	}))
+
+	request := func(method, path string, body interface{}) int {
+		r := newTestRequest(t, ts, method, path, body)
+		r.AddCookie(cookie)
+		return do(t, r, nil)
+	}
+	update := appUpdateRequest{AppName: "baz"}
+	require.Equal(t, http.StatusOK, request("POST", "/admin/app/"+app.ID,
+		update))
+	require.Equal(t, http.StatusForbidden, request("POST",
+		"/admin/app/"+other.ID, update))
+	renamed, err := s.Store.GetApp(app.ID)
+	require.Nil(t, err)
+	require.Equal(t, "baz", renamed.AppName)
+	renamed, err = s.Store.GetApp(other.ID)
+	require.Nil(t, err)
+	require.Equal(t, "bar", renamed.AppName)
+	// Updates do not create apps either
+	apps, err := s.Store.GetApps("")
+	require.Nil(t, err)
+	require.Len(t, apps, 2)
+
+	require.Equal(t, http.StatusForbidden, request("GET", "/admin/server",
+		nil))
+	require.Equal(t, http.StatusForbidden, request("GET",
+		"/admin/signing-key", nil))
+	require.Equal(t, http.StatusForbidden, request("DELETE",
+		"/admin/app/"+app.ID, nil))
+
+	// Once granted, listings only show the admin's app
+	require.Nil(t, s.Store.CreatePermissions([]Permission{
+		{"admin", app.ID, permissionServers},
+	}))
+	r := newTestRequest(t, ts, "GET", "/admin/server", nil)
+	r.AddCookie(cookie)
+	var servers []AppServerInfo
+	require.Equal(t, http.StatusOK, do(t, r, &servers))
+	require.Len(t, servers, 1)
+	require.Equal(t, mine.ID, servers[0].ID)
+
+	// Global permissions count for the admin's own app
+	global := loginAdmin(t, s, Admin{ID: "global", Role: roleAdmin,
+		AdminFor: other.ID})
+	require.Nil(t, s.Store.CreatePermissions([]Permission{
+		{"global", "1", permissionApps},
+	}))
+	r = newTestRequest(t, ts, "POST", "/admin/app/"+other.ID, update)
+	r.AddCookie(global)
+	require.Equal(t, http.StatusOK, do(t, r, nil))
+	r = newTestRequest(t, ts, "POST", "/admin/app/"+app.ID, update)
+	r.AddCookie(global)
+	require.Equal(t, http.StatusForbidden, do(t, r, nil))
+
+	// Inactive admins cannot do anything
+	a, err := s.Store.GetAdmin("admin")
+	require.Nil(t, err)
+	a.Status = "disabled"
+	require.Nil(t, s.Store.UpdateAdmin(a))
+	require.Equal(t, http.StatusForbidden, request("POST",
+		"/admin/app/"+app.ID, update))
+}
+
+func TestAdminsCannotRaiseTheirOwnPermissions(t *testing.T) {
+	s, ts := newTestServer(t)
+	app := newTestApp(t, s, "foo")
+	cookie := loginAdmin(t, s, Admin{ID: "admin", Role: roleAdmin,
+		AdminFor: app.ID})
+	require.Nil(t, s.Store.CreatePermissions([]Permission{
+		{"admin", app.ID, permissionPermissions},
+	}))
+	super := loginSuperAdmin(t, s)
+
+	grant := func(cookie *http.Cookie, adminID string,
+		permissions ...Permission) int {
+		r := newTestRequest(t, ts, "POST", "/admin/permission",
+			newPermissionsRequest{permissions})
+		r.AddCookie(cookie)
+		r.Header.Set(nonceHeader, getNonce(t, ts, cookie, adminID, "POST",
+			"/admin/permission"))
+		return do(t, r, nil)
+	}
+	for name, p := range map[string]Permission{
+		"to themselves":         {"admin", app.ID, permissionAdmins},
+		"to themselves for all": {"admin", "1", permissionAdmins},
+		"Permissions":           {"other", app.ID, permissionPermissions},
+		"for another app":       {"other", "2", permissionAdmins},
+	} {
+		require.Equal(t, http.StatusForbidden, grant(cookie, "admin", p),
+			"Granted %s", name)
+	}
+	// Nothing is granted if any permission is refused
+	require.Equal(t, http.StatusForbidden, grant(cookie, "admin",
+		Permission{"other", app.ID, permissionKeys},
+		Permission{"admin", app.ID, permissionKeys}))
+	granted, err := s.Store.GetPermissions(app.ID)
+	require.Nil(t, err)
+	require.Len(t, granted, 1)
+
+	require.Equal(t, http.StatusOK, grant(cookie, "admin",
+		Permission{"other", app.ID, permissionKeys}))
+	require.Equal(t, http.StatusOK, grant(super, "super",
+		Permission{"other", app.ID, permissionPermissions},
+		Permission{"super", "1", permissionKeys}))
+	granted, err = s.Store.GetPermissions(app.ID)
+	require.Nil(t, err)
+	require.Len(t, granted, 3)
+}
+
+func TestAdminsCannotEditSuperadmins(t *testing.T) {
+	s, ts := newTestServer(t)
+	app := newTestApp(t, s, "foo")
+	cookie := loginAdmin(t, s, Admin{ID: "appadmin", Role: roleAdmin,
+		AdminFor: app.ID})
+	require.Nil(t, s.Store.CreatePermissions([]Permission{
+		{"appadmin", app.ID, permissionAdmins},
+	}))
+	super := loginSuperAdmin(t, s)
+	for _, a := range []Admin{
+		{ID: "root", Role: roleSuperAdmin, AdminFor: app.ID},
+		{ID: "peer", Role: roleAdmin, AdminFor: app.ID},
+	} {
+		a.Status = adminActive
+		require.Nil(t, s.Store.CreateAdmin(a))
+	}
+
+	update := func(cookie *http.Cookie, adminID string,
+		req adminUpdateRequest) int {
+		r := newTestRequest(t, ts, "PUT", "/admin/admin/"+adminID, req)
+		r.AddCookie(cookie)
+		return do(t, r, nil)
+	}
+	require.Equal(t, http.StatusForbidden, update(cookie, "root",
+		adminUpdateRequest{Email: "mallory@example.com"}))
+	require.Equal(t, http.StatusOK, update(cookie, "peer",
+		adminUpdateRequest{Name: "Peer"}))
+	// Only superadmins choose the key that vouches for an admin
+	require.Equal(t, http.StatusForbidden, update(cookie, "peer",
+		adminUpdateRequest{PrimarySigningKeyID: "mine"}))
+	require.Equal(t, http.StatusForbidden, update(cookie, "appadmin",
+		adminUpdateRequest{PrimarySigningKeyID: "mine"}))
+	require.Equal(t, http.StatusOK, update(super, "root",
+		adminUpdateRequest{PrimarySigningKeyID: "key"}))
+
+	for id, expected := range map[string]Admin{
+		"root": {Email: "", PrimarySigningKeyID: "key"},
+		"peer": {Name: "Peer"},
+	} {
+		a, err := s.Store.GetAdmin(id)
+		require.Nil(t, err)
+		require.Equal(t, expected.Name, a.Name, id)
+		require.Equal(t, expected.Email, a.Email, id)
+		require.Equal(t, expected.PrimarySigningKeyID,
+			a.PrimarySigningKeyID, id)
+	}
+}
+
+func TestAdminRolesMustBeKnown(t *testing.T) {
+	s, ts := newTestServer(t)
+	super := loginSuperAdmin(t, s)
+	loginAdmin(t, s, Admin{ID: "admin", Role: roleAdmin, AdminFor: "1"})
+
+	change := func(req adminRoleChangeRequest) int {
+		req.AdminID = "admin"
+		r := newTestRequest(t, ts, "POST", "/admin/admin/roles", req)
+		r.AddCookie(super)
+		r.Header.Set(nonceHeader, getNonce(t, ts, super, "super", "POST",
+			"/admin/admin/roles"))
+		return do(t, r, nil)
+	}
+	for _, req := range []adminRoleChangeRequest{
+		{Role: "owner"},
+		{Role: "Superadmin"},
+		{Status: "disabled"},
+		{Role: roleSuperAdmin, Status: "disabled"},
+	} {
+		require.Equal(t, http.StatusBadRequest, change(req), "%+v", req)
+	}
+	a, err := s.Store.GetAdmin("admin")
+	require.Nil(t, err)
+	require.Equal(t, roleAdmin, a.Role)
+	require.Equal(t, adminActive, a.Status)
+
+	require.Equal(t, http.StatusOK, change(adminRoleChangeRequest{
+		Role: roleSuperAdmin, Status: adminInactive}))
+	a, err = s.Store.GetAdmin("admin")
+	require.Nil(t, err)
+	require.Equal(t, roleSuperAdmin, a.Role)
+	require.Equal(t, adminInactive, a.Status)
+}
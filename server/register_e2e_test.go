@@ -4,47 +4,255 @@ package server
 
 import (
 	"net/http"
+	"net/http/httptest"
+	"strconv"
 	"testing"
 
+	"github.com/tera-insights/2Q2R-enterprise/security"
+	"github.com/tera-insights/2Q2R-enterprise/util"
+
 	"github.com/stretchr/testify/require"
 )
 
-// Create app server
-// Add user to system
-// Add key to system
+// waitFor starts waiting on request `requestID` at `route` and returns a
+// channel with the eventual status code.
+func waitFor(t *testing.T, ts *httptest.Server, route,
+	requestID string) <-chan int {
+	r := newTestRequest(t, ts, "POST", route, requestIDWrapper{requestID})
+	done := make(chan int, 1)
+	go func() {
+		res, err := http.DefaultClient.Do(r)
+		if err != nil {
+			done <- 0
+			return
+		}
+		res.Body.Close()
+		done <- res.StatusCode
+	}()
+	return done
+}
 
 func TestIFrameAuthentication(t *testing.T) {
-	serverName := "register_e2e_test"
-
-	// Create app server
-	postJSON("/admin/servers", NewServerRequest{
-		ServerName:  serverName,
-		AppID:       goodAppID,
-		BaseURL:     goodBaseURL,
-		KeyType:     goodKeyType,
-		PublicKey:   goodPublicKey,
-		Permissions: goodPermissions,
+	s, ts := newTestServer(t)
+	app := newTestApp(t, s, "foo")
+	asi := newTestAppServer(t, s, app.ID, permissionRegister,
+		permissionLogin)
+	origin := s.Config.getBaseURLWithProtocol()
+	tok := newU2FToken(t)
+
+	// Register a token for the user, while the app server waits
+	rr := setUpRegistration(t, s, ts, asi, "bar")
+	registered := waitFor(t, ts, "/v1/register/wait", rr.RequestID)
+	r := newTestRequest(t, ts, "POST", "/v1/register", tok.register(t,
+		util.EncodeBase64(rr.Challenge.Challenge), origin))
+	require.Equal(t, http.StatusOK, do(t, r, nil))
+	require.Equal(t, http.StatusOK, <-registered)
+
+	// The app server now knows the user
+	r = newTestRequest(t, ts, "GET", "/v1/users/bar", nil)
+	signRequest(t, s, r, asi)
+	exists := userExistsReply{}
+	require.Equal(t, http.StatusOK, do(t, r, &exists))
+	require.True(t, exists.Exists)
+
+	// Set up an authentication request and pick the token in the iFrame
+	r = newTestRequest(t, ts, "GET", "/v1/auth/request/bar/nonce", nil)
+	signRequest(t, s, r, asi)
+	setupInfo := authenticationSetupReply{}
+	require.Equal(t, http.StatusOK, do(t, r, &setupInfo))
+	authenticated := waitFor(t, ts, "/v1/auth/wait", setupInfo.RequestID)
+
+	r = newTestRequest(t, ts, "POST", "/v1/auth/challenge", setKeyRequest{
+		KeyHandle: tok.id(),
+		RequestID: setupInfo.RequestID,
 	})
+	challenge := setKeyReply{}
+	require.Equal(t, http.StatusOK, do(t, r, &challenge))
+	require.Equal(t, app.ID, challenge.AppID)
+
+	// Sign the challenge and send the result to /v1/auth
+	r = newTestRequest(t, ts, "POST", "/v1/auth", tok.sign(t,
+		challenge.Challenge, origin))
+	require.Equal(t, http.StatusOK, do(t, r, nil))
+
+	// Assert that the waiting app server was told
+	require.Equal(t, http.StatusOK, <-authenticated)
+	k, err := s.Store.GetKey(tok.id())
+	require.Nil(t, err)
+	require.Equal(t, tok.counter, k.Counter)
+}
+
+// registerToken registers a new U2F token for `userID`.
+func registerToken(t *testing.T, s *Server, ts *httptest.Server,
+	asi testAppServer, userID string) *u2fToken {
+	tok := newU2FToken(t)
+	rr := setUpRegistration(t, s, ts, asi, userID)
+	r := newTestRequest(t, ts, "POST", "/v1/register", tok.register(t,
+		util.EncodeBase64(rr.Challenge.Challenge),
+		s.Config.getBaseURLWithProtocol()))
+	require.Equal(t, http.StatusOK, do(t, r, nil))
+	return tok
+}
 
-	// Add user to system
-	res, err := postJSON("/admin/user/new", NewUserRequest{})
+// authenticate answers a new authentication request for `userID` with the
+// key `keyHandle` and the response that `sign` returns for its challenge.
+func authenticate(t *testing.T, s *Server, ts *httptest.Server,
+	asi testAppServer, userID, keyHandle string,
+	sign func(challenge string) authenticateRequest) int {
+	// A fresh nonce keeps the app server's MACs unique
+	nonce, err := util.RandString(16)
 	require.Nil(t, err)
-	userData := new(NewUserReply)
-	unmarshalJSONBody(res, userData)
+	r := newTestRequest(t, ts, "GET",
+		"/v1/auth/request/"+userID+"/"+nonce, nil)
+	signRequest(t, s, r, asi)
+	setupInfo := authenticationSetupReply{}
+	require.Equal(t, http.StatusOK, do(t, r, &setupInfo))
+
+	r = newTestRequest(t, ts, "POST", "/v1/auth/challenge",
+		setKeyRequest{keyHandle, setupInfo.RequestID})
+	challenge := setKeyReply{}
+	require.Equal(t, http.StatusOK, do(t, r, &challenge))
+	r = newTestRequest(t, ts, "POST", "/v1/auth", sign(challenge.Challenge))
+	return do(t, r, nil)
+}
+
+func TestCounterRegressed(t *testing.T) {
+	for _, c := range []struct {
+		received, stored uint32
+		regressed        bool
+	}{
+		{1, 0, false},
+		{6, 5, false},
+		{5, 5, true},
+		{2, 5, true},
+		// Authenticators without a signature counter always report zero
+		{0, 0, false},
+		{0, 5, true},
+	} {
+		if counterRegressed(c.received, c.stored) != c.regressed {
+			t.Errorf("Counter %d after %d: expected regressed to be %v",
+				c.received, c.stored, c.regressed)
+		}
+	}
+}
+
+func TestClonedU2FKeysAreDetected(t *testing.T) {
+	s, ts := newTestServer(t)
+	app := newTestApp(t, s, "foo")
+	asi := newTestAppServer(t, s, app.ID, permissionRegister,
+		permissionLogin)
+	origin := s.Config.getBaseURLWithProtocol()
 
-	// Set up a registration request
-	res, err = http.Get("/v1/register/request" + userData.UserID)
+	for i, c := range []struct {
+		name    string
+		counter uint32 // of the clone, after the token reached 5
+		forged  bool
+		code    int
+		suspect bool
+	}{
+		{"a higher counter", 6, false, http.StatusOK, false},
+		{"an equal counter", 5, false, http.StatusForbidden, true},
+		{"a lower counter", 2, false, http.StatusForbidden, true},
+		// Only verified counters count, or anyone could lock a user out
+		{"a forged lower counter", 2, true, http.StatusBadRequest, false},
+	} {
+		userID := "user" + strconv.Itoa(i)
+		tok := registerToken(t, s, ts, asi, userID)
+		tok.counter = 4
+		require.Equal(t, http.StatusOK, authenticate(t, s, ts, asi, userID,
+			tok.id(), func(challenge string) authenticateRequest {
+				return tok.sign(t, challenge, origin)
+			}), c.name)
+
+		clone := *tok
+		if c.forged {
+			clone.key = newU2FToken(t).key
+		}
+		clone.counter = c.counter - 1
+		require.Equal(t, c.code, authenticate(t, s, ts, asi, userID,
+			tok.id(), func(challenge string) authenticateRequest {
+				return clone.sign(t, challenge, origin)
+			}), c.name)
+		k, err := s.Store.GetKey(tok.id())
+		require.Nil(t, err)
+		require.Equal(t, c.suspect, k.Suspect, c.name)
+	}
+	// Apps can have keys suspended as soon as they look cloned
+	app.SuspendClonedKeys = true
+	require.Nil(t, s.Store.UpdateApp(app))
+	tok := registerToken(t, s, ts, asi, "suspended")
+	sign := func(challenge string) authenticateRequest {
+		return tok.sign(t, challenge, origin)
+	}
+	require.Equal(t, http.StatusOK, authenticate(t, s, ts, asi, "suspended",
+		tok.id(), sign))
+	tok.counter = 0
+	require.Equal(t, http.StatusForbidden, authenticate(t, s, ts, asi,
+		"suspended", tok.id(), sign))
+	k, err := s.Store.GetKey(tok.id())
 	require.Nil(t, err)
-	setupInfo := new(RegistrationSetupReply)
-	unmarshalJSONBody(res, setupInfo)
+	require.Equal(t, security.KeyStateSuspended, k.State)
+
+	// So the genuine token cannot be picked any more
+	r := newTestRequest(t, ts, "GET", "/v1/auth/request/suspended/nonce", nil)
+	signRequest(t, s, r, asi)
+	setupInfo := authenticationSetupReply{}
+	require.Equal(t, http.StatusOK, do(t, r, &setupInfo))
+	r = newTestRequest(t, ts, "POST", "/v1/auth/challenge",
+		setKeyRequest{tok.id(), setupInfo.RequestID})
+	require.Equal(t, http.StatusForbidden, do(t, r, nil))
+}
+
+func TestKeysOfOtherUsersAreRejected(t *testing.T) {
+	s, ts := newTestServer(t)
+	app := newTestApp(t, s, "foo")
+	asi := newTestAppServer(t, s, app.ID, permissionRegister,
+		permissionLogin)
+	origin := s.Config.getBaseURLWithProtocol()
+	victim := registerToken(t, s, ts, asi, "alice")
+	attacker := registerToken(t, s, ts, asi, "mallory")
+
+	r := newTestRequest(t, ts, "GET", "/v1/auth/request/alice/nonce", nil)
+	signRequest(t, s, r, asi)
+	setupInfo := authenticationSetupReply{}
+	require.Equal(t, http.StatusOK, do(t, r, &setupInfo))
+	embedded := authenticateData{}
+	extractEmbeddedData(t, ts, "/v1/auth/iframe", setupInfo.RequestID,
+		&embedded)
+	challenge := embedded.Challenge
 
-	// Get the registration iFrame and extract the challenge
-	gleanedData := new(registerData)
-	extractEmbeddedData("/register/"+setupInfo.RequestID, gleanedData)
+	for _, c := range []struct {
+		name      string
+		keyHandle string
+		expected  int
+	}{
+		{"empty", "", http.StatusBadRequest},
+		{"other user's", attacker.id(), http.StatusForbidden},
+	} {
+		r = newTestRequest(t, ts, "POST", "/v1/auth/challenge",
+			setKeyRequest{c.keyHandle, setupInfo.RequestID})
+		if code := do(t, r, nil); code != c.expected {
+			t.Errorf("Expected %d for the %s key. Got %d", c.expected,
+				c.name, code)
+		}
+	}
 
-	// In a separate routine, wait for the registration challenge to be met
+	// Without a chosen key, a signature with the attacker's key is refused
+	r = newTestRequest(t, ts, "POST", "/v1/auth", attacker.sign(t, challenge,
+		origin))
+	require.Equal(t, http.StatusBadRequest, do(t, r, nil))
 
-	// Sign the challenge and send the result to /v1/register
+	// The victim can still log in, and only their counter changes
+	r = newTestRequest(t, ts, "POST", "/v1/auth/challenge",
+		setKeyRequest{victim.id(), setupInfo.RequestID})
+	require.Equal(t, http.StatusOK, do(t, r, nil))
+	r = newTestRequest(t, ts, "POST", "/v1/auth", victim.sign(t, challenge,
+		origin))
+	require.Equal(t, http.StatusOK, do(t, r, nil))
 
-	// Assert that the waiting thread came to a close
+	for tok, counter := range map[*u2fToken]uint32{victim: 1, attacker: 0} {
+		k, err := s.Store.GetKey(tok.id())
+		require.Nil(t, err)
+		require.Equal(t, counter, k.Counter)
+	}
 }
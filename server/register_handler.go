@@ -5,6 +5,7 @@ package server
 import (
 	"bytes"
 	"crypto"
+	"crypto/sha256"
 	"encoding/json"
 	"html/template"
 	"io"
@@ -16,105 +17,69 @@ import (
 	"github.com/tera-insights/2Q2R-enterprise/security"
 	"github.com/tera-insights/2Q2R-enterprise/util"
 
-	"sync"
-
 	"github.com/gorilla/mux"
-	cache "github.com/patrickmn/go-cache"
 	"github.com/pkg/errors"
 	"github.com/tstranex/u2f"
 )
 
-func withLocking(l *sync.RWMutex, f func()) {
-	defer l.Unlock()
-	l.Lock()
-	f()
-}
-
 type registerHandler struct {
 	s *Server
 
-	// Migrated from cache
-	registrationReqs     *cache.Cache
-	challengeToRequestID *cache.Cache
-	expiration           time.Duration
-
-	// Migrated from queue
-	recent     *cache.Cache // Maps request ID to status code
+	requests   requestStore
+	expiration time.Duration
 	rcTimeout  time.Duration
-	rcInterval time.Duration
-	listeners  *cache.Cache
 	lTimeout   time.Duration
-	lInterval  time.Duration
-
-	stateLock *sync.RWMutex
 }
 
 type registerData struct {
-	RequestID   string   `json:"id"`
-	KeyTypes    []string `json:"keyTypes"`
-	Challenge   string   `json:"challenge"` // base-64 URL-encoded
-	UserID      string   `json:"userID"`
-	AppID       string   `json:"appId"`
-	BaseURL     string   `json:"baseUrl"`
-	InfoURL     string   `json:"infoUrl"`
-	RegisterURL string   `json:"registerUrl"`
-	WaitURL     string   `json:"waitUrl"`
-	AppURL      string   `json:"appUrl"`
+	RequestID          string   `json:"id"`
+	KeyTypes           []string `json:"keyTypes"`
+	Challenge          string   `json:"challenge"` // base-64 URL-encoded
+	UserID             string   `json:"userID"`
+	AppID              string   `json:"appId"`
+	BaseURL            string   `json:"baseUrl"`
+	InfoURL            string   `json:"infoUrl"`
+	RegisterURL        string   `json:"registerUrl"`
+	WaitURL            string   `json:"waitUrl"`
+	AppURL             string   `json:"appUrl"`
+	WebAuthnOptionsURL string   `json:"webAuthnOptionsUrl"`
+	WebAuthnURL        string   `json:"webAuthnUrl"`
 }
 
-type registrationReq struct {
-	RequestID  string
-	Challenge  *u2f.Challenge
-	AppID      string
-	UserID     string
-	OriginalIP string
+// Credential algorithms offered to WebAuthn authenticators, in order of
+// preference.
+var webAuthnCredentialParams = []webAuthnCredentialParam{
+	{Type: "public-key", Algorithm: security.COSEAlgES256},
+	{Type: "public-key", Algorithm: security.COSEAlgEdDSA},
+	{Type: "public-key", Algorithm: security.COSEAlgRS256},
 }
 
 func newRegisterHandler(s *Server) *registerHandler {
-	rcet := s.Config.RecentlyCompletedExpirationTime
-	ct := s.Config.CleanTime
-
 	return &registerHandler{
 		s,
-		cache.New(rcet, ct),
-		cache.New(rcet, ct),
+		s.registrations,
 		s.Config.ExpirationTime,
-		cache.New(rcet, ct),
-		rcet,
-		ct,
-		cache.New(s.Config.ListenerExpirationTime, ct),
+		s.Config.RecentlyCompletedExpirationTime,
 		s.Config.ListenerExpirationTime,
-		ct,
-		&sync.RWMutex{},
 	}
 }
 
 // GetRequest returns the request for a particular request ID.
-func (rh *registerHandler) GetRequest(id string) (*registrationReq, error) {
-	if val, found := rh.registrationReqs.Get(id); found {
-		rr := val.(registrationReq)
-		ptr := &rr
-		return ptr, nil
+func (rh *registerHandler) GetRequest(id string) (*pendingRequest, error) {
+	rr, err := rh.requests.Get(id)
+	if err == nil {
+		return &rr, nil
+	} else if err != errRequestNotFound {
+		return nil, err
 	}
 
-	// For long-term requests
-	ltr := LongTermRequest{}
+	// For long-term requests, which can only be used once
 	h := crypto.SHA256.New()
 	io.WriteString(h, id)
-
-	// We transactionally find the long-term request and then delete it from
-	// the DB.
-	tx := rh.s.DB.Begin()
-	query := LongTermRequest{ID: h.Sum(nil)}
-	if err := tx.First(ltr, query).Error; err != nil {
-		tx.Rollback()
-		return nil, err
-	}
-	if err := tx.Delete(LongTermRequest{}, query).Error; err != nil {
-		tx.Rollback()
+	ltr, err := rh.s.Store.TakeLongTermRequest(h.Sum(nil))
+	if err != nil {
 		return nil, err
 	}
-	tx.Commit()
 
 	base := rh.s.Config.getBaseURLWithProtocol()
 	challenge, err := u2f.NewChallenge(base, []string{base})
@@ -122,26 +87,23 @@ func (rh *registerHandler) GetRequest(id string) (*registrationReq, error) {
 		return nil, err
 	}
 
-	rh.registrationReqs.Set(id, registrationReq{
+	rr = pendingRequest{
 		RequestID: id,
 		Challenge: challenge,
 		AppID:     ltr.AppID,
-	}, rh.expiration)
-	s := util.EncodeBase64(challenge.Challenge)
-	rh.challengeToRequestID.Set(s, id, rh.expiration)
-	return nil, errors.Errorf("Could not find request with id %s", id)
+	}
+	if err = rh.requests.Put(rr, rh.expiration); err != nil {
+		return nil, err
+	}
+	rh.s.metrics.countSetup(registrationRequests, rr.AppID)
+	return &rr, nil
 }
 
 // Setup sets up the registration of a new two-factor device.
 // GET /v1/register/request/{userID}
 func (rh *registerHandler) Setup(w http.ResponseWriter, r *http.Request) {
-	serverID, _, err := getAuthDataFromHeaders(r)
-	util.OptionalInternalPanic(err, "Could not decode authentication headers")
-
+	server := appServerFor(r)
 	userID := mux.Vars(r)["userID"]
-	server := AppServerInfo{}
-	err = rh.s.DB.First(&server, AppServerInfo{ID: serverID}).Error
-	util.OptionalBadRequestPanic(err, "Could not find app server")
 
 	challenge, err := u2f.NewChallenge(rh.s.Config.getBaseURLWithProtocol(),
 		[]string{rh.s.Config.getBaseURLWithProtocol()})
@@ -151,16 +113,15 @@ func (rh *registerHandler) Setup(w http.ResponseWriter, r *http.Request) {
 	util.OptionalInternalPanic(err, "Could not generate request ID")
 
 	host, _, _ := net.SplitHostPort(r.RemoteAddr)
-	rr := registrationReq{
+	err = rh.requests.Put(pendingRequest{
 		RequestID:  requestID,
 		Challenge:  challenge,
 		AppID:      server.AppID,
 		UserID:     userID,
 		OriginalIP: host,
-	}
-	rh.registrationReqs.Set(requestID, rr, rh.expiration)
-	s := util.EncodeBase64(rr.Challenge.Challenge)
-	rh.challengeToRequestID.Set(s, requestID, rh.expiration)
+	}, rh.expiration)
+	util.OptionalInternalPanic(err, "Could not save request")
+	rh.s.metrics.countSetup(registrationRequests, server.AppID)
 
 	writeJSON(w, http.StatusOK, registrationSetupReply{
 		requestID,
@@ -179,7 +140,7 @@ func (rh *registerHandler) IFrame(w http.ResponseWriter, r *http.Request) {
 	templateBox, err := rice.FindBox("assets")
 	util.OptionalInternalPanic(err, "Failed to load assets")
 
-	templateString, err := templateBox.String("all.html")
+	templateString, err := templateBox.String("iframes/all.html")
 	util.OptionalInternalPanic(err, "Failed to load template")
 
 	t, err := template.New("register").Parse(templateString)
@@ -188,23 +149,20 @@ func (rh *registerHandler) IFrame(w http.ResponseWriter, r *http.Request) {
 	cachedRequest, err := rh.GetRequest(req.RequestID)
 	util.OptionalBadRequestPanic(err, "Failed to get registration request")
 
-	var appInfo AppInfo
-	query := AppInfo{ID: cachedRequest.AppID}
-	err = rh.s.DB.Model(AppInfo{}).Find(&appInfo, query).Error
-	util.OptionalInternalPanic(err, "Failed to find app information")
-
 	base := rh.s.Config.getBaseURLWithProtocol()
 	data, err := json.Marshal(registerData{
-		RequestID:   req.RequestID,
-		KeyTypes:    []string{"2q2r", "u2f"},
-		Challenge:   util.EncodeBase64(cachedRequest.Challenge.Challenge),
-		UserID:      cachedRequest.UserID,
-		AppID:       cachedRequest.AppID,
-		BaseURL:     base,
-		AppURL:      base,
-		InfoURL:     base + "/v1/info/" + cachedRequest.AppID,
-		RegisterURL: base + "/v1/register",
-		WaitURL:     base + "/v1/register/wait",
+		RequestID:          req.RequestID,
+		KeyTypes:           []string{"2q2r", "u2f", "webauthn"},
+		Challenge:          util.EncodeBase64(cachedRequest.Challenge.Challenge),
+		UserID:             cachedRequest.UserID,
+		AppID:              cachedRequest.AppID,
+		BaseURL:            base,
+		AppURL:             base,
+		InfoURL:            base + "/v1/info/" + cachedRequest.AppID,
+		RegisterURL:        base + "/v1/register",
+		WaitURL:            base + "/v1/register/wait",
+		WebAuthnOptionsURL: base + "/v1/register/webauthn/options",
+		WebAuthnURL:        base + "/v1/register/webauthn",
 	})
 	util.OptionalInternalPanic(err, "Failed to generate template")
 
@@ -219,7 +177,7 @@ func (rh *registerHandler) IFrame(w http.ResponseWriter, r *http.Request) {
 // Steps:
 // 1. Parse request
 // 2. Assert that we have a pending registration request for the challenge
-// 3. Verify the signature in the request
+// 3. Verify the signature and attestation in the request
 // 4. Record the valid public key in the database
 // POST /v1/register
 func (rh *registerHandler) Register(w http.ResponseWriter, r *http.Request) {
@@ -267,88 +225,192 @@ func (rh *registerHandler) Register(w http.ResponseWriter, r *http.Request) {
 	err = decoder.Decode(&clientData)
 	util.OptionalBadRequestPanic(err, "Could not decode client data")
 
-	// Assert that the challenge exists
-	val, found := rh.challengeToRequestID.Get(clientData.Challenge)
-	util.PanicIfFalse(found, http.StatusForbidden, "Challenge does not exist")
-
-	requestID, ok := val.(string)
-	util.PanicIfFalse(ok, http.StatusInternalServerError, "Invalid cached data")
-
-	// Get challenge data
-	val, found = rh.registrationReqs.Get(requestID)
-	util.PanicIfFalse(found, http.StatusInternalServerError, "Failed to look up "+
-		"data for valid challenge")
+	rr := rh.requestForChallenge(clientData.Challenge)
+	defer rh.s.metrics.countFailure(registrationRequests, rr.AppID)
+	app := rh.s.appForRequest(rr.AppID)
 
-	rr, ok := val.(registrationReq)
-	util.PanicIfFalse(ok, http.StatusInternalServerError, "Invalid cached data")
-
-	// Verify signature
+	// Verify signature and, depending on the app's policy, attestation
 	resp := u2f.RegisterResponse{
 		RegistrationData: successData.RegistrationData,
 		ClientData:       successData.ClientData,
 	}
-	reg, err := u2f.Register(resp, *rr.Challenge, &u2f.Config{
-		SkipAttestationVerify: true,
-	})
+	reg, err := u2f.Register(resp, *rr.Challenge, rh.s.u2fConfig(app))
 	util.OptionalBadRequestPanic(err, "Could not verify signature")
+	subject := rh.s.checkU2FAttestation(app, reg)
 
 	// Record valid public key in database
 	marshalledRegistration, err := reg.MarshalBinary()
+	util.OptionalInternalPanic(err, "Could not marshal registration")
 
-	tx := rh.s.DB.Begin()
-
-	// Save key
-	err = tx.Model(&security.Key{}).Create(&security.Key{
+	rh.saveKey(w, r, rr, security.Key{
 		ID:                     util.EncodeBase64(reg.KeyHandle),
 		Type:                   successData.Type,
 		Name:                   successData.DeviceName,
 		UserID:                 rr.UserID,
 		AppID:                  rr.AppID,
+		Format:                 security.FormatU2F,
 		MarshalledRegistration: marshalledRegistration,
 		Counter:                0,
-	}).Error
-	if err != nil {
-		tx.Rollback()
-		util.OptionalInternalPanic(err, "Could not save key to database")
-	}
-
-	// Mark the request as completed
-	withLocking(rh.stateLock, func() {
-		defer func() {
-			if r := recover(); r != nil {
-				tx.Rollback()
-				rh.recent.Delete(requestID)
-			}
-		}()
-
-		if _, found = rh.recent.Get(requestID); found {
-			writeJSON(w, http.StatusUnauthorized, "Request timed out")
-			tx.Rollback()
-			return
-		}
-		rh.recent.Set(requestID, http.StatusOK, rh.rcTimeout)
+		AttestationSubject:     subject,
 	})
+}
+
+// WebAuthnOptions returns the options that the iFrame passes to
+// navigator.credentials.create() for a pending registration request.
+// POST /v1/register/webauthn/options
+func (rh *registerHandler) WebAuthnOptions(w http.ResponseWriter,
+	r *http.Request) {
+	var req requestIDWrapper
+	err := json.NewDecoder(r.Body).Decode(&req)
+	util.OptionalBadRequestPanic(err, "Could not decode request body")
+
+	rr, err := rh.GetRequest(req.RequestID)
+	util.OptionalBadRequestPanic(err, "Failed to get registration request")
+
+	appInfo := rh.s.appForRequest(rr.AppID)
 
-	// Tell all the listeners that we finished
-	withLocking(rh.stateLock, func() {
-		if cached, found := rh.listeners.Get(requestID); found {
-			listeners := cached.([]chan int)
-			for _, listener := range listeners {
-				select {
-				case listener <- http.StatusOK:
-				default:
-				}
-			}
-			rh.listeners.Delete(requestID)
+	// Keep the user from registering the same authenticator twice
+	existing, err := rh.s.Store.GetKeys(rr.AppID, rr.UserID)
+	util.OptionalInternalPanic(err, "Could not load existing keys")
+
+	exclude := []webAuthnCredentialDescriptor{}
+	for _, k := range existing {
+		if !k.IsWebAuthn() {
+			continue
 		}
+		exclude = append(exclude, webAuthnCredentialDescriptor{
+			Type: "public-key",
+			ID:   k.ID,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, webAuthnCreationOptions{
+		Challenge: util.EncodeBase64(rr.Challenge.Challenge),
+		RP: webAuthnRelyingParty{
+			ID:   rh.s.Config.getRelyingPartyID(),
+			Name: appInfo.AppName,
+		},
+		User: webAuthnUser{
+			ID:          util.EncodeBase64([]byte(rr.UserID)),
+			Name:        rr.UserID,
+			DisplayName: rr.UserID,
+		},
+		PubKeyCredParams:   webAuthnCredentialParams,
+		Timeout:            int64(rh.expiration / time.Millisecond),
+		ExcludeCredentials: exclude,
+		Attestation:        appInfo.getAttestationPolicy(),
 	})
+}
 
-	if err != nil {
-		tx.Rollback()
-		util.OptionalInternalPanic(err, "Could not notify request listeners")
+// RegisterWebAuthn registers a new WebAuthn credential.
+// Steps:
+// 1. Parse the client data and attestation object
+// 2. Assert that we have a pending registration request for the challenge
+// 3. Check the origin, relying party and credential public key
+// 4. Enforce the app's attestation policy
+// 5. Record the credential in the database
+// POST /v1/register/webauthn
+func (rh *registerHandler) RegisterWebAuthn(w http.ResponseWriter,
+	r *http.Request) {
+	req := webAuthnRegisterRequest{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	util.OptionalBadRequestPanic(err, "Could not decode request body")
+
+	clientDataJSON, err := util.DecodeBase64(req.ClientDataJSON)
+	util.OptionalBadRequestPanic(err, "Could not decode client data")
+
+	clientData, err := security.ParseClientData(clientDataJSON,
+		"webauthn.create")
+	util.OptionalBadRequestPanic(err, "Invalid client data")
+	util.PanicIfFalse(clientData.Origin == rh.s.Config.getBaseURLWithProtocol(),
+		http.StatusForbidden, "Client data has the wrong origin")
+
+	rr := rh.requestForChallenge(clientData.Challenge)
+	defer rh.s.metrics.countFailure(registrationRequests, rr.AppID)
+
+	rawAttestation, err := util.DecodeBase64(req.AttestationObject)
+	util.OptionalBadRequestPanic(err, "Could not decode attestation object")
+
+	ao, err := security.ParseAttestationObject(rawAttestation)
+	util.OptionalBadRequestPanic(err, "Could not parse attestation object")
+
+	util.PanicIfFalse(bytes.Equal(ao.AuthData.RPIDHash,
+		rh.s.Config.getRelyingPartyIDHash()), http.StatusBadRequest,
+		"Credential was created for a different relying party")
+	util.PanicIfFalse(ao.AuthData.Flags&security.FlagUserPresent != 0,
+		http.StatusBadRequest, "User was not present")
+
+	_, _, err = security.ParseCOSEKey(ao.AuthData.CredentialPublicKey)
+	util.OptionalBadRequestPanic(err, "Unsupported credential public key")
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	attestation := rh.s.checkWebAuthnAttestation(rh.s.appForRequest(rr.AppID),
+		ao, clientDataHash[:])
+	var subject string
+	if cert := attestation.Certificate(); cert != nil {
+		subject = cert.Subject.String()
+	}
+
+	keyType := req.Type
+	if keyType == "" {
+		keyType = security.FormatWebAuthn
 	}
 
-	tx.Commit()
+	rh.saveKey(w, r, rr, security.Key{
+		ID:                  util.EncodeBase64(ao.AuthData.CredentialID),
+		Type:                keyType,
+		Name:                req.DeviceName,
+		UserID:              rr.UserID,
+		AppID:               rr.AppID,
+		Format:              security.FormatWebAuthn,
+		CredentialPublicKey: ao.AuthData.CredentialPublicKey,
+		Counter:             ao.AuthData.Counter,
+		AttestationSubject:  subject,
+		AAGUID:              security.FormatAAGUID(ao.AuthData.AAGUID),
+	})
+}
+
+// requestForChallenge returns the pending registration request that issued
+// `challenge`.
+func (rh *registerHandler) requestForChallenge(
+	challenge string) pendingRequest {
+	rr, err := rh.requests.GetByChallenge(challenge)
+	util.PanicIfFalse(err != errRequestNotFound, http.StatusForbidden,
+		"Challenge does not exist")
+	util.OptionalInternalPanic(err, "Failed to look up data for valid "+
+		"challenge")
+	return rr
+}
+
+// saveKey stores a verified key and marks the registration request as
+// completed, which wakes up anyone waiting on it.
+func (rh *registerHandler) saveKey(w http.ResponseWriter, r *http.Request,
+	rr pendingRequest, k security.Key) {
+	timedOut := false
+	err := rh.s.Store.Transaction(func(st Store) error {
+		// Save key
+		k.State = security.KeyStateActive
+		if err := st.CreateKey(k); err != nil {
+			return errors.Wrap(err, "Could not save key to database")
+		}
+
+		// Mark the request as completed
+		set, err := rh.requests.Within(st).SetResult(rr.RequestID,
+			http.StatusOK, rh.rcTimeout)
+		if err != nil {
+			return err
+		} else if !set {
+			timedOut = true
+			return errors.New("Request timed out")
+		}
+		return nil
+	})
+	if timedOut {
+		writeJSON(w, http.StatusUnauthorized, "Request timed out")
+		return
+	}
+	util.OptionalInternalPanic(err, "Could not save key to database")
+	rh.s.metrics.countResult(registrationRequests, rr.AppID, resultSuccess)
 
 	host, _, _ := net.SplitHostPort(r.RemoteAddr)
 	rh.s.disperser.addEvent(registration, time.Now(), rr.AppID,
@@ -360,7 +422,8 @@ func (rh *registerHandler) Register(w http.ResponseWriter, r *http.Request) {
 }
 
 // Wait allows the requester to check the result of the registration. It blocks
-// until the registration is complete.
+// until the registration is complete, on whichever server instance, or times
+// out.
 // POST /v1/register/wait
 func (rh *registerHandler) Wait(w http.ResponseWriter, r *http.Request) {
 	var req requestIDWrapper
@@ -368,41 +431,21 @@ func (rh *registerHandler) Wait(w http.ResponseWriter, r *http.Request) {
 	err := decoder.Decode(&req)
 	util.OptionalBadRequestPanic(err, "Could not decode request body")
 
-	c := make(chan int, 1)
-
-	rh.stateLock.RLock()
-	status, found := rh.recent.Get(req.RequestID)
-	rh.stateLock.RUnlock()
-
-	if found {
-		c <- status.(int)
-	} else {
-		withLocking(rh.stateLock, func() {
-			if val, found := rh.listeners.Get(req.RequestID); found {
-				listeners := val.([]chan int)
-				newListeners := append(listeners, c)
-				rh.listeners.Set(req.RequestID, newListeners, rh.lTimeout)
-			} else {
-				rh.listeners.Set(req.RequestID, []chan int{c}, rh.lTimeout)
-			}
-		})
-
-		go func() {
-			time.Sleep(rh.lTimeout)
-			withLocking(rh.stateLock, func() {
-				// Only time the request out if it did not complete
-				if _, found := rh.recent.Get(req.RequestID); !found {
-					rr, _ := rh.GetRequest(req.RequestID)
-					rh.recent.Set(req.RequestID, http.StatusRequestTimeout,
-						rh.rcTimeout)
-					rh.listeners.Delete(req.RequestID)
-					rh.s.disperser.addEvent(registration, time.Now(),
-						rr.AppID, "timeout", rr.UserID, rr.OriginalIP, "")
-				}
-			})
-		}()
+	ctx, cancel := rh.s.waitContext(r)
+	defer cancel()
+	start := time.Now()
+	status, timedOut, err := awaitResult(ctx, rh.requests, req.RequestID,
+		rh.lTimeout, rh.rcTimeout)
+	rh.s.panicIfStopping(w)
+	util.OptionalInternalPanic(err, "Could not wait for request")
+	rh.s.metrics.observeWait(registrationRequests, start, status, timedOut)
+	if timedOut {
+		rr, _ := rh.requests.Get(req.RequestID)
+		rh.s.metrics.countResult(registrationRequests, rr.AppID, resultTimeout)
+		rh.s.disperser.addEvent(registration, time.Now(), rr.AppID,
+			"timeout", rr.UserID, rr.OriginalIP, "")
 	}
-	w.WriteHeader(<-c)
+	w.WriteHeader(status)
 }
 
 // GetChallenge returns the challenge for a particular request.
@@ -414,15 +457,10 @@ func (rh *registerHandler) GetChallenge(w http.ResponseWriter,
 	err := decoder.Decode(&req)
 	util.OptionalBadRequestPanic(err, "Could not decode request body")
 
-	var rr registrationReq
-	withLocking(rh.stateLock, func() {
-		val, ok := rh.registrationReqs.Get(req.RequestID)
-		util.PanicIfFalse(ok, http.StatusNotFound, "No request found")
-
-		rr, ok = val.(registrationReq)
-		util.PanicIfFalse(ok, http.StatusInternalServerError, "Invalid "+
-			"cached data")
-	})
+	rr, err := rh.requests.Get(req.RequestID)
+	util.PanicIfFalse(err != errRequestNotFound, http.StatusNotFound,
+		"No request found")
+	util.OptionalInternalPanic(err, "Could not load request")
 
 	writeJSON(w, http.StatusOK, map[string]string{
 		"challenge": util.EncodeBase64(rr.Challenge.Challenge),
@@ -2,11 +2,195 @@
 
 package server
 
-import "testing"
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
 
-// Create app and app server
-// Add user to system
+	"github.com/tera-insights/2Q2R-enterprise/util"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tstranex/u2f"
+)
+
+// u2fToken is a software U2F token with a self-signed attestation
+// certificate.
+type u2fToken struct {
+	key       *ecdsa.PrivateKey
+	keyHandle []byte
+	counter   uint32
+
+	attestationKey  *ecdsa.PrivateKey
+	attestationCert []byte
+}
+
+func newU2FToken(t testing.TB) *u2fToken {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	attestationKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Test U2F token"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template,
+		&attestationKey.PublicKey, attestationKey)
+	require.Nil(t, err)
+
+	keyHandle := make([]byte, 32)
+	_, err = rand.Read(keyHandle)
+	require.Nil(t, err)
+	return &u2fToken{key, keyHandle, 0, attestationKey, cert}
+}
+
+// id returns the key handle as the server stores it.
+func (tok *u2fToken) id() string {
+	return util.EncodeBase64(tok.keyHandle)
+}
+
+// u2fClientData returns the client data for answering `challenge` from
+// `origin`, and its hash.
+func u2fClientData(t testing.TB, typ, challenge, origin string) ([]byte,
+	[32]byte) {
+	clientData, err := json.Marshal(u2f.ClientData{
+		Typ:       typ,
+		Challenge: challenge,
+		Origin:    origin,
+	})
+	require.Nil(t, err)
+	return clientData, sha256.Sum256(clientData)
+}
+
+// register answers a registration challenge of the server at `origin`.
+func (tok *u2fToken) register(t testing.TB, challenge,
+	origin string) registerRequest {
+	clientData, challengeParam := u2fClientData(t,
+		"navigator.id.finishEnrollment", challenge, origin)
+	appParam := sha256.Sum256([]byte(origin))
+	pub := elliptic.Marshal(elliptic.P256(), tok.key.X, tok.key.Y)
+
+	signed := []byte{0}
+	signed = append(signed, appParam[:]...)
+	signed = append(signed, challengeParam[:]...)
+	signed = append(signed, tok.keyHandle...)
+	signed = append(signed, pub...)
+	hash := sha256.Sum256(signed)
+	sig, err := ecdsa.SignASN1(rand.Reader, tok.attestationKey, hash[:])
+	require.Nil(t, err)
+
+	data := []byte{5}
+	data = append(data, pub...)
+	data = append(data, byte(len(tok.keyHandle)))
+	data = append(data, tok.keyHandle...)
+	data = append(data, tok.attestationCert...)
+	data = append(data, sig...)
+
+	return registerRequest{
+		Successful: true,
+		Data: map[string]interface{}{
+			"clientData":       util.EncodeBase64(clientData),
+			"registrationData": util.EncodeBase64(data),
+			"deviceName":       "Test token",
+			"type":             "u2f",
+		},
+	}
+}
+
+// sign answers an authentication challenge of the server at `origin`.
+func (tok *u2fToken) sign(t testing.TB, challenge,
+	origin string) authenticateRequest {
+	clientData, challengeParam := u2fClientData(t,
+		"navigator.id.getAssertion", challenge, origin)
+	appParam := sha256.Sum256([]byte(origin))
+
+	tok.counter++
+	raw := make([]byte, 5)
+	raw[0] = 1 // user presence
+	binary.BigEndian.PutUint32(raw[1:], tok.counter)
+
+	signed := append([]byte{}, appParam[:]...)
+	signed = append(signed, raw...)
+	signed = append(signed, challengeParam[:]...)
+	hash := sha256.Sum256(signed)
+	sig, err := ecdsa.SignASN1(rand.Reader, tok.key, hash[:])
+	require.Nil(t, err)
+
+	return authenticateRequest{
+		Successful: true,
+		Data: map[string]interface{}{
+			"clientData":    util.EncodeBase64(clientData),
+			"signatureData": util.EncodeBase64(append(raw, sig...)),
+		},
+	}
+}
+
+// setUpRegistration asks for a registration of `userID` on behalf of `asi`
+// and returns the pending request.
+func setUpRegistration(t testing.TB, s *Server, ts *httptest.Server,
+	asi testAppServer, userID string) pendingRequest {
+	r := newTestRequest(t, ts, "GET", "/v1/register/request/"+userID, nil)
+	signRequest(t, s, r, asi)
+	setupInfo := registrationSetupReply{}
+	require.Equal(t, http.StatusOK, do(t, r, &setupInfo))
+
+	rr, err := s.registrations.Get(setupInfo.RequestID)
+	require.Nil(t, err)
+	return rr
+}
 
 func TestRegister(t *testing.T) {
-	// Similar process to auth_e2e_test.go
+	s, ts := newTestServer(t)
+	app := newTestApp(t, s, "foo")
+	asi := newTestAppServer(t, s, app.ID, permissionRegister)
+	origin := s.Config.getBaseURLWithProtocol()
+
+	rr := setUpRegistration(t, s, ts, asi, "bar")
+	challenge := util.EncodeBase64(rr.Challenge.Challenge)
+	tok := newU2FToken(t)
+
+	// A response that was not signed by the attestation key does not verify
+	forger := *tok
+	forger.attestationKey = newU2FToken(t).attestationKey
+	r := newTestRequest(t, ts, "POST", "/v1/register", forger.register(t,
+		challenge, origin))
+	require.Equal(t, http.StatusBadRequest, do(t, r, nil))
+
+	// Nor does a response for a challenge that the server never issued
+	r = newTestRequest(t, ts, "POST", "/v1/register", tok.register(t,
+		util.EncodeBase64([]byte("unknown")), origin))
+	require.Equal(t, http.StatusForbidden, do(t, r, nil))
+
+	// Nor does one for another origin
+	r = newTestRequest(t, ts, "POST", "/v1/register", tok.register(t,
+		challenge, "https://evil.example.com"))
+	require.Equal(t, http.StatusBadRequest, do(t, r, nil))
+
+	r = newTestRequest(t, ts, "POST", "/v1/register", tok.register(t,
+		challenge, origin))
+	reply := registerResponse{}
+	require.Equal(t, http.StatusOK, do(t, r, &reply))
+	require.True(t, reply.Successful)
+
+	k, err := s.Store.GetKey(tok.id())
+	require.Nil(t, err)
+	require.Equal(t, "bar", k.UserID)
+	require.Equal(t, app.ID, k.AppID)
+
+	// The request can only be completed once
+	r = newTestRequest(t, ts, "POST", "/v1/register", newU2FToken(t).register(
+		t, challenge, origin))
+	require.Equal(t, http.StatusUnauthorized, do(t, r, nil))
 }
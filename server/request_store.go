@@ -0,0 +1,444 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tera-insights/2Q2R-enterprise/util"
+
+	"github.com/jinzhu/gorm"
+	cache "github.com/patrickmn/go-cache"
+	"github.com/pkg/errors"
+	"github.com/tstranex/u2f"
+)
+
+// errRequestNotFound is returned by requestStore.Get and GetByChallenge for
+// unknown and expired requests.
+var errRequestNotFound = errors.New("Request not found")
+
+// Kinds of in-flight requests. Each kind has its own requestStore.
+const (
+	registrationRequests   = "registration"
+	authenticationRequests = "authentication"
+)
+
+// pendingRequest is an in-flight registration or authentication request. It
+// is kept by a requestStore, which may serialize it.
+type pendingRequest struct {
+	RequestID  string
+	Challenge  *u2f.Challenge
+	AppID      string
+	UserID     string
+	OriginalIP string
+
+	// Only set for authentication requests
+	KeyHandle string
+	Nonce     string
+}
+
+// requestStore holds in-flight requests of one kind and their results. With a
+// shared backend, any instance of the server can complete a request or wait
+// on it.
+type requestStore interface {
+	// Saves a request, replacing the request with the same ID. The request
+	// and its challenge can be looked up until `ttl` passes.
+	Put(req pendingRequest, ttl time.Duration) error
+	Get(id string) (pendingRequest, error)
+	GetByChallenge(challenge string) (pendingRequest, error)
+
+	// Records the result of a request, which is an HTTP status code, and
+	// keeps it for `ttl`. It returns false, without changing anything, if the
+	// request already has a result.
+	SetResult(id string, status int, ttl time.Duration) (bool, error)
+
+	// The result of a request, if it has one
+	Result(id string) (int, bool, error)
+
+	// Like Result, but waits up to `timeout` for the result to be set. It
+	// returns ctx.Err() if `ctx` is done first.
+	WaitResult(ctx context.Context, id string, timeout time.Duration) (int,
+		bool, error)
+
+	// Forgets expired requests and results
+	DeleteExpired() error
+
+	// The number of live requests that have no result yet
+	Pending() (int, error)
+
+	// Returns a request store whose changes are part of the transaction of
+	// `st`, if they are kept in the same database
+	Within(st Store) requestStore
+}
+
+// newRequestStore returns the store named by Config.RequestStore for requests
+// of `kind`.
+func newRequestStore(c *Config, store Store, kind string) (requestStore,
+	error) {
+	switch c.RequestStore {
+	case "", "memory":
+		return newMemoryRequestStore(), nil
+	case "database":
+		gs, ok := store.(*gormStore)
+		if !ok {
+			return nil, errors.New("The database request store needs a " +
+				"database")
+		}
+		return &dbRequestStore{gs.db, kind, c.RequestPollInterval}, nil
+	}
+	return nil, errors.Errorf("Unknown request store %s", c.RequestStore)
+}
+
+// awaitResult waits up to `timeout` for the result of request `id`. If there
+// is none by then, the request is timed out, which is reported by `timedOut`,
+// and its status is kept for `ttl`. If `ctx` is done first, the request is
+// left pending and ctx.Err() is returned.
+func awaitResult(ctx context.Context, rs requestStore, id string, timeout,
+	ttl time.Duration) (status int, timedOut bool, err error) {
+	status, found, err := rs.WaitResult(ctx, id, timeout)
+	if err != nil || found {
+		return status, false, err
+	}
+
+	set, err := rs.SetResult(id, http.StatusRequestTimeout, ttl)
+	if err != nil || set {
+		return http.StatusRequestTimeout, set, err
+	}
+
+	// The request completed after all
+	status, _, err = rs.Result(id)
+	return status, false, err
+}
+
+// memoryRequestStore keeps requests in memory, so requests must be completed
+// and waited on through the instance that created them.
+type memoryRequestStore struct {
+	lock       sync.Mutex
+	requests   *cache.Cache // Request ID to pendingRequest
+	challenges *cache.Cache // Challenge to request ID
+	results    *cache.Cache // Request ID to status code
+	waiters    map[string][]chan int
+}
+
+// newMemoryRequestStore creates a store whose expired requests are removed by
+// DeleteExpired.
+func newMemoryRequestStore() *memoryRequestStore {
+	return &memoryRequestStore{
+		requests:   cache.New(cache.NoExpiration, 0),
+		challenges: cache.New(cache.NoExpiration, 0),
+		results:    cache.New(cache.NoExpiration, 0),
+		waiters:    make(map[string][]chan int),
+	}
+}
+
+func (rs *memoryRequestStore) Put(req pendingRequest, ttl time.Duration) error {
+	rs.requests.Set(req.RequestID, req, ttl)
+	if req.Challenge != nil {
+		rs.challenges.Set(encodeChallenge(req.Challenge), req.RequestID, ttl)
+	}
+	return nil
+}
+
+func (rs *memoryRequestStore) Get(id string) (pendingRequest, error) {
+	if val, found := rs.requests.Get(id); found {
+		return val.(pendingRequest), nil
+	}
+	return pendingRequest{}, errRequestNotFound
+}
+
+func (rs *memoryRequestStore) GetByChallenge(
+	challenge string) (pendingRequest, error) {
+	if val, found := rs.challenges.Get(challenge); found {
+		return rs.Get(val.(string))
+	}
+	return pendingRequest{}, errRequestNotFound
+}
+
+func (rs *memoryRequestStore) SetResult(id string, status int,
+	ttl time.Duration) (bool, error) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	if _, found := rs.results.Get(id); found {
+		return false, nil
+	}
+	rs.results.Set(id, status, ttl)
+	for _, c := range rs.waiters[id] {
+		c <- status
+	}
+	delete(rs.waiters, id)
+	return true, nil
+}
+
+func (rs *memoryRequestStore) Result(id string) (int, bool, error) {
+	if val, found := rs.results.Get(id); found {
+		return val.(int), true, nil
+	}
+	return 0, false, nil
+}
+
+func (rs *memoryRequestStore) WaitResult(ctx context.Context, id string,
+	timeout time.Duration) (int, bool, error) {
+	c := make(chan int, 1)
+	rs.lock.Lock()
+	if val, found := rs.results.Get(id); found {
+		rs.lock.Unlock()
+		return val.(int), true, nil
+	}
+	rs.waiters[id] = append(rs.waiters[id], c)
+	rs.lock.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case status := <-c:
+		return status, true, nil
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	waiters := rs.waiters[id]
+	for i, w := range waiters {
+		if w == c {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(rs.waiters, id)
+	} else {
+		rs.waiters[id] = waiters
+	}
+
+	// The result may have been sent while the lock was not held
+	select {
+	case status := <-c:
+		return status, true, nil
+	default:
+		return 0, false, ctx.Err()
+	}
+}
+
+func (rs *memoryRequestStore) DeleteExpired() error {
+	rs.requests.DeleteExpired()
+	rs.challenges.DeleteExpired()
+	rs.results.DeleteExpired()
+	return nil
+}
+
+func (rs *memoryRequestStore) Pending() (int, error) {
+	pending := 0
+	for id := range rs.requests.Items() {
+		if _, found := rs.results.Get(id); !found {
+			pending++
+		}
+	}
+	return pending, nil
+}
+
+func (rs *memoryRequestStore) Within(st Store) requestStore {
+	return rs
+}
+
+// requestState is the Gorm model for an in-flight request and its result.
+type requestState struct {
+	Kind      string `gorm:"primary_key"`
+	ID        string `gorm:"primary_key"`
+	Challenge string `gorm:"index"`
+	Request   []byte // JSON-encoded pendingRequest
+
+	// HTTP status code of the result, or 0 while the request is pending
+	Status    int
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+// dbRequestStore keeps requests in the database, so that they are shared by
+// every instance of the server. Waiting polls the database every
+// pollInterval.
+type dbRequestStore struct {
+	db           *gorm.DB
+	kind         string
+	pollInterval time.Duration
+}
+
+func (rs *dbRequestStore) Put(req pendingRequest, ttl time.Duration) error {
+	encoded, err := json.Marshal(req)
+	if err != nil {
+		return errors.Wrap(err, "Could not encode request")
+	}
+	state := requestState{
+		Kind:      rs.kind,
+		ID:        req.RequestID,
+		Request:   encoded,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	if req.Challenge != nil {
+		state.Challenge = encodeChallenge(req.Challenge)
+	}
+
+	// Keep the result of a request that is replaced
+	query := rs.db.Model(&requestState{}).Where(
+		"kind = ? AND id = ?", rs.kind, req.RequestID).Updates(
+		map[string]interface{}{
+			gorm.ToDBName("Challenge"): state.Challenge,
+			gorm.ToDBName("Request"):   state.Request,
+			gorm.ToDBName("ExpiresAt"): state.ExpiresAt,
+		})
+	if query.Error != nil || query.RowsAffected > 0 {
+		return query.Error
+	}
+	return rs.db.Create(&state).Error
+}
+
+// first loads the live request state that matches `where`.
+func (rs *dbRequestStore) first(where requestState) (requestState, error) {
+	var state requestState
+	if where.ID == "" && where.Challenge == "" {
+		return state, errRequestNotFound
+	}
+	where.Kind = rs.kind
+	err := rs.db.Where("expires_at > ?", time.Now()).First(&state,
+		&where).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return state, errRequestNotFound
+	}
+	return state, err
+}
+
+func (rs *dbRequestStore) decode(state requestState) (pendingRequest, error) {
+	var req pendingRequest
+	if len(state.Request) == 0 {
+		// Only the result of the request is known
+		return req, errRequestNotFound
+	}
+	err := json.Unmarshal(state.Request, &req)
+	return req, errors.Wrap(err, "Could not decode request")
+}
+
+func (rs *dbRequestStore) Get(id string) (pendingRequest, error) {
+	state, err := rs.first(requestState{ID: id})
+	if err != nil {
+		return pendingRequest{}, err
+	}
+	return rs.decode(state)
+}
+
+func (rs *dbRequestStore) GetByChallenge(
+	challenge string) (pendingRequest, error) {
+	state, err := rs.first(requestState{Challenge: challenge})
+	if err != nil {
+		return pendingRequest{}, err
+	}
+	return rs.decode(state)
+}
+
+func (rs *dbRequestStore) SetResult(id string, status int,
+	ttl time.Duration) (bool, error) {
+	// Only a pending request can be updated, so that of two instances that
+	// set a result at the same time, exactly one succeeds
+	expiresAt := time.Now().Add(ttl)
+	query := rs.db.Model(&requestState{}).Where(
+		"kind = ? AND id = ? AND status = 0", rs.kind, id).Updates(
+		map[string]interface{}{
+			gorm.ToDBName("Status"):    status,
+			gorm.ToDBName("ExpiresAt"): expiresAt,
+		})
+	if query.Error != nil {
+		return false, errors.Wrap(query.Error, "Could not set request result")
+	} else if query.RowsAffected > 0 {
+		return true, nil
+	}
+
+	// Either there is a result already, or the request expired and was
+	// deleted. In the latter case, only the result is kept.
+	if found, err := rs.exists(id); err != nil || found {
+		return false, err
+	}
+	err := rs.db.Create(&requestState{
+		Kind:      rs.kind,
+		ID:        id,
+		Status:    status,
+		ExpiresAt: expiresAt,
+	}).Error
+	if err != nil {
+		// Another instance may have set the result in the meantime
+		if found, _ := rs.exists(id); found {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "Could not set request result")
+	}
+	return true, nil
+}
+
+// exists returns whether there is a row for request `id`, even an expired one.
+func (rs *dbRequestStore) exists(id string) (bool, error) {
+	var count int
+	err := rs.db.Model(&requestState{}).Where("kind = ? AND id = ?", rs.kind,
+		id).Count(&count).Error
+	return count > 0, err
+}
+
+func (rs *dbRequestStore) Result(id string) (int, bool, error) {
+	state, err := rs.first(requestState{ID: id})
+	if err == errRequestNotFound {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	return state.Status, state.Status != 0, nil
+}
+
+func (rs *dbRequestStore) WaitResult(ctx context.Context, id string,
+	timeout time.Duration) (int, bool, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		status, found, err := rs.Result(id)
+		if err != nil || found {
+			return status, found, err
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return 0, false, nil
+		}
+		if wait > rs.pollInterval {
+			wait = rs.pollInterval
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return 0, false, ctx.Err()
+		}
+	}
+}
+
+func (rs *dbRequestStore) DeleteExpired() error {
+	return rs.db.Where("kind = ? AND expires_at <= ?", rs.kind,
+		time.Now()).Delete(requestState{}).Error
+}
+
+// Pending counts the live requests without a result. Rows that only hold a
+// result have no challenge.
+func (rs *dbRequestStore) Pending() (int, error) {
+	var count int
+	err := rs.db.Model(&requestState{}).Where(
+		"kind = ? AND status = 0 AND challenge <> '' AND expires_at > ?",
+		rs.kind, time.Now()).Count(&count).Error
+	return count, err
+}
+
+func (rs *dbRequestStore) Within(st Store) requestStore {
+	if gs, ok := st.(*gormStore); ok {
+		return &dbRequestStore{gs.db, rs.kind, rs.pollInterval}
+	}
+	return rs
+}
+
+// encodeChallenge returns the challenge as it appears in client data.
+func encodeChallenge(c *u2f.Challenge) string {
+	return util.EncodeBase64(c.Challenge)
+}
@@ -0,0 +1,133 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tstranex/u2f"
+)
+
+// testRequestStores returns pairs of request stores that share their backend,
+// as two instances of the server would.
+func testRequestStores(t *testing.T) map[string][2]requestStore {
+	memory := newMemoryRequestStore()
+
+	conn := openTestDatabase(t, "sqlite3",
+		filepath.Join(t.TempDir(), "test.db"))
+	if err := NewMigrator(conn).Up(); err != nil {
+		t.Fatal(err)
+	}
+	db := func() requestStore {
+		return &dbRequestStore{conn, registrationRequests, time.Millisecond}
+	}
+
+	return map[string][2]requestStore{
+		"memory":   {memory, memory},
+		"database": {db(), db()},
+	}
+}
+
+func TestRequestStoreSharesRequests(t *testing.T) {
+	for kind, stores := range testRequestStores(t) {
+		t.Run(kind, func(t *testing.T) {
+			a, b := stores[0], stores[1]
+			challenge, err := u2f.NewChallenge("https://2q2r", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = a.Put(pendingRequest{
+				RequestID: "request",
+				Challenge: challenge,
+				UserID:    "user",
+			}, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req, err := b.GetByChallenge(encodeChallenge(challenge))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req.RequestID != "request" || req.UserID != "user" ||
+				string(req.Challenge.Challenge) !=
+					string(challenge.Challenge) {
+				t.Errorf("Loaded %+v", req)
+			}
+			if _, err := b.GetByChallenge(""); err != errRequestNotFound {
+				t.Errorf("Found a request for an empty challenge: %v", err)
+			}
+
+			// b waits on a request that a completes
+			go func() {
+				time.Sleep(20 * time.Millisecond)
+				a.SetResult("request", http.StatusOK, time.Minute)
+			}()
+			status, found, err := b.WaitResult(context.Background(), "request",
+				time.Second)
+			if err != nil || !found || status != http.StatusOK {
+				t.Fatalf("Waited for %d, %v (%v)", status, found, err)
+			}
+			set, err := b.SetResult("request", http.StatusRequestTimeout,
+				time.Minute)
+			if err != nil || set {
+				t.Errorf("Replaced the result (%v)", err)
+			}
+
+			// A request that completes after it expired
+			err = a.Put(pendingRequest{RequestID: "expired"}, time.Millisecond)
+			if err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(5 * time.Millisecond)
+			if _, err := b.Get("expired"); err != errRequestNotFound {
+				t.Errorf("Loaded an expired request: %v", err)
+			}
+			if err := b.DeleteExpired(); err != nil {
+				t.Fatal(err)
+			}
+			status, timedOut, err := awaitResult(context.Background(), b, "expired",
+				10*time.Millisecond, time.Minute)
+			if err != nil || !timedOut || status != http.StatusRequestTimeout {
+				t.Errorf("Timed out with %d, %v (%v)", status, timedOut, err)
+			}
+			status, found, err = a.Result("expired")
+			if err != nil || !found || status != http.StatusRequestTimeout {
+				t.Errorf("Result was %d, %v (%v)", status, found, err)
+			}
+		})
+	}
+}
+
+func TestRequestStoreWaitIsCanceled(t *testing.T) {
+	for kind, stores := range testRequestStores(t) {
+		t.Run(kind, func(t *testing.T) {
+			rs := stores[0]
+			err := rs.Put(pendingRequest{RequestID: "request"}, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				time.Sleep(20 * time.Millisecond)
+				cancel()
+			}()
+			_, _, err = awaitResult(ctx, rs, "request", time.Minute,
+				time.Minute)
+			if err != context.Canceled {
+				t.Fatalf("Wait ended with %v", err)
+			}
+
+			// The request is still pending, so it can be completed
+			set, err := rs.SetResult("request", http.StatusOK, time.Minute)
+			if err != nil || !set {
+				t.Errorf("Could not complete the request (%v)", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tera-insights/2Q2R-enterprise/util"
+
+	"github.com/pkg/errors"
+)
+
+// Reasons that a successful authentication is risky, for event.RiskReasons
+const (
+	// The user could not have traveled from where they last authenticated in
+	// time
+	riskImpossibleTravel = "impossibleTravel"
+
+	// The user never authenticated from this country or autonomous system
+	riskNewCountry = "newCountry"
+	riskNewASN     = "newASN"
+
+	// The user never authenticated around this time of day (in UTC)
+	riskUnusualHour = "unusualHour"
+)
+
+// How much each reason adds to the risk score of an authentication. Scores
+// are capped at maxRiskScore.
+var riskWeights = map[string]int{
+	riskImpossibleTravel: 60,
+	riskNewCountry:       35,
+	riskNewASN:           15,
+	riskUnusualHour:      10,
+}
+
+const maxRiskScore = 100
+
+// Per-app thresholds when AppInfo leaves them at 0
+const (
+	defaultAnomalyThreshold = 50
+	defaultMaxTravelSpeed   = 1000 // km/h, a little faster than airliners
+)
+
+// The history that an authentication is compared with
+const (
+	// The latest successful authentications of the user within the window
+	riskHistorySize   = 50
+	riskHistoryWindow = 90 * 24 * time.Hour
+
+	// Authentications from fewer places than this apart are not travel,
+	// since geolocation is not that precise
+	minTravelDistance = 100 // km
+
+	// A user needs this many authentications before their usual hours are
+	// known
+	minHistoryForHours = 10
+
+	// Hours of the day around an authentication in which the user must have
+	// authenticated before for it not to be at an unusual hour
+	usualHourMargin = 1
+)
+
+// riskEngine compares each successful authentication with the recent history
+// of its user, and emits an anomaly event if it looks risky enough for the
+// app.
+type riskEngine struct {
+	log   eventLog
+	store Store
+}
+
+func newRiskEngine(log eventLog, store Store) *riskEngine {
+	return &riskEngine{log, store}
+}
+
+// riskThresholds returns the anomaly threshold and the maximum travel speed,
+// in km/h, of app `appID`.
+func (re *riskEngine) riskThresholds(appID string) (int, float64, error) {
+	app, err := re.store.GetApp(appID)
+	if err != nil && err != ErrNotFound {
+		return 0, 0, errors.Wrap(err, "Could not read app")
+	}
+	threshold, speed := app.AnomalyThreshold, app.MaxTravelSpeed
+	if threshold == 0 {
+		threshold = defaultAnomalyThreshold
+	}
+	if speed == 0 {
+		speed = defaultMaxTravelSpeed
+	}
+	return threshold, speed, nil
+}
+
+// checkRiskThresholds panics unless `threshold` and `maxSpeed` can be set on
+// an app.
+func checkRiskThresholds(threshold int, maxSpeed float64) {
+	util.PanicIfFalse(threshold >= 0, http.StatusBadRequest,
+		"Anomaly threshold cannot be negative")
+	util.PanicIfFalse(maxSpeed >= 0, http.StatusBadRequest,
+		"Maximum travel speed cannot be negative")
+}
+
+// assess returns the anomaly event for `e`, a persisted event, or nil if
+// `e` is not a successful authentication or is not risky enough.
+func (re *riskEngine) assess(e event) (*event, error) {
+	if e.Name != events[authentication] || e.Status != "success" {
+		return nil, nil
+	}
+	threshold, maxSpeed, err := re.riskThresholds(e.AppID)
+	if err != nil {
+		return nil, err
+	}
+	if threshold > maxRiskScore {
+		return nil, nil
+	}
+
+	history, err := re.log.Query(eventQuery{
+		AppID:  e.AppID,
+		UserID: e.UserID,
+		Name:   events[authentication],
+		Status: "success",
+		From:   e.Timestamp.Add(-riskHistoryWindow),
+		Before: e.ID,
+		Limit:  riskHistorySize,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not read authentication history")
+	}
+
+	score, reasons := riskScore(e, history, maxSpeed)
+	if score < threshold {
+		return nil, nil
+	}
+	return &event{
+		Name:             events[anomaly],
+		OriginalIP:       e.OriginalIP,
+		OriginalLat:      e.OriginalLat,
+		OriginalLong:     e.OriginalLong,
+		ResolvingIP:      e.ResolvingIP,
+		ResolvingLat:     e.ResolvingLat,
+		ResolvingLong:    e.ResolvingLong,
+		AppID:            e.AppID,
+		Timestamp:        e.Timestamp,
+		Status:           "suspect",
+		UserID:           e.UserID,
+		OriginalCountry:  e.OriginalCountry,
+		OriginalCity:     e.OriginalCity,
+		OriginalASN:      e.OriginalASN,
+		ResolvingCountry: e.ResolvingCountry,
+		ResolvingCity:    e.ResolvingCity,
+		ResolvingASN:     e.ResolvingASN,
+		RiskScore:        score,
+		RiskReasons:      strings.Join(reasons, ","),
+		CauseID:          e.ID,
+	}, nil
+}
+
+// riskScore scores authentication `e` against `history`, the user's earlier
+// successful authentications, newest first. The user's location is that of
+// the resolving IP, the address that completed the authentication.
+func riskScore(e event, history []event, maxSpeed float64) (int, []string) {
+	var reasons []string
+	if len(history) == 0 {
+		return 0, reasons
+	}
+
+	if e.hasResolvingCoordinates() {
+		for _, prev := range history {
+			if !prev.hasResolvingCoordinates() {
+				continue
+			}
+			km := distance(prev.ResolvingLat, prev.ResolvingLong,
+				e.ResolvingLat, e.ResolvingLong)
+			hours := e.Timestamp.Sub(prev.Timestamp).Hours()
+			if km >= minTravelDistance && (hours <= 0 || km/hours > maxSpeed) {
+				reasons = append(reasons, riskImpossibleTravel)
+			}
+			break
+		}
+	}
+
+	countries := map[string]bool{}
+	asns := map[uint]bool{}
+	for _, prev := range history {
+		if prev.ResolvingCountry != "" {
+			countries[prev.ResolvingCountry] = true
+		}
+		if prev.ResolvingASN != 0 {
+			asns[prev.ResolvingASN] = true
+		}
+	}
+	if e.ResolvingCountry != "" && len(countries) > 0 &&
+		!countries[e.ResolvingCountry] {
+		reasons = append(reasons, riskNewCountry)
+	}
+	if e.ResolvingASN != 0 && len(asns) > 0 && !asns[e.ResolvingASN] {
+		reasons = append(reasons, riskNewASN)
+	}
+
+	if len(history) >= minHistoryForHours && unusualHour(e, history) {
+		reasons = append(reasons, riskUnusualHour)
+	}
+
+	score := 0
+	for _, r := range reasons {
+		score += riskWeights[r]
+	}
+	if score > maxRiskScore {
+		score = maxRiskScore
+	}
+	return score, reasons
+}
+
+// unusualHour returns whether none of `history` happened within
+// usualHourMargin hours of the time of day of `e`.
+func unusualHour(e event, history []event) bool {
+	hour := e.Timestamp.UTC().Hour()
+	for _, prev := range history {
+		apart := hour - prev.Timestamp.UTC().Hour()
+		if apart < 0 {
+			apart = -apart
+		}
+		if apart > 12 {
+			apart = 24 - apart
+		}
+		if apart <= usualHourMargin {
+			return false
+		}
+	}
+	return true
+}
+
+// hasResolvingCoordinates returns whether the resolving IP was located. The
+// GeoResolver leaves coordinates at 0 when it does not know them.
+func (e event) hasResolvingCoordinates() bool {
+	return e.ResolvingLat != 0 || e.ResolvingLong != 0
+}
+
+// distance returns the great-circle distance in km between two coordinates,
+// in degrees.
+func distance(lat1, long1, lat2, long2 float64) float64 {
+	const earthRadius = 6371 // km
+	rad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := rad(lat2 - lat1)
+	dLong := rad(long2 - long1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(rad(lat1))*math.Cos(rad(lat2))*
+			math.Sin(dLong/2)*math.Sin(dLong/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
@@ -0,0 +1,122 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDistance(t *testing.T) {
+	// New York to London
+	if km := distance(40.71, -74.01, 51.51, -0.13); math.Abs(km-5570) > 10 {
+		t.Errorf("Distance was %f km, expected about 5570", km)
+	}
+	if km := distance(10, 20, 10, 20); km != 0 {
+		t.Errorf("Distance to the same place was %f km", km)
+	}
+}
+
+func TestRiskScore(t *testing.T) {
+	start := time.Date(2017, 1, 2, 9, 0, 0, 0, time.UTC)
+	home := event{Timestamp: start, ResolvingLat: 29.65,
+		ResolvingLong: -82.32, ResolvingCountry: "US", ResolvingASN: 64500}
+	var history []event // newest first, the latest at start
+	for i := minHistoryForHours - 1; i >= 0; i-- {
+		prev := home
+		prev.Timestamp = start.Add(-time.Duration(i) * 24 * time.Hour)
+		history = append([]event{prev}, history...)
+	}
+
+	abroad := home
+	abroad.ResolvingLat, abroad.ResolvingLong = 52.52, 13.40
+	abroad.ResolvingCountry, abroad.ResolvingASN = "DE", 64501
+
+	for name, c := range map[string]struct {
+		e       event
+		history []event
+		score   int
+		reasons string
+	}{
+		"usual": {at(home, start.Add(24*time.Hour)), history, 0, ""},
+		"first": {abroad, nil, 0, ""},
+		"flight": {at(abroad, start.Add(time.Hour)), history, 100,
+			"impossibleTravel,newCountry,newASN"},
+		"trip": {at(abroad, start.Add(12*time.Hour)), history, 60,
+			"newCountry,newASN,unusualHour"},
+		"nearby":      {near(home, start.Add(time.Minute)), history, 0, ""},
+		"night":       {at(home, start.Add(12*time.Hour)), history, 10, "unusualHour"},
+		"unlocated":   {at(event{}, start.Add(time.Hour)), history, 0, ""},
+		"new network": {withASN(home, 64502), history, 15, "newASN"},
+	} {
+		score, reasons := riskScore(c.e, c.history, defaultMaxTravelSpeed)
+		if score != c.score || strings.Join(reasons, ",") != c.reasons {
+			t.Errorf("%s scored %d for %v, expected %d for %s", name, score,
+				reasons, c.score, c.reasons)
+		}
+	}
+}
+
+func at(e event, t time.Time) event {
+	e.Timestamp = t
+	return e
+}
+
+// near moves `e` less than minTravelDistance.
+func near(e event, t time.Time) event {
+	e.Timestamp = t
+	e.ResolvingLat += 0.5
+	return e
+}
+
+func withASN(e event, asn uint) event {
+	e.ResolvingASN = asn
+	return e
+}
+
+func TestAnomaliesAreDispersed(t *testing.T) {
+	geo, err := newCIDRResolver(writeTempFile(t, "networks.csv", `
+192.0.2.0/24, US, Gainesville, 29.65, -82.32, AS64500
+198.51.100.0/24, DE, Berlin, 52.52, 13.40, AS64501
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newMemoryStore()
+	for _, app := range []AppInfo{
+		{ID: "strict", AnomalyThreshold: 10},
+		{ID: "off", AnomalyThreshold: maxRiskScore + 1},
+	} {
+		if err = store.CreateApp(app); err != nil {
+			t.Fatal(err)
+		}
+	}
+	log := &memoryEventLog{}
+	d := startDisperser(geo, log, nil, newRiskEngine(log, store))
+	defer d.stop()
+
+	now := time.Now()
+	for _, appID := range []string{"strict", "off", "default"} {
+		d.addEvent(authentication, now, appID, "success", "u", "", "192.0.2.1")
+		d.addEvent(authentication, now.Add(time.Hour), appID, "success", "u",
+			"", "198.51.100.1")
+	}
+	// Failures are not assessed
+	d.addEvent(authentication, now.Add(time.Hour), "strict", "failure", "u",
+		"", "198.51.100.1")
+
+	found, _ := log.Query(eventQuery{Name: "anomaly"})
+	if len(found) != 2 {
+		t.Fatalf("Recorded anomalies %+v", found)
+	}
+	for i, appID := range []string{"default", "strict"} {
+		a := found[i]
+		if a.AppID != appID || a.UserID != "u" || a.RiskScore != 100 ||
+			a.RiskReasons != "impossibleTravel,newCountry,newASN" ||
+			a.ResolvingCountry != "DE" || a.CauseID != a.ID-1 {
+			t.Errorf("Anomaly of %s was %+v", appID, a)
+		}
+	}
+}
@@ -3,21 +3,22 @@
 package server
 
 import (
-	_ "crypto/elliptic"
-	_ "crypto/hmac"
+	"bytes"
+	"crypto/elliptic"
+	"crypto/hmac"
 	"crypto/rsa"
-	_ "crypto/sha256"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
+	"fmt"
 	"html/template"
 	"io"
 	"io/ioutil"
-	"log"
-	_ "math/big"
 	"net/http"
-	"os"
+	"runtime/debug"
+	"strconv"
 	"strings"
 	"time"
 
@@ -25,12 +26,9 @@ import (
 	"github.com/tera-insights/2Q2R-enterprise/util"
 
 	rice "github.com/GeertJohan/go.rice"
-	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/securecookie"
-	"github.com/jinzhu/gorm"
-	_ "github.com/jinzhu/gorm/dialects/postgres" // Needed for Gorm
-	_ "github.com/jinzhu/gorm/dialects/sqlite"   // Needed for Gorm
+	cache "github.com/patrickmn/go-cache"
 	"github.com/pkg/errors"
 	glob "github.com/ryanuber/go-glob"
 	"github.com/spf13/viper"
@@ -38,7 +36,10 @@ import (
 
 // Config is the configuration for the server.
 type Config struct {
-	Port         string
+	Port string
+
+	// A Gorm dialect and its connection string, or "memory" to keep
+	// everything in memory
 	DatabaseType string
 	DatabaseName string
 
@@ -58,11 +59,15 @@ type Config struct {
 	HTTPS       bool
 	LogRequests bool
 
+	// Level ("debug", "info", "warn" or "error") and format ("logfmt" or
+	// "json") of the server's log
+	LogLevel  string
+	LogFormat string
+
 	CertFile string
 	KeyFile  string
 
-	Base64EncodedPublicKey string
-	KeyType                string
+	KeyType string
 
 	// Path to the private ECDSA key that verifies server-to-server
 	// authentication
@@ -72,12 +77,87 @@ type Config struct {
 	PrivateKeyEncrypted bool
 	PrivateKeyPassword  string
 
-	AdminSessionLength time.Duration
-	MaxMindPath        string
+	// Admin sessions expire after AdminSessionLength without use, and
+	// AdminSessionMaxLength after login regardless of use
+	AdminSessionLength    time.Duration
+	AdminSessionMaxLength time.Duration
+
+	// Either "database" (the default) or "memory"
+	SessionStore string
+
+	// Where in-flight registration and authentication requests are kept:
+	// either "memory" (the default), which only works with a single instance
+	// of the server, or "database", which lets every instance that shares the
+	// database complete and wait on any request. Waiting on the database
+	// polls it every RequestPollInterval.
+	RequestStore        string
+	RequestPollInterval time.Duration
+
+	// Locates the IP addresses of security events: "maxmind" (the default)
+	// looks them up in the MaxMind City DB at MaxMindPath and, if it is set,
+	// the MaxMind ASN DB at MaxMindASNPath, which are reloaded when they
+	// change, checked every GeoReloadInterval; "cidr" looks them up in the
+	// file at GeoCIDRPath, and "none" leaves events without locations.
+	GeoResolver       string
+	MaxMindPath       string
+	MaxMindASNPath    string
+	GeoCIDRPath       string
+	GeoReloadInterval time.Duration
 
 	MaxOpenDBConnections int
 
+	// How long admin nonces are valid for
 	NonceTime time.Duration
+
+	// WebAuthn relying party ID. Must be a registrable domain suffix of
+	// BaseURL; defaults to BaseURL.
+	RelyingPartyID string
+
+	// Directory of PEM-encoded root certificates that attestation
+	// certificates must chain to
+	AttestationRootsPath string
+
+	// Path to a FIDO MDS3 blob downloaded from the metadata service, and the
+	// directory of PEM-encoded roots that its signing certificate chains to
+	MetadataBlobPath  string
+	MetadataRootsPath string
+
+	// How far an app server's X-Timestamp may be from our clock
+	ServerAuthSkew time.Duration
+
+	// Keys that sign and encrypt admin session cookies, as standard base-64
+	// encoded "<hash key>:<block key>" pairs. The first pair encrypts new
+	// cookies and the rest only decrypt, so that keys can be rotated.
+	// SessionKeysFile holds more pairs, one per line, after SessionKeys.
+	SessionKeys     []string
+	SessionKeysFile string
+
+	// The standard base-64 encoded 32-byte master key that wraps the data
+	// keys, which encrypt key registrations, app server public keys and
+	// signing keys in the database. It is read from MasterKeyFile or, if that
+	// is empty, from the environment variable named MasterKeyEnv. Without a
+	// master key, those columns are stored in plaintext.
+	MasterKeyFile string
+	MasterKeyEnv  string
+
+	// When the server is stopped, /readyz fails for ShutdownDelay before it
+	// stops accepting connections, and cmd/server then waits up to
+	// ShutdownTimeout for in-flight requests
+	ShutdownDelay   time.Duration
+	ShutdownTimeout time.Duration
+
+	// How long security events are kept in the event log, and webhook
+	// deliveries that are no longer pending. Zero keeps them forever.
+	EventRetention time.Duration
+
+	// How long to wait for a webhook to answer, and how many attempts to
+	// deliver an event to a webhook are made before it is dead
+	WebhookTimeout     time.Duration
+	WebhookMaxAttempts int
+
+	// Whether webhooks may be sent to loopback, private and link-local
+	// addresses, such as services on the server's own network
+	WebhookAllowPrivateNetworks bool
 }
 
 func (c *Config) getBaseURLWithProtocol() string {
@@ -87,16 +167,49 @@ func (c *Config) getBaseURLWithProtocol() string {
 	return "http://" + c.BaseURL + c.Port
 }
 
+func (c *Config) getRelyingPartyID() string {
+	if c.RelyingPartyID != "" {
+		return c.RelyingPartyID
+	}
+	return c.BaseURL
+}
+
+func (c *Config) getRelyingPartyIDHash() []byte {
+	h := sha256.Sum256([]byte(c.getRelyingPartyID()))
+	return h[:]
+}
+
 // Server is the type that represents the 2Q2R server.
 type Server struct {
-	Config    *Config
-	DB        *gorm.DB
-	disperser *disperser
-	Pub       *rsa.PublicKey
-	priv      *rsa.PrivateKey
-	sc        *securecookie.SecureCookie
-	kc        *security.KeyCache
-	ng        *security.NonceGen
+	Config           *Config
+	Store            Store
+	disperser        *disperser
+	Pub              *rsa.PublicKey
+	priv             *rsa.PrivateKey
+	cookieCodecs     []securecookie.Codec
+	kc               *security.KeyCache
+	ng               *security.NonceGen
+	attestationRoots *x509.CertPool
+	metadata         *metadataStore
+
+	// MACs of recent app server requests, to reject replays
+	serverMACs *cache.Cache
+
+	sessions sessionStore
+
+	// In-flight requests
+	registrations   requestStore
+	authentications requestStore
+
+	// Persisted security events
+	events eventLog
+
+	// Sends security events to the webhooks of apps
+	webhooks *webhookDispatcher
+
+	metrics *metrics
+
+	lc *lifecycle
 }
 
 // Used in registration and authentication templates
@@ -106,8 +219,9 @@ type templateData struct {
 	Data template.JS
 }
 
-// NewServer creates a new 2Q2R server.
-func NewServer(r io.Reader, ct string) (s Server) {
+// LoadConfig reads the configuration from `r`, which has config type `ct`,
+// filling in defaults for missing options.
+func LoadConfig(r io.Reader, ct string) *Config {
 	viper.SetConfigType(ct)
 
 	viper.SetDefault("Port", ":8080")
@@ -120,18 +234,29 @@ func NewServer(r io.Reader, ct string) (s Server) {
 	viper.SetDefault("BaseURL", "127.0.0.1")
 	viper.SetDefault("HTTPS", true)
 	viper.SetDefault("LogRequests", false)
-	viper.SetDefault("Base64EncodedPublicKey", "mypubkey")
+	viper.SetDefault("LogLevel", "info")
+	viper.SetDefault("LogFormat", "logfmt")
 	viper.SetDefault("KeyType", "ECC-P256")
 	viper.SetDefault("PrivateKeyFile", "app_server_priv.pem")
 	viper.SetDefault("PrivateKeyEncrypted", false)
 	viper.SetDefault("AdminSessionLength", 15*time.Minute)
+	viper.SetDefault("AdminSessionMaxLength", 12*time.Hour)
+	viper.SetDefault("NonceTime", 30*time.Second)
+	viper.SetDefault("GeoResolver", geoMaxMind)
 	viper.SetDefault("MaxMindPath", "db.mmdb")
+	viper.SetDefault("GeoReloadInterval", time.Minute)
 	viper.SetDefault("MaxOpenDBConnections", 1)
-
-	err := viper.ReadConfig(r)
-	if err != nil {
-		log.Printf("Could not read config file! Using default options\n")
-	}
+	viper.SetDefault("ServerAuthSkew", 1*time.Minute)
+	viper.SetDefault("MasterKeyEnv", "TWOQ2R_MASTER_KEY")
+	viper.SetDefault("RequestStore", "memory")
+	viper.SetDefault("RequestPollInterval", 250*time.Millisecond)
+	viper.SetDefault("ShutdownTimeout", 30*time.Second)
+	viper.SetDefault("EventRetention", 90*24*time.Hour)
+	viper.SetDefault("WebhookTimeout", 10*time.Second)
+	viper.SetDefault("WebhookMaxAttempts", 8)
+	viper.SetDefault("WebhookAllowPrivateNetworks", false)
+
+	readErr := viper.ReadConfig(r)
 
 	c := &Config{
 		Port:                            viper.GetString("Port"),
@@ -144,17 +269,56 @@ func NewServer(r io.Reader, ct string) (s Server) {
 		BaseURL:                         viper.GetString("BaseURL"),
 		HTTPS:                           viper.GetBool("HTTPS"),
 		LogRequests:                     viper.GetBool("LogRequests"),
+		LogLevel:                        viper.GetString("LogLevel"),
+		LogFormat:                       viper.GetString("LogFormat"),
 		CertFile:                        viper.GetString("CertFile"),
 		KeyFile:                         viper.GetString("KeyFile"),
-		Base64EncodedPublicKey:          viper.GetString("Base64EncodedPublicKey"),
 		KeyType:                         viper.GetString("KeyType"),
 		PrivateKeyFile:                  viper.GetString("PrivateKeyFile"),
 		PrivateKeyEncrypted:             viper.GetBool("PrivateKeyEncrypted"),
 		PrivateKeyPassword:              viper.GetString("PrivateKeyPassword"),
 		AdminSessionLength:              viper.GetDuration("AdminSessionLength"),
+		AdminSessionMaxLength:           viper.GetDuration("AdminSessionMaxLength"),
+		SessionStore:                    viper.GetString("SessionStore"),
+		RequestStore:                    viper.GetString("RequestStore"),
+		RequestPollInterval:             viper.GetDuration("RequestPollInterval"),
+		GeoResolver:                     viper.GetString("GeoResolver"),
 		MaxMindPath:                     viper.GetString("MaxMindPath"),
+		MaxMindASNPath:                  viper.GetString("MaxMindASNPath"),
+		GeoCIDRPath:                     viper.GetString("GeoCIDRPath"),
+		GeoReloadInterval:               viper.GetDuration("GeoReloadInterval"),
 		MaxOpenDBConnections:            viper.GetInt("MaxOpenDBConnections"),
+		NonceTime:                       viper.GetDuration("NonceTime"),
+		RelyingPartyID:                  viper.GetString("RelyingPartyID"),
+		AttestationRootsPath:            viper.GetString("AttestationRootsPath"),
+		MetadataBlobPath:                viper.GetString("MetadataBlobPath"),
+		MetadataRootsPath:               viper.GetString("MetadataRootsPath"),
+		ServerAuthSkew:                  viper.GetDuration("ServerAuthSkew"),
+		SessionKeys:                     viper.GetStringSlice("SessionKeys"),
+		SessionKeysFile:                 viper.GetString("SessionKeysFile"),
+		MasterKeyFile:                   viper.GetString("MasterKeyFile"),
+		MasterKeyEnv:                    viper.GetString("MasterKeyEnv"),
+		ShutdownDelay:                   viper.GetDuration("ShutdownDelay"),
+		ShutdownTimeout:                 viper.GetDuration("ShutdownTimeout"),
+		EventRetention:                  viper.GetDuration("EventRetention"),
+		WebhookTimeout:                  viper.GetDuration("WebhookTimeout"),
+		WebhookMaxAttempts:              viper.GetInt("WebhookMaxAttempts"),
+		WebhookAllowPrivateNetworks:     viper.GetBool("WebhookAllowPrivateNetworks"),
+	}
+
+	if err := configureLogging(c); err != nil {
+		logger.WithError(err).Warn("Using the default log options")
 	}
+	if readErr != nil {
+		logger.WithError(readErr).Warn("Could not read config file! Using " +
+			"default options")
+	}
+	return c
+}
+
+// NewServer creates a new 2Q2R server.
+func NewServer(r io.Reader, ct string) (s Server) {
+	c := LoadConfig(r, ct)
 
 	// Load the Tera Insights RSA public key
 	pubKey := "MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEAyY2LvohHNfGhWrRJ1XHX" +
@@ -196,45 +360,79 @@ func NewServer(r io.Reader, ct string) (s Server) {
 		panic(errors.Wrap(err, "Couldn't parse file as DER-encoded ECDSA private key"))
 	}
 
-	db, err := gorm.Open(c.DatabaseType, c.DatabaseName)
-	if err != nil {
-		panic(errors.Wrap(err, "Could not open database"))
-	}
-	db.DB().SetMaxOpenConns(c.MaxOpenDBConnections)
-
-	err = db.AutoMigrate(&AppInfo{}).
-		AutoMigrate(&AppServerInfo{}).
-		AutoMigrate(&security.Key{}).
-		AutoMigrate(&Admin{}).
-		AutoMigrate(&security.KeySignature{}).
-		AutoMigrate(&security.SigningKey{}).
-		AutoMigrate(&Permission{}).
-		AutoMigrate(&LongTermRequest{}).Error
+	store, err := newStore(c)
 	if err != nil {
-		panic(errors.Wrap(err, "Could not migrate schemas"))
+		panic(errors.Wrap(err, "Could not open store"))
 	}
 
-	d, err := newDisperser(c.MaxMindPath)
+	events := newEventLog(store)
+	webhooks := newWebhookDispatcher(newWebhookStore(store), c)
+	geo, err := newGeoResolver(c)
 	if err != nil {
-		panic(errors.Wrap(err, "Could not create event disperser"))
+		logger.WithError(err).Warn("Security events will not be located")
+		geo = noopResolver{}
 	}
+	d := startDisperser(geo, events, webhooks, newRiskEngine(events, store))
 
 	rsa, ok := pub.(*rsa.PublicKey)
 	if !ok {
 		panic(errors.New("Could not cast key as RSA"))
 	}
 
+	roots, err := loadAttestationRoots(c.AttestationRootsPath)
+	if err != nil {
+		panic(errors.Wrap(err, "Could not load attestation roots"))
+	}
+
+	md, err := newMetadataStore(c.MetadataBlobPath, c.MetadataRootsPath)
+	if err != nil {
+		panic(errors.Wrap(err, "Could not load FIDO metadata"))
+	}
+
+	codecs, err := loadSessionCodecs(c)
+	if err != nil {
+		panic(errors.Wrap(err, "Could not load session keys"))
+	}
+
+	sessions, err := newSessionStore(c.SessionStore, store)
+	if err != nil {
+		panic(errors.Wrap(err, "Could not create session store"))
+	}
+
+	registrations, err := newRequestStore(c, store, registrationRequests)
+	if err != nil {
+		panic(errors.Wrap(err, "Could not create request store"))
+	}
+	authentications, err := newRequestStore(c, store, authenticationRequests)
+	if err != nil {
+		panic(errors.Wrap(err, "Could not create request store"))
+	}
+
+	kc := security.NewKeyCache(c.ExpirationTime, c.CleanTime, rsa, store,
+		priv.D.Bytes())
+
 	s = Server{
 		c,
-		db,
+		store,
 		d,
 		rsa,
 		priv,
-		securecookie.New(securecookie.GenerateRandomKey(64), nil),
-		security.NewKeyCache(c.ExpirationTime, c.CleanTime, rsa, db,
-			priv.D.Bytes()),
+		codecs,
+		kc,
 		security.NewNonceGen(c.NonceTime),
+		roots,
+		md,
+		cache.New(2*c.ServerAuthSkew, 0),
+		sessions,
+		registrations,
+		authentications,
+		events,
+		webhooks,
+		newMetrics(registrations, authentications, d, kc),
+		newLifecycle(c),
 	}
+	s.background(s.clean)
+	s.background(func() { webhooks.run(s.lc.done) })
 	return s
 }
 
@@ -251,8 +449,9 @@ func forMethod(r *mux.Router, s string, h http.HandlerFunc, m string) {
 }
 
 type errorResponse struct {
-	Message string
-	Info    interface{} `json:",omitempty"`
+	Message   string
+	Info      interface{} `json:",omitempty"`
+	RequestID string      `json:",omitempty"`
 }
 
 func (s *Server) recoverWrap(handle http.Handler) http.Handler {
@@ -261,64 +460,49 @@ func (s *Server) recoverWrap(handle http.Handler) http.Handler {
 			if err := recover(); err != nil {
 				var statusCode int
 				var response errorResponse
+				entry := logFor(r)
 				if be, ok := err.(util.BubbledError); ok {
 					statusCode = be.StatusCode
 					response = errorResponse{
 						Message: be.Message,
 						Info:    be.Info,
 					}
+					if be.Err != nil {
+						entry = entry.WithError(be.Err)
+					}
 				} else {
 					statusCode = http.StatusInternalServerError
 					response = errorResponse{
 						Message: "Internal server error",
 					}
+					entry = entry.WithField("panic", fmt.Sprint(err))
 				}
+				response.RequestID = requestIDFor(r)
+
+				// Client errors are expected, so they are only logged when
+				// debugging
+				entry = entry.WithField("status", statusCode)
+				if statusCode >= http.StatusInternalServerError {
+					entry.WithField("stack", string(debug.Stack())).Error(
+						response.Message)
+				} else {
+					entry.Debug(response.Message)
+				}
+
 				writingErr := writeJSON(w, statusCode, response)
 				if writingErr != nil {
-					log.Printf("Failed to encode error as JSON.\nEncoding "+
-						"error: %v\nOriginal error:%v\n", writingErr, err)
+					logFor(r).WithError(writingErr).Error(
+						"Failed to encode error as JSON")
 				}
 			}
 		}()
 
-		headerAuthPatterns := []string{
-			"/*/register/request/*",
-		}
-		for _, pattern := range headerAuthPatterns {
-			if glob.Glob(pattern, r.URL.Path) {
-				// currently disabled because of large portion of commented out code higher up
-				// s.headerAuthentication(w, r)
-				break
-			}
+		if route, found := serverRouteFor(r); found {
+			r = s.authenticateAppServer(r, route)
 		}
 
 		if glob.Glob("/admin/*", r.URL.Path) {
-			cookie, err := r.Cookie("admin-session")
-			util.OptionalPanic(err, http.StatusUnauthorized, "No session cookie")
-
-			var m map[string]interface{}
-			err = s.sc.Decode("admin-session", cookie.Value, &m)
-			util.OptionalPanic(err, http.StatusUnauthorized, "Invalid session "+
-				"cookie")
-
-			var expires time.Time
-			val, found := m["set"]
-			util.PanicIfFalse(found, http.StatusBadRequest, "Invalid cookie")
-
-			expires = val.(time.Time)
-
-			distance := time.Now().Sub(expires).Nanoseconds()
-			valid := distance < s.Config.AdminSessionLength.Nanoseconds()
-			util.PanicIfFalse(valid, http.StatusUnauthorized, "Session expired")
-
-			encoded, err := s.sc.Encode("admin-session", time.Now())
-			util.OptionalInternalPanic(err, "Could not update session cookie")
-
-			http.SetCookie(w, &http.Cookie{
-				Name:  "admin-session",
-				Value: encoded,
-				Path:  "/",
-			})
+			r = s.authorizeAdmin(r, s.currentSession(r))
 		}
 
 		// If none of the middleware panicked, serve the main route
@@ -335,70 +519,86 @@ func getAuthDataFromHeaders(r *http.Request) (string, string, error) {
 	return parts[0], parts[1], nil
 }
 
-// For requests coming from an app sever or the admin frontend
-// func (s *Server) headerAuthentication(w http.ResponseWriter, r *http.Request) {
-// 	id, received, err := getAuthDataFromHeaders(r)
-// 	util.OptionalBadRequestPanic(err, "Invalid X-Authentication header")
-
-// 	hmacBytes, err := util.DecodeBase64(received)
-// 	util.OptionalInternalPanic(err, "Failed to decode MAC")
-
-// 	var key []byte
-// 	var x, y *big.Int
-// 	if r.Header.Get("X-Authentication-Type") == "admin-frontend" {
-// 		// Look up admin's signing key
-// 		var a Admin
-// 		err = s.DB.Find(&a, Admin{ID: id}).Error
-// 		util.OptionalBadRequestPanic(err, "Could not find admin with ID "+id)
-// 		var sk security.SigningKey
-// 		err = s.DB.Find(&sk, security.SigningKey{ID: a.PrimarySigningKeyID}).Error
-// 		util.OptionalInternalPanic(err, "Could not find admin's signing key")
-// 		skBytes, err := util.DecodeBase64(sk.PublicKey)
-// 		util.OptionalInternalPanic(err, "Could not decode admin's signing key")
-// 		x, y = elliptic.Unmarshal(elliptic.P256(), skBytes)
-
-// 		// Verify nonce
-// 		nonce, err := s.ng.GetNonce(id)
-// 		util.OptionalBadRequestPanic(err, "No nonce for admin")
-// 		util.PanicIfFalse(nonce == r.Header.Get("X-Nonce"),
-// 			http.StatusBadRequest, "Nonces do not match")
-
-// 		// Verify ephemeral signature
-// 		pub := r.Header.Get("X-Public-Key")
-// 		sig := r.Header.Get("X-Public-Signature")
-// 		key, err = s.kc.VerifyEphemeralKey(pub, sig, sk)
-// 		util.OptionalBadRequestPanic(err, "Could not "+
-// 			"verify ephemeral key signature")
-// 	} else {
-// 		var app AppServerInfo
-// 		err := s.DB.First(&app, AppServerInfo{ID: id}).Error
-// 		util.OptionalBadRequestPanic(err, "Could not find app server")
-
-// 		x, y = elliptic.Unmarshal(elliptic.P256(), app.PublicKey)
-// 		key = s.kc.GetShared(x, y)
-// 	}
-
-// 	route := []byte(r.URL.Path)
-// 	var body []byte
-// 	if r.ContentLength > 0 {
-// 		_, err := r.Body.Read(body)
-// 		util.OptionalInternalPanic(err, "Failed to read request body")
-// 	}
-
-// 	hash := hmac.New(sha256.New, []byte(util.EncodeBase64(key)))
-// 	hash.Write(route)
-// 	if len(body) > 0 {
-// 		hash.Write(body)
-// 	}
-// 	if r.Header.Get("X-Authentication-Type") == "admin-frontend" {
-// 		hash.Write([]byte(r.Header.Get("X-Nonce")))
-// 	}
-
-// 	match := hmac.Equal(hmacBytes, hash.Sum(nil))
-// 	util.PanicIfFalse(match, http.StatusUnauthorized, "Invalid security headers")
-
-// 	s.kc.PutShared(x, y, key)
-// }
+// maxServerRequestSize is the largest body that an app server may send. Bodies
+// are read whole so that they can be MACed.
+const maxServerRequestSize = 1 << 20
+
+// headerAuthentication authenticates a request from an app server. The
+// server sends
+//
+//	X-Authentication: <server ID>:<MAC>
+//	X-Timestamp: <Unix time in seconds>
+//
+// where the MAC is the base-64 web encoded HMAC-SHA256 of
+//
+//	<method> "\n" <path and query> "\n" <timestamp> "\n" <body>
+//
+// keyed with the ECDH secret shared between the server's public key and ours:
+// the base-64 web encoding of the big-endian X coordinate, without leading
+// zeros, of the app server's private key times the P-256 point published as
+// serverPubKey by /v1/info/{appID}. Each MAC is only accepted once. Returns the
+// authenticated app server.
+func (s *Server) headerAuthentication(r *http.Request) AppServerInfo {
+	id, received, err := getAuthDataFromHeaders(r)
+	util.OptionalPanic(err, http.StatusUnauthorized,
+		"Invalid X-Authentication header")
+
+	mac, err := util.DecodeBase64(received)
+	util.OptionalPanic(err, http.StatusUnauthorized, "Could not decode MAC")
+
+	timestamp := r.Header.Get("X-Timestamp")
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	util.OptionalPanic(err, http.StatusUnauthorized, "Invalid X-Timestamp "+
+		"header")
+	skew := time.Since(time.Unix(sent, 0))
+	util.PanicIfFalse(-s.Config.ServerAuthSkew < skew &&
+		skew < s.Config.ServerAuthSkew, http.StatusUnauthorized,
+		"Request timestamp is too far from the server's time")
+
+	app, err := s.Store.GetServer(id)
+	util.OptionalPanic(err, http.StatusUnauthorized, "Could not find app "+
+		"server")
+
+	x, y := elliptic.Unmarshal(elliptic.P256(), app.PublicKey)
+	util.PanicIfFalse(x != nil, http.StatusInternalServerError,
+		"App server's public key was not on the elliptic curve")
+	key := s.kc.GetShared(x, y)
+
+	// Read the body so that it can be MACed, then put it back for the handler
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body,
+		maxServerRequestSize))
+	util.OptionalPanic(err, http.StatusRequestEntityTooLarge,
+		"Request body was too large")
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	hash := hmac.New(sha256.New, []byte(util.EncodeBase64(key)))
+	io.WriteString(hash, r.Method+"\n"+r.URL.RequestURI()+"\n"+timestamp+"\n")
+	hash.Write(body)
+
+	match := hmac.Equal(mac, hash.Sum(nil))
+	util.PanicIfFalse(match, http.StatusUnauthorized, "Invalid security headers")
+
+	// The MAC covers the timestamp, so a replay must happen within the skew
+	// window, which is shorter than the cache's expiration. The MAC is
+	// re-encoded so that other encodings of it count as replays too.
+	err = s.serverMACs.Add(id+":"+util.EncodeBase64(mac), true,
+		cache.DefaultExpiration)
+	util.OptionalPanic(err, http.StatusUnauthorized, "Request was replayed")
+
+	return app
+}
+
+// keyAppID returns the app that a user's key belongs to. Admins' keys are
+// registered under app ID "1", so they belong to the app that the admin
+// administers.
+func (s *Server) keyAppID(appID, userID string) string {
+	if appID != "1" {
+		return appID
+	}
+	a, err := s.Store.GetAdmin(userID)
+	util.OptionalBadRequestPanic(err, "Could not find admin")
+	return a.AdminFor
+}
 
 // GetHandler returns the routes used by the 2Q2R server.
 func (s *Server) GetHandler() http.Handler {
@@ -409,9 +609,19 @@ func (s *Server) GetHandler() http.Handler {
 		writeJSON(w, http.StatusOK, s.priv.PublicKey)
 	}, "GET")
 
+	// Probes for the orchestrator
+	hh := healthHandler{s}
+	forMethod(router, "/healthz", hh.Healthz, "GET")
+	forMethod(router, "/readyz", hh.Readyz, "GET")
+	forMethod(router, "/version", hh.GetVersion, "GET")
+
+	// Prometheus metrics
+	forMethod(router, "/metrics", s.metrics.handler().ServeHTTP, "GET")
+
 	// Admin routes
 	ah := adminHandler{s}
 	forMethod(router, "/admin/new", ah.NewAdmin, "POST")
+	forMethod(router, "/admin/logout", ah.Logout, "POST")
 
 	forMethod(router, "/admin/admin", ah.GetAdmins, "GET")
 	// super-admins only
@@ -420,10 +630,30 @@ func (s *Server) GetHandler() http.Handler {
 	// super-admins only
 	forMethod(router, "/admin/admin/{adminID}", ah.DeleteAdmin, "DELETE")
 
-	forMethod(router, "/admin/app", ah.GetApps, "GET")
-	forMethod(router, "/admin/app", ah.NewApp, "POST")
+	// super-admins only
+	forMethod(router, "/admin/session/{adminID}", ah.GetSessions, "GET")
+	forMethod(router, "/admin/session/{adminID}", ah.RevokeSessions, "DELETE")
+
+	// Webhooks; before /admin/app/{appID}, which matches their prefix
+	wh := webhookHandler{s}
+	forMethod(router, "/admin/app/{appID}/webhooks/dead/{deliveryID}/retry",
+		wh.RetryDelivery, "POST")
+	forMethod(router, "/admin/app/{appID}/webhooks/dead", wh.GetDeadDeliveries,
+		"GET")
+	forMethod(router, "/admin/app/{appID}/webhooks/{webhookID}/test",
+		wh.TestWebhook, "POST")
+	forMethod(router, "/admin/app/{appID}/webhooks/{webhookID}",
+		wh.UpdateWebhook, "PUT")
+	forMethod(router, "/admin/app/{appID}/webhooks/{webhookID}",
+		wh.DeleteWebhook, "DELETE")
+	forMethod(router, "/admin/app/{appID}/webhooks", wh.GetWebhooks, "GET")
+	forMethod(router, "/admin/app/{appID}/webhooks", wh.NewWebhook, "POST")
+
+	// Before /admin/app, which matches their prefix
 	forMethod(router, "/admin/app/{appID}", ah.UpdateApp, "POST")
 	forMethod(router, "/admin/app/{appID}", ah.DeleteApp, "DELETE")
+	forMethod(router, "/admin/app", ah.GetApps, "GET")
+	forMethod(router, "/admin/app", ah.NewApp, "POST")
 
 	forMethod(router, "/admin/server", ah.GetServers, "GET")
 	forMethod(router, "/admin/server", ah.NewServer, "POST")
@@ -441,12 +671,32 @@ func (s *Server) GetHandler() http.Handler {
 	forMethod(router, "/admin/permission/{appID}/{adminID}/{permission}",
 		ah.DeletePermission, "DELETE")
 
+	forMethod(router, "/admin/key/suspect", ah.GetSuspectKeys, "GET")
+	forMethod(router, "/admin/key/{keyID}/clear", ah.ClearSuspectKey, "POST")
+	forMethod(router, "/admin/key/{keyID}", ah.UpdateKey, "PUT")
+
+	forMethod(router, "/admin/metadata/reload", ah.ReloadMetadata, "POST")
+	forMethod(router, "/admin/metadata/{id}", ah.GetAuthenticator, "GET")
+
 	forMethod(router, "/admin/stats/listen", ah.RegisterListener, "GET")
+	forMethod(router, "/admin/stats/stream", ah.StreamEvents, "GET")
 	forMethod(router, "/admin/stats/recent", ah.GetMostRecent, "GET")
+	forMethod(router, "/admin/events", ah.GetEvents, "GET")
 
 	forMethod(router, "/admin/nonce/{adminID}", func(w http.ResponseWriter,
 		r *http.Request) {
-		nonce, exp, err := s.ng.GenerateNonce(mux.Vars(r)["adminID"])
+		adminID := mux.Vars(r)["adminID"]
+		as := adminFor(r)
+		util.PanicIfFalse(as.isSuper() || adminID == as.Admin.ID,
+			http.StatusForbidden, "Cannot generate nonces for other admins")
+
+		// The nonce may only be used for this request
+		method := r.URL.Query().Get("method")
+		path := r.URL.Query().Get("path")
+		util.PanicIfFalse(method != "" && path != "", http.StatusBadRequest,
+			"Nonces must be requested for a method and path")
+
+		nonce, exp, err := s.ng.GenerateNonce(adminID, method, path)
 		util.OptionalInternalPanic(err, "Could not generate nonce")
 
 		writeJSON(w, http.StatusOK, map[string]interface{}{
@@ -472,6 +722,8 @@ func (s *Server) GetHandler() http.Handler {
 	forMethod(router, "/v1/auth/wait", th.Wait, "POST")
 	forMethod(router, "/v1/auth/challenge", th.SetKey, "POST")
 	forMethod(router, "/v1/auth/iframe", th.IFrame, "POST")
+	forMethod(router, "/v1/auth/webauthn/options", th.WebAuthnOptions, "POST")
+	forMethod(router, "/v1/auth/webauthn", th.AuthenticateWebAuthn, "POST")
 	forMethod(router, "/v1/auth", th.Authenticate, "POST")
 
 	// Register routes
@@ -480,6 +732,9 @@ func (s *Server) GetHandler() http.Handler {
 	forMethod(router, "/v1/register/wait", rh.Wait, "POST")
 	forMethod(router, "/v1/register/challenge", rh.GetChallenge, "POST")
 	forMethod(router, "/v1/register/iframe", rh.IFrame, "POST")
+	forMethod(router, "/v1/register/webauthn/options", rh.WebAuthnOptions,
+		"POST")
+	forMethod(router, "/v1/register/webauthn", rh.RegisterWebAuthn, "POST")
 	forMethod(router, "/v1/register", rh.Register, "POST")
 
 	// Static files
@@ -488,9 +743,5 @@ func (s *Server) GetHandler() http.Handler {
 		r.URL.Path = strings.Replace(r.URL.Path, "/static/", "", 1)
 		fileServer.ServeHTTP(w, r)
 	})
-	h := s.recoverWrap(router)
-	if s.Config.LogRequests {
-		return handlers.LoggingHandler(os.Stdout, h)
-	}
-	return h
+	return s.trace(s.metrics.instrument(router, s.recoverWrap(router)))
 }
@@ -4,126 +4,446 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/json"
-	"fmt"
-	"net"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
-	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/tera-insights/2Q2R-enterprise/util"
+
+	"github.com/gorilla/securecookie"
 )
 
-var s = NewServer(Config{
-	Port:           ":8080",
-	DatabaseType:   "sqlite3",
-	DatabaseName:   "test.db",
-	ExpirationTime: 5 * time.Minute,
-	CleanTime:      30 * time.Second,
-	BaseURL:        "127.0.0.1",
-})
-
-var ts = httptest.NewUnstartedServer(s.GetHandler())
-var goodServerName = "foo"
-var goodAppName = "bar"
-var badAppID = util.EncodeBase64([]byte("321saWQgc3RyaW5nCg=="))
-var goodBaseURL = "2q2r.org"
-var goodKeyType = "P256"
-var goodPublicKey = "notHidden!"
-var goodPermissions = "[]"
-var goodAppID string
-
-// Create new app for use in other
-func TestMain(m *testing.M) {
-	l, err := net.Listen("tcp", s.c.BaseURL+s.c.Port)
+// testConfig runs the server on the memory store, without geolocation.
+const testConfig = `
+DatabaseType: memory
+PrivateKeyFile: ../app_server_priv.pem
+HTTPS: false
+GeoResolver: none
+`
+
+// newTestServer starts a server for the length of the test.
+func newTestServer(t testing.TB) (*Server, *httptest.Server) {
+	return newTestServerWithConfig(t, testConfig)
+}
+
+// newTestServerWithConfig starts a server with the YAML `config` for the
+// length of the test.
+func newTestServerWithConfig(t testing.TB,
+	config string) (*Server, *httptest.Server) {
+	s := NewServer(strings.NewReader(config), "yaml")
+	ts := httptest.NewServer(s.GetHandler())
+	t.Cleanup(func() {
+		ts.Close()
+		s.Close()
+	})
+	return &s, ts
+}
+
+// newTestRequest builds a request to `ts` whose body is `body` encoded as
+// JSON, unless `body` is nil.
+func newTestRequest(t testing.TB, ts *httptest.Server, method, path string,
+	body interface{}) *http.Request {
+	var b []byte
+	if body != nil {
+		var err error
+		b, err = json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, err := http.NewRequest(method, ts.URL+path, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+	return r
+}
+
+// do sends `r` and decodes the JSON reply into `reply`, unless it is nil.
+// Returns the status code.
+func do(t testing.TB, r *http.Request, reply interface{}) int {
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if reply != nil && res.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(res.Body).Decode(reply); err != nil {
+			t.Fatalf("Could not decode reply to %s %s: %+v", r.Method,
+				r.URL.Path, err)
+		}
+	}
+	return res.StatusCode
+}
+
+// loginAdmin saves `a` as an active admin and returns a session cookie for
+// them.
+func loginAdmin(t testing.TB, s *Server, a Admin) *http.Cookie {
+	a.Status = adminActive
+	if err := s.Store.CreateAdmin(a); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := util.RandString(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	err = s.sessions.Create(AdminSession{
+		ID:        id,
+		AdminID:   a.ID,
+		CreatedAt: now,
+		LastSeen:  now,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoded, err := securecookie.EncodeMulti(sessionCookieName,
+		sessionCookie{id}, s.cookieCodecs...)
 	if err != nil {
-		panic(fmt.Sprintf("Failed to listen on a port: %+v\n", err))
+		t.Fatal(err)
 	}
-	ts.Listener = l // overwriting the default random port given by httptest
-	ts.Start()
-	defer ts.Close()
-	res, _ := postJSON("/admin/apps", NewAppRequest{
-		AppName: goodAppName,
+	return &http.Cookie{Name: sessionCookieName, Value: encoded}
+}
+
+// loginSuperAdmin logs in a new superadmin.
+func loginSuperAdmin(t testing.TB, s *Server) *http.Cookie {
+	return loginAdmin(t, s, Admin{
+		ID:       "super",
+		Name:     "Super",
+		Role:     roleSuperAdmin,
+		AdminFor: "1",
 	})
-	appReply := new(NewAppReply)
-	unmarshalJSONBody(res, appReply)
-	goodAppID = appReply.AppID
-	code := m.Run()
-	os.Exit(code)
 }
 
-func postJSON(route string, d interface{}) (*http.Response, error) {
-	b := new(bytes.Buffer)
-	json.NewEncoder(b).Encode(d)
-	return http.Post(ts.URL+route, "application/json; charset=utf-8", b)
+// newTestApp saves an app with the default policies.
+func newTestApp(t testing.TB, s *Server, name string) AppInfo {
+	id, err := util.RandString(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := AppInfo{
+		ID:                id,
+		AppName:           name,
+		AttestationPolicy: attestationNone,
+	}
+	if err := s.Store.CreateApp(info); err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+// newPublicKey returns a marshalled P-256 public key.
+func newPublicKey(t testing.TB) []byte {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return elliptic.Marshal(elliptic.P256(), priv.X, priv.Y)
+}
+
+// testAppServer is an app server along with its private key.
+type testAppServer struct {
+	AppServerInfo
+	key *ecdsa.PrivateKey
+}
+
+// newTestAppServer saves an app server for `appID` with `permissions`.
+func newTestAppServer(t testing.TB, s *Server, appID string,
+	permissions ...string) testAppServer {
+	id, err := util.RandString(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	granted, err := json.Marshal(permissions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := AppServerInfo{
+		ID:          id,
+		BaseURL:     "https://app.example.com",
+		AppID:       appID,
+		KeyType:     "P256",
+		PublicKey:   elliptic.Marshal(elliptic.P256(), key.X, key.Y),
+		Permissions: string(granted),
+	}
+	if err := s.Store.CreateServer(info); err != nil {
+		t.Fatal(err)
+	}
+	return testAppServer{info, key}
 }
 
-func unmarshalJSONBody(r *http.Response, d interface{}) {
-	json.NewDecoder(r.Body).Decode(d)
-	r.Body.Close()
+// serverMAC returns the MAC that app server `asi` sends with a request. Like
+// an app server, it derives the key from its own private key and the point
+// that the server publishes for the app.
+func serverMAC(t testing.TB, s *Server, asi testAppServer, method,
+	path, timestamp string, body []byte) string {
+	res := httptest.NewRecorder()
+	s.GetHandler().ServeHTTP(res, httptest.NewRequest("GET",
+		"/v1/info/"+asi.AppID, nil))
+	info := appIDInfoReply{}
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := util.DecodeBase64(info.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, y := elliptic.Unmarshal(elliptic.P256(), pub)
+	if x == nil {
+		t.Fatalf("Server published an invalid public key %q", info.PublicKey)
+	}
+	x, _ = elliptic.P256().ScalarMult(x, y, asi.key.D.Bytes())
+
+	hash := hmac.New(sha256.New, []byte(util.EncodeBase64(x.Bytes())))
+	io.WriteString(hash, method+"\n"+path+"\n"+timestamp+"\n")
+	hash.Write(body)
+	return util.EncodeBase64(hash.Sum(nil))
 }
 
-func checkStatus(t *testing.T, expected int, r *http.Response) {
-	if expected != r.StatusCode {
-		t.Errorf("Expected status code %d but got %d\n", expected, r.StatusCode)
+// signRequest authenticates `r` as app server `asi`.
+func signRequest(t testing.TB, s *Server, r *http.Request,
+	asi testAppServer) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		t.Fatal(err)
 	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := serverMAC(t, s, asi, r.Method, r.URL.RequestURI(), timestamp, body)
+	r.Header.Set("X-Authentication", asi.ID+":"+mac)
+	r.Header.Set("X-Timestamp", timestamp)
 }
 
 func TestCreateNewApp(t *testing.T) {
+	s, ts := newTestServer(t)
+	cookie := loginSuperAdmin(t, s)
+
+	// Create new app
+	r := newTestRequest(t, ts, "POST", "/admin/app", newAppRequest{
+		AppName: "bar",
+	})
+	r.AddCookie(cookie)
+	app := AppInfo{}
+	if code := do(t, r, &app); code != http.StatusOK {
+		t.Fatalf("Could not create app: %d", code)
+	}
+
 	// Create new server
-	res, _ := postJSON("/admin/servers", NewServerRequest{
-		ServerName:  goodServerName,
-		AppID:       goodAppID,
-		BaseURL:     goodBaseURL,
-		KeyType:     goodKeyType,
-		PublicKey:   goodPublicKey,
-		Permissions: goodPermissions,
+	r = newTestRequest(t, ts, "POST", "/admin/server", newServerRequest{
+		AppID:       app.ID,
+		BaseURL:     "2q2r.org",
+		KeyType:     "P256",
+		PublicKey:   util.EncodeBase64(newPublicKey(t)),
+		Permissions: "[]",
 	})
-	newReply := new(NewServerReply)
-	unmarshalJSONBody(res, newReply)
-	if newReply.ServerName != goodServerName {
-		t.Errorf("Expected server name of %s. Got %s", goodServerName, newReply.ServerName)
+	r.AddCookie(cookie)
+	created := AppServerInfo{}
+	if code := do(t, r, &created); code != http.StatusOK {
+		t.Fatalf("Could not create app server: %d", code)
+	}
+	if created.AppID != app.ID {
+		t.Errorf("Expected app ID %s. Got %s", app.ID, created.AppID)
 	}
 
 	// Test app info
-	res, _ = http.Get(ts.URL + "/v1/info/" + goodAppID)
-	appInfo := new(AppIDInfoReply)
-	unmarshalJSONBody(res, appInfo)
-	if appInfo.AppName != goodAppName {
-		t.Errorf("Expected app name of %s. Got %s", goodAppName, appInfo.AppName)
+	r = newTestRequest(t, ts, "GET", "/v1/info/"+app.ID, nil)
+	appInfo := appIDInfoReply{}
+	if code := do(t, r, &appInfo); code != http.StatusOK {
+		t.Fatalf("Could not get app info: %d", code)
+	}
+	if appInfo.AppName != "bar" {
+		t.Errorf("Expected app name of bar. Got %s", appInfo.AppName)
 	}
 
 	// Test server info
-	res, _ = postJSON("/admin/servers", AppServerInfoRequest{
-		ServerID: newReply.ServerID,
-	})
-	serverInfo := new(AppServerInfo)
-	unmarshalJSONBody(res, serverInfo)
-	if serverInfo.ServerName != goodServerName {
-		t.Errorf("Expected server name of %s. Got %s", goodServerName, serverInfo.ServerName)
+	r = newTestRequest(t, ts, "GET", "/admin/server", nil)
+	r.AddCookie(cookie)
+	var servers []AppServerInfo
+	if code := do(t, r, &servers); code != http.StatusOK {
+		t.Fatalf("Could not list app servers: %d", code)
+	}
+	if len(servers) != 1 || servers[0].ID != created.ID {
+		t.Errorf("Expected to find server %s. Got %+v", created.ID, servers)
 	}
 
 	// Delete server
-	res, _ = postJSON("/admin/servers/"+serverInfo.ServerID, DeleteServerRequest{})
-	checkStatus(t, http.StatusOK, res)
+	r = newTestRequest(t, ts, "DELETE", "/admin/server/"+created.ID, nil)
+	r.AddCookie(cookie)
+	if code := do(t, r, nil); code != http.StatusOK {
+		t.Errorf("Could not delete app server: %d", code)
+	}
 
 	// Assert that server was deleted
-	res, _ = postJSON("/admin/servers", AppServerInfoRequest{
-		ServerID: newReply.ServerID,
-	})
-	deletedServerInfo := new(AppServerInfo)
-	unmarshalJSONBody(res, deletedServerInfo)
-	checkStatus(t, http.StatusNotFound, res)
+	r = newTestRequest(t, ts, "GET", "/admin/server", nil)
+	r.AddCookie(cookie)
+	servers = nil
+	do(t, r, &servers)
+	if len(servers) != 0 {
+		t.Errorf("Expected no servers after deletion. Got %+v", servers)
+	}
 
 	// Test invalid method but with proper app ID
-	res, _ = http.Post(ts.URL+"/v1/info/"+goodAppID, "", nil)
-	checkStatus(t, http.StatusMethodNotAllowed, res)
+	r = newTestRequest(t, ts, "POST", "/v1/info/"+app.ID, nil)
+	if code := do(t, r, nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status code %d but got %d",
+			http.StatusMethodNotAllowed, code)
+	}
 }
 
 func TestNonExistingApp(t *testing.T) {
-	// Test nonexisting app
-	res, _ := http.Get(ts.URL + "/v1/info/" + badAppID)
-	checkStatus(t, http.StatusNotFound, res)
+	_, ts := newTestServer(t)
+
+	badAppID := util.EncodeBase64([]byte("321saWQgc3RyaW5nCg=="))
+	r := newTestRequest(t, ts, "GET", "/v1/info/"+badAppID, nil)
+	if code := do(t, r, nil); code != http.StatusNotFound {
+		t.Errorf("Expected status code %d but got %d", http.StatusNotFound,
+			code)
+	}
+}
+
+func TestCloseWaitsForBackgroundJobs(t *testing.T) {
+	s, _ := newTestServer(t)
+	finished := make(chan struct{})
+	s.background(func() {
+		<-s.lc.done
+		// A job that still uses the store after shutdown started
+		time.Sleep(50 * time.Millisecond)
+		if _, err := s.Store.GetApps(""); err != nil {
+			t.Errorf("Store was closed before the job finished: %v", err)
+		}
+		close(finished)
+	})
+	s.Close()
+	select {
+	case <-finished:
+	default:
+		t.Error("Close returned before the job finished")
+	}
+}
+
+func TestShutdownAnswersPendingWaits(t *testing.T) {
+	s, ts := newTestServer(t)
+	app := newTestApp(t, s, "foo")
+	asi := newTestAppServer(t, s, app.ID, permissionRegister)
+	rr := setUpRegistration(t, s, ts, asi, "bar")
+
+	replies := make(chan *http.Response, 1)
+	go func() {
+		r := newTestRequest(t, ts, "POST", "/v1/register/wait",
+			requestIDWrapper{rr.RequestID})
+		res, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Error(err)
+			close(replies)
+			return
+		}
+		res.Body.Close()
+		replies <- res
+	}()
+	// Let the wait start before shutting down
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case res := <-replies:
+		if res == nil {
+			t.FailNow()
+		}
+		if res.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("Wait was answered with %d, expected %d", res.StatusCode,
+				http.StatusServiceUnavailable)
+		}
+		if res.Header.Get("Retry-After") == "" {
+			t.Error("Wait was answered without Retry-After")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Wait was not answered after shutdown")
+	}
+}
+
+func TestCloseWaitsForWebhookDeliveries(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	unblock := func() { once.Do(func() { close(release) }) }
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		close(started)
+		<-release
+	}))
+	defer hook.Close()
+	defer unblock()
+
+	db := filepath.Join(t.TempDir(), "test.db")
+	if err := NewMigrator(openTestDatabase(t, "sqlite3", db)).Up(); err != nil {
+		t.Fatal(err)
+	}
+	s, _ := newTestServerWithConfig(t, strings.Replace(testConfig,
+		"DatabaseType: memory", "DatabaseType: sqlite3\nDatabaseName: "+db+
+			"\nWebhookAllowPrivateNetworks: true", 1))
+	err := s.webhooks.store.CreateWebhook(Webhook{ID: "hook", AppID: "app",
+		URL: hook.URL, Secret: "secret", Active: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.webhooks.enqueue(event{ID: 1, Name: "registration", AppID: "app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.webhooks.wakeUp()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Webhook was not delivered")
+	}
+
+	// Shutting down waits for the delivery in flight
+	closed := make(chan struct{})
+	go func() {
+		s.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatal("Close returned while a webhook was being delivered")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unblock()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return after the delivery")
+	}
+
+	// Its outcome was recorded before the database was closed
+	ws := &dbWebhookStore{db: openTestDatabase(t, "sqlite3", db)}
+	delivered, err := ws.GetDeliveries("app", "hook", deliveryDelivered, 10)
+	if err != nil || len(delivered) != 1 {
+		t.Errorf("Delivered %+v (error: %v)", delivered, err)
+	}
 }
@@ -0,0 +1,192 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"bufio"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tera-insights/2Q2R-enterprise/util"
+
+	"github.com/gorilla/securecookie"
+	"github.com/pkg/errors"
+)
+
+const sessionCookieName = "admin-session"
+
+// sessionCookie is the contents of the admin-session cookie, which is both
+// signed and encrypted. The session itself is kept in the session store.
+type sessionCookie struct {
+	SessionID string
+}
+
+// loadSessionCodecs creates the codecs for the admin-session cookie from the
+// key pairs in the config and the key file. The first pair encodes new
+// cookies; every pair can decode them, so that keys can be rotated by adding a
+// new pair at the front and removing the old one once its sessions expire.
+func loadSessionCodecs(c *Config) ([]securecookie.Codec, error) {
+	pairs := append([]string{}, c.SessionKeys...)
+	if c.SessionKeysFile != "" {
+		f, err := os.Open(c.SessionKeysFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not open session key file %s",
+				c.SessionKeysFile)
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				pairs = append(pairs, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, errors.Wrap(err, "Could not read session key file")
+		}
+	}
+
+	if len(pairs) == 0 {
+		logger.Warn("No session keys are configured! Admins will be logged " +
+			"out when the server restarts")
+		return []securecookie.Codec{newSessionCodec(c,
+			securecookie.GenerateRandomKey(64),
+			securecookie.GenerateRandomKey(32))}, nil
+	}
+
+	codecs := make([]securecookie.Codec, 0, len(pairs))
+	for i, pair := range pairs {
+		hashKey, blockKey, err := parseSessionKeyPair(pair)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid session key pair %d", i)
+		}
+		codecs = append(codecs, newSessionCodec(c, hashKey, blockKey))
+	}
+	return codecs, nil
+}
+
+// parseSessionKeyPair parses a "<hash key>:<block key>" pair of standard
+// base-64 encoded keys.
+func parseSessionKeyPair(pair string) ([]byte, []byte, error) {
+	parts := strings.Split(pair, ":")
+	if len(parts) != 2 {
+		return nil, nil, errors.Errorf("Found %d parts, expected 2",
+			len(parts))
+	}
+	hashKey, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Could not decode hash key")
+	}
+	if len(hashKey) < 32 {
+		return nil, nil, errors.New("Hash key must be at least 32 bytes")
+	}
+	blockKey, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Could not decode block key")
+	}
+	if len(blockKey) != 16 && len(blockKey) != 24 && len(blockKey) != 32 {
+		return nil, nil, errors.New("Block key must be 16, 24 or 32 bytes")
+	}
+	return hashKey, blockKey, nil
+}
+
+func newSessionCodec(c *Config, hashKey, blockKey []byte) securecookie.Codec {
+	sc := securecookie.New(hashKey, blockKey)
+	sc.MaxAge(int(c.AdminSessionMaxLength / time.Second))
+	return sc
+}
+
+// readSessionCookie decodes the admin-session cookie.
+func (s *Server) readSessionCookie(r *http.Request) sessionCookie {
+	cookie, err := r.Cookie(sessionCookieName)
+	util.OptionalPanic(err, http.StatusUnauthorized, "No session cookie")
+
+	var sc sessionCookie
+	err = securecookie.DecodeMulti(sessionCookieName, cookie.Value, &sc,
+		s.cookieCodecs...)
+	util.OptionalPanic(err, http.StatusUnauthorized, "Invalid session cookie")
+	return sc
+}
+
+// setSessionCookie encodes `sc` with the newest key and sets it as the
+// admin-session cookie.
+func (s *Server) setSessionCookie(w http.ResponseWriter, sc sessionCookie) {
+	encoded, err := securecookie.EncodeMulti(sessionCookieName, sc,
+		s.cookieCodecs...)
+	util.OptionalInternalPanic(err, "Could not set session cookie")
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    encoded,
+		Path:     "/",
+		Secure:   s.Config.HTTPS,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// startSession creates a session for `a` and sets its cookie.
+func (s *Server) startSession(w http.ResponseWriter, r *http.Request, a Admin) {
+	id, err := util.RandString(32)
+	util.OptionalInternalPanic(err, "Could not generate session ID")
+
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	now := time.Now()
+	err = s.sessions.Create(AdminSession{
+		ID:        id,
+		AdminID:   a.ID,
+		IP:        host,
+		UserAgent: r.UserAgent(),
+		CreatedAt: now,
+		LastSeen:  now,
+	})
+	util.OptionalInternalPanic(err, "Could not save session")
+
+	s.setSessionCookie(w, sessionCookie{id})
+}
+
+// currentSession loads the session of an admin request and marks it as used.
+// Sessions expire after AdminSessionLength without use, or
+// AdminSessionMaxLength after they were created.
+func (s *Server) currentSession(r *http.Request) AdminSession {
+	sess, err := s.sessions.Get(s.readSessionCookie(r).SessionID)
+	if err == errSessionNotFound {
+		panic(util.BubbledError{
+			StatusCode: http.StatusUnauthorized,
+			Message:    "Session expired",
+		})
+	}
+	util.OptionalInternalPanic(err, "Could not load session")
+
+	now := time.Now()
+	if now.Sub(sess.LastSeen) >= s.Config.AdminSessionLength ||
+		now.Sub(sess.CreatedAt) >= s.Config.AdminSessionMaxLength {
+		s.sessions.Delete(sess.ID)
+		panic(util.BubbledError{
+			StatusCode: http.StatusUnauthorized,
+			Message:    "Session expired",
+		})
+	}
+
+	err = s.sessions.Touch(sess.ID, now)
+	util.OptionalInternalPanic(err, "Could not update session")
+	return sess
+}
+
+// clearSessionCookie tells the browser to forget the admin-session cookie.
+func (s *Server) clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   s.Config.HTTPS,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
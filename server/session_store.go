@@ -0,0 +1,184 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// errSessionNotFound is returned by sessionStore.Get for unknown, revoked and
+// expired sessions.
+var errSessionNotFound = errors.New("Session not found")
+
+// sessionStore holds the server side of admin sessions. The admin-session
+// cookie only holds the session ID, so deleting a session logs the admin out
+// everywhere that the cookie was copied to.
+type sessionStore interface {
+	Create(sess AdminSession) error
+	Get(id string) (AdminSession, error)
+	Touch(id string, t time.Time) error
+	Delete(id string) error
+
+	// Sessions of one admin, for listing and revoking them
+	ListForAdmin(adminID string) ([]AdminSession, error)
+	DeleteForAdmin(adminID string) (int64, error)
+
+	// Removes sessions that were idle since `idle` or created before
+	// `created`
+	DeleteExpired(idle, created time.Time) error
+}
+
+// newSessionStore returns the store named by Config.SessionStore. Sessions are
+// only kept in the database if `store` is backed by one.
+func newSessionStore(kind string, store Store) (sessionStore, error) {
+	switch kind {
+	case "", "database":
+		if gs, ok := store.(*gormStore); ok {
+			return &dbSessionStore{gs.db}, nil
+		}
+		return newMemorySessionStore(), nil
+	case "memory":
+		return newMemorySessionStore(), nil
+	}
+	return nil, errors.Errorf("Unknown session store %s", kind)
+}
+
+// dbSessionStore keeps sessions in the database, so that they are shared by
+// every instance of the server.
+type dbSessionStore struct {
+	db *gorm.DB
+}
+
+func (ss *dbSessionStore) Create(sess AdminSession) error {
+	return ss.db.Create(&sess).Error
+}
+
+func (ss *dbSessionStore) Get(id string) (AdminSession, error) {
+	var sess AdminSession
+	err := ss.db.Where("id = ?", id).First(&sess).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return sess, errSessionNotFound
+	}
+	return sess, err
+}
+
+func (ss *dbSessionStore) Touch(id string, t time.Time) error {
+	return ss.db.Model(&AdminSession{}).Where("id = ?", id).Update(
+		gorm.ToDBName("LastSeen"), t).Error
+}
+
+func (ss *dbSessionStore) Delete(id string) error {
+	return ss.db.Where("id = ?", id).Delete(AdminSession{}).Error
+}
+
+func (ss *dbSessionStore) ListForAdmin(adminID string) ([]AdminSession, error) {
+	var found []AdminSession
+	err := ss.db.Where("admin_id = ?", adminID).Order("created_at desc").
+		Find(&found).Error
+	return found, err
+}
+
+func (ss *dbSessionStore) DeleteForAdmin(adminID string) (int64, error) {
+	query := ss.db.Where("admin_id = ?", adminID).Delete(AdminSession{})
+	return query.RowsAffected, query.Error
+}
+
+func (ss *dbSessionStore) DeleteExpired(idle, created time.Time) error {
+	return ss.db.Where("last_seen < ? OR created_at < ?", idle, created).
+		Delete(AdminSession{}).Error
+}
+
+// memorySessionStore keeps sessions in memory. It is meant for tests and
+// single-instance deployments.
+type memorySessionStore struct {
+	lock     sync.RWMutex
+	sessions map[string]AdminSession
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{sessions: make(map[string]AdminSession)}
+}
+
+func (ss *memorySessionStore) Create(sess AdminSession) error {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	if _, found := ss.sessions[sess.ID]; found {
+		return errors.Errorf("Session %s already exists", sess.ID)
+	}
+	ss.sessions[sess.ID] = sess
+	return nil
+}
+
+func (ss *memorySessionStore) Get(id string) (AdminSession, error) {
+	ss.lock.RLock()
+	defer ss.lock.RUnlock()
+	sess, found := ss.sessions[id]
+	if !found {
+		return sess, errSessionNotFound
+	}
+	return sess, nil
+}
+
+func (ss *memorySessionStore) Touch(id string, t time.Time) error {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	sess, found := ss.sessions[id]
+	if !found {
+		return errSessionNotFound
+	}
+	sess.LastSeen = t
+	ss.sessions[id] = sess
+	return nil
+}
+
+func (ss *memorySessionStore) Delete(id string) error {
+	ss.lock.Lock()
+	delete(ss.sessions, id)
+	ss.lock.Unlock()
+	return nil
+}
+
+func (ss *memorySessionStore) ListForAdmin(adminID string) ([]AdminSession,
+	error) {
+	ss.lock.RLock()
+	defer ss.lock.RUnlock()
+	var found []AdminSession
+	for _, sess := range ss.sessions {
+		if sess.AdminID == adminID {
+			found = append(found, sess)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].CreatedAt.After(found[j].CreatedAt)
+	})
+	return found, nil
+}
+
+func (ss *memorySessionStore) DeleteForAdmin(adminID string) (int64, error) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	var n int64
+	for id, sess := range ss.sessions {
+		if sess.AdminID == adminID {
+			delete(ss.sessions, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (ss *memorySessionStore) DeleteExpired(idle, created time.Time) error {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	for id, sess := range ss.sessions {
+		if sess.LastSeen.Before(idle) || sess.CreatedAt.Before(created) {
+			delete(ss.sessions, id)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionStores(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	for kind, st := range testStores(t) {
+		t.Run(kind, func(t *testing.T) {
+			ss, err := newSessionStore(kind, st)
+			require.Nil(t, err)
+
+			for _, sess := range []AdminSession{
+				{ID: "old", AdminID: "alice",
+					CreatedAt: now.Add(-2 * time.Hour), LastSeen: now},
+				{ID: "idle", AdminID: "alice", CreatedAt: now.Add(-time.Hour),
+					LastSeen: now.Add(-time.Hour)},
+				{ID: "new", AdminID: "alice", CreatedAt: now, LastSeen: now},
+				{ID: "bob", AdminID: "bob", CreatedAt: now, LastSeen: now},
+			} {
+				require.Nil(t, ss.Create(sess))
+			}
+			require.NotNil(t, ss.Create(AdminSession{ID: "new"}))
+
+			for _, id := range []string{"", "unknown"} {
+				_, err := ss.Get(id)
+				require.Equal(t, errSessionNotFound, err, "Session %q", id)
+			}
+			found, err := ss.ListForAdmin("")
+			require.Nil(t, err)
+			require.Empty(t, found)
+
+			// Sessions are listed newest first
+			found, err = ss.ListForAdmin("alice")
+			require.Nil(t, err)
+			require.Len(t, found, 3)
+			for i, id := range []string{"new", "idle", "old"} {
+				require.Equal(t, id, found[i].ID)
+			}
+
+			require.Nil(t, ss.Touch("idle", now))
+			sess, err := ss.Get("idle")
+			require.Nil(t, err)
+			require.True(t, now.Equal(sess.LastSeen))
+			require.Nil(t, ss.Touch("old", now.Add(-time.Hour)))
+
+			// Both idle and old sessions expire
+			require.Nil(t, ss.DeleteExpired(now.Add(-time.Minute),
+				now.Add(-90*time.Minute)))
+			for id, expected := range map[string]error{
+				"old":  errSessionNotFound,
+				"idle": nil,
+				"new":  nil,
+				"bob":  nil,
+			} {
+				_, err := ss.Get(id)
+				require.Equal(t, expected, err, "Session %s", id)
+			}
+
+			n, err := ss.DeleteForAdmin("")
+			require.Nil(t, err)
+			require.Equal(t, int64(0), n)
+			n, err = ss.DeleteForAdmin("alice")
+			require.Nil(t, err)
+			require.Equal(t, int64(2), n)
+			_, err = ss.Get("bob")
+			require.Nil(t, err)
+
+			require.Nil(t, ss.Delete("bob"))
+			_, err = ss.Get("bob")
+			require.Equal(t, errSessionNotFound, err)
+		})
+	}
+}
+
+// sessionOf returns the only session of admin `adminID`.
+func sessionOf(t *testing.T, s *Server, adminID string) AdminSession {
+	found, err := s.sessions.ListForAdmin(adminID)
+	require.Nil(t, err)
+	require.Len(t, found, 1)
+	return found[0]
+}
+
+func TestAdminSessionsExpire(t *testing.T) {
+	s, ts := newTestServer(t)
+	cookie := loginSuperAdmin(t, s)
+	request := func() int {
+		r := newTestRequest(t, ts, "GET", "/admin/app", nil)
+		r.AddCookie(cookie)
+		return do(t, r, nil)
+	}
+	// backdate moves the session's times back by the given durations
+	backdate := func(created, seen time.Duration) {
+		sess := sessionOf(t, s, "super")
+		require.Nil(t, s.sessions.Delete(sess.ID))
+		sess.CreatedAt = sess.CreatedAt.Add(-created)
+		sess.LastSeen = sess.LastSeen.Add(-seen)
+		require.Nil(t, s.sessions.Create(sess))
+	}
+	idle := s.Config.AdminSessionLength
+
+	// Using a session keeps it alive
+	backdate(idle/2, idle/2)
+	require.Equal(t, http.StatusOK, request())
+	sess := sessionOf(t, s, "super")
+	require.True(t, time.Since(sess.LastSeen) < time.Minute)
+	backdate(idle/2, idle/2)
+	require.Equal(t, http.StatusOK, request())
+
+	backdate(0, idle)
+	require.Equal(t, http.StatusUnauthorized, request())
+	_, err := s.sessions.Get(sess.ID)
+	require.Equal(t, errSessionNotFound, err)
+
+	// Even a session in use ends after AdminSessionMaxLength
+	cookie = loginAdmin(t, s, Admin{ID: "other", Role: roleSuperAdmin,
+		AdminFor: "1"})
+	sess = sessionOf(t, s, "other")
+	require.Nil(t, s.sessions.Delete(sess.ID))
+	sess.CreatedAt = sess.CreatedAt.Add(-s.Config.AdminSessionMaxLength)
+	require.Nil(t, s.sessions.Create(sess))
+	require.Equal(t, http.StatusUnauthorized, request())
+}
+
+func TestAdminSessionsCanBeRevoked(t *testing.T) {
+	s, ts := newTestServer(t)
+	super := loginSuperAdmin(t, s)
+	request := func(cookie *http.Cookie, method, path string) int {
+		r := newTestRequest(t, ts, method, path, nil)
+		r.AddCookie(cookie)
+		return do(t, r, nil)
+	}
+	login := func(id string) *http.Cookie {
+		return loginAdmin(t, s, Admin{ID: id, Role: roleAdmin,
+			AdminFor: "1"})
+	}
+
+	// Logging out ends the session, even if the cookie was kept
+	cookie := login("alice")
+	require.Equal(t, http.StatusOK, request(cookie, "GET", "/admin/app"))
+	res := httptest.NewRecorder()
+	r := newTestRequest(t, ts, "POST", "/admin/logout", nil)
+	r.AddCookie(cookie)
+	s.GetHandler().ServeHTTP(res, r)
+	require.Equal(t, http.StatusOK, res.Code)
+	require.Contains(t, res.Header().Get("Set-Cookie"),
+		sessionCookieName+"=;")
+	require.Equal(t, http.StatusUnauthorized, request(cookie, "GET",
+		"/admin/app"))
+
+	// Only superadmins can revoke other admins' sessions
+	cookie = login("bob")
+	require.Equal(t, http.StatusForbidden, request(cookie, "DELETE",
+		"/admin/session/super"))
+	require.Equal(t, http.StatusOK, request(super, "DELETE",
+		"/admin/session/bob"))
+	require.Equal(t, http.StatusUnauthorized, request(cookie, "GET",
+		"/admin/app"))
+	require.Equal(t, http.StatusOK, request(super, "GET", "/admin/app"))
+
+	// Deleting an admin revokes their sessions
+	_, err := s.Store.DeleteAdmin("bob")
+	require.Nil(t, err)
+	cookie = login("bob")
+	nonce := getNonce(t, ts, super, "super", "DELETE", "/admin/admin/bob")
+	r = newTestRequest(t, ts, "DELETE", "/admin/admin/bob", nil)
+	r.AddCookie(super)
+	r.Header.Set(nonceHeader, nonce)
+	require.Equal(t, http.StatusOK, do(t, r, nil))
+	found, err := s.sessions.ListForAdmin("bob")
+	require.Nil(t, err)
+	require.Empty(t, found)
+	require.Equal(t, http.StatusUnauthorized, request(cookie, "GET",
+		"/admin/app"))
+
+	// As does deactivating them
+	cookie = login("carol")
+	nonce = getNonce(t, ts, super, "super", "POST", "/admin/admin/roles")
+	r = newTestRequest(t, ts, "POST", "/admin/admin/roles",
+		adminRoleChangeRequest{AdminID: "carol", Status: "inactive"})
+	r.AddCookie(super)
+	r.Header.Set(nonceHeader, nonce)
+	require.Equal(t, http.StatusOK, do(t, r, nil))
+	require.Equal(t, http.StatusUnauthorized, request(cookie, "GET",
+		"/admin/app"))
+}
+
+// newSessionKeyPair returns a random key pair in the config's format.
+func newSessionKeyPair() string {
+	return base64.StdEncoding.EncodeToString(
+		securecookie.GenerateRandomKey(64)) + ":" +
+		base64.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+}
+
+func TestParseSessionKeyPair(t *testing.T) {
+	key := func(n int) string {
+		return base64.StdEncoding.EncodeToString(make([]byte, n))
+	}
+	for pair, valid := range map[string]bool{
+		key(32) + ":" + key(16):                 true,
+		key(64) + ":" + key(24):                 true,
+		key(64) + ":" + key(32):                 true,
+		key(64):                                 false,
+		key(64) + ":" + key(32) + ":" + key(32): false,
+		key(16) + ":" + key(32):                 false,
+		key(64) + ":" + key(20):                 false,
+		"not base-64:" + key(32):                false,
+		key(64) + ":not base-64":                false,
+	} {
+		_, _, err := parseSessionKeyPair(pair)
+		require.Equal(t, valid, err == nil, "Pair %q: %+v", pair, err)
+	}
+}
+
+func TestSessionKeysCanBeRotated(t *testing.T) {
+	old, current := newSessionKeyPair(), newSessionKeyPair()
+	codecs := func(pairs ...string) []securecookie.Codec {
+		c, err := loadSessionCodecs(&Config{
+			SessionKeys:        pairs,
+			AdminSessionLength: time.Hour,
+		})
+		require.Nil(t, err)
+		return c
+	}
+	sc := sessionCookie{SessionID: "session"}
+	encoded, err := securecookie.EncodeMulti(sessionCookieName, sc,
+		codecs(old)...)
+	require.Nil(t, err)
+
+	// The cookie is encrypted, not only signed
+	raw, err := base64.URLEncoding.DecodeString(encoded)
+	require.Nil(t, err)
+	require.False(t, strings.Contains(string(raw), sc.SessionID))
+
+	// Cookies set with a key that is still listed last can be read
+	decoded := sessionCookie{}
+	require.Nil(t, securecookie.DecodeMulti(sessionCookieName, encoded,
+		&decoded, codecs(current, old)...))
+	require.Equal(t, sc, decoded)
+	require.NotNil(t, securecookie.DecodeMulti(sessionCookieName, encoded,
+		&decoded, codecs(current)...))
+
+	// Pairs in the key file come after those in the config
+	path := filepath.Join(t.TempDir(), "session-keys")
+	require.Nil(t, ioutil.WriteFile(path, []byte("# Rotated out soon\n"+
+		old+"\n\n"), 0600))
+	c, err := loadSessionCodecs(&Config{
+		SessionKeys:        []string{current},
+		SessionKeysFile:    path,
+		AdminSessionLength: time.Hour,
+	})
+	require.Nil(t, err)
+	require.Len(t, c, 2)
+	require.Nil(t, securecookie.DecodeMulti(sessionCookieName, encoded,
+		&decoded, c...))
+
+	_, err = loadSessionCodecs(&Config{SessionKeys: []string{"invalid"}})
+	require.NotNil(t, err)
+	_, err = loadSessionCodecs(&Config{
+		SessionKeysFile: filepath.Join(t.TempDir(), "missing"),
+	})
+	require.NotNil(t, err)
+}
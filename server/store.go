@@ -0,0 +1,101 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"time"
+
+	"github.com/tera-insights/2Q2R-enterprise/security"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNotFound is returned by the Store methods that look up a single record
+// when there is no such record.
+var ErrNotFound = errors.New("Record not found")
+
+// Store holds everything that the server persists, other than admin sessions.
+// Handlers only reach the database through it, so that they can be tested
+// against the in-memory store and other backends can be added.
+//
+// In methods that list records, an empty app ID means every app.
+type Store interface {
+	security.KeyStore
+
+	GetApp(id string) (AppInfo, error)
+	GetApps(appID string) ([]AppInfo, error)
+	CreateApp(app AppInfo) error
+	UpdateApp(app AppInfo) error
+	DeleteApp(id string) (int64, error)
+
+	GetServer(id string) (AppServerInfo, error)
+	GetServers(appID string) ([]AppServerInfo, error)
+	CreateServer(info AppServerInfo) error
+	UpdateServer(info AppServerInfo) error
+	DeleteServer(id string) (int64, error)
+
+	GetAdmin(id string) (Admin, error)
+	GetAdmins(adminFor string) ([]Admin, error)
+	CreateAdmin(a Admin) error
+	UpdateAdmin(a Admin) error
+	DeleteAdmin(id string) (int64, error)
+
+	// Keys of a user, or of every user for an empty user ID
+	GetKeys(appID, userID string) ([]security.Key, error)
+	GetSuspectKeys(appID string) ([]security.Key, error)
+	CreateKey(k security.Key) error
+	DeleteKey(id string) (int64, error)
+	DeleteKeys(appID, userID string) (int64, error)
+
+	// Only updates the key if it belongs to `userID`
+	UpdateKeyCounter(id, userID string, counter uint32) error
+	UpdateKeyState(id, state string) error
+	UpdateKeyExpiry(id string, expiresAt *time.Time) error
+
+	// Flags a key that may have been cloned, suspending it if `suspend`
+	MarkKeySuspect(id string, at time.Time, suspend bool) error
+
+	// Clears the suspect flag, reinstating the key if it was suspended
+	ClearKeySuspect(id string) (int64, error)
+
+	// Permissions of every admin, or of one admin for the passed apps
+	GetPermissions(appID string) ([]Permission, error)
+	GetAdminPermissions(adminID string, appIDs ...string) ([]Permission, error)
+	CreatePermissions(ps []Permission) error
+	DeletePermission(p Permission) (int64, error)
+
+	GetSigningKeys() ([]security.SigningKey, error)
+	CreateSigningKey(sk security.SigningKey) error
+	CreateKeySignature(sig security.KeySignature) error
+
+	CreateLongTermRequest(ltr LongTermRequest) error
+	DeleteLongTermRequest(appID string, hashedID []byte) (int64, error)
+
+	// Finds and deletes a long-term request, so that it is used only once
+	TakeLongTermRequest(hashedID []byte) (LongTermRequest, error)
+
+	// Runs `fn` against a store whose changes are only kept if `fn` returns
+	// nil and does not panic
+	Transaction(fn func(Store) error) error
+
+	// Checks that the store can be reached
+	Ping() error
+
+	// Releases the store, closing its database if it has one
+	Close() error
+}
+
+// newStore returns the store for Config.DatabaseType. "memory" keeps
+// everything in memory, which is meant for tests; anything else is a Gorm
+// dialect.
+func newStore(c *Config) (Store, error) {
+	if c.DatabaseType == "memory" {
+		return newMemoryStore(), nil
+	}
+	master, err := loadMasterKey(c)
+	if err != nil {
+		return nil, err
+	}
+	return openGormStore(c.DatabaseType, c.DatabaseName,
+		c.MaxOpenDBConnections, master)
+}
@@ -0,0 +1,466 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"time"
+
+	"github.com/tera-insights/2Q2R-enterprise/security"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres" // Needed for Gorm
+	_ "github.com/jinzhu/gorm/dialects/sqlite"   // Needed for Gorm
+	"github.com/pkg/errors"
+)
+
+// gormStore keeps everything in a SQL database through Gorm. Key
+// registrations, app server public keys and signing keys are encrypted with
+// env.
+type gormStore struct {
+	db  *gorm.DB
+	env *security.Envelope
+}
+
+// openGormStore opens the database, which must be on LatestSchemaVersion.
+// Without a master key, sensitive columns are stored in plaintext.
+func openGormStore(dialect, name string, maxOpen int,
+	master []byte) (*gormStore, error) {
+	db, err := gorm.Open(dialect, name)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not open database")
+	}
+	db.DB().SetMaxOpenConns(maxOpen)
+
+	if err = checkSchemaVersion(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	env, err := loadEnvelope(db, master)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &gormStore{db, env}, nil
+}
+
+// sealKey encrypts the registration of `k` for storing.
+func (gs *gormStore) sealKey(k *security.Key) (err error) {
+	k.MarshalledRegistration, err = gs.env.Encrypt(k.MarshalledRegistration,
+		keyField("marshalled_registration", k.ID))
+	if err != nil {
+		return err
+	}
+	k.CredentialPublicKey, err = gs.env.Encrypt(k.CredentialPublicKey,
+		keyField("credential_public_key", k.ID))
+	return err
+}
+
+// openKey decrypts the registration of a key that was loaded.
+func (gs *gormStore) openKey(k *security.Key) (err error) {
+	k.MarshalledRegistration, err = gs.env.Decrypt(k.MarshalledRegistration,
+		keyField("marshalled_registration", k.ID))
+	if err == nil {
+		k.CredentialPublicKey, err = gs.env.Decrypt(k.CredentialPublicKey,
+			keyField("credential_public_key", k.ID))
+	}
+	return errors.Wrapf(err, "Could not decrypt key %s", k.ID)
+}
+
+func (gs *gormStore) openKeys(ks []security.Key) error {
+	for i := range ks {
+		if err := gs.openKey(&ks[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (gs *gormStore) sealServer(info *AppServerInfo) (err error) {
+	info.PublicKey, err = gs.env.Encrypt(info.PublicKey,
+		serverField("public_key", info.ID))
+	return err
+}
+
+func (gs *gormStore) openServer(info *AppServerInfo) (err error) {
+	info.PublicKey, err = gs.env.Decrypt(info.PublicKey,
+		serverField("public_key", info.ID))
+	return errors.Wrapf(err, "Could not decrypt server %s", info.ID)
+}
+
+// signingKeyFields returns the encrypted columns of `sk`.
+func signingKeyFields(sk *security.SigningKey) map[string]*string {
+	return map[string]*string{
+		"iv":         &sk.IV,
+		"salt":       &sk.Salt,
+		"public_key": &sk.PublicKey,
+	}
+}
+
+func (gs *gormStore) sealSigningKey(sk *security.SigningKey) (err error) {
+	for column, value := range signingKeyFields(sk) {
+		*value, err = gs.env.EncryptString(*value,
+			signingKeyField(column, sk.ID))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (gs *gormStore) openSigningKey(sk *security.SigningKey) (err error) {
+	for column, value := range signingKeyFields(sk) {
+		*value, err = gs.env.DecryptString(*value,
+			signingKeyField(column, sk.ID))
+		if err != nil {
+			return errors.Wrapf(err, "Could not decrypt signing key %s",
+				sk.ID)
+		}
+	}
+	return nil
+}
+
+// first loads the first record matching `where` into `out`, translating
+// Gorm's not-found error.
+func (gs *gormStore) first(out, where interface{}) error {
+	err := gs.db.First(out, where).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (gs *gormStore) GetKey(id string) (security.Key, error) {
+	var k security.Key
+	if id == "" {
+		// Gorm leaves out empty conditions, which would match any key
+		return k, ErrNotFound
+	}
+	if err := gs.first(&k, &security.Key{ID: id}); err != nil {
+		return k, err
+	}
+	return k, gs.openKey(&k)
+}
+
+func (gs *gormStore) GetUserKey(userID string) (security.Key, error) {
+	var k security.Key
+	if err := gs.first(&k, &security.Key{UserID: userID}); err != nil {
+		return k, err
+	}
+	return k, gs.openKey(&k)
+}
+
+func (gs *gormStore) GetKeySignature(
+	signedPublicKey string) (security.KeySignature, error) {
+	var sig security.KeySignature
+	err := gs.first(&sig, &security.KeySignature{
+		SignedPublicKey: signedPublicKey,
+	})
+	return sig, err
+}
+
+func (gs *gormStore) GetApp(id string) (AppInfo, error) {
+	var app AppInfo
+	err := gs.first(&app, &AppInfo{ID: id})
+	return app, err
+}
+
+func (gs *gormStore) GetApps(appID string) ([]AppInfo, error) {
+	var found []AppInfo
+	err := gs.db.Find(&found, &AppInfo{ID: appID}).Error
+	return found, err
+}
+
+func (gs *gormStore) CreateApp(app AppInfo) error {
+	return gs.db.Create(&app).Error
+}
+
+func (gs *gormStore) UpdateApp(app AppInfo) error {
+	return gs.db.Save(&app).Error
+}
+
+func (gs *gormStore) DeleteApp(id string) (int64, error) {
+	query := gs.db.Delete(AppInfo{}, &AppInfo{ID: id})
+	return query.RowsAffected, query.Error
+}
+
+func (gs *gormStore) GetServer(id string) (AppServerInfo, error) {
+	var info AppServerInfo
+	if err := gs.first(&info, &AppServerInfo{ID: id}); err != nil {
+		return info, err
+	}
+	return info, gs.openServer(&info)
+}
+
+func (gs *gormStore) GetServers(appID string) ([]AppServerInfo, error) {
+	var found []AppServerInfo
+	err := gs.db.Find(&found, &AppServerInfo{AppID: appID}).Error
+	if err != nil {
+		return nil, err
+	}
+	for i := range found {
+		if err = gs.openServer(&found[i]); err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
+
+func (gs *gormStore) CreateServer(info AppServerInfo) error {
+	if err := gs.sealServer(&info); err != nil {
+		return err
+	}
+	return gs.db.Create(&info).Error
+}
+
+func (gs *gormStore) UpdateServer(info AppServerInfo) error {
+	if err := gs.sealServer(&info); err != nil {
+		return err
+	}
+	return gs.db.Save(&info).Error
+}
+
+func (gs *gormStore) DeleteServer(id string) (int64, error) {
+	query := gs.db.Delete(AppServerInfo{}, &AppServerInfo{ID: id})
+	return query.RowsAffected, query.Error
+}
+
+func (gs *gormStore) GetAdmin(id string) (Admin, error) {
+	var a Admin
+	err := gs.first(&a, &Admin{ID: id})
+	return a, err
+}
+
+func (gs *gormStore) GetAdmins(adminFor string) ([]Admin, error) {
+	var found []Admin
+	err := gs.db.Find(&found, &Admin{AdminFor: adminFor}).Error
+	return found, err
+}
+
+func (gs *gormStore) CreateAdmin(a Admin) error {
+	return gs.db.Create(&a).Error
+}
+
+func (gs *gormStore) UpdateAdmin(a Admin) error {
+	return gs.db.Save(&a).Error
+}
+
+func (gs *gormStore) DeleteAdmin(id string) (int64, error) {
+	query := gs.db.Delete(Admin{}, &Admin{ID: id})
+	return query.RowsAffected, query.Error
+}
+
+func (gs *gormStore) GetKeys(appID, userID string) ([]security.Key, error) {
+	var found []security.Key
+	err := gs.db.Find(&found, &security.Key{
+		AppID:  appID,
+		UserID: userID,
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+	return found, gs.openKeys(found)
+}
+
+func (gs *gormStore) GetSuspectKeys(appID string) ([]security.Key, error) {
+	var found []security.Key
+	err := gs.db.Where(&security.Key{
+		AppID:   appID,
+		Suspect: true,
+	}).Order("suspect_at desc").Find(&found).Error
+	if err != nil {
+		return nil, err
+	}
+	return found, gs.openKeys(found)
+}
+
+func (gs *gormStore) CreateKey(k security.Key) error {
+	if err := gs.sealKey(&k); err != nil {
+		return err
+	}
+	return gs.db.Create(&k).Error
+}
+
+func (gs *gormStore) DeleteKey(id string) (int64, error) {
+	query := gs.db.Delete(security.Key{}, &security.Key{ID: id})
+	return query.RowsAffected, query.Error
+}
+
+func (gs *gormStore) DeleteKeys(appID, userID string) (int64, error) {
+	query := gs.db.Delete(security.Key{}, &security.Key{
+		AppID:  appID,
+		UserID: userID,
+	})
+	return query.RowsAffected, query.Error
+}
+
+// updateKey sets columns of the key with ID `id`.
+// updateKey updates the key with ID `id`. The condition is spelled out
+// because Gorm leaves out empty struct conditions, so an empty ID would
+// update every key.
+func (gs *gormStore) updateKey(id string,
+	updates map[string]interface{}) *gorm.DB {
+	return gs.db.Model(&security.Key{}).Where("id = ?", id).Updates(updates)
+}
+
+func (gs *gormStore) UpdateKeyCounter(id, userID string,
+	counter uint32) error {
+	return gs.db.Model(&security.Key{}).
+		Where("id = ? AND user_id = ?", id, userID).
+		Updates(map[string]interface{}{
+			gorm.ToDBName("Counter"): counter,
+		}).Error
+}
+
+func (gs *gormStore) UpdateKeyState(id, state string) error {
+	return gs.updateKey(id, map[string]interface{}{
+		gorm.ToDBName("State"): state,
+	}).Error
+}
+
+func (gs *gormStore) UpdateKeyExpiry(id string, expiresAt *time.Time) error {
+	return gs.updateKey(id, map[string]interface{}{
+		gorm.ToDBName("ExpiresAt"): expiresAt,
+	}).Error
+}
+
+func (gs *gormStore) MarkKeySuspect(id string, at time.Time,
+	suspend bool) error {
+	updates := map[string]interface{}{
+		gorm.ToDBName("Suspect"):   true,
+		gorm.ToDBName("SuspectAt"): at,
+	}
+	if suspend {
+		updates[gorm.ToDBName("State")] = security.KeyStateSuspended
+	}
+	return gs.updateKey(id, updates).Error
+}
+
+func (gs *gormStore) ClearKeySuspect(id string) (int64, error) {
+	query := gs.updateKey(id, map[string]interface{}{
+		gorm.ToDBName("Suspect"):   false,
+		gorm.ToDBName("SuspectAt"): nil,
+	})
+	if query.Error != nil {
+		return 0, query.Error
+	}
+
+	err := gs.db.Model(&security.Key{}).Where(&security.Key{
+		ID:    id,
+		State: security.KeyStateSuspended,
+	}).Update(gorm.ToDBName("State"), security.KeyStateActive).Error
+	return query.RowsAffected, err
+}
+
+func (gs *gormStore) GetPermissions(appID string) ([]Permission, error) {
+	var found []Permission
+	err := gs.db.Find(&found, &Permission{AppID: appID}).Error
+	return found, err
+}
+
+func (gs *gormStore) GetAdminPermissions(adminID string,
+	appIDs ...string) ([]Permission, error) {
+	var found []Permission
+	err := gs.db.Where("admin_id = ? AND app_id IN (?)", adminID,
+		appIDs).Find(&found).Error
+	return found, err
+}
+
+func (gs *gormStore) CreatePermissions(ps []Permission) error {
+	return gs.Transaction(func(st Store) error {
+		tx := st.(*gormStore).db
+		for _, p := range ps {
+			if err := tx.Create(&p).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (gs *gormStore) DeletePermission(p Permission) (int64, error) {
+	query := gs.db.Delete(Permission{}, &p)
+	return query.RowsAffected, query.Error
+}
+
+func (gs *gormStore) GetSigningKeys() ([]security.SigningKey, error) {
+	var found []security.SigningKey
+	if err := gs.db.Find(&found).Error; err != nil {
+		return nil, err
+	}
+	for i := range found {
+		if err := gs.openSigningKey(&found[i]); err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
+
+func (gs *gormStore) CreateSigningKey(sk security.SigningKey) error {
+	if err := gs.sealSigningKey(&sk); err != nil {
+		return err
+	}
+	return gs.db.Create(&sk).Error
+}
+
+func (gs *gormStore) CreateKeySignature(sig security.KeySignature) error {
+	return gs.db.Create(&sig).Error
+}
+
+func (gs *gormStore) CreateLongTermRequest(ltr LongTermRequest) error {
+	return gs.db.Create(&ltr).Error
+}
+
+func (gs *gormStore) DeleteLongTermRequest(appID string,
+	hashedID []byte) (int64, error) {
+	query := gs.db.Delete(LongTermRequest{}, &LongTermRequest{
+		AppID: appID,
+		ID:    hashedID,
+	})
+	return query.RowsAffected, query.Error
+}
+
+func (gs *gormStore) TakeLongTermRequest(
+	hashedID []byte) (LongTermRequest, error) {
+	var ltr LongTermRequest
+	err := gs.Transaction(func(st Store) error {
+		tx := st.(*gormStore)
+		query := LongTermRequest{ID: hashedID}
+		if err := tx.first(&ltr, &query); err != nil {
+			return err
+		}
+		return tx.db.Delete(LongTermRequest{}, &query).Error
+	})
+	return ltr, err
+}
+
+func (gs *gormStore) Ping() error {
+	return gs.db.DB().Ping()
+}
+
+func (gs *gormStore) Close() error {
+	return gs.db.Close()
+}
+
+// Transaction runs `fn` inside a database transaction. Nested transactions
+// run inside the outermost one.
+func (gs *gormStore) Transaction(fn func(Store) error) (err error) {
+	tx := gs.db.Begin()
+	if tx.Error == gorm.ErrCantStartTransaction {
+		// Already in a transaction
+		return fn(gs)
+	} else if tx.Error != nil {
+		return tx.Error
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+			panic(r)
+		}
+	}()
+	if err = fn(&gormStore{tx, gs.env}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
@@ -0,0 +1,569 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tera-insights/2Q2R-enterprise/security"
+
+	"github.com/pkg/errors"
+)
+
+// memoryData is everything that a memoryStore holds.
+type memoryData struct {
+	apps        map[string]AppInfo
+	servers     map[string]AppServerInfo
+	admins      map[string]Admin
+	keys        map[string]security.Key
+	permissions map[Permission]bool
+	signingKeys map[string]security.SigningKey
+	signatures  []security.KeySignature
+	ltrs        []LongTermRequest
+}
+
+func newMemoryData() memoryData {
+	return memoryData{
+		apps:        make(map[string]AppInfo),
+		servers:     make(map[string]AppServerInfo),
+		admins:      make(map[string]Admin),
+		keys:        make(map[string]security.Key),
+		permissions: make(map[Permission]bool),
+		signingKeys: make(map[string]security.SigningKey),
+	}
+}
+
+// copy returns a copy of `md` that does not share any maps or slices with it.
+func (md memoryData) copy() memoryData {
+	c := newMemoryData()
+	for id, app := range md.apps {
+		c.apps[id] = app
+	}
+	for id, info := range md.servers {
+		c.servers[id] = info
+	}
+	for id, a := range md.admins {
+		c.admins[id] = a
+	}
+	for id, k := range md.keys {
+		c.keys[id] = k
+	}
+	for p := range md.permissions {
+		c.permissions[p] = true
+	}
+	for id, sk := range md.signingKeys {
+		c.signingKeys[id] = sk
+	}
+	c.signatures = append(c.signatures, md.signatures...)
+	c.ltrs = append(c.ltrs, md.ltrs...)
+	return c
+}
+
+// memoryStore keeps everything in memory, so that handlers can be tested
+// without a database. Lists are sorted by ID.
+type memoryStore struct {
+	lock sync.RWMutex
+	data memoryData
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{data: newMemoryData()}
+}
+
+func (ms *memoryStore) GetKey(id string) (security.Key, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	k, found := ms.data.keys[id]
+	if !found {
+		return k, ErrNotFound
+	}
+	return k, nil
+}
+
+func (ms *memoryStore) GetUserKey(userID string) (security.Key, error) {
+	keys, err := ms.GetKeys("", userID)
+	if err == nil && len(keys) == 0 {
+		err = ErrNotFound
+	}
+	if err != nil {
+		return security.Key{}, err
+	}
+	return keys[0], nil
+}
+
+func (ms *memoryStore) GetKeySignature(
+	signedPublicKey string) (security.KeySignature, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	for _, sig := range ms.data.signatures {
+		if sig.SignedPublicKey == signedPublicKey {
+			return sig, nil
+		}
+	}
+	return security.KeySignature{}, ErrNotFound
+}
+
+func (ms *memoryStore) GetApp(id string) (AppInfo, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	app, found := ms.data.apps[id]
+	if !found {
+		return app, ErrNotFound
+	}
+	return app, nil
+}
+
+func (ms *memoryStore) GetApps(appID string) ([]AppInfo, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	var found []AppInfo
+	for _, app := range ms.data.apps {
+		if appID == "" || app.ID == appID {
+			found = append(found, app)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].ID < found[j].ID
+	})
+	return found, nil
+}
+
+func (ms *memoryStore) CreateApp(app AppInfo) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if _, found := ms.data.apps[app.ID]; found {
+		return errors.Errorf("App %s already exists", app.ID)
+	}
+	ms.data.apps[app.ID] = app
+	return nil
+}
+
+func (ms *memoryStore) UpdateApp(app AppInfo) error {
+	ms.lock.Lock()
+	ms.data.apps[app.ID] = app
+	ms.lock.Unlock()
+	return nil
+}
+
+func (ms *memoryStore) DeleteApp(id string) (int64, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if _, found := ms.data.apps[id]; !found {
+		return 0, nil
+	}
+	delete(ms.data.apps, id)
+	return 1, nil
+}
+
+func (ms *memoryStore) GetServer(id string) (AppServerInfo, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	info, found := ms.data.servers[id]
+	if !found {
+		return info, ErrNotFound
+	}
+	return info, nil
+}
+
+func (ms *memoryStore) GetServers(appID string) ([]AppServerInfo, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	var found []AppServerInfo
+	for _, info := range ms.data.servers {
+		if appID == "" || info.AppID == appID {
+			found = append(found, info)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].ID < found[j].ID
+	})
+	return found, nil
+}
+
+func (ms *memoryStore) CreateServer(info AppServerInfo) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if _, found := ms.data.servers[info.ID]; found {
+		return errors.Errorf("App server %s already exists", info.ID)
+	}
+	ms.data.servers[info.ID] = info
+	return nil
+}
+
+func (ms *memoryStore) UpdateServer(info AppServerInfo) error {
+	ms.lock.Lock()
+	ms.data.servers[info.ID] = info
+	ms.lock.Unlock()
+	return nil
+}
+
+func (ms *memoryStore) DeleteServer(id string) (int64, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if _, found := ms.data.servers[id]; !found {
+		return 0, nil
+	}
+	delete(ms.data.servers, id)
+	return 1, nil
+}
+
+func (ms *memoryStore) GetAdmin(id string) (Admin, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	a, found := ms.data.admins[id]
+	if !found {
+		return a, ErrNotFound
+	}
+	return a, nil
+}
+
+func (ms *memoryStore) GetAdmins(adminFor string) ([]Admin, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	var found []Admin
+	for _, a := range ms.data.admins {
+		if adminFor == "" || a.AdminFor == adminFor {
+			found = append(found, a)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].ID < found[j].ID
+	})
+	return found, nil
+}
+
+func (ms *memoryStore) CreateAdmin(a Admin) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if _, found := ms.data.admins[a.ID]; found {
+		return errors.Errorf("Admin %s already exists", a.ID)
+	}
+	ms.data.admins[a.ID] = a
+	return nil
+}
+
+func (ms *memoryStore) UpdateAdmin(a Admin) error {
+	ms.lock.Lock()
+	ms.data.admins[a.ID] = a
+	ms.lock.Unlock()
+	return nil
+}
+
+func (ms *memoryStore) DeleteAdmin(id string) (int64, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if _, found := ms.data.admins[id]; !found {
+		return 0, nil
+	}
+	delete(ms.data.admins, id)
+	return 1, nil
+}
+
+// matchingKeys returns the keys of `appID` and `userID`, either of which may
+// be empty to match anything. The caller must hold the lock.
+func (ms *memoryStore) matchingKeys(appID, userID string) []security.Key {
+	var found []security.Key
+	for _, k := range ms.data.keys {
+		if (appID == "" || k.AppID == appID) &&
+			(userID == "" || k.UserID == userID) {
+			found = append(found, k)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].ID < found[j].ID
+	})
+	return found
+}
+
+func (ms *memoryStore) GetKeys(appID, userID string) ([]security.Key, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	return ms.matchingKeys(appID, userID), nil
+}
+
+func (ms *memoryStore) GetSuspectKeys(appID string) ([]security.Key, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	var found []security.Key
+	for _, k := range ms.matchingKeys(appID, "") {
+		if k.Suspect {
+			found = append(found, k)
+		}
+	}
+
+	// Most recently flagged first
+	sort.SliceStable(found, func(i, j int) bool {
+		if found[i].SuspectAt == nil || found[j].SuspectAt == nil {
+			return found[i].SuspectAt != nil
+		}
+		return found[i].SuspectAt.After(*found[j].SuspectAt)
+	})
+	return found, nil
+}
+
+func (ms *memoryStore) CreateKey(k security.Key) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if _, found := ms.data.keys[k.ID]; found {
+		return errors.Errorf("Key %s already exists", k.ID)
+	}
+	ms.data.keys[k.ID] = k
+	return nil
+}
+
+func (ms *memoryStore) DeleteKey(id string) (int64, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if _, found := ms.data.keys[id]; !found {
+		return 0, nil
+	}
+	delete(ms.data.keys, id)
+	return 1, nil
+}
+
+func (ms *memoryStore) DeleteKeys(appID, userID string) (int64, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	keys := ms.matchingKeys(appID, userID)
+	for _, k := range keys {
+		delete(ms.data.keys, k.ID)
+	}
+	return int64(len(keys)), nil
+}
+
+// updateKey applies `update` to the key with ID `id`, if there is one, and
+// returns whether there was.
+func (ms *memoryStore) updateKey(id string, update func(*security.Key)) bool {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	k, found := ms.data.keys[id]
+	if found {
+		update(&k)
+		ms.data.keys[id] = k
+	}
+	return found
+}
+
+func (ms *memoryStore) UpdateKeyCounter(id, userID string,
+	counter uint32) error {
+	ms.updateKey(id, func(k *security.Key) {
+		if k.UserID == userID {
+			k.Counter = counter
+		}
+	})
+	return nil
+}
+
+func (ms *memoryStore) UpdateKeyState(id, state string) error {
+	ms.updateKey(id, func(k *security.Key) {
+		k.State = state
+	})
+	return nil
+}
+
+func (ms *memoryStore) UpdateKeyExpiry(id string, expiresAt *time.Time) error {
+	ms.updateKey(id, func(k *security.Key) {
+		k.ExpiresAt = expiresAt
+	})
+	return nil
+}
+
+func (ms *memoryStore) MarkKeySuspect(id string, at time.Time,
+	suspend bool) error {
+	ms.updateKey(id, func(k *security.Key) {
+		k.Suspect = true
+		k.SuspectAt = &at
+		if suspend {
+			k.State = security.KeyStateSuspended
+		}
+	})
+	return nil
+}
+
+func (ms *memoryStore) ClearKeySuspect(id string) (int64, error) {
+	found := ms.updateKey(id, func(k *security.Key) {
+		k.Suspect = false
+		k.SuspectAt = nil
+		if k.State == security.KeyStateSuspended {
+			k.State = security.KeyStateActive
+		}
+	})
+	if !found {
+		return 0, nil
+	}
+	return 1, nil
+}
+
+// sortPermissions sorts permissions by admin, app and then permission.
+func sortPermissions(ps []Permission) {
+	sort.Slice(ps, func(i, j int) bool {
+		if ps[i].AdminID != ps[j].AdminID {
+			return ps[i].AdminID < ps[j].AdminID
+		}
+		if ps[i].AppID != ps[j].AppID {
+			return ps[i].AppID < ps[j].AppID
+		}
+		return ps[i].Permission < ps[j].Permission
+	})
+}
+
+func (ms *memoryStore) GetPermissions(appID string) ([]Permission, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	var found []Permission
+	for p := range ms.data.permissions {
+		if appID == "" || p.AppID == appID {
+			found = append(found, p)
+		}
+	}
+	sortPermissions(found)
+	return found, nil
+}
+
+func (ms *memoryStore) GetAdminPermissions(adminID string,
+	appIDs ...string) ([]Permission, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	var found []Permission
+	for p := range ms.data.permissions {
+		if p.AdminID != adminID {
+			continue
+		}
+		for _, appID := range appIDs {
+			if p.AppID == appID {
+				found = append(found, p)
+				break
+			}
+		}
+	}
+	sortPermissions(found)
+	return found, nil
+}
+
+func (ms *memoryStore) CreatePermissions(ps []Permission) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	for _, p := range ps {
+		if ms.data.permissions[p] {
+			return errors.Errorf("Admin %s already has permission %s for "+
+				"app %s", p.AdminID, p.Permission, p.AppID)
+		}
+	}
+	for _, p := range ps {
+		ms.data.permissions[p] = true
+	}
+	return nil
+}
+
+func (ms *memoryStore) DeletePermission(p Permission) (int64, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if !ms.data.permissions[p] {
+		return 0, nil
+	}
+	delete(ms.data.permissions, p)
+	return 1, nil
+}
+
+func (ms *memoryStore) GetSigningKeys() ([]security.SigningKey, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	var found []security.SigningKey
+	for _, sk := range ms.data.signingKeys {
+		found = append(found, sk)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].ID < found[j].ID
+	})
+	return found, nil
+}
+
+func (ms *memoryStore) CreateSigningKey(sk security.SigningKey) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if _, found := ms.data.signingKeys[sk.ID]; found {
+		return errors.Errorf("Signing key %s already exists", sk.ID)
+	}
+	ms.data.signingKeys[sk.ID] = sk
+	return nil
+}
+
+func (ms *memoryStore) CreateKeySignature(sig security.KeySignature) error {
+	ms.lock.Lock()
+	ms.data.signatures = append(ms.data.signatures, sig)
+	ms.lock.Unlock()
+	return nil
+}
+
+func (ms *memoryStore) CreateLongTermRequest(ltr LongTermRequest) error {
+	ms.lock.Lock()
+	ms.data.ltrs = append(ms.data.ltrs, ltr)
+	ms.lock.Unlock()
+	return nil
+}
+
+// removeLongTermRequests removes the long-term requests for which `match`
+// returns true, and returns them. The caller must hold the lock.
+func (ms *memoryStore) removeLongTermRequests(
+	match func(LongTermRequest) bool) []LongTermRequest {
+	var kept, removed []LongTermRequest
+	for _, ltr := range ms.data.ltrs {
+		if match(ltr) {
+			removed = append(removed, ltr)
+		} else {
+			kept = append(kept, ltr)
+		}
+	}
+	ms.data.ltrs = kept
+	return removed
+}
+
+func (ms *memoryStore) DeleteLongTermRequest(appID string,
+	hashedID []byte) (int64, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	removed := ms.removeLongTermRequests(func(ltr LongTermRequest) bool {
+		return ltr.AppID == appID && bytes.Equal(ltr.ID, hashedID)
+	})
+	return int64(len(removed)), nil
+}
+
+func (ms *memoryStore) TakeLongTermRequest(
+	hashedID []byte) (LongTermRequest, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	removed := ms.removeLongTermRequests(func(ltr LongTermRequest) bool {
+		return bytes.Equal(ltr.ID, hashedID)
+	})
+	if len(removed) == 0 {
+		return LongTermRequest{}, ErrNotFound
+	}
+	return removed[0], nil
+}
+
+func (ms *memoryStore) Ping() error {
+	return nil
+}
+
+func (ms *memoryStore) Close() error {
+	return nil
+}
+
+// Transaction runs `fn` against a copy of the store's contents, which
+// replaces them if `fn` succeeds. The store stays locked until then, so
+// transactions neither see nor undo other writes, and `fn` must only use the
+// store that it is passed.
+func (ms *memoryStore) Transaction(fn func(Store) error) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	tx := &memoryStore{data: ms.data.copy()}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	ms.data = tx.data
+	return nil
+}
@@ -0,0 +1,253 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tera-insights/2Q2R-enterprise/security"
+
+	"github.com/pkg/errors"
+)
+
+// testStores returns the memory store and a database store on a new SQLite
+// file, which should behave the same.
+func testStores(t *testing.T) map[string]Store {
+	conn := openTestDatabase(t, "sqlite3",
+		filepath.Join(t.TempDir(), "test.db"))
+	if err := NewMigrator(conn).Up(); err != nil {
+		t.Fatal(err)
+	}
+	env := security.NewEnvelope()
+	if err := env.AddKey(bytes.Repeat([]byte{4}, 32), true); err != nil {
+		t.Fatal(err)
+	}
+	return map[string]Store{
+		"memory":   newMemoryStore(),
+		"database": &gormStore{conn, env},
+	}
+}
+
+func TestStoreKeysAreScoped(t *testing.T) {
+	for kind, st := range testStores(t) {
+		t.Run(kind, func(t *testing.T) {
+			for _, k := range []security.Key{
+				{ID: "k1", UserID: "alice", AppID: "a"},
+				{ID: "k2", UserID: "mallory", AppID: "a"},
+			} {
+				k.Format = security.FormatU2F
+				k.MarshalledRegistration = []byte("registration")
+				k.State = security.KeyStateActive
+				if err := st.CreateKey(k); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if _, err := st.GetKey(""); err != ErrNotFound {
+				t.Errorf("Expected ErrNotFound for an empty ID. Got %v", err)
+			}
+
+			// Counters only change for the key's own user
+			if err := st.UpdateKeyCounter("k1", "mallory", 5); err != nil {
+				t.Fatal(err)
+			}
+			if err := st.UpdateKeyCounter("k1", "alice", 7); err != nil {
+				t.Fatal(err)
+			}
+			// An empty ID does not update every key
+			err := st.UpdateKeyState("", security.KeyStateRevoked)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for id, counter := range map[string]uint32{"k1": 7, "k2": 0} {
+				k, err := st.GetKey(id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if k.Counter != counter {
+					t.Errorf("Expected counter %d for %s. Got %d", counter,
+						id, k.Counter)
+				}
+				if k.State != security.KeyStateActive {
+					t.Errorf("Expected %s to stay active. Got %s", id,
+						k.State)
+				}
+			}
+		})
+	}
+}
+
+func TestStoreListingsAreScopedByApp(t *testing.T) {
+	for kind, st := range testStores(t) {
+		t.Run(kind, func(t *testing.T) {
+			for _, id := range []string{"a", "b"} {
+				if err := st.CreateApp(AppInfo{ID: id, AppName: id}); err != nil {
+					t.Fatal(err)
+				}
+				err := st.CreateServer(AppServerInfo{ID: "server-" + id,
+					AppID: id, PublicKey: []byte("key")})
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = st.CreateAdmin(Admin{ID: "admin-" + id, AdminFor: id})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, k := range []security.Key{
+				{ID: "k1", UserID: "alice", AppID: "a"},
+				{ID: "k2", UserID: "alice", AppID: "a"},
+				{ID: "k3", UserID: "bob", AppID: "a"},
+				{ID: "k4", UserID: "alice", AppID: "b"},
+			} {
+				k.State = security.KeyStateActive
+				if err := st.CreateKey(k); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := st.CreatePermissions([]Permission{
+				{AdminID: "admin-a", AppID: "a", Permission: permissionKeys},
+				{AdminID: "admin-a", AppID: "b", Permission: permissionApps},
+				{AdminID: "admin-a", AppID: "1", Permission: permissionServers},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			count := func(n int, err error) int {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return n
+			}
+			for name, c := range map[string][2]int{
+				"all apps":        {2, count(lenOf(st.GetApps("")))},
+				"one app":         {1, count(lenOf(st.GetApps("a")))},
+				"servers":         {1, count(lenOf(st.GetServers("a")))},
+				"admins":          {1, count(lenOf(st.GetAdmins("b")))},
+				"keys of app":     {3, count(lenOf(st.GetKeys("a", "")))},
+				"keys of user":    {2, count(lenOf(st.GetKeys("a", "alice")))},
+				"keys everywhere": {4, count(lenOf(st.GetKeys("", "")))},
+				"permissions": {2, count(lenOf(
+					st.GetAdminPermissions("admin-a", "a", "1")))},
+			} {
+				if c[0] != c[1] {
+					t.Errorf("Expected %d %s. Got %d", c[0], name, c[1])
+				}
+			}
+
+			n, err := st.DeleteKeys("a", "alice")
+			if err != nil || n != 2 {
+				t.Errorf("Expected to delete 2 keys. Deleted %d: %v", n, err)
+			}
+			if _, err := st.GetKey("k4"); err != nil {
+				t.Errorf("Key of another app was deleted: %v", err)
+			}
+
+			if _, err := st.GetApp("c"); err != ErrNotFound {
+				t.Errorf("Expected ErrNotFound for a missing app. Got %v", err)
+			}
+			if _, err := st.GetServer("c"); err != ErrNotFound {
+				t.Errorf("Expected ErrNotFound for a missing server. Got %v",
+					err)
+			}
+			if _, err := st.GetAdmin("c"); err != ErrNotFound {
+				t.Errorf("Expected ErrNotFound for a missing admin. Got %v",
+					err)
+			}
+		})
+	}
+}
+
+// lenOf returns the length of a listing and its error.
+func lenOf(listing interface{}, err error) (int, error) {
+	return reflect.ValueOf(listing).Len(), err
+}
+
+func TestStoreTransactions(t *testing.T) {
+	failed := errors.New("failed")
+	for kind, st := range testStores(t) {
+		t.Run(kind, func(t *testing.T) {
+			create := func(id string) func(Store) error {
+				return func(tx Store) error {
+					if err := tx.CreateApp(AppInfo{ID: id}); err != nil {
+						return err
+					}
+					// The transaction sees its own writes
+					_, err := tx.GetApp(id)
+					return err
+				}
+			}
+
+			if err := st.Transaction(create("kept")); err != nil {
+				t.Fatal(err)
+			}
+			err := st.Transaction(func(tx Store) error {
+				create("failed")(tx)
+				return failed
+			})
+			if err != failed {
+				t.Errorf("Expected the transaction's error. Got %v", err)
+			}
+			func() {
+				defer func() { recover() }()
+				st.Transaction(func(tx Store) error {
+					create("panicked")(tx)
+					panic(failed)
+				})
+			}()
+
+			for id, expected := range map[string]error{
+				"kept":     nil,
+				"failed":   ErrNotFound,
+				"panicked": ErrNotFound,
+			} {
+				if _, err := st.GetApp(id); err != expected {
+					t.Errorf("Expected %v for app %s. Got %v", expected, id,
+						err)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryTransactionsKeepOtherWrites(t *testing.T) {
+	ms := newMemoryStore()
+	started := make(chan struct{})
+	written := make(chan error)
+	err := ms.Transaction(func(tx Store) error {
+		if err := tx.CreateApp(AppInfo{ID: "undone"}); err != nil {
+			return err
+		}
+		// Writes outside the transaction wait for it to finish
+		go func() {
+			close(started)
+			written <- ms.CreateApp(AppInfo{ID: "other"})
+		}()
+		<-started
+		select {
+		case err := <-written:
+			t.Errorf("Write finished during the transaction: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		return errors.New("failed")
+	})
+	if err == nil {
+		t.Fatal("Expected the transaction to fail")
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ms.GetApp("other"); err != nil {
+		t.Errorf("Failed transaction undid another write: %v", err)
+	}
+	if _, err := ms.GetApp("undone"); err != ErrNotFound {
+		t.Errorf("Failed transaction was kept: %v", err)
+	}
+}
@@ -0,0 +1,316 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Headers of webhook requests
+const (
+	webhookEventHeader     = "X-2Q2R-Event"
+	webhookDeliveryHeader  = "X-2Q2R-Delivery"
+	webhookTimestampHeader = "X-2Q2R-Timestamp"
+	webhookSignatureHeader = "X-2Q2R-Signature"
+)
+
+// How the webhook queue is worked off
+const (
+	webhookPollInterval  = time.Second
+	webhookBatchSize     = 50
+	webhookWorkers       = 8
+	webhookInitialDelay  = 10 * time.Second
+	webhookMaxRetryDelay = time.Hour
+)
+
+// The name of the event that POST /admin/app/{appID}/webhooks/{id}/test
+// sends
+const webhookTestEvent = "test"
+
+// webhookPayload is the body of a webhook request.
+type webhookPayload struct {
+	WebhookID string `json:"webhookID"`
+	Event     event  `json:"event"`
+}
+
+// webhookDispatcher queues the events of apps for their webhooks and sends
+// them. Deliveries that fail are retried with exponential backoff until
+// Config.WebhookMaxAttempts attempts have failed; then they are dead.
+type webhookDispatcher struct {
+	store       webhookStore
+	client      *http.Client
+	maxAttempts int
+
+	// Wakes up run when a delivery is queued
+	wake chan struct{}
+}
+
+func newWebhookDispatcher(store webhookStore, c *Config) *webhookDispatcher {
+	return &webhookDispatcher{
+		store,
+		newWebhookClient(c),
+		c.WebhookMaxAttempts,
+		make(chan struct{}, 1),
+	}
+}
+
+// Networks that webhooks may not be sent to, besides the loopback,
+// link-local, multicast and unspecified addresses
+var privateNetworks = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12",
+		"192.168.0.0/16", "100.64.0.0/10", "0.0.0.0/8", "fc00::/7"} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// isPublicAddress returns whether webhooks may be sent to `ip` when private
+// networks are not allowed.
+func isPublicAddress(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+var errWebhookAddressBlocked = errors.New("Webhook address is not public")
+
+// newWebhookClient returns the client that webhooks are sent with. Unless
+// Config.WebhookAllowPrivateNetworks is set, it refuses to connect to
+// addresses that are not public. The address is checked when connecting, so
+// that host names which resolve to such addresses are refused as well.
+// Redirects are not followed, and proxies are not used, as they would connect
+// on the client's behalf.
+func newWebhookClient(c *Config) *http.Client {
+	dialer := &net.Dialer{Timeout: c.WebhookTimeout}
+	if !c.WebhookAllowPrivateNetworks {
+		dialer.Control = func(network, address string,
+			_ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicAddress(ip) {
+				return errWebhookAddressBlocked
+			}
+			return nil
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, network,
+		address string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, address)
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   c.WebhookTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// enqueue queues `e` for every active webhook of its app that receives it.
+// Events without an app are not sent to any webhook, rather than to those of
+// every app.
+func (wd *webhookDispatcher) enqueue(e event) error {
+	if e.AppID == "" {
+		return nil
+	}
+	hooks, err := wd.store.GetWebhooks(e.AppID)
+	if err != nil {
+		return errors.Wrap(err, "Could not load webhooks")
+	}
+	queued := false
+	for _, h := range hooks {
+		if !h.Active || !h.accepts(e.Name) {
+			continue
+		}
+		payload, err := json.Marshal(webhookPayload{h.ID, e})
+		if err != nil {
+			return errors.Wrap(err, "Could not encode webhook payload")
+		}
+		now := time.Now().UTC()
+		err = wd.store.CreateDelivery(&webhookDelivery{
+			WebhookID:   h.ID,
+			AppID:       h.AppID,
+			EventID:     e.ID,
+			EventType:   e.Name,
+			Payload:     payload,
+			State:       deliveryPending,
+			NextAttempt: now,
+			CreatedAt:   now,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "Could not queue event for webhook %s",
+				h.ID)
+		}
+		queued = true
+	}
+	if queued {
+		wd.wakeUp()
+	}
+	return nil
+}
+
+// wakeUp makes run look for due deliveries without waiting for its ticker.
+func (wd *webhookDispatcher) wakeUp() {
+	select {
+	case wd.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run sends due deliveries until `done` is closed.
+func (wd *webhookDispatcher) run(done <-chan struct{}) {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		case <-wd.wake:
+		}
+		if err := wd.deliverDue(); err != nil {
+			logger.WithError(err).Error("Could not deliver webhooks")
+		}
+	}
+}
+
+// deliverDue claims the deliveries that are due and sends them, a few at a
+// time.
+func (wd *webhookDispatcher) deliverDue() error {
+	// Long enough that a claimed delivery is sent before its lease ends
+	lease := 2*wd.client.Timeout + time.Minute
+	due, err := wd.store.ClaimDeliveries(time.Now().UTC(), lease,
+		webhookBatchSize)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, webhookWorkers)
+	for _, d := range due {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(d webhookDelivery) {
+			defer wg.Done()
+			defer func() { <-workers }()
+			wd.attempt(d)
+		}(d)
+	}
+	wg.Wait()
+	return nil
+}
+
+// attempt sends a delivery once and records the outcome.
+func (wd *webhookDispatcher) attempt(d webhookDelivery) {
+	entry := logger.WithField("webhook", d.WebhookID).WithField("delivery",
+		d.ID)
+	h, err := wd.store.GetWebhook(d.WebhookID)
+	if err == errWebhookNotFound {
+		return // deleted since the delivery was claimed
+	} else if err != nil {
+		entry.WithError(err).Error("Could not load webhook")
+		return
+	}
+
+	d.Attempts++
+	d.LastStatus, err = wd.send(h, d.EventType, d.ID, d.Payload)
+	switch {
+	case err == nil:
+		d.State = deliveryDelivered
+		d.LastError = ""
+	case d.Attempts >= wd.maxAttempts:
+		d.State = deliveryDead
+		d.LastError = err.Error()
+		entry.WithError(err).Warn("Giving up on webhook delivery")
+	default:
+		d.NextAttempt = time.Now().UTC().Add(webhookRetryDelay(d.Attempts))
+		d.LastError = err.Error()
+	}
+	if err = wd.store.UpdateDelivery(d); err != nil {
+		entry.WithError(err).Error("Could not update webhook delivery")
+	}
+}
+
+// send posts `payload` to the webhook's URL, signed with its secret. It
+// returns the status of the response, and an error unless it is a 2xx.
+func (wd *webhookDispatcher) send(h Webhook, eventType string,
+	deliveryID uint64, payload []byte) (int, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, errors.Wrap(err, "Invalid webhook URL")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, eventType)
+	req.Header.Set(webhookDeliveryHeader, strconv.FormatUint(deliveryID, 10))
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader,
+		signWebhook(h.Secret, timestamp, payload))
+
+	resp, err := wd.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, errors.Errorf("Webhook answered %s",
+			resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// signWebhook returns the signature header of a webhook request:
+//
+//	sha256=<hex of HMAC-SHA256(secret, <timestamp> "." <body>)>
+//
+// Receivers should reject requests whose timestamp is too old, so that
+// requests cannot be replayed.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	io.WriteString(mac, timestamp+".")
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookRetryDelay returns how long to wait after `attempts` failed
+// attempts: 10s, 20s, 40s and so on, up to an hour.
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := webhookInitialDelay
+	for i := 1; i < attempts && delay < webhookMaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > webhookMaxRetryDelay {
+		delay = webhookMaxRetryDelay
+	}
+	return delay
+}
@@ -0,0 +1,259 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tera-insights/2Q2R-enterprise/util"
+
+	"github.com/gorilla/mux"
+)
+
+type webhookHandler struct {
+	s *Server
+}
+
+// Webhook secrets that admins choose must be at least this long
+const minWebhookSecretLength = 16
+
+// How many dead deliveries GET /admin/app/{appID}/webhooks/dead returns
+const maxDeadDeliveries = 500
+
+// appID returns the app of the route, which the admin must be able to act
+// for.
+func (wh *webhookHandler) appID(r *http.Request) string {
+	appID := mux.Vars(r)["appID"]
+	err := util.CheckBase64(appID)
+	util.OptionalBadRequestPanic(err, "App ID was not base-64 encoded")
+	adminFor(r).requireApp(appID)
+	return appID
+}
+
+// webhook returns the webhook of the route, which must belong to `appID`.
+func (wh *webhookHandler) webhook(r *http.Request, appID string) Webhook {
+	h, err := wh.s.webhooks.store.GetWebhook(mux.Vars(r)["webhookID"])
+	util.PanicIfFalse(err != errWebhookNotFound && (err != nil ||
+		h.AppID == appID), http.StatusNotFound, "Webhook not found")
+	util.OptionalInternalPanic(err, "Could not read webhook")
+	return h
+}
+
+// checkWebhookURL panics unless `u` is an absolute HTTP or HTTPS URL. Unless
+// `allowPrivate`, it may not name localhost or an address that is not public.
+// Host names are checked again when webhooks are sent, once they are
+// resolved.
+func checkWebhookURL(u string, allowPrivate bool) {
+	parsed, err := url.Parse(u)
+	util.OptionalBadRequestPanic(err, "Invalid webhook URL")
+	util.PanicIfFalse((parsed.Scheme == "http" || parsed.Scheme == "https") &&
+		parsed.Host != "", http.StatusBadRequest,
+		"Webhook URL must be an absolute http or https URL")
+	if allowPrivate {
+		return
+	}
+	host := strings.ToLower(strings.TrimSuffix(parsed.Hostname(), "."))
+	ip := net.ParseIP(host)
+	util.PanicIfFalse(host != "localhost" &&
+		!strings.HasSuffix(host, ".localhost") &&
+		(ip == nil || isPublicAddress(ip)), http.StatusBadRequest,
+		"Webhook URL must be on a public address")
+}
+
+// encodeEventTypes checks that `types` are names of events and encodes them
+// for Webhook.EventTypes.
+func encodeEventTypes(types []string) string {
+	if len(types) == 0 {
+		return ""
+	}
+	known := map[string]bool{}
+	for _, name := range events {
+		known[name] = true
+	}
+	for _, t := range types {
+		util.PanicIfFalse(known[t], http.StatusBadRequest,
+			"Unknown event type "+t)
+	}
+	encoded, err := json.Marshal(types)
+	util.OptionalInternalPanic(err, "Could not encode event types")
+	return string(encoded)
+}
+
+func newWebhookReply(h Webhook) webhookReply {
+	types := h.eventTypes()
+	if types == nil {
+		types = []string{}
+	}
+	return webhookReply{h, types, ""}
+}
+
+// GetWebhooks lists the webhooks of an app.
+// GET /admin/app/{appID}/webhooks
+func (wh *webhookHandler) GetWebhooks(w http.ResponseWriter,
+	r *http.Request) {
+	found, err := wh.s.webhooks.store.GetWebhooks(wh.appID(r))
+	util.OptionalInternalPanic(err, "Could not read webhooks")
+
+	replies := []webhookReply{}
+	for _, h := range found {
+		replies = append(replies, newWebhookReply(h))
+	}
+	writeJSON(w, http.StatusOK, replies)
+}
+
+// NewWebhook subscribes a URL to the events of an app. The reply is the only
+// place where the secret that signs payloads is returned.
+// POST /admin/app/{appID}/webhooks
+func (wh *webhookHandler) NewWebhook(w http.ResponseWriter, r *http.Request) {
+	req := newWebhookRequest{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	util.OptionalBadRequestPanic(err, "Could not decode request body")
+
+	appID := wh.appID(r)
+	_, err = wh.s.Store.GetApp(appID)
+	util.PanicIfFalse(err != ErrNotFound, http.StatusNotFound,
+		"App not found")
+	util.OptionalInternalPanic(err, "Could not read app")
+
+	checkWebhookURL(req.URL, wh.s.Config.WebhookAllowPrivateNetworks)
+	if req.Secret == "" {
+		req.Secret, err = util.RandString(32)
+		util.OptionalInternalPanic(err, "Could not generate webhook secret")
+	}
+	util.PanicIfFalse(len(req.Secret) >= minWebhookSecretLength,
+		http.StatusBadRequest, "Webhook secret must have at least "+
+			strconv.Itoa(minWebhookSecretLength)+" characters")
+
+	webhookID, err := util.RandString(32)
+	util.OptionalInternalPanic(err, "Could not generate webhook ID")
+
+	h := Webhook{
+		ID:         webhookID,
+		AppID:      appID,
+		URL:        req.URL,
+		Secret:     req.Secret,
+		EventTypes: encodeEventTypes(req.EventTypes),
+		Active:     true,
+		CreatedAt:  time.Now().UTC(),
+	}
+	err = wh.s.webhooks.store.CreateWebhook(h)
+	util.OptionalInternalPanic(err, "Could not create webhook")
+
+	reply := newWebhookReply(h)
+	reply.Secret = h.Secret
+	writeJSON(w, http.StatusOK, reply)
+}
+
+// UpdateWebhook changes the URL or event types of a webhook, or pauses and
+// resumes it. Events that happen while a webhook is paused are not sent.
+// PUT /admin/app/{appID}/webhooks/{webhookID}
+func (wh *webhookHandler) UpdateWebhook(w http.ResponseWriter,
+	r *http.Request) {
+	req := webhookUpdateRequest{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	util.OptionalBadRequestPanic(err, "Could not decode request body")
+
+	h := wh.webhook(r, wh.appID(r))
+	if req.URL != "" {
+		checkWebhookURL(req.URL, wh.s.Config.WebhookAllowPrivateNetworks)
+		h.URL = req.URL
+	}
+	if req.EventTypes != nil {
+		h.EventTypes = encodeEventTypes(req.EventTypes)
+	}
+	if req.Active != nil {
+		h.Active = *req.Active
+	}
+
+	err = wh.s.webhooks.store.UpdateWebhook(h)
+	util.OptionalInternalPanic(err, "Could not update webhook")
+
+	writeJSON(w, http.StatusOK, newWebhookReply(h))
+}
+
+// DeleteWebhook deletes a webhook and drops its queued deliveries.
+// DELETE /admin/app/{appID}/webhooks/{webhookID}
+func (wh *webhookHandler) DeleteWebhook(w http.ResponseWriter,
+	r *http.Request) {
+	h := wh.webhook(r, wh.appID(r))
+
+	n, err := wh.s.webhooks.store.DeleteWebhook(h.ID)
+	util.OptionalInternalPanic(err, "Could not delete webhook")
+
+	writeJSON(w, http.StatusOK, modificationReply{
+		NumAffected: n,
+	})
+}
+
+// TestWebhook sends a signed "test" event to a webhook right away, even if it
+// is paused, and replies with how the webhook answered. The test is not
+// queued or retried.
+// POST /admin/app/{appID}/webhooks/{webhookID}/test
+func (wh *webhookHandler) TestWebhook(w http.ResponseWriter,
+	r *http.Request) {
+	appID := wh.appID(r)
+	h := wh.webhook(r, appID)
+
+	payload, err := json.Marshal(webhookPayload{h.ID, event{
+		Name:      webhookTestEvent,
+		AppID:     appID,
+		Timestamp: time.Now(),
+		Status:    "success",
+		UserID:    adminFor(r).Admin.ID,
+	}})
+	util.OptionalInternalPanic(err, "Could not encode webhook payload")
+
+	// The reason is only logged, so that tests cannot be used to probe
+	// which hosts and ports the server can reach
+	status, err := wh.s.webhooks.send(h, webhookTestEvent, 0, payload)
+	reply := webhookTestReply{Delivered: err == nil, Status: status}
+	if err != nil {
+		logFor(r).WithError(err).WithField("webhook", h.ID).Info(
+			"Test event was not delivered")
+		reply.Error = "Webhook did not accept the test event"
+	}
+	writeJSON(w, http.StatusOK, reply)
+}
+
+// GetDeadDeliveries lists the newest deliveries of an app that were given up
+// on. The optional webhookID query parameter limits them to one webhook.
+// GET /admin/app/{appID}/webhooks/dead
+func (wh *webhookHandler) GetDeadDeliveries(w http.ResponseWriter,
+	r *http.Request) {
+	found, err := wh.s.webhooks.store.GetDeliveries(wh.appID(r),
+		r.URL.Query().Get("webhookID"), deliveryDead, maxDeadDeliveries)
+	util.OptionalInternalPanic(err, "Could not read webhook deliveries")
+
+	writeJSON(w, http.StatusOK, found)
+}
+
+// RetryDelivery queues a dead delivery again, with a fresh set of attempts.
+// POST /admin/app/{appID}/webhooks/dead/{deliveryID}/retry
+func (wh *webhookHandler) RetryDelivery(w http.ResponseWriter,
+	r *http.Request) {
+	appID := wh.appID(r)
+	deliveryID, err := strconv.ParseUint(mux.Vars(r)["deliveryID"], 10, 64)
+	util.OptionalBadRequestPanic(err, "Invalid delivery ID")
+
+	d, err := wh.s.webhooks.store.GetDelivery(deliveryID)
+	util.PanicIfFalse(err != errWebhookNotFound && (err != nil ||
+		d.AppID == appID), http.StatusNotFound, "Delivery not found")
+	util.OptionalInternalPanic(err, "Could not read webhook delivery")
+	util.PanicIfFalse(d.State == deliveryDead, http.StatusConflict,
+		"Delivery is not dead")
+
+	d.State = deliveryPending
+	d.Attempts = 0
+	d.NextAttempt = time.Now().UTC()
+	err = wh.s.webhooks.store.UpdateDelivery(d)
+	util.OptionalInternalPanic(err, "Could not update webhook delivery")
+	wh.s.webhooks.wakeUp()
+
+	writeJSON(w, http.StatusOK, d)
+}
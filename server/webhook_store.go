@@ -0,0 +1,449 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"github.com/tera-insights/2Q2R-enterprise/security"
+)
+
+// errWebhookNotFound is returned for unknown webhooks and deliveries.
+var errWebhookNotFound = errors.New("Webhook not found")
+
+// States of webhook deliveries
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryDead      = "dead" // gave up after Config.WebhookMaxAttempts
+)
+
+// Webhook is the Gorm model for an app's subscription to its security events.
+type Webhook struct {
+	ID    string `json:"webhookID"`
+	AppID string `json:"appID" gorm:"index"`
+	URL   string `json:"url"`
+
+	// Key of the HMAC that signs payloads, encrypted at rest
+	Secret string `json:"-"`
+
+	// JSON-encoded list of the event names to send, or empty for all events
+	EventTypes string `json:"-"`
+
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// eventTypes returns the names of the events that the webhook receives,
+// or nil for all events.
+func (h Webhook) eventTypes() []string {
+	var types []string
+	json.Unmarshal([]byte(h.EventTypes), &types)
+	return types
+}
+
+// accepts returns whether the webhook receives events named `name`.
+func (h Webhook) accepts(name string) bool {
+	types := h.eventTypes()
+	for _, t := range types {
+		if t == name {
+			return true
+		}
+	}
+	return len(types) == 0
+}
+
+// webhookDelivery is the Gorm model for an event that is, or was, queued for a
+// webhook.
+type webhookDelivery struct {
+	ID        uint64 `json:"deliveryID" gorm:"primary_key"`
+	WebhookID string `json:"webhookID" gorm:"index"`
+	AppID     string `json:"appID" gorm:"index"`
+	EventID   uint64 `json:"eventID"`
+	EventType string `json:"eventType"`
+
+	// The body that is sent, the same for every attempt
+	Payload []byte `json:"-"`
+
+	State       string    `json:"state" gorm:"index"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt" gorm:"index"`
+
+	// The HTTP status of the last attempt, 0 if it got no response, and why
+	// it failed
+	LastStatus int    `json:"lastStatus"`
+	LastError  string `json:"lastError"`
+
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (webhookDelivery) TableName() string { return "webhook_deliveries" }
+
+// webhookStore holds webhooks and the queue of their deliveries. With a
+// shared database, every instance of the server works off the same queue.
+type webhookStore interface {
+	// Webhooks of an app
+	GetWebhooks(appID string) ([]Webhook, error)
+	GetWebhook(id string) (Webhook, error)
+	CreateWebhook(h Webhook) error
+	UpdateWebhook(h Webhook) error
+
+	// Deletes the webhook and its deliveries
+	DeleteWebhook(id string) (int64, error)
+
+	// Queues a delivery, setting its ID
+	CreateDelivery(d *webhookDelivery) error
+	GetDelivery(id uint64) (webhookDelivery, error)
+	UpdateDelivery(d webhookDelivery) error
+
+	// Returns up to `limit` pending deliveries whose next attempt is due at
+	// `now`, and postpones their next attempt by `lease`, so that no other
+	// instance claims them while they are sent. Times are in UTC, so that
+	// SQLite compares them correctly.
+	ClaimDeliveries(now time.Time, lease time.Duration,
+		limit int) ([]webhookDelivery, error)
+
+	// Deliveries of an app, or of one of its webhooks, in state `state`,
+	// newest first
+	GetDeliveries(appID, webhookID, state string,
+		limit int) ([]webhookDelivery, error)
+
+	// Removes delivered and dead deliveries that were created before `t`
+	DeleteDeliveriesBefore(t time.Time) (int64, error)
+}
+
+// newWebhookStore keeps webhooks in the database if `store` is backed by one,
+// and in memory otherwise.
+func newWebhookStore(store Store) webhookStore {
+	if gs, ok := store.(*gormStore); ok {
+		return &dbWebhookStore{gs.db, gs.env}
+	}
+	return newMemoryWebhookStore()
+}
+
+// dbWebhookStore keeps webhooks and deliveries in the database. Secrets are
+// encrypted with the store's envelope.
+type dbWebhookStore struct {
+	db  *gorm.DB
+	env *security.Envelope
+}
+
+func (ws *dbWebhookStore) open(h *Webhook) (err error) {
+	h.Secret, err = ws.env.DecryptString(h.Secret,
+		webhookField("secret", h.ID))
+	return errors.Wrapf(err, "Could not decrypt webhook %s", h.ID)
+}
+
+func (ws *dbWebhookStore) GetWebhooks(appID string) ([]Webhook, error) {
+	var found []Webhook
+	err := ws.db.Where("app_id = ?", appID).Order("id").Find(&found).Error
+	if err != nil {
+		return nil, err
+	}
+	return found, ws.openAll(found)
+}
+
+// openAll decrypts the secrets of `hooks`.
+func (ws *dbWebhookStore) openAll(hooks []Webhook) error {
+	for i := range hooks {
+		if err := ws.open(&hooks[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allWebhooks returns the webhooks of every app, for re-encrypting them.
+func (ws *dbWebhookStore) allWebhooks() ([]Webhook, error) {
+	var found []Webhook
+	if err := ws.db.Order("id").Find(&found).Error; err != nil {
+		return nil, err
+	}
+	return found, ws.openAll(found)
+}
+
+func (ws *dbWebhookStore) GetWebhook(id string) (Webhook, error) {
+	var h Webhook
+	err := ws.db.Where("id = ?", id).First(&h).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return h, errWebhookNotFound
+	} else if err != nil {
+		return h, err
+	}
+	return h, ws.open(&h)
+}
+
+func (ws *dbWebhookStore) CreateWebhook(h Webhook) (err error) {
+	h.Secret, err = ws.env.EncryptString(h.Secret,
+		webhookField("secret", h.ID))
+	if err != nil {
+		return err
+	}
+	return ws.db.Create(&h).Error
+}
+
+// UpdateWebhook updates the URL, event types and whether the webhook is
+// active. The secret cannot be changed.
+func (ws *dbWebhookStore) UpdateWebhook(h Webhook) error {
+	query := ws.db.Model(&Webhook{}).Where("id = ?", h.ID).Updates(
+		map[string]interface{}{
+			gorm.ToDBName("URL"):        h.URL,
+			gorm.ToDBName("EventTypes"): h.EventTypes,
+			gorm.ToDBName("Active"):     h.Active,
+		})
+	if query.Error == nil && query.RowsAffected == 0 {
+		return errWebhookNotFound
+	}
+	return query.Error
+}
+
+func (ws *dbWebhookStore) DeleteWebhook(id string) (int64, error) {
+	var n int64
+	err := ws.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("webhook_id = ?", id).Delete(webhookDelivery{}).Error
+		if err != nil {
+			return err
+		}
+		query := tx.Where("id = ?", id).Delete(Webhook{})
+		n = query.RowsAffected
+		return query.Error
+	})
+	return n, err
+}
+
+func (ws *dbWebhookStore) CreateDelivery(d *webhookDelivery) error {
+	return ws.db.Create(d).Error
+}
+
+func (ws *dbWebhookStore) GetDelivery(id uint64) (webhookDelivery, error) {
+	var d webhookDelivery
+	if id == 0 {
+		return d, errWebhookNotFound
+	}
+	err := ws.db.Where("id = ?", id).First(&d).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return d, errWebhookNotFound
+	}
+	return d, err
+}
+
+func (ws *dbWebhookStore) UpdateDelivery(d webhookDelivery) error {
+	return ws.db.Model(&webhookDelivery{}).Where("id = ?", d.ID).Updates(
+		map[string]interface{}{
+			gorm.ToDBName("State"):       d.State,
+			gorm.ToDBName("Attempts"):    d.Attempts,
+			gorm.ToDBName("NextAttempt"): d.NextAttempt,
+			gorm.ToDBName("LastStatus"):  d.LastStatus,
+			gorm.ToDBName("LastError"):   d.LastError,
+		}).Error
+}
+
+func (ws *dbWebhookStore) ClaimDeliveries(now time.Time, lease time.Duration,
+	limit int) ([]webhookDelivery, error) {
+	var due []webhookDelivery
+	err := ws.db.Where("state = ? AND next_attempt <= ?", deliveryPending,
+		now).Order("next_attempt").Limit(limit).Find(&due).Error
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the instance whose update finds the delivery still due claims it
+	claimed := due[:0]
+	for _, d := range due {
+		query := ws.db.Model(&webhookDelivery{}).Where(
+			"id = ? AND state = ? AND next_attempt <= ?", d.ID,
+			deliveryPending, now).Update(
+			gorm.ToDBName("NextAttempt"), now.Add(lease))
+		if query.Error != nil {
+			return nil, query.Error
+		}
+		if query.RowsAffected > 0 {
+			claimed = append(claimed, d)
+		}
+	}
+	return claimed, nil
+}
+
+func (ws *dbWebhookStore) GetDeliveries(appID, webhookID, state string,
+	limit int) ([]webhookDelivery, error) {
+	var found []webhookDelivery
+	query := ws.db.Where("app_id = ? AND state = ?", appID, state)
+	if webhookID != "" {
+		query = query.Where("webhook_id = ?", webhookID)
+	}
+	err := query.Order("id desc").Limit(limit).Find(&found).Error
+	return found, err
+}
+
+func (ws *dbWebhookStore) DeleteDeliveriesBefore(t time.Time) (int64, error) {
+	query := ws.db.Where("state <> ? AND created_at < ?", deliveryPending,
+		t).Delete(webhookDelivery{})
+	return query.RowsAffected, query.Error
+}
+
+// memoryWebhookStore keeps webhooks and deliveries in memory. It is meant for
+// tests and the memory store.
+type memoryWebhookStore struct {
+	lock       sync.Mutex
+	webhooks   map[string]Webhook
+	deliveries map[uint64]webhookDelivery
+	lastID     uint64
+}
+
+func newMemoryWebhookStore() *memoryWebhookStore {
+	return &memoryWebhookStore{
+		webhooks:   make(map[string]Webhook),
+		deliveries: make(map[uint64]webhookDelivery),
+	}
+}
+
+func (ws *memoryWebhookStore) GetWebhooks(appID string) ([]Webhook, error) {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	found := []Webhook{}
+	for _, h := range ws.webhooks {
+		if h.AppID == appID {
+			found = append(found, h)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].ID < found[j].ID })
+	return found, nil
+}
+
+func (ws *memoryWebhookStore) GetWebhook(id string) (Webhook, error) {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	h, found := ws.webhooks[id]
+	if !found {
+		return h, errWebhookNotFound
+	}
+	return h, nil
+}
+
+func (ws *memoryWebhookStore) CreateWebhook(h Webhook) error {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	if _, found := ws.webhooks[h.ID]; found {
+		return errors.Errorf("Webhook %s already exists", h.ID)
+	}
+	ws.webhooks[h.ID] = h
+	return nil
+}
+
+func (ws *memoryWebhookStore) UpdateWebhook(h Webhook) error {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	old, found := ws.webhooks[h.ID]
+	if !found {
+		return errWebhookNotFound
+	}
+	old.URL = h.URL
+	old.EventTypes = h.EventTypes
+	old.Active = h.Active
+	ws.webhooks[h.ID] = old
+	return nil
+}
+
+func (ws *memoryWebhookStore) DeleteWebhook(id string) (int64, error) {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	if _, found := ws.webhooks[id]; !found {
+		return 0, nil
+	}
+	delete(ws.webhooks, id)
+	for deliveryID, d := range ws.deliveries {
+		if d.WebhookID == id {
+			delete(ws.deliveries, deliveryID)
+		}
+	}
+	return 1, nil
+}
+
+func (ws *memoryWebhookStore) CreateDelivery(d *webhookDelivery) error {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	ws.lastID++
+	d.ID = ws.lastID
+	ws.deliveries[d.ID] = *d
+	return nil
+}
+
+func (ws *memoryWebhookStore) GetDelivery(id uint64) (webhookDelivery, error) {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	d, found := ws.deliveries[id]
+	if !found {
+		return d, errWebhookNotFound
+	}
+	return d, nil
+}
+
+func (ws *memoryWebhookStore) UpdateDelivery(d webhookDelivery) error {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	if _, found := ws.deliveries[d.ID]; !found {
+		return errWebhookNotFound
+	}
+	ws.deliveries[d.ID] = d
+	return nil
+}
+
+func (ws *memoryWebhookStore) ClaimDeliveries(now time.Time,
+	lease time.Duration, limit int) ([]webhookDelivery, error) {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	var due []webhookDelivery
+	for _, d := range ws.deliveries {
+		if d.State == deliveryPending && !d.NextAttempt.After(now) {
+			due = append(due, d)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].NextAttempt.Before(due[j].NextAttempt)
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	for _, d := range due {
+		d.NextAttempt = now.Add(lease)
+		ws.deliveries[d.ID] = d
+	}
+	return due, nil
+}
+
+func (ws *memoryWebhookStore) GetDeliveries(appID, webhookID, state string,
+	limit int) ([]webhookDelivery, error) {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	found := []webhookDelivery{}
+	for _, d := range ws.deliveries {
+		if d.AppID == appID && d.State == state &&
+			(webhookID == "" || d.WebhookID == webhookID) {
+			found = append(found, d)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].ID > found[j].ID })
+	if len(found) > limit {
+		found = found[:limit]
+	}
+	return found, nil
+}
+
+func (ws *memoryWebhookStore) DeleteDeliveriesBefore(t time.Time) (int64,
+	error) {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	var n int64
+	for id, d := range ws.deliveries {
+		if d.State != deliveryPending && d.CreatedAt.Before(t) {
+			delete(ws.deliveries, id)
+			n++
+		}
+	}
+	return n, nil
+}
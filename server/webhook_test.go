@@ -0,0 +1,413 @@
+// Copyright 2016 Tera Insights, LLC. All Rights Reserved.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tera-insights/2Q2R-enterprise/security"
+)
+
+func testWebhookStores(t *testing.T) map[string]webhookStore {
+	conn := openTestDatabase(t, "sqlite3",
+		filepath.Join(t.TempDir(), "test.db"))
+	if err := NewMigrator(conn).Up(); err != nil {
+		t.Fatal(err)
+	}
+	env := security.NewEnvelope()
+	if err := env.AddKey(bytes.Repeat([]byte{3}, 32), true); err != nil {
+		t.Fatal(err)
+	}
+	return map[string]webhookStore{
+		"memory":   newMemoryWebhookStore(),
+		"database": newWebhookStore(&gormStore{conn, env}),
+	}
+}
+
+func TestWebhookStoreQueuesDeliveries(t *testing.T) {
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	for kind, ws := range testWebhookStores(t) {
+		t.Run(kind, func(t *testing.T) {
+			for _, h := range []Webhook{
+				{ID: "h1", AppID: "a", URL: "http://a", Secret: "secret",
+					Active: true},
+				{ID: "h2", AppID: "b", URL: "http://b", Secret: "other"},
+			} {
+				if err := ws.CreateWebhook(h); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if dbws, ok := ws.(*dbWebhookStore); ok {
+				var raw Webhook
+				dbws.db.First(&raw, &Webhook{ID: "h1"})
+				if !security.IsEncrypted([]byte(raw.Secret)) {
+					t.Error("Webhook secret was stored in plaintext")
+				}
+			}
+			hooks, err := ws.GetWebhooks("a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hooks) != 1 || hooks[0].Secret != "secret" {
+				t.Fatalf("Found webhooks %+v", hooks)
+			}
+
+			for i := 0; i < 3; i++ {
+				err := ws.CreateDelivery(&webhookDelivery{
+					WebhookID:   "h1",
+					AppID:       "a",
+					State:       deliveryPending,
+					NextAttempt: now.Add(time.Duration(i) * time.Minute),
+					CreatedAt:   now,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			due, err := ws.ClaimDeliveries(now.Add(time.Minute), time.Hour, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(due) != 2 {
+				t.Fatalf("Claimed %d deliveries, expected 2", len(due))
+			}
+			again, err := ws.ClaimDeliveries(now.Add(time.Minute), time.Hour,
+				10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(again) != 0 {
+				t.Errorf("Claimed deliveries %v twice", again)
+			}
+
+			due[0].State = deliveryDead
+			due[0].Attempts = 8
+			due[0].LastError = "Webhook answered 500"
+			if err = ws.UpdateDelivery(due[0]); err != nil {
+				t.Fatal(err)
+			}
+			dead, err := ws.GetDeliveries("a", "", deliveryDead, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(dead) != 1 || dead[0].ID != due[0].ID ||
+				dead[0].Attempts != 8 {
+				t.Errorf("Found dead deliveries %+v", dead)
+			}
+
+			n, err := ws.DeleteDeliveriesBefore(now.Add(time.Second))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 1 {
+				t.Errorf("Deleted %d deliveries, expected 1", n)
+			}
+			if n, err = ws.DeleteWebhook("h1"); err != nil || n != 1 {
+				t.Fatalf("Deleted %d webhooks: %v", n, err)
+			}
+			left, err := ws.GetDeliveries("a", "", deliveryPending, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(left) != 0 {
+				t.Errorf("Deliveries of a deleted webhook were kept: %v", left)
+			}
+		})
+	}
+}
+
+func TestWebhooksAreScopedByApp(t *testing.T) {
+	for kind, ws := range testWebhookStores(t) {
+		t.Run(kind, func(t *testing.T) {
+			for _, h := range []Webhook{
+				{ID: "h1", AppID: "a", URL: "http://a", Secret: "secret",
+					Active: true},
+				{ID: "h2", AppID: "b", URL: "http://b", Secret: "other",
+					Active: true},
+			} {
+				if err := ws.CreateWebhook(h); err != nil {
+					t.Fatal(err)
+				}
+				err := ws.CreateDelivery(&webhookDelivery{WebhookID: h.ID,
+					AppID: h.AppID, State: deliveryDead})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if hooks, err := ws.GetWebhooks(""); err != nil || len(hooks) != 0 {
+				t.Errorf("Found webhooks %+v for no app: %v", hooks, err)
+			}
+			if _, err := ws.GetWebhook(""); err != errWebhookNotFound {
+				t.Errorf("Expected errWebhookNotFound for no ID. Got %v", err)
+			}
+			dead, err := ws.GetDeliveries("", "", deliveryDead, 10)
+			if err != nil || len(dead) != 0 {
+				t.Errorf("Found deliveries %+v for no app: %v", dead, err)
+			}
+			if err := ws.UpdateWebhook(Webhook{}); err != errWebhookNotFound {
+				t.Errorf("Expected errWebhookNotFound for no ID. Got %v", err)
+			}
+			if n, err := ws.DeleteWebhook(""); err != nil || n != 0 {
+				t.Errorf("Deleted %d webhooks without an ID: %v", n, err)
+			}
+
+			for _, h := range []string{"h1", "h2"} {
+				found, err := ws.GetWebhook(h)
+				if err != nil || !found.Active {
+					t.Errorf("Webhook %s was %+v: %v", h, found, err)
+				}
+			}
+			dead, err = ws.GetDeliveries("a", "", deliveryDead, 10)
+			if err != nil || len(dead) != 1 || dead[0].WebhookID != "h1" {
+				t.Errorf("Found deliveries %+v of app a: %v", dead, err)
+			}
+		})
+	}
+}
+
+func TestEventsWithoutAppAreNotSent(t *testing.T) {
+	ws := newMemoryWebhookStore()
+	wd := newWebhookDispatcher(ws, &Config{WebhookTimeout: time.Second})
+	for _, h := range []Webhook{
+		{ID: "h1", AppID: "a", URL: "http://a", Secret: "secret",
+			Active: true},
+		{ID: "h2", AppID: "b", URL: "http://b", Secret: "secret",
+			Active: true},
+	} {
+		if err := ws.CreateWebhook(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := wd.enqueue(event{ID: 1, Name: "authentication"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, appID := range []string{"a", "b"} {
+		queued, _ := ws.GetDeliveries(appID, "", deliveryPending, 10)
+		if len(queued) != 0 {
+			t.Errorf("Event without an app was queued for app %s: %+v",
+				appID, queued)
+		}
+	}
+}
+
+func TestWebhookRetryDelay(t *testing.T) {
+	for attempts, expected := range map[int]time.Duration{
+		1:  10 * time.Second,
+		2:  20 * time.Second,
+		4:  80 * time.Second,
+		20: time.Hour,
+	} {
+		if got := webhookRetryDelay(attempts); got != expected {
+			t.Errorf("Waited %s after %d attempts, expected %s", got,
+				attempts, expected)
+		}
+	}
+}
+
+func TestWebhookDeliveriesAreSignedAndRetried(t *testing.T) {
+	failing := true
+	var received []webhookPayload
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		expected := signWebhook("secret", r.Header.Get(webhookTimestampHeader),
+			body)
+		if r.Header.Get(webhookSignatureHeader) != expected {
+			t.Errorf("Signature was %s, expected %s",
+				r.Header.Get(webhookSignatureHeader), expected)
+		}
+		if failing {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		var p webhookPayload
+		if err := json.Unmarshal(body, &p); err != nil {
+			t.Error(err)
+		}
+		received = append(received, p)
+	}))
+	defer hook.Close()
+
+	ws := newMemoryWebhookStore()
+	wd := newWebhookDispatcher(ws, &Config{
+		WebhookTimeout:              time.Second,
+		WebhookMaxAttempts:          2,
+		WebhookAllowPrivateNetworks: true,
+	})
+	for _, h := range []Webhook{
+		{ID: "all", AppID: "a", URL: hook.URL, Secret: "secret", Active: true},
+		{ID: "paused", AppID: "a", URL: hook.URL, Secret: "secret"},
+		{ID: "filtered", AppID: "a", URL: hook.URL, Secret: "secret",
+			EventTypes: `["keyDeletion"]`, Active: true},
+	} {
+		if err := ws.CreateWebhook(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"authentication", "registration"} {
+		if err := wd.enqueue(event{ID: 7, Name: name, AppID: "a"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	queued, _ := ws.GetDeliveries("a", "", deliveryPending, 10)
+	if len(queued) != 2 {
+		t.Fatalf("Queued %d deliveries, expected 2", len(queued))
+	}
+
+	// The first attempt fails and is retried later
+	if err := wd.deliverDue(); err != nil {
+		t.Fatal(err)
+	}
+	retried, _ := ws.GetDeliveries("a", "", deliveryPending, 10)
+	for _, d := range retried {
+		if d.Attempts != 1 || d.LastStatus != http.StatusBadGateway ||
+			!d.NextAttempt.After(time.Now().Add(5*time.Second)) {
+			t.Errorf("Failed delivery was %+v", d)
+		}
+	}
+
+	// The second attempt succeeds for one delivery and gives up on the other
+	first := retried[0]
+	first.NextAttempt = time.Now().UTC()
+	ws.UpdateDelivery(first)
+	failing = false
+	if err := wd.deliverDue(); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := ws.GetDelivery(first.ID); d.State != deliveryDelivered {
+		t.Errorf("Delivery was %s after it succeeded", d.State)
+	}
+	if len(received) != 1 || received[0].WebhookID != "all" ||
+		received[0].Event.ID != 7 {
+		t.Errorf("Webhook received %+v", received)
+	}
+
+	second := retried[1]
+	second.NextAttempt = time.Now().UTC()
+	ws.UpdateDelivery(second)
+	failing = true
+	if err := wd.deliverDue(); err != nil {
+		t.Fatal(err)
+	}
+	dead, _ := ws.GetDeliveries("a", "all", deliveryDead, 10)
+	if len(dead) != 1 || dead[0].ID != second.ID {
+		t.Errorf("Dead deliveries were %+v", dead)
+	}
+}
+
+func TestWebhookAddressesMustBePublic(t *testing.T) {
+	for address, public := range map[string]bool{
+		"93.184.216.34":    true,
+		"2606:4700::1111":  true,
+		"127.0.0.1":        false,
+		"::1":              false,
+		"10.1.2.3":         false,
+		"172.16.0.1":       false,
+		"192.168.1.1":      false,
+		"100.64.0.1":       false,
+		"169.254.169.254":  false,
+		"fe80::1":          false,
+		"fd00::1":          false,
+		"0.0.0.0":          false,
+		"::ffff:127.0.0.1": false,
+	} {
+		if isPublicAddress(net.ParseIP(address)) != public {
+			t.Errorf("Expected %s to be public: %v", address, public)
+		}
+	}
+
+	for u, valid := range map[string]bool{
+		"https://hooks.example.com/2q2r": true,
+		"http://93.184.216.34:8080":      true,
+		"ftp://hooks.example.com":        false,
+		"/relative":                      false,
+		"http://localhost:8080":          false,
+		"http://api.localhost":           false,
+		"http://127.0.0.1":               false,
+		"http://[::1]:80":                false,
+		"http://169.254.169.254/latest":  false,
+		"http://10.0.0.1":                false,
+	} {
+		err := func() (err interface{}) {
+			defer func() { err = recover() }()
+			checkWebhookURL(u, false)
+			return nil
+		}()
+		if (err == nil) != valid {
+			t.Errorf("Expected %s to be valid: %v (%v)", u, valid, err)
+		}
+	}
+	// Unless private networks are allowed
+	checkWebhookURL("http://127.0.0.1:8080", true)
+}
+
+func TestWebhookClientRefusesPrivateAddressesAndRedirects(t *testing.T) {
+	reached := false
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/elsewhere", http.StatusFound)
+			return
+		}
+		reached = true
+	}))
+	defer hook.Close()
+
+	h := Webhook{ID: "h", URL: hook.URL, Secret: "secret"}
+	strict := newWebhookDispatcher(nil, &Config{WebhookTimeout: time.Second})
+	if _, err := strict.send(h, "test", 0, nil); err == nil || reached {
+		t.Errorf("Webhook on the loopback address was sent: %v", err)
+	}
+
+	allowed := newWebhookDispatcher(nil, &Config{
+		WebhookTimeout:              time.Second,
+		WebhookAllowPrivateNetworks: true,
+	})
+	h.URL = hook.URL + "/redirect"
+	status, err := allowed.send(h, "test", 0, nil)
+	if err == nil || status != http.StatusFound || reached {
+		t.Errorf("Redirect was followed: %d, %v", status, err)
+	}
+}
+
+func TestWebhookTestHidesWhyDeliveryFailed(t *testing.T) {
+	s, ts := newTestServer(t)
+	cookie := loginSuperAdmin(t, s)
+	app := newTestApp(t, s, "foo")
+
+	r := newTestRequest(t, ts, "POST", "/admin/app/"+app.ID+"/webhooks",
+		newWebhookRequest{URL: "http://127.0.0.1:1/hook"})
+	r.AddCookie(cookie)
+	if code := do(t, r, nil); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a webhook on localhost. Got %d", code)
+	}
+
+	// Stored before addresses were checked
+	h := Webhook{ID: "h", AppID: app.ID, URL: "http://127.0.0.1:1/hook",
+		Secret: "secret", Active: true}
+	if err := s.webhooks.store.CreateWebhook(h); err != nil {
+		t.Fatal(err)
+	}
+	r = newTestRequest(t, ts, "POST",
+		"/admin/app/"+app.ID+"/webhooks/h/test", nil)
+	r.AddCookie(cookie)
+	reply := webhookTestReply{}
+	if code := do(t, r, &reply); code != http.StatusOK {
+		t.Fatalf("Could not test webhook: %d", code)
+	}
+	if reply.Delivered || strings.Contains(reply.Error, "127.0.0.1") ||
+		strings.Contains(reply.Error, "public") {
+		t.Errorf("Test reply was %+v", reply)
+	}
+}
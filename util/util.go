@@ -46,6 +46,9 @@ type BubbledError struct {
 	StatusCode int
 	Message    string
 	Info       interface{}
+
+	// The error that caused it, which is logged but not sent to the client
+	Err error
 }
 
 func OptionalPanic(err error, code int, message string) {
@@ -53,6 +56,7 @@ func OptionalPanic(err error, code int, message string) {
 		panic(BubbledError{
 			StatusCode: code,
 			Message:    message,
+			Err:        err,
 		})
 	}
 }